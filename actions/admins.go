@@ -0,0 +1,345 @@
+package actions
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/matoous/go-nanoid/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/models"
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+// CreateFirstAdmin creates the first admin of the service, once an admin exists the others have
+// to be invited
+func CreateFirstAdmin(email string, hashedPassword string, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	// the locking read keeps two concurrent bootstraps from both seeing an empty table
+	var count int
+	err = sq.Select("COUNT(*)").
+		From("admins").
+		Suffix("FOR UPDATE").
+		RunWith(tx).
+		QueryRow().
+		Scan(&count)
+	if err != nil {
+		return status.Error(codes.Internal, "failed to query the database")
+	}
+	if count > 0 {
+		return status.Error(codes.FailedPrecondition, "an admin already exists, admins have to be invited")
+	}
+
+	_, err = sq.Insert("admins").
+		Columns("email", "password").
+		Values(email, hashedPassword).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to insert admin in the database")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return status.Error(codes.Internal, "failed to commit transaction")
+	}
+	return nil
+}
+
+// CreateAdminInvitation invites an email to become an admin and returns the code the invitee
+// sets their password with, the previous invitations of the email are replaced
+func CreateAdminInvitation(email string, invitedBy int, ttl time.Duration, db *sql.DB) (string, error) {
+	var count int
+	err := sq.Select("COUNT(*)").
+		From("admins").
+		Where(sq.Eq{"email": email}).
+		RunWith(db).
+		QueryRow().
+		Scan(&count)
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to query the database")
+	}
+	if count > 0 {
+		return "", status.Error(codes.AlreadyExists, "admin already exists")
+	}
+
+	code, err := gonanoid.New(32)
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to generate the invitation code")
+	}
+	hashedCode, err := utils.HashPasswordResetCode(code)
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to hash the invitation code")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	_, err = sq.Delete("admin_invitations").
+		Where(sq.Eq{"email": email, "accepted_at": nil}).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to delete the previous invitations")
+	}
+
+	_, err = sq.Insert("admin_invitations").
+		Columns("email", "code", "invited_by", "expires_at").
+		Values(email, hashedCode, invitedBy, time.Now().Add(ttl)).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to save the invitation")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", status.Error(codes.Internal, "failed to commit transaction")
+	}
+	return code, nil
+}
+
+// AcceptAdminInvitation creates the admin account of an invitation, an invitation is only accepted
+// once and before it expires
+func AcceptAdminInvitation(code string, hashedPassword string, db *sql.DB) (string, error) {
+	hashedCode, err := utils.HashPasswordResetCode(code)
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to hash the invitation code")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	var invitation models.AdminInvitation
+	err = sq.Select("id", "email", "expires_at", "accepted_at").
+		From("admin_invitations").
+		Where(sq.Eq{"code": hashedCode}).
+		Suffix("FOR UPDATE").
+		RunWith(tx).
+		QueryRow().
+		Scan(&invitation.ID, &invitation.Email, &invitation.ExpiresAt, &invitation.AcceptedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", status.Error(codes.NotFound, "invitation not found")
+		}
+		return "", status.Error(codes.Internal, "failed to query the database")
+	}
+
+	if invitation.AcceptedAt.Valid {
+		return "", status.Error(codes.FailedPrecondition, "invitation was already accepted")
+	}
+	if time.Now().After(invitation.ExpiresAt) {
+		return "", status.Error(codes.FailedPrecondition, "invitation is expired")
+	}
+
+	_, err = sq.Insert("admins").
+		Columns("email", "password").
+		Values(invitation.Email, hashedPassword).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return "", status.Error(codes.AlreadyExists, "admin already exists")
+	}
+
+	_, err = sq.Update("admin_invitations").
+		Set("accepted_at", time.Now()).
+		Where(sq.Eq{"id": invitation.ID}).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to update the invitation")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", status.Error(codes.Internal, "failed to commit transaction")
+	}
+	return invitation.Email, nil
+}
+
+// ListAdmins returns the admins, the deactivated ones included
+func ListAdmins(db *sql.DB) ([]models.Admin, error) {
+	rows, err := sq.Select("id", "email", "deactivated_at", "created_at").
+		From("admins").
+		OrderBy("id").
+		RunWith(db).
+		Query()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+	defer rows.Close()
+
+	var admins []models.Admin
+	for rows.Next() {
+		var admin models.Admin
+		if err := rows.Scan(&admin.ID, &admin.Email, &admin.DeactivatedAt, &admin.CreatedAt); err != nil {
+			return nil, status.Error(codes.Internal, "failed to scan the admin")
+		}
+		admins = append(admins, admin)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	return admins, nil
+}
+
+// GetAdmin returns the admin with the id, the deactivated admins included
+func GetAdmin(adminID int, db *sql.DB) (models.Admin, error) {
+	var admin models.Admin
+	err := sq.Select("id", "email", "token_version", "deactivated_at", "created_at").
+		From("admins").
+		Where(sq.Eq{"id": adminID}).
+		RunWith(db).
+		QueryRow().
+		Scan(&admin.ID, &admin.Email, &admin.TokenVersion, &admin.DeactivatedAt, &admin.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return admin, status.Error(codes.NotFound, "admin not found")
+		}
+		return admin, status.Error(codes.Internal, "failed to query the database")
+	}
+	return admin, nil
+}
+
+// DeactivateAdmin blocks the logins and the tokens of an admin, the last active admin can not be
+// deactivated
+func DeactivateAdmin(adminID int, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	if err := checkOtherActiveAdmin(adminID, tx); err != nil {
+		return err
+	}
+
+	result, err := sq.Update("admins").
+		Set("deactivated_at", time.Now()).
+		Where(sq.Eq{"id": adminID, "deactivated_at": nil}).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to deactivate the admin")
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to deactivate the admin")
+	}
+	if updated == 0 {
+		return status.Error(codes.FailedPrecondition, "admin not found or already deactivated")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return status.Error(codes.Internal, "failed to commit transaction")
+	}
+	return nil
+}
+
+// DeleteAdmin deletes an admin, the last active admin can not be deleted
+func DeleteAdmin(adminID int, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	if err := checkOtherActiveAdmin(adminID, tx); err != nil {
+		return err
+	}
+
+	result, err := sq.Delete("admins").
+		Where(sq.Eq{"id": adminID}).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to delete the admin")
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to delete the admin")
+	}
+	if deleted == 0 {
+		return status.Error(codes.NotFound, "admin not found")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return status.Error(codes.Internal, "failed to commit transaction")
+	}
+	return nil
+}
+
+// ChangeAdminPassword replaces the password of an admin and revokes the tokens issued to them
+func ChangeAdminPassword(adminID int, hashedPassword string, db *sql.DB) error {
+	result, err := sq.Update("admins").
+		Set("password", hashedPassword).
+		Set("token_version", sq.Expr("token_version + 1")).
+		Set("updated_at", time.Now()).
+		Where(sq.Eq{"id": adminID}).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to update the password")
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to update the password")
+	}
+	if updated == 0 {
+		return status.Error(codes.NotFound, "admin not found")
+	}
+	return nil
+}
+
+// checkOtherActiveAdmin makes sure an active admin remains besides the given one, the active admins
+// are locked until the transaction ends
+func checkOtherActiveAdmin(adminID int, tx *sql.Tx) error {
+	var count int
+	err := sq.Select("COUNT(*)").
+		From("admins").
+		Where(sq.Eq{"deactivated_at": nil}).
+		Where(sq.NotEq{"id": adminID}).
+		Suffix("FOR UPDATE").
+		RunWith(tx).
+		QueryRow().
+		Scan(&count)
+	if err != nil {
+		return status.Error(codes.Internal, "failed to query the database")
+	}
+	if count == 0 {
+		return status.Error(codes.FailedPrecondition, "the last active admin can not be removed")
+	}
+	return nil
+}
+
+// BlacklistAdminToken revokes an access token of an admin until it expires, the token is returned
+// for the revocation cache
+func BlacklistAdminToken(adminID int, jti string, expiresAt time.Time, db *sql.DB) (models.BlacklistedToken, error) {
+	token := models.BlacklistedToken{JTI: jti, AdminID: adminID, ExpiresAt: expiresAt}
+
+	_, err := sq.Insert("tokens_blacklist").
+		Options("IGNORE").
+		Columns("admin_id", "jti", "expires_at").
+		Values(token.AdminID, token.JTI, token.ExpiresAt).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return token, status.Error(codes.Internal, "failed to blacklist the token")
+	}
+	return token, nil
+}
@@ -0,0 +1,249 @@
+package actions
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/models"
+)
+
+// auditGenesisHash is the previous hash of the first event of the chain
+var auditGenesisHash = strings.Repeat("0", 64)
+
+// AuditEventFilter narrows the listed audit events, the zero values match every event
+type AuditEventFilter struct {
+	EventType string
+	ActorType string
+	ActorID   int
+	Outcome   string
+	Since     time.Time
+	Until     time.Time
+	// BeforeID continues the listing after the last event of the previous page
+	BeforeID int
+}
+
+// RecordAuditEvent appends the event to the audit log, it is chained to the last event under the
+// lock of the head of the chain
+func RecordAuditEvent(event models.AuditEvent, db *sql.DB) error {
+	metadata, err := json.Marshal(event.Metadata)
+	if err != nil {
+		return status.Error(codes.Internal, "failed to encode the audit metadata")
+	}
+	// the hash covers the values as stored, the timestamps are stored to the second
+	event.Actor = truncate(event.Actor, 255)
+	event.Target = truncate(event.Target, 255)
+	event.CreatedAt = time.Now().Truncate(time.Second)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	err = sq.Select("hash").
+		From("audit_chain").
+		Where(sq.Eq{"id": 1}).
+		Suffix("FOR UPDATE").
+		RunWith(tx).
+		QueryRow().
+		Scan(&event.PrevHash)
+	if err != nil {
+		return status.Error(codes.Internal, "failed to query the database")
+	}
+
+	event.Hash, err = auditEventHash(event, string(metadata))
+	if err != nil {
+		return status.Error(codes.Internal, "failed to hash the audit event")
+	}
+
+	_, err = sq.Insert("audit_events").
+		Columns("event_type", "actor_type", "actor_id", "actor", "target", "ip", "outcome", "metadata", "prev_hash", "hash", "created_at").
+		Values(
+			event.EventType,
+			event.ActorType,
+			event.ActorID,
+			event.Actor,
+			event.Target,
+			event.IP,
+			event.Outcome,
+			string(metadata),
+			event.PrevHash,
+			event.Hash,
+			event.CreatedAt,
+		).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to save the audit event")
+	}
+
+	_, err = sq.Update("audit_chain").
+		Set("hash", event.Hash).
+		Where(sq.Eq{"id": 1}).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to update the audit chain")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return status.Error(codes.Internal, "failed to commit transaction")
+	}
+	return nil
+}
+
+// ListAuditEvents returns a page of the audit events matching the filter, the most recent first.
+// Every event is verified against its content and the hash of the event recorded before it.
+func ListAuditEvents(filter AuditEventFilter, limit int, db *sql.DB) ([]models.AuditEvent, error) {
+	query := sq.Select(
+		"id",
+		"event_type",
+		"actor_type",
+		"actor_id",
+		"actor",
+		"target",
+		"ip",
+		"outcome",
+		"metadata",
+		"prev_hash",
+		"hash",
+		"created_at",
+		"(SELECT previous.hash FROM audit_events AS previous WHERE previous.id < audit_events.id ORDER BY previous.id DESC LIMIT 1)",
+	).
+		From("audit_events").
+		OrderBy("id DESC").
+		Limit(uint64(limit))
+
+	if filter.EventType != "" {
+		query = query.Where(sq.Eq{"event_type": filter.EventType})
+	}
+	if filter.ActorType != "" {
+		query = query.Where(sq.Eq{"actor_type": filter.ActorType})
+	}
+	if filter.ActorID != 0 {
+		query = query.Where(sq.Eq{"actor_id": filter.ActorID})
+	}
+	if filter.Outcome != "" {
+		query = query.Where(sq.Eq{"outcome": filter.Outcome})
+	}
+	if !filter.Since.IsZero() {
+		query = query.Where(sq.GtOrEq{"created_at": filter.Since})
+	}
+	if !filter.Until.IsZero() {
+		query = query.Where(sq.Lt{"created_at": filter.Until})
+	}
+	if filter.BeforeID != 0 {
+		query = query.Where(sq.Lt{"id": filter.BeforeID})
+	}
+
+	rows, err := query.RunWith(db).Query()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+	defer rows.Close()
+
+	var events []models.AuditEvent
+	for rows.Next() {
+		var event models.AuditEvent
+		var metadata string
+		var previousHash sql.NullString
+		err := rows.Scan(
+			&event.ID,
+			&event.EventType,
+			&event.ActorType,
+			&event.ActorID,
+			&event.Actor,
+			&event.Target,
+			&event.IP,
+			&event.Outcome,
+			&metadata,
+			&event.PrevHash,
+			&event.Hash,
+			&event.CreatedAt,
+			&previousHash,
+		)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "failed to scan the audit event")
+		}
+		if err := json.Unmarshal([]byte(metadata), &event.Metadata); err != nil {
+			return nil, status.Error(codes.Internal, "failed to decode the audit metadata")
+		}
+
+		expectedPrevHash := auditGenesisHash
+		if previousHash.Valid {
+			expectedPrevHash = previousHash.String
+		}
+		hash, err := auditEventHash(event, metadata)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "failed to hash the audit event")
+		}
+		event.Verified = event.PrevHash == expectedPrevHash && event.Hash == hash
+
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	return events, nil
+}
+
+// GetAuditChainHead returns the hash of the last recorded event as kept in the head of the chain,
+// and whether the last event in the log still carries it. The events removed from the end of the
+// log do not break the chain of the events left, they are only detected against the head.
+func GetAuditChainHead(db *sql.DB) (string, bool, error) {
+	var head string
+	var last sql.NullString
+	// a single statement reads the head and the last event from the same snapshot
+	err := sq.Select("hash", "(SELECT hash FROM audit_events ORDER BY id DESC LIMIT 1)").
+		From("audit_chain").
+		Where(sq.Eq{"id": 1}).
+		RunWith(db).
+		QueryRow().
+		Scan(&head, &last)
+	if err != nil {
+		return "", false, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	expected := auditGenesisHash
+	if last.Valid {
+		expected = last.String
+	}
+	return head, head == expected, nil
+}
+
+// auditEventHash hashes the fields of the event along with the hash of the previous event, the
+// metadata is hashed as stored
+func auditEventHash(event models.AuditEvent, metadata string) (string, error) {
+	var actorID interface{}
+	if event.ActorID.Valid {
+		actorID = event.ActorID.Int64
+	}
+
+	content, err := json.Marshal([]interface{}{
+		event.PrevHash,
+		event.EventType,
+		event.ActorType,
+		actorID,
+		event.Actor,
+		event.Target,
+		event.IP,
+		event.Outcome,
+		metadata,
+		event.CreatedAt.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:]), nil
+}
@@ -0,0 +1,138 @@
+package actions
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/isaacwassouf/authentication-service/consts"
+	"github.com/isaacwassouf/authentication-service/models"
+)
+
+// auditChain returns the events chained the way they are recorded
+func auditChain(t *testing.T, metadata string, events ...models.AuditEvent) []models.AuditEvent {
+	t.Helper()
+
+	prevHash := auditGenesisHash
+	for i := range events {
+		events[i].PrevHash = prevHash
+		hash, err := auditEventHash(events[i], metadata)
+		if err != nil {
+			t.Fatalf("failed to hash the event: %v", err)
+		}
+		events[i].Hash = hash
+		prevHash = hash
+	}
+	return events
+}
+
+func TestAuditEventHashChainsEvents(t *testing.T) {
+	createdAt := time.Now().Truncate(time.Second)
+	event := models.AuditEvent{
+		EventType: consts.AUDIT_ADMIN_LOGIN,
+		ActorType: consts.AUDIT_ACTOR_ADMIN,
+		ActorID:   sql.NullInt64{Int64: 1, Valid: true},
+		Actor:     "admin@example.com",
+		IP:        "203.0.113.5",
+		Outcome:   consts.AUDIT_OUTCOME_SUCCESS,
+		CreatedAt: createdAt,
+	}
+	events := auditChain(t, "{}", event, event, event)
+
+	// the same content is hashed differently at every position of the chain
+	if events[0].Hash == events[1].Hash || events[1].Hash == events[2].Hash {
+		t.Fatal("expected the hashes to depend on the previous event")
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].PrevHash != events[i-1].Hash {
+			t.Fatalf("expected the event %d to be chained to the previous one", i)
+		}
+	}
+
+	// the hash is stable so that the events can be verified when listed
+	hash, err := auditEventHash(events[1], "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != events[1].Hash {
+		t.Fatal("expected the hash of an unchanged event to be the same")
+	}
+}
+
+func TestAuditEventHashDetectsTampering(t *testing.T) {
+	event := auditChain(t, `{"error":""}`, models.AuditEvent{
+		EventType: consts.AUDIT_ADMIN_LOGIN,
+		ActorType: consts.AUDIT_ACTOR_ADMIN,
+		ActorID:   sql.NullInt64{Int64: 1, Valid: true},
+		Actor:     "admin@example.com",
+		Target:    "user:1",
+		IP:        "203.0.113.5",
+		Outcome:   consts.AUDIT_OUTCOME_SUCCESS,
+		CreatedAt: time.Now().Truncate(time.Second),
+	})[0]
+
+	tampers := map[string]func(event *models.AuditEvent){
+		"prev_hash":  func(event *models.AuditEvent) { event.PrevHash = "f" + event.PrevHash[1:] },
+		"event_type": func(event *models.AuditEvent) { event.EventType = consts.AUDIT_EMAIL_VERIFIED },
+		"actor_id":   func(event *models.AuditEvent) { event.ActorID = sql.NullInt64{} },
+		"actor":      func(event *models.AuditEvent) { event.Actor = "other@example.com" },
+		"target":     func(event *models.AuditEvent) { event.Target = "user:2" },
+		"ip":         func(event *models.AuditEvent) { event.IP = "198.51.100.7" },
+		"outcome":    func(event *models.AuditEvent) { event.Outcome = consts.AUDIT_OUTCOME_FAILURE },
+		"created_at": func(event *models.AuditEvent) { event.CreatedAt = event.CreatedAt.Add(time.Second) },
+	}
+	for field, tamper := range tampers {
+		tampered := event
+		tamper(&tampered)
+		hash, err := auditEventHash(tampered, `{"error":""}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hash == event.Hash {
+			t.Errorf("expected a change of the %s to change the hash", field)
+		}
+	}
+
+	hash, err := auditEventHash(event, `{"error":"denied"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash == event.Hash {
+		t.Error("expected a change of the metadata to change the hash")
+	}
+}
+
+func TestGetAuditChainHeadDetectsRemovedEvents(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create the database mock: %v", err)
+	}
+	defer db.Close()
+
+	tests := []struct {
+		name     string
+		head     string
+		last     interface{}
+		verified bool
+	}{
+		{name: "empty log", head: auditGenesisHash, last: nil, verified: true},
+		{name: "last event", head: "hash", last: "hash", verified: true},
+		{name: "removed event", head: "hash", last: "previous", verified: false},
+	}
+	for _, test := range tests {
+		mock.ExpectQuery("FROM audit_chain").WillReturnRows(sqlmock.NewRows([]string{"hash", "last"}).AddRow(test.head, test.last))
+
+		head, verified, err := GetAuditChainHead(db)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if head != test.head || verified != test.verified {
+			t.Errorf("%s: expected %s %v, got %s %v", test.name, test.head, test.verified, head, verified)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
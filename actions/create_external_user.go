@@ -7,82 +7,30 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
-	"github.com/isaacwassouf/authentication-service/consts"
-	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
+	"github.com/isaacwassouf/authentication-service/models"
 )
 
-func CreateGoogleUser(in *pb.GoogleLoginRequest, db *sql.DB) (int, error) {
+// CreateExternalUser creates a user authenticated by any external auth provider
+func CreateExternalUser(provider string, identity models.ExternalIdentity, db *sql.DB) (int, error) {
 	tx, err := db.Begin()
 	if err != nil {
-		status.Error(codes.Internal, "failed to start transaction")
+		return -1, status.Error(codes.Internal, "failed to start transaction")
 	}
+	defer tx.Rollback()
 
-	// insert the user in the users table
-	result, err := sq.Insert("users").
-		Columns("name").
-		Values(in.Name).
-		RunWith(tx).
-		Exec()
-	if err != nil {
-		return -1, status.Error(codes.Internal, "failed to insert user in the database")
-	}
-
-	id, err := result.LastInsertId()
-	if err != nil {
-		return -1, status.Error(codes.Internal, "failed to get the last inserted id")
-	}
-
-	// insert the user in the users_email table
-	_, err = sq.Insert("users_email").
-		Columns("user_id", "email", "is_verified").
-		Values(id, in.Email, true).
-		RunWith(tx).
-		Exec()
-	if err != nil {
-		return -1, status.Error(codes.Internal, "failed to insert user in the database")
-	}
-
-	// get the auth provider id
-	var authProviderID int
-	err = sq.Select("id").
-		From("auth_providers").
-		Where(sq.Eq{"name": consts.GOOGLE}).
-		RunWith(tx).
-		QueryRow().
-		Scan(&authProviderID)
-	if err != nil {
-		return -1, status.Error(codes.Internal, "failed to get the auth provider id")
-	}
-
-	// insert the user in the users_authentication table
-	_, err = sq.Insert("users_authentication").
-		Columns("user_id", "auth_provider_id", "auth_provider_identifier").
-		Values(id, authProviderID, in.Identifier).
-		RunWith(tx).
-		Exec()
-	if err != nil {
-		return -1, status.Error(codes.Internal, "failed to insert user in the database")
+	// the profile name is optional at most providers
+	name := identity.Name
+	if name == "" {
+		name = identity.Email
 	}
-
-	// commit the transaction
-	err = tx.Commit()
-	if err != nil {
-		return -1, status.Error(codes.Internal, "failed to commit transaction")
-	}
-
-	return int(id), nil
-}
-
-func CreateGitHubUser(in *pb.GitHubLoginRequest, db *sql.DB) (int, error) {
-	tx, err := db.Begin()
-	if err != nil {
-		status.Error(codes.Internal, "failed to start transaction")
+	if name == "" {
+		name = identity.Identifier
 	}
 
 	// insert the user in the users table
 	result, err := sq.Insert("users").
 		Columns("name").
-		Values(in.Name).
+		Values(name).
 		RunWith(tx).
 		Exec()
 	if err != nil {
@@ -94,11 +42,11 @@ func CreateGitHubUser(in *pb.GitHubLoginRequest, db *sql.DB) (int, error) {
 		return -1, status.Error(codes.Internal, "failed to get the last inserted id")
 	}
 
-	if in.Email != "" {
+	if identity.Email != "" {
 		// insert the user in the users_email table
 		_, err = sq.Insert("users_email").
 			Columns("user_id", "email", "is_verified").
-			Values(id, in.Email, true).
+			Values(id, identity.Email, identity.EmailVerified).
 			RunWith(tx).
 			Exec()
 		if err != nil {
@@ -110,7 +58,7 @@ func CreateGitHubUser(in *pb.GitHubLoginRequest, db *sql.DB) (int, error) {
 	var authProviderID int
 	err = sq.Select("id").
 		From("auth_providers").
-		Where(sq.Eq{"name": consts.GITHUB}).
+		Where(sq.Eq{"name": provider}).
 		RunWith(tx).
 		QueryRow().
 		Scan(&authProviderID)
@@ -121,7 +69,7 @@ func CreateGitHubUser(in *pb.GitHubLoginRequest, db *sql.DB) (int, error) {
 	// insert the user in the users_authentication table
 	_, err = sq.Insert("users_authentication").
 		Columns("user_id", "auth_provider_id", "auth_provider_identifier").
-		Values(id, authProviderID, in.Identifier).
+		Values(id, authProviderID, identity.Identifier).
 		RunWith(tx).
 		Exec()
 	if err != nil {
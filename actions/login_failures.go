@@ -0,0 +1,210 @@
+package actions
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/models"
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+// the same error is returned for locked accounts and throttled attempts so that it does not
+// reveal anything about the account
+var errTooManyAttempts = status.Error(codes.ResourceExhausted, "too many failed login attempts, try again later")
+
+// LoginThrottle holds the brute-force protection thresholds configured in the settings table
+type LoginThrottle struct {
+	MaxFailedAttempts      int
+	MaxFailedAttemptsPerIP int
+	Window                 time.Duration
+	LockoutDuration        time.Duration
+	ProgressiveDelay       time.Duration
+}
+
+// LoginSubjects are the keys the failed attempts of a login are counted against
+type LoginSubjects struct {
+	Account string
+	IP      string
+}
+
+func NewLoginSubjects(accountType string, email string, ip string) LoginSubjects {
+	subjects := LoginSubjects{Account: accountType + ":" + strings.ToLower(strings.TrimSpace(email))}
+	if ip != "" {
+		subjects.IP = "ip:" + ip
+	}
+	return subjects
+}
+
+// NewIPLoginSubjects counts the failed attempts against the IP only, for the logins where the
+// account is not known yet, e.g., a passkey login before its user handle is read
+func NewIPLoginSubjects(ip string) LoginSubjects {
+	return LoginSubjects{IP: NewLoginSubjects("", "", ip).IP}
+}
+
+func GetLoginThrottle(db *sql.DB) (LoginThrottle, error) {
+	var throttle LoginThrottle
+	var err error
+
+	if throttle.MaxFailedAttempts, err = utils.GetIntSetting("LOGIN_MAX_FAILED_ATTEMPTS", 5, db); err != nil {
+		return throttle, err
+	}
+	if throttle.MaxFailedAttemptsPerIP, err = utils.GetIntSetting("LOGIN_MAX_FAILED_ATTEMPTS_PER_IP", 50, db); err != nil {
+		return throttle, err
+	}
+	if throttle.Window, err = utils.GetDurationSetting("LOGIN_FAILED_ATTEMPTS_WINDOW", time.Minute*15, db); err != nil {
+		return throttle, err
+	}
+	if throttle.LockoutDuration, err = utils.GetDurationSetting("LOGIN_LOCKOUT_DURATION", time.Minute*15, db); err != nil {
+		return throttle, err
+	}
+	if throttle.ProgressiveDelay, err = utils.GetDurationSetting("LOGIN_PROGRESSIVE_DELAY", time.Second, db); err != nil {
+		return throttle, err
+	}
+	return throttle, nil
+}
+
+// CheckLoginAllowed rejects the login while the account or the IP is locked, or while the delay
+// that grows with every failed attempt has not elapsed
+func CheckLoginAllowed(subjects LoginSubjects, throttle LoginThrottle, db *sql.DB) error {
+	for _, subject := range subjects.list() {
+		failure, err := getLoginFailure(subject, db)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			return status.Error(codes.Internal, "failed to query the database")
+		}
+
+		if failure.LockedUntil.Valid && time.Now().Before(failure.LockedUntil.Time) {
+			return errTooManyAttempts
+		}
+
+		// the delay only applies to the account, a shared IP is only locked past its threshold
+		if subject != subjects.Account {
+			continue
+		}
+		// the failures outside of the window are forgotten
+		if time.Since(failure.LastFailedAt) > throttle.Window || failure.FailedCount == 0 {
+			continue
+		}
+		if time.Now().Before(failure.LastFailedAt.Add(progressiveDelay(throttle.ProgressiveDelay, failure.FailedCount))) {
+			return errTooManyAttempts
+		}
+	}
+	return nil
+}
+
+// RecordLoginFailure counts a failed attempt and locks the subjects that reached their threshold.
+// The count is read and updated in a single statement so that concurrent failures are not lost.
+func RecordLoginFailure(subjects LoginSubjects, throttle LoginThrottle, db *sql.DB) error {
+	for _, subject := range subjects.list() {
+		threshold := throttle.MaxFailedAttempts
+		if subject == subjects.IP {
+			threshold = throttle.MaxFailedAttemptsPerIP
+		}
+
+		now := time.Now()
+		lockedUntil := now.Add(throttle.LockoutDuration)
+
+		// the first failure of the subject
+		failedCount := 1
+		var firstLockedUntil sql.NullTime
+		if threshold > 0 && failedCount >= threshold {
+			firstLockedUntil = sql.NullTime{Time: lockedUntil, Valid: true}
+			failedCount = 0
+		}
+
+		// the failures outside of the window are forgotten, and the count starts again once the
+		// subject is locked. MySQL assigns the columns from left to right, so failed_count and
+		// last_failed_at are still the stored ones while the new count is computed.
+		newCount := "IF(last_failed_at >= ?, failed_count + 1, 1)"
+		windowStart := now.Add(-throttle.Window)
+		_, err := sq.Insert("login_failures").
+			Columns("subject", "failed_count", "last_failed_at", "locked_until").
+			Values(subject, failedCount, now, firstLockedUntil).
+			Suffix(
+				"ON DUPLICATE KEY UPDATE "+
+					"locked_until = IF(? > 0 AND "+newCount+" >= ?, ?, locked_until), "+
+					"failed_count = IF(? > 0 AND "+newCount+" >= ?, 0, "+newCount+"), "+
+					"last_failed_at = ?",
+				threshold, windowStart, threshold, lockedUntil,
+				threshold, windowStart, threshold, windowStart,
+				now,
+			).
+			RunWith(db).
+			Exec()
+		if err != nil {
+			return status.Error(codes.Internal, "failed to record the failed login attempt")
+		}
+	}
+	return nil
+}
+
+// ClearLoginFailures forgets the failed attempts of an account after a successful login
+func ClearLoginFailures(subjects LoginSubjects, db *sql.DB) error {
+	_, err := sq.Delete("login_failures").
+		Where(sq.Eq{"subject": subjects.Account}).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to clear the failed login attempts")
+	}
+	return nil
+}
+
+// UnlockLoginSubjects removes the lockouts and the failed attempts of the given subjects
+func UnlockLoginSubjects(subjects []string, db *sql.DB) (int64, error) {
+	result, err := sq.Delete("login_failures").
+		Where(sq.Eq{"subject": subjects}).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return 0, status.Error(codes.Internal, "failed to unlock the account")
+	}
+
+	unlocked, err := result.RowsAffected()
+	if err != nil {
+		return 0, status.Error(codes.Internal, "failed to unlock the account")
+	}
+	return unlocked, nil
+}
+
+func (s LoginSubjects) list() []string {
+	var subjects []string
+	if s.Account != "" {
+		subjects = append(subjects, s.Account)
+	}
+	if s.IP != "" {
+		subjects = append(subjects, s.IP)
+	}
+	return subjects
+}
+
+func getLoginFailure(subject string, db *sql.DB) (models.LoginFailure, error) {
+	var failure models.LoginFailure
+	err := sq.Select("id", "subject", "failed_count", "last_failed_at", "locked_until").
+		From("login_failures").
+		Where(sq.Eq{"subject": subject}).
+		RunWith(db).
+		QueryRow().
+		Scan(&failure.ID, &failure.Subject, &failure.FailedCount, &failure.LastFailedAt, &failure.LockedUntil)
+	return failure, err
+}
+
+// progressiveDelay doubles the delay with every failed attempt, capped at a minute
+func progressiveDelay(base time.Duration, failedCount int) time.Duration {
+	delay := base
+	for i := 1; i < failedCount && delay < time.Minute; i++ {
+		delay *= 2
+	}
+	if delay > time.Minute {
+		delay = time.Minute
+	}
+	return delay
+}
@@ -0,0 +1,303 @@
+package actions
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/matoous/go-nanoid/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/models"
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+// MFAChallengeTTL is the time a user has to complete the second factor after the password
+const MFAChallengeTTL = time.Minute * 5
+
+// the same error is returned for unknown, expired, completed and exhausted challenges
+var errInvalidMFAChallenge = status.Error(codes.Unauthenticated, "invalid or expired MFA challenge, log in again")
+
+// MFAVerifier checks the code submitted for a challenge with the method chosen by the user
+type MFAVerifier func(challenge models.MFAChallenge) (bool, error)
+
+// CreateMFAChallenge starts the second factor of a login that passed the first factor through the
+// provider. The returned challenge id is only stored hashed, like the codes.
+func CreateMFAChallenge(userID int, provider string, methods []string, db *sql.DB) (string, error) {
+	return createMFAChallenge("user_id", userID, provider, methods, db)
+}
+
+// CreateAdminMFAChallenge starts the second factor of an admin login that passed the password
+func CreateAdminMFAChallenge(adminID int, methods []string, db *sql.DB) (string, error) {
+	return createMFAChallenge("admin_id", adminID, "password", methods, db)
+}
+
+// GetMFAChallenge returns a challenge of a user login that can still be completed
+func GetMFAChallenge(challengeID string, maxAttempts int, db *sql.DB) (models.MFAChallenge, error) {
+	return getMFAChallenge(challengeID, maxAttempts, false, false, db)
+}
+
+// GetAdminMFAChallenge returns a challenge of an admin login that can still be completed
+func GetAdminMFAChallenge(challengeID string, maxAttempts int, db *sql.DB) (models.MFAChallenge, error) {
+	return getMFAChallenge(challengeID, maxAttempts, true, false, db)
+}
+
+// SetMFAChallengeEmailCode binds an emailed code to the challenge, a new code replaces the
+// previous one
+func SetMFAChallengeEmailCode(challengeID string, code string, db *sql.DB) error {
+	hashedChallengeID, err := utils.HashMFACode(challengeID)
+	if err != nil {
+		return status.Error(codes.Internal, "failed to hash the MFA challenge")
+	}
+
+	hashedCode, err := utils.HashMFACode(code)
+	if err != nil {
+		return status.Error(codes.Internal, "failed to hash MFA token")
+	}
+
+	_, err = sq.Update("mfa_challenges").
+		Set("email_code", hashedCode).
+		Where(sq.Eq{"challenge": hashedChallengeID}).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to save the MFA token")
+	}
+	return nil
+}
+
+// SetMFAChallengeWebAuthnSession binds the assertion options sent to the authenticator to the
+// challenge, new options replace the previous ones
+func SetMFAChallengeWebAuthnSession(challengeID string, data *webauthn.SessionData, db *sql.DB) error {
+	hashedChallengeID, err := utils.HashMFACode(challengeID)
+	if err != nil {
+		return status.Error(codes.Internal, "failed to hash the MFA challenge")
+	}
+
+	encodedData, err := json.Marshal(data)
+	if err != nil {
+		return status.Error(codes.Internal, "failed to encode the WebAuthn session")
+	}
+
+	_, err = sq.Update("mfa_challenges").
+		Set("webauthn_session", string(encodedData)).
+		Where(sq.Eq{"challenge": hashedChallengeID}).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to save the WebAuthn session")
+	}
+	return nil
+}
+
+// CompleteMFAChallenge verifies the code of a challenge of a user login. Every wrong code counts as
+// an attempt and the challenge is invalidated once maxAttempts is reached, a valid code completes
+// it so that it can not be used again.
+func CompleteMFAChallenge(
+	challengeID string,
+	method string,
+	maxAttempts int,
+	verify MFAVerifier,
+	db *sql.DB,
+) (models.MFAChallenge, error) {
+	return completeMFAChallenge(challengeID, method, maxAttempts, false, verify, db)
+}
+
+// CompleteAdminMFAChallenge verifies the code of a challenge of an admin login the same way
+func CompleteAdminMFAChallenge(
+	challengeID string,
+	method string,
+	maxAttempts int,
+	verify MFAVerifier,
+	db *sql.DB,
+) (models.MFAChallenge, error) {
+	return completeMFAChallenge(challengeID, method, maxAttempts, true, verify, db)
+}
+
+func completeMFAChallenge(
+	challengeID string,
+	method string,
+	maxAttempts int,
+	admin bool,
+	verify MFAVerifier,
+	db *sql.DB,
+) (models.MFAChallenge, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return models.MFAChallenge{}, status.Error(codes.Internal, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	// the lock keeps concurrent guesses from going past the attempts limit
+	challenge, err := getMFAChallenge(challengeID, maxAttempts, admin, true, tx)
+	if err != nil {
+		return challenge, err
+	}
+
+	if !slices.Contains(strings.Split(challenge.Methods, ","), method) {
+		return challenge, status.Error(codes.InvalidArgument, "MFA method is not available")
+	}
+
+	valid, err := verify(challenge)
+	if err != nil {
+		return challenge, err
+	}
+
+	if !valid {
+		_, err = sq.Update("mfa_challenges").
+			Set("attempts", sq.Expr("attempts + 1")).
+			Where(sq.Eq{"id": challenge.ID}).
+			RunWith(tx).
+			Exec()
+		if err != nil {
+			return challenge, status.Error(codes.Internal, "failed to update the MFA challenge")
+		}
+		if err = tx.Commit(); err != nil {
+			return challenge, status.Error(codes.Internal, "failed to commit transaction")
+		}
+
+		if challenge.Attempts+1 >= maxAttempts {
+			return challenge, errInvalidMFAChallenge
+		}
+		return challenge, status.Error(codes.InvalidArgument, "invalid code")
+	}
+
+	_, err = sq.Update("mfa_challenges").
+		Set("completed_at", time.Now()).
+		Where(sq.Eq{"id": challenge.ID}).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return challenge, status.Error(codes.Internal, "failed to update the MFA challenge")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return challenge, status.Error(codes.Internal, "failed to commit transaction")
+	}
+
+	return challenge, nil
+}
+
+// CheckMFAEmailCode compares a submitted code with the one emailed for the challenge
+func CheckMFAEmailCode(challenge models.MFAChallenge, code string) (bool, error) {
+	if !challenge.EmailCode.Valid {
+		return false, nil
+	}
+
+	hashedCode, err := utils.HashMFACode(code)
+	if err != nil {
+		return false, status.Error(codes.Internal, "failed to hash MFA code")
+	}
+
+	return subtle.ConstantTimeCompare([]byte(hashedCode), []byte(challenge.EmailCode.String)) == 1, nil
+}
+
+func createMFAChallenge(subjectColumn string, subjectID int, provider string, methods []string, db *sql.DB) (string, error) {
+	challengeID, err := gonanoid.New(32)
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to generate the MFA challenge")
+	}
+
+	hashedChallengeID, err := utils.HashMFACode(challengeID)
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to hash the MFA challenge")
+	}
+
+	_, err = sq.Insert("mfa_challenges").
+		Columns("challenge", subjectColumn, "provider", "methods", "expires_at").
+		Values(hashedChallengeID, subjectID, provider, strings.Join(methods, ","), time.Now().Add(MFAChallengeTTL)).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to save the MFA challenge")
+	}
+
+	// clean up the challenges that were never completed
+	_, err = sq.Delete("mfa_challenges").
+		Where(sq.Lt{"expires_at": time.Now().Add(-time.Hour * 24)}).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to delete the expired MFA challenges")
+	}
+
+	return challengeID, nil
+}
+
+// getMFAChallenge looks the challenge up among the ones of the user logins or of the admin logins,
+// a challenge is never completed by the flow of the other kind of login
+func getMFAChallenge(challengeID string, maxAttempts int, admin bool, lock bool, runner sq.BaseRunner) (models.MFAChallenge, error) {
+	var challenge models.MFAChallenge
+
+	if challengeID == "" {
+		return challenge, status.Error(codes.InvalidArgument, "MFA challenge is required")
+	}
+
+	hashedChallengeID, err := utils.HashMFACode(challengeID)
+	if err != nil {
+		return challenge, status.Error(codes.Internal, "failed to hash the MFA challenge")
+	}
+
+	query := sq.Select(
+		"id",
+		"challenge",
+		"user_id",
+		"admin_id",
+		"provider",
+		"methods",
+		"email_code",
+		"webauthn_session",
+		"attempts",
+		"expires_at",
+		"completed_at",
+		"created_at",
+	).
+		From("mfa_challenges").
+		Where(sq.Eq{"challenge": hashedChallengeID})
+	if admin {
+		query = query.Where(sq.NotEq{"admin_id": nil})
+	} else {
+		query = query.Where(sq.Eq{"admin_id": nil})
+	}
+	if lock {
+		query = query.Suffix("FOR UPDATE")
+	}
+
+	var userID sql.NullInt64
+	err = query.RunWith(runner).
+		QueryRow().
+		Scan(
+			&challenge.ID,
+			&challenge.Challenge,
+			&userID,
+			&challenge.AdminID,
+			&challenge.Provider,
+			&challenge.Methods,
+			&challenge.EmailCode,
+			&challenge.WebAuthnSession,
+			&challenge.Attempts,
+			&challenge.ExpiresAt,
+			&challenge.CompletedAt,
+			&challenge.CreatedAt,
+		)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return challenge, errInvalidMFAChallenge
+		}
+		return challenge, status.Error(codes.Internal, "failed to query the database")
+	}
+	challenge.UserID = int(userID.Int64)
+
+	if challenge.CompletedAt.Valid || time.Now().After(challenge.ExpiresAt) || challenge.Attempts >= maxAttempts {
+		return challenge, errInvalidMFAChallenge
+	}
+
+	return challenge, nil
+}
@@ -0,0 +1,246 @@
+package actions
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/consts"
+	"github.com/isaacwassouf/authentication-service/models"
+)
+
+// the more specific scope wins, e.g., a user policy overrides the policy of their roles
+var mfaScopePrecedence = map[string]int{
+	consts.MFA_SCOPE_GLOBAL:   0,
+	consts.MFA_SCOPE_PROVIDER: 1,
+	consts.MFA_SCOPE_ROLE:     2,
+	consts.MFA_SCOPE_USER:     3,
+}
+
+// between the policies of the roles of a user the strictest wins
+var mfaModeStrictness = map[string]int{
+	consts.MFA_OFF:      0,
+	consts.MFA_OPTIONAL: 1,
+	consts.MFA_REQUIRED: 2,
+}
+
+// ResolveMFAPolicy returns the policy that applies to a login of the user through the provider.
+// The MFA is optional when no policy matches.
+func ResolveMFAPolicy(userID int, provider string, db *sql.DB) (models.MFAPolicy, error) {
+	resolved := models.MFAPolicy{Scope: consts.MFA_SCOPE_GLOBAL, Mode: consts.MFA_OPTIONAL}
+
+	roles := sq.Select("roles.name").
+		From("roles").
+		InnerJoin("user_roles ON roles.id = user_roles.role_id").
+		Where(sq.Eq{"user_roles.user_id": userID})
+	rolesQuery, rolesArgs, err := roles.ToSql()
+	if err != nil {
+		return resolved, status.Error(codes.Internal, "failed to build the query")
+	}
+
+	policies, err := queryMFAPolicies(sq.Or{
+		sq.Eq{"scope": consts.MFA_SCOPE_GLOBAL},
+		sq.Eq{"scope": consts.MFA_SCOPE_PROVIDER, "scope_value": provider},
+		sq.And{sq.Eq{"scope": consts.MFA_SCOPE_ROLE}, sq.Expr("scope_value IN ("+rolesQuery+")", rolesArgs...)},
+		sq.Eq{"scope": consts.MFA_SCOPE_USER, "scope_value": strconv.Itoa(userID)},
+	}, db)
+	if err != nil {
+		return resolved, err
+	}
+
+	found := false
+	for _, policy := range policies {
+		if !found || mfaScopePrecedence[policy.Scope] > mfaScopePrecedence[resolved.Scope] {
+			resolved, found = policy, true
+			continue
+		}
+		if policy.Scope == resolved.Scope && mfaModeStrictness[policy.Mode] > mfaModeStrictness[resolved.Mode] {
+			resolved = policy
+		}
+	}
+
+	return resolved, nil
+}
+
+// GetMFAEnrollmentDeadline returns the time until which a user without a second factor can still
+// log in without it under a required policy. The grace period starts when the policy became
+// required or when the user registered, whichever is the latest.
+func GetMFAEnrollmentDeadline(policy models.MFAPolicy, userID int, db *sql.DB) (time.Time, error) {
+	var createdAt time.Time
+	err := sq.Select("created_at").
+		From("users").
+		Where(sq.Eq{"id": userID}).
+		RunWith(db).
+		QueryRow().
+		Scan(&createdAt)
+	if err != nil {
+		return time.Time{}, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	start := policy.CreatedAt
+	if policy.EnforcedSince.Valid {
+		start = policy.EnforcedSince.Time
+	}
+	if createdAt.After(start) {
+		start = createdAt
+	}
+	return start.Add(time.Duration(policy.GracePeriodHours) * time.Hour), nil
+}
+
+// ListMFAPolicies returns all the policies, the global one first
+func ListMFAPolicies(db *sql.DB) ([]models.MFAPolicy, error) {
+	return queryMFAPolicies(nil, db)
+}
+
+// GetMFAPolicy returns the policy of a scope
+func GetMFAPolicy(scope string, scopeValue string, db *sql.DB) (models.MFAPolicy, error) {
+	policies, err := queryMFAPolicies(sq.Eq{"scope": scope, "scope_value": scopeValue}, db)
+	if err != nil {
+		return models.MFAPolicy{}, err
+	}
+	if len(policies) == 0 {
+		return models.MFAPolicy{}, status.Error(codes.NotFound, "MFA policy not found")
+	}
+	return policies[0], nil
+}
+
+// SetMFAPolicy creates or replaces the policy of a scope
+func SetMFAPolicy(scope string, scopeValue string, mode string, gracePeriodHours int, db *sql.DB) (models.MFAPolicy, error) {
+	if _, ok := mfaModeStrictness[mode]; !ok {
+		return models.MFAPolicy{}, status.Error(codes.InvalidArgument, "mode must be required, optional or off")
+	}
+	if gracePeriodHours < 0 {
+		return models.MFAPolicy{}, status.Error(codes.InvalidArgument, "grace period can not be negative")
+	}
+	if err := validateMFAPolicyScope(scope, scopeValue, db); err != nil {
+		return models.MFAPolicy{}, err
+	}
+
+	var enforcedSince sql.NullTime
+	if mode == consts.MFA_REQUIRED {
+		enforcedSince = sql.NullTime{Time: time.Now(), Valid: true}
+	}
+
+	// enforced_since only moves when the mode becomes required, so that changing the grace period
+	// or saving the policy again does not restart the grace period. MySQL assigns the columns from
+	// left to right, so mode is still the stored one when enforced_since is assigned.
+	_, err := sq.Insert("mfa_policies").
+		Columns("scope", "scope_value", "mode", "grace_period_hours", "enforced_since").
+		Values(scope, scopeValue, mode, gracePeriodHours, enforcedSince).
+		Suffix(
+			"ON DUPLICATE KEY UPDATE "+
+				"enforced_since = IF(VALUES(mode) = ? AND mode <> ?, VALUES(enforced_since), enforced_since), "+
+				"mode = VALUES(mode), grace_period_hours = VALUES(grace_period_hours), updated_at = CURRENT_TIMESTAMP",
+			consts.MFA_REQUIRED, consts.MFA_REQUIRED,
+		).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return models.MFAPolicy{}, status.Error(codes.Internal, "failed to save the MFA policy")
+	}
+
+	return GetMFAPolicy(scope, scopeValue, db)
+}
+
+// DeleteMFAPolicy removes a policy, the logins then fall back to the less specific policies. The
+// removed policy is returned.
+func DeleteMFAPolicy(id int, db *sql.DB) (models.MFAPolicy, error) {
+	policies, err := queryMFAPolicies(sq.Eq{"id": id}, db)
+	if err != nil {
+		return models.MFAPolicy{}, err
+	}
+	if len(policies) == 0 {
+		return models.MFAPolicy{}, status.Error(codes.NotFound, "MFA policy not found")
+	}
+
+	result, err := sq.Delete("mfa_policies").
+		Where(sq.Eq{"id": id}).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return models.MFAPolicy{}, status.Error(codes.Internal, "failed to delete the MFA policy")
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return models.MFAPolicy{}, status.Error(codes.Internal, "failed to delete the MFA policy")
+	}
+	if deleted == 0 {
+		return models.MFAPolicy{}, status.Error(codes.NotFound, "MFA policy not found")
+	}
+	return policies[0], nil
+}
+
+func validateMFAPolicyScope(scope string, scopeValue string, db *sql.DB) error {
+	var query sq.SelectBuilder
+	switch scope {
+	case consts.MFA_SCOPE_GLOBAL:
+		if scopeValue != "" {
+			return status.Error(codes.InvalidArgument, "the global policy does not take a scope value")
+		}
+		return nil
+	case consts.MFA_SCOPE_PROVIDER:
+		if scopeValue == consts.PASSWORD {
+			return nil
+		}
+		query = sq.Select("COUNT(*)").From("auth_providers").Where(sq.Eq{"name": scopeValue})
+	case consts.MFA_SCOPE_ROLE:
+		query = sq.Select("COUNT(*)").From("roles").Where(sq.Eq{"name": scopeValue})
+	case consts.MFA_SCOPE_USER:
+		query = sq.Select("COUNT(*)").From("users").Where(sq.Eq{"id": scopeValue})
+	default:
+		return status.Error(codes.InvalidArgument, "scope must be global, provider, role or user")
+	}
+
+	var count int
+	if err := query.RunWith(db).QueryRow().Scan(&count); err != nil {
+		return status.Error(codes.Internal, "failed to query the database")
+	}
+	if count == 0 {
+		return status.Error(codes.NotFound, scope+" not found")
+	}
+	return nil
+}
+
+func queryMFAPolicies(condition sq.Sqlizer, db *sql.DB) ([]models.MFAPolicy, error) {
+	query := sq.Select("id", "scope", "scope_value", "mode", "grace_period_hours", "enforced_since", "created_at", "updated_at").
+		From("mfa_policies").
+		OrderBy("FIELD(scope, 'global', 'provider', 'role', 'user')", "scope_value")
+	if condition != nil {
+		query = query.Where(condition)
+	}
+
+	rows, err := query.RunWith(db).Query()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+	defer rows.Close()
+
+	var policies []models.MFAPolicy
+	for rows.Next() {
+		var policy models.MFAPolicy
+		err := rows.Scan(
+			&policy.ID,
+			&policy.Scope,
+			&policy.ScopeValue,
+			&policy.Mode,
+			&policy.GracePeriodHours,
+			&policy.EnforcedSince,
+			&policy.CreatedAt,
+			&policy.UpdatedAt,
+		)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "failed to scan the MFA policy")
+		}
+		policies = append(policies, policy)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	return policies, nil
+}
@@ -0,0 +1,149 @@
+package actions
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/matoous/go-nanoid/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/models"
+	"github.com/isaacwassouf/authentication-service/oauth"
+)
+
+// OAuthStateTTL is how long the user has to complete the login at the provider
+const OAuthStateTTL = time.Minute * 10
+
+// CreateOAuthState records the state, PKCE verifier and nonce of a new authorization request
+func CreateOAuthState(provider string, redirectURL string, db *sql.DB) (models.OAuthState, error) {
+	var oauthState models.OAuthState
+
+	err := sq.Select("id").
+		From("auth_providers").
+		Where(sq.Eq{"name": provider}).
+		RunWith(db).
+		QueryRow().
+		Scan(&oauthState.AuthProviderID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return oauthState, status.Error(codes.NotFound, "Auth provider not found")
+		}
+		return oauthState, status.Error(codes.Internal, "Failed to query the database")
+	}
+
+	oauthState.State, err = gonanoid.New(32)
+	if err != nil {
+		return oauthState, status.Error(codes.Internal, "Failed to generate a random state")
+	}
+	oauthState.Nonce, err = gonanoid.New(32)
+	if err != nil {
+		return oauthState, status.Error(codes.Internal, "Failed to generate a nonce")
+	}
+	oauthState.CodeVerifier, err = oauth.GenerateCodeVerifier()
+	if err != nil {
+		return oauthState, status.Error(codes.Internal, "Failed to generate a code verifier")
+	}
+	oauthState.RedirectURL = sql.NullString{String: redirectURL, Valid: redirectURL != ""}
+	oauthState.ExpiresAt = time.Now().Add(OAuthStateTTL)
+
+	_, err = sq.Insert("oauth_states").
+		Columns("state", "auth_provider_id", "code_verifier", "nonce", "redirect_url", "expires_at").
+		Values(
+			oauthState.State,
+			oauthState.AuthProviderID,
+			oauthState.CodeVerifier,
+			oauthState.Nonce,
+			oauthState.RedirectURL,
+			oauthState.ExpiresAt,
+		).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return oauthState, status.Error(codes.Internal, "Failed to save the state")
+	}
+
+	// clean up the states that were never used
+	_, err = sq.Delete("oauth_states").
+		Where(sq.Lt{"expires_at": time.Now().Add(-time.Hour * 24)}).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return oauthState, status.Error(codes.Internal, "Failed to delete the expired states")
+	}
+
+	return oauthState, nil
+}
+
+// ConsumeOAuthState marks the state of an authorization request as used, a state is only accepted
+// once, before it expires and for the provider it was issued for
+func ConsumeOAuthState(provider string, state string, db *sql.DB) (models.OAuthState, error) {
+	var oauthState models.OAuthState
+
+	if state == "" {
+		return oauthState, status.Error(codes.InvalidArgument, "State is required")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return oauthState, status.Error(codes.Internal, "Failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	err = sq.Select(
+		"oauth_states.id",
+		"oauth_states.state",
+		"oauth_states.auth_provider_id",
+		"oauth_states.code_verifier",
+		"oauth_states.nonce",
+		"oauth_states.redirect_url",
+		"oauth_states.used_at",
+		"oauth_states.expires_at",
+	).
+		From("oauth_states").
+		Join("auth_providers ON auth_providers.id = oauth_states.auth_provider_id").
+		Where(sq.Eq{"oauth_states.state": state, "auth_providers.name": provider}).
+		Suffix("FOR UPDATE").
+		RunWith(tx).
+		QueryRow().
+		Scan(
+			&oauthState.ID,
+			&oauthState.State,
+			&oauthState.AuthProviderID,
+			&oauthState.CodeVerifier,
+			&oauthState.Nonce,
+			&oauthState.RedirectURL,
+			&oauthState.UsedAt,
+			&oauthState.ExpiresAt,
+		)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return oauthState, status.Error(codes.InvalidArgument, "Unknown state")
+		}
+		return oauthState, status.Error(codes.Internal, "Failed to query the database")
+	}
+
+	if oauthState.UsedAt.Valid {
+		return oauthState, status.Error(codes.InvalidArgument, "State was already used")
+	}
+	if time.Now().After(oauthState.ExpiresAt) {
+		return oauthState, status.Error(codes.InvalidArgument, "State is expired")
+	}
+
+	_, err = sq.Update("oauth_states").
+		Set("used_at", time.Now()).
+		Where(sq.Eq{"id": oauthState.ID}).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return oauthState, status.Error(codes.Internal, "Failed to update the state")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return oauthState, status.Error(codes.Internal, "Failed to commit transaction")
+	}
+
+	return oauthState, nil
+}
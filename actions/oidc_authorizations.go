@@ -0,0 +1,276 @@
+package actions
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/matoous/go-nanoid/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/models"
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+const (
+	// OIDCAuthorizationTTL is how long the user has to log in and approve an authorization request
+	OIDCAuthorizationTTL = time.Minute * 10
+	// OIDCCodeTTL is how long the client has to exchange an authorization code
+	OIDCCodeTTL = time.Minute
+)
+
+// CreateOIDCAuthorization records the authorization request of a client until the user logs in
+// and approves it, the returned request id is handed to the login page
+func CreateOIDCAuthorization(authorization models.OIDCAuthorization, db *sql.DB) (string, error) {
+	requestID, err := gonanoid.New(32)
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to generate the request id")
+	}
+
+	_, err = sq.Insert("oidc_authorizations").
+		Columns("request_id", "client_id", "redirect_uri", "scope", "state", "nonce", "code_challenge", "expires_at").
+		Values(
+			requestID,
+			authorization.ClientID,
+			authorization.RedirectURI,
+			authorization.Scope,
+			authorization.State,
+			authorization.Nonce,
+			authorization.CodeChallenge,
+			time.Now().Add(OIDCAuthorizationTTL),
+		).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to save the authorization request")
+	}
+
+	// clean up the requests that were never completed
+	_, err = sq.Delete("oidc_authorizations").
+		Where(sq.Lt{"expires_at": time.Now().Add(-time.Hour * 24)}).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to delete the expired authorization requests")
+	}
+
+	return requestID, nil
+}
+
+// GetOIDCAuthorization returns an authorization request the user can still approve
+func GetOIDCAuthorization(requestID string, db *sql.DB) (models.OIDCAuthorization, error) {
+	authorization, err := scanOIDCAuthorization(
+		selectOIDCAuthorizations().
+			Where(sq.Eq{"request_id": requestID}).
+			RunWith(db).
+			QueryRow(),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return authorization, status.Error(codes.NotFound, "authorization request not found")
+		}
+		return authorization, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	if authorization.ApprovedAt.Valid || authorization.UsedAt.Valid {
+		return authorization, status.Error(codes.FailedPrecondition, "authorization request was already completed")
+	}
+	if time.Now().After(authorization.ExpiresAt) {
+		return authorization, status.Error(codes.FailedPrecondition, "authorization request is expired")
+	}
+	return authorization, nil
+}
+
+// ApproveOIDCAuthorization binds an authorization request to the user who approved it and returns
+// the authorization code the client exchanges for the tokens. The auth method and time of the
+// login of the user end up in the ID token.
+func ApproveOIDCAuthorization(requestID string, userID int, authMethod string, authTime time.Time, db *sql.DB) (string, error) {
+	code, err := gonanoid.New(48)
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to generate the authorization code")
+	}
+	hashedCode, err := utils.HashMFACode(code)
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to hash the authorization code")
+	}
+
+	now := time.Now()
+	result, err := sq.Update("oidc_authorizations").
+		Set("user_id", userID).
+		Set("code", hashedCode).
+		Set("auth_method", authMethod).
+		Set("auth_time", authTime).
+		Set("approved_at", now).
+		Set("expires_at", now.Add(OIDCCodeTTL)).
+		Where(sq.Eq{"request_id": requestID, "approved_at": nil, "used_at": nil}).
+		Where(sq.Gt{"expires_at": now}).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to approve the authorization request")
+	}
+
+	approved, err := result.RowsAffected()
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to approve the authorization request")
+	}
+	if approved == 0 {
+		return "", status.Error(codes.FailedPrecondition, "authorization request was already completed or is expired")
+	}
+	return code, nil
+}
+
+// DenyOIDCAuthorization closes an authorization request the user turned down
+func DenyOIDCAuthorization(requestID string, db *sql.DB) error {
+	_, err := sq.Update("oidc_authorizations").
+		Set("used_at", time.Now()).
+		Where(sq.Eq{"request_id": requestID, "used_at": nil}).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to deny the authorization request")
+	}
+	return nil
+}
+
+// ConsumeOIDCAuthorizationCode marks an authorization code as used, a code is only accepted once,
+// before it expires and by the client it was issued to
+func ConsumeOIDCAuthorizationCode(code string, clientID int, db *sql.DB) (models.OIDCAuthorization, error) {
+	var authorization models.OIDCAuthorization
+
+	hashedCode, err := utils.HashMFACode(code)
+	if err != nil {
+		return authorization, status.Error(codes.Internal, "failed to hash the authorization code")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return authorization, status.Error(codes.Internal, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	authorization, err = scanOIDCAuthorization(
+		selectOIDCAuthorizations().
+			Where(sq.Eq{"code": hashedCode, "client_id": clientID}).
+			Suffix("FOR UPDATE").
+			RunWith(tx).
+			QueryRow(),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return authorization, status.Error(codes.InvalidArgument, "unknown authorization code")
+		}
+		return authorization, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	if authorization.UsedAt.Valid {
+		return authorization, status.Error(codes.InvalidArgument, "authorization code was already used")
+	}
+	if time.Now().After(authorization.ExpiresAt) {
+		return authorization, status.Error(codes.InvalidArgument, "authorization code is expired")
+	}
+
+	_, err = sq.Update("oidc_authorizations").
+		Set("used_at", time.Now()).
+		Where(sq.Eq{"id": authorization.ID}).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return authorization, status.Error(codes.Internal, "failed to update the authorization code")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return authorization, status.Error(codes.Internal, "failed to commit transaction")
+	}
+	return authorization, nil
+}
+
+// GetOIDCConsent returns the scopes the user already consented to share with the client
+func GetOIDCConsent(userID int, clientID int, db *sql.DB) ([]string, error) {
+	var scope string
+	err := sq.Select("scope").
+		From("oidc_consents").
+		Where(sq.Eq{"user_id": userID, "client_id": clientID}).
+		RunWith(db).
+		QueryRow().
+		Scan(&scope)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+	return strings.Fields(scope), nil
+}
+
+// GrantOIDCConsent adds the scopes to the ones the user consented to share with the client
+func GrantOIDCConsent(userID int, clientID int, scopes []string, db *sql.DB) error {
+	granted, err := GetOIDCConsent(userID, clientID, db)
+	if err != nil {
+		return err
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(granted, scope) {
+			granted = append(granted, scope)
+		}
+	}
+
+	scope := strings.Join(granted, " ")
+	_, err = sq.Insert("oidc_consents").
+		Columns("user_id", "client_id", "scope").
+		Values(userID, clientID, scope).
+		Suffix("ON DUPLICATE KEY UPDATE scope = ?", scope).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to save the consent")
+	}
+	return nil
+}
+
+func selectOIDCAuthorizations() sq.SelectBuilder {
+	return sq.Select(
+		"id",
+		"request_id",
+		"client_id",
+		"redirect_uri",
+		"scope",
+		"state",
+		"nonce",
+		"code_challenge",
+		"user_id",
+		"auth_method",
+		"auth_time",
+		"approved_at",
+		"used_at",
+		"expires_at",
+		"created_at",
+	).
+		From("oidc_authorizations")
+}
+
+func scanOIDCAuthorization(row sq.RowScanner) (models.OIDCAuthorization, error) {
+	var authorization models.OIDCAuthorization
+	err := row.Scan(
+		&authorization.ID,
+		&authorization.RequestID,
+		&authorization.ClientID,
+		&authorization.RedirectURI,
+		&authorization.Scope,
+		&authorization.State,
+		&authorization.Nonce,
+		&authorization.CodeChallenge,
+		&authorization.UserID,
+		&authorization.AuthMethod,
+		&authorization.AuthTime,
+		&authorization.ApprovedAt,
+		&authorization.UsedAt,
+		&authorization.ExpiresAt,
+		&authorization.CreatedAt,
+	)
+	return authorization, err
+}
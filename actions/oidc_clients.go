@@ -0,0 +1,166 @@
+package actions
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/matoous/go-nanoid/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/models"
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+// CreateOIDCClient registers a client of the OpenID Connect provider. The secret of a confidential
+// client is returned once and only stored hashed, a public client gets none.
+func CreateOIDCClient(name string, redirectURIs []string, scopes []string, public bool, db *sql.DB) (string, string, error) {
+	clientID, err := gonanoid.New(32)
+	if err != nil {
+		return "", "", status.Error(codes.Internal, "failed to generate the client id")
+	}
+
+	var clientSecret string
+	var hashedSecret sql.NullString
+	if !public {
+		clientSecret, err = gonanoid.New(48)
+		if err != nil {
+			return "", "", status.Error(codes.Internal, "failed to generate the client secret")
+		}
+		hashedSecret.String, err = utils.HashMFACode(clientSecret)
+		if err != nil {
+			return "", "", status.Error(codes.Internal, "failed to hash the client secret")
+		}
+		hashedSecret.Valid = true
+	}
+
+	_, err = sq.Insert("oidc_clients").
+		Columns("client_id", "client_secret", "name", "redirect_uris", "scopes").
+		Values(clientID, hashedSecret, name, strings.Join(redirectURIs, " "), strings.Join(scopes, " ")).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return "", "", status.Error(codes.Internal, "failed to save the client")
+	}
+
+	return clientID, clientSecret, nil
+}
+
+// ListOIDCClients returns the registered clients, the most recent first
+func ListOIDCClients(db *sql.DB) ([]models.OIDCClient, error) {
+	rows, err := selectOIDCClients().
+		OrderBy("id DESC").
+		RunWith(db).
+		Query()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+	defer rows.Close()
+
+	var clients []models.OIDCClient
+	for rows.Next() {
+		client, err := scanOIDCClient(rows)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "failed to scan the client")
+		}
+		clients = append(clients, client)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	return clients, nil
+}
+
+// GetOIDCClient returns a registered client by its client id
+func GetOIDCClient(clientID string, db *sql.DB) (models.OIDCClient, error) {
+	client, err := scanOIDCClient(
+		selectOIDCClients().
+			Where(sq.Eq{"client_id": clientID}).
+			RunWith(db).
+			QueryRow(),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return client, status.Error(codes.NotFound, "client not found")
+		}
+		return client, status.Error(codes.Internal, "failed to query the database")
+	}
+	return client, nil
+}
+
+// GetOIDCClientByID returns a registered client by its primary key
+func GetOIDCClientByID(id int, db *sql.DB) (models.OIDCClient, error) {
+	client, err := scanOIDCClient(
+		selectOIDCClients().
+			Where(sq.Eq{"id": id}).
+			RunWith(db).
+			QueryRow(),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return client, status.Error(codes.NotFound, "client not found")
+		}
+		return client, status.Error(codes.Internal, "failed to query the database")
+	}
+	return client, nil
+}
+
+// CheckOIDCClientSecret reports whether the secret is the one of the confidential client
+func CheckOIDCClientSecret(client models.OIDCClient, clientSecret string) (bool, error) {
+	if client.IsPublic() || clientSecret == "" {
+		return false, nil
+	}
+
+	hashedSecret, err := utils.HashMFACode(clientSecret)
+	if err != nil {
+		return false, status.Error(codes.Internal, "failed to hash the client secret")
+	}
+	return subtle.ConstantTimeCompare([]byte(hashedSecret), []byte(client.ClientSecret.String)) == 1, nil
+}
+
+// DeleteOIDCClient deletes a client along with its pending authorizations and the consents given
+// to it, the tokens it already obtained expire on their own
+func DeleteOIDCClient(clientID string, db *sql.DB) error {
+	result, err := sq.Delete("oidc_clients").
+		Where(sq.Eq{"client_id": clientID}).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to delete the client")
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to delete the client")
+	}
+	if deleted == 0 {
+		return status.Error(codes.NotFound, "client not found")
+	}
+	return nil
+}
+
+func selectOIDCClients() sq.SelectBuilder {
+	return sq.Select("id", "client_id", "client_secret", "name", "redirect_uris", "scopes", "created_at").
+		From("oidc_clients")
+}
+
+func scanOIDCClient(row sq.RowScanner) (models.OIDCClient, error) {
+	var client models.OIDCClient
+	var redirectURIs, scopes string
+	err := row.Scan(
+		&client.ID,
+		&client.ClientID,
+		&client.ClientSecret,
+		&client.Name,
+		&redirectURIs,
+		&scopes,
+		&client.CreatedAt,
+	)
+	client.RedirectURIs = strings.Fields(redirectURIs)
+	client.Scopes = strings.Fields(scopes)
+	return client, err
+}
@@ -0,0 +1,101 @@
+package actions
+
+import (
+	"database/sql"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+// RecoveryCodesCount is the number of recovery codes generated at once
+const RecoveryCodesCount = 10
+
+// GenerateRecoveryCodes replaces the recovery codes of the user with a new batch, the codes are
+// only returned once and stored hashed
+func GenerateRecoveryCodes(userID int, db *sql.DB) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	// the previous batch is invalidated, including the unused codes
+	_, err = sq.Delete("mfa_recovery_codes").
+		Where(sq.Eq{"user_id": userID}).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to delete the previous recovery codes")
+	}
+
+	recoveryCodes := make([]string, 0, RecoveryCodesCount)
+	query := sq.Insert("mfa_recovery_codes").Columns("user_id", "code")
+	for len(recoveryCodes) < RecoveryCodesCount {
+		code, err := utils.GenerateRecoveryCode()
+		if err != nil {
+			return nil, status.Error(codes.Internal, "failed to generate the recovery codes")
+		}
+
+		hashedCode, err := utils.HashMFACode(utils.NormalizeRecoveryCode(code))
+		if err != nil {
+			return nil, status.Error(codes.Internal, "failed to hash the recovery codes")
+		}
+
+		query = query.Values(userID, hashedCode)
+		recoveryCodes = append(recoveryCodes, code)
+	}
+
+	if _, err = query.RunWith(tx).Exec(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to save the recovery codes")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to commit transaction")
+	}
+
+	return recoveryCodes, nil
+}
+
+// UseRecoveryCode marks an unused recovery code of the user as used, it reports whether the code
+// was valid
+func UseRecoveryCode(userID int, code string, db *sql.DB) (bool, error) {
+	hashedCode, err := utils.HashMFACode(utils.NormalizeRecoveryCode(code))
+	if err != nil {
+		return false, status.Error(codes.Internal, "failed to hash the recovery code")
+	}
+
+	result, err := sq.Update("mfa_recovery_codes").
+		Set("used_at", time.Now()).
+		Where(sq.Eq{"user_id": userID, "code": hashedCode, "used_at": nil}).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return false, status.Error(codes.Internal, "failed to use the recovery code")
+	}
+
+	used, err := result.RowsAffected()
+	if err != nil {
+		return false, status.Error(codes.Internal, "failed to use the recovery code")
+	}
+
+	return used == 1, nil
+}
+
+// CountRecoveryCodes returns the number of recovery codes the user has left
+func CountRecoveryCodes(userID int, db *sql.DB) (int, error) {
+	var count int
+	err := sq.Select("COUNT(*)").
+		From("mfa_recovery_codes").
+		Where(sq.Eq{"user_id": userID, "used_at": nil}).
+		RunWith(db).
+		QueryRow().
+		Scan(&count)
+	if err != nil {
+		return 0, status.Error(codes.Internal, "failed to count the recovery codes")
+	}
+	return count, nil
+}
@@ -0,0 +1,219 @@
+package actions
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/matoous/go-nanoid/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/models"
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+// ErrRefreshTokenReuse is returned when a refresh token is exchanged a second time
+var ErrRefreshTokenReuse = status.Error(codes.Unauthenticated, "refresh token reuse detected")
+
+// CreateRefreshToken stores a new refresh token for the user and returns its plain value.
+// An empty familyID starts a new token family, i.e., a new login.
+func CreateRefreshToken(userID int, familyID string, runner sq.BaseRunner) (string, error) {
+	return createRefreshToken(userID, familyID, sql.NullInt64{}, runner)
+}
+
+// CreateOIDCRefreshToken stores a new refresh token issued to an OpenID Connect client, only the
+// same client can refresh it
+func CreateOIDCRefreshToken(userID int, familyID string, clientID int, runner sq.BaseRunner) (string, error) {
+	return createRefreshToken(userID, familyID, sql.NullInt64{Int64: int64(clientID), Valid: true}, runner)
+}
+
+func createRefreshToken(userID int, familyID string, clientID sql.NullInt64, runner sq.BaseRunner) (string, error) {
+	if familyID == "" {
+		id, err := gonanoid.New()
+		if err != nil {
+			return "", status.Error(codes.Internal, "failed to generate the refresh token family")
+		}
+		familyID = id
+	}
+
+	token, err := utils.GenerateRefreshToken()
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to generate the refresh token")
+	}
+
+	hashedToken, err := utils.HashRefreshToken(token)
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to hash the refresh token")
+	}
+
+	_, err = sq.Insert("refresh_tokens").
+		Columns("user_id", "family_id", "client_id", "token", "expires_at").
+		Values(userID, familyID, clientID, hashedToken, time.Now().Add(utils.RefreshTokenTTL)).
+		RunWith(runner).
+		Exec()
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to save the refresh token")
+	}
+
+	return token, nil
+}
+
+// RotateRefreshToken consumes a refresh token and issues its successor in the same family, the
+// user and the family of the token are returned along with it. The token has to be issued to the
+// given OpenID Connect client, or to none when the client id is null.
+// Presenting a token that was already used revokes the whole family, since either the
+// legitimate client or an attacker is replaying a stolen token.
+func RotateRefreshToken(token string, clientID sql.NullInt64, db *sql.DB) (int, string, string, error) {
+	hashedToken, err := utils.HashRefreshToken(token)
+	if err != nil {
+		return -1, "", "", status.Error(codes.Internal, "failed to hash the refresh token")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return -1, "", "", status.Error(codes.Internal, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	var refreshToken models.RefreshToken
+	err = sq.Select("id", "user_id", "family_id", "client_id", "used_at", "revoked_at", "expires_at").
+		From("refresh_tokens").
+		Where(sq.Eq{"token": hashedToken}).
+		Suffix("FOR UPDATE").
+		RunWith(tx).
+		QueryRow().
+		Scan(
+			&refreshToken.ID,
+			&refreshToken.UserID,
+			&refreshToken.FamilyID,
+			&refreshToken.ClientID,
+			&refreshToken.UsedAt,
+			&refreshToken.RevokedAt,
+			&refreshToken.ExpiresAt,
+		)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return -1, "", "", status.Error(codes.Unauthenticated, "invalid refresh token")
+		}
+		return -1, "", "", status.Error(codes.Internal, "failed to query the database")
+	}
+
+	// a token presented by another client is rejected without being consumed
+	if refreshToken.ClientID != clientID {
+		return -1, "", "", status.Error(codes.Unauthenticated, "refresh token was not issued to the client")
+	}
+
+	if refreshToken.RevokedAt.Valid {
+		return -1, "", "", status.Error(codes.Unauthenticated, "refresh token is revoked")
+	}
+
+	// the token was already exchanged, revoke every token of the family. The user and the family
+	// are returned along with the error so that the session is logged out as well.
+	if refreshToken.UsedAt.Valid {
+		err = RevokeRefreshTokenFamily(refreshToken.FamilyID, tx)
+		if err != nil {
+			return -1, "", "", err
+		}
+		if err = tx.Commit(); err != nil {
+			return -1, "", "", status.Error(codes.Internal, "failed to commit transaction")
+		}
+		return refreshToken.UserID, refreshToken.FamilyID, "", ErrRefreshTokenReuse
+	}
+
+	if time.Now().After(refreshToken.ExpiresAt) {
+		return -1, "", "", status.Error(codes.Unauthenticated, "refresh token is expired")
+	}
+
+	// mark the token as used
+	_, err = sq.Update("refresh_tokens").
+		Set("used_at", time.Now()).
+		Where(sq.Eq{"id": refreshToken.ID}).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return -1, "", "", status.Error(codes.Internal, "failed to update the refresh token")
+	}
+
+	newToken, err := createRefreshToken(refreshToken.UserID, refreshToken.FamilyID, refreshToken.ClientID, tx)
+	if err != nil {
+		return -1, "", "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return -1, "", "", status.Error(codes.Internal, "failed to commit transaction")
+	}
+
+	return refreshToken.UserID, refreshToken.FamilyID, newToken, nil
+}
+
+// RevokeRefreshTokenFamily revokes every refresh token issued from the same login
+func RevokeRefreshTokenFamily(familyID string, runner sq.BaseRunner) error {
+	_, err := sq.Update("refresh_tokens").
+		Set("revoked_at", time.Now()).
+		Where(sq.Eq{"family_id": familyID, "revoked_at": nil}).
+		RunWith(runner).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to revoke the refresh tokens")
+	}
+	return nil
+}
+
+// RevokeRefreshToken revokes the family of the given refresh token, a token issued to another
+// user is reported as not found
+func RevokeRefreshToken(userID int, token string, db *sql.DB) error {
+	hashedToken, err := utils.HashRefreshToken(token)
+	if err != nil {
+		return status.Error(codes.Internal, "failed to hash the refresh token")
+	}
+
+	var familyID string
+	err = sq.Select("family_id").
+		From("refresh_tokens").
+		Where(sq.Eq{"token": hashedToken, "user_id": userID}).
+		RunWith(db).
+		QueryRow().
+		Scan(&familyID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return status.Error(codes.NotFound, "refresh token not found")
+		}
+		return status.Error(codes.Internal, "failed to query the database")
+	}
+
+	return RevokeRefreshTokenFamily(familyID, db)
+}
+
+// GetRefreshToken returns the stored refresh token matching a plain token
+func GetRefreshToken(token string, db *sql.DB) (models.RefreshToken, error) {
+	var refreshToken models.RefreshToken
+
+	hashedToken, err := utils.HashRefreshToken(token)
+	if err != nil {
+		return refreshToken, status.Error(codes.Internal, "failed to hash the refresh token")
+	}
+
+	err = sq.Select("id", "user_id", "family_id", "used_at", "revoked_at", "expires_at", "created_at").
+		From("refresh_tokens").
+		Where(sq.Eq{"token": hashedToken}).
+		RunWith(db).
+		QueryRow().
+		Scan(
+			&refreshToken.ID,
+			&refreshToken.UserID,
+			&refreshToken.FamilyID,
+			&refreshToken.UsedAt,
+			&refreshToken.RevokedAt,
+			&refreshToken.ExpiresAt,
+			&refreshToken.CreatedAt,
+		)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return refreshToken, status.Error(codes.NotFound, "refresh token not found")
+		}
+		return refreshToken, status.Error(codes.Internal, "failed to query the database")
+	}
+	return refreshToken, nil
+}
@@ -0,0 +1,141 @@
+package actions
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+// refreshTokenRows returns a refresh token of the user 1 in the family "family"
+func refreshTokenRows(clientID interface{}, usedAt interface{}, revokedAt interface{}, expiresAt time.Time) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "user_id", "family_id", "client_id", "used_at", "revoked_at", "expires_at"}).
+		AddRow(1, 1, "family", clientID, usedAt, revokedAt, expiresAt)
+}
+
+func TestRotateRefreshTokenIssuesSuccessor(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create the database mock: %v", err)
+	}
+	defer db.Close()
+
+	hashedToken, err := utils.HashRefreshToken("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM refresh_tokens").
+		WithArgs(hashedToken).
+		WillReturnRows(refreshTokenRows(nil, nil, nil, time.Now().Add(time.Hour)))
+	mock.ExpectExec("UPDATE refresh_tokens SET used_at").WillReturnResult(sqlmock.NewResult(0, 1))
+	// the successor stays in the family of the consumed token
+	mock.ExpectExec("INSERT INTO refresh_tokens").
+		WithArgs(1, "family", nil, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectCommit()
+
+	userID, familyID, newToken, err := RotateRefreshToken("token", sql.NullInt64{}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID != 1 || familyID != "family" || newToken == "" || newToken == "token" {
+		t.Fatalf("unexpected rotation %d %s %s", userID, familyID, newToken)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRotateRefreshTokenRevokesFamilyOnReuse(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create the database mock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM refresh_tokens").
+		WillReturnRows(refreshTokenRows(nil, time.Now().Add(-time.Minute), nil, time.Now().Add(time.Hour)))
+	mock.ExpectExec("UPDATE refresh_tokens SET revoked_at").
+		WithArgs(sqlmock.AnyArg(), "family").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	// the user and the family are returned so that the session is logged out as well
+	userID, familyID, newToken, err := RotateRefreshToken("token", sql.NullInt64{}, db)
+	if !errors.Is(err, ErrRefreshTokenReuse) {
+		t.Fatalf("expected the reuse to be detected, got %v", err)
+	}
+	if userID != 1 || familyID != "family" || newToken != "" {
+		t.Fatalf("unexpected rotation %d %s %s", userID, familyID, newToken)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRotateRefreshTokenRejectsInvalidTokens(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create the database mock: %v", err)
+	}
+	defer db.Close()
+
+	tests := []struct {
+		name     string
+		rows     *sqlmock.Rows
+		clientID sql.NullInt64
+	}{
+		{
+			name: "unknown token",
+			rows: sqlmock.NewRows([]string{"id", "user_id", "family_id", "client_id", "used_at", "revoked_at", "expires_at"}),
+		},
+		{
+			name: "revoked token",
+			rows: refreshTokenRows(nil, nil, time.Now().Add(-time.Minute), time.Now().Add(time.Hour)),
+		},
+		{
+			name: "expired token",
+			rows: refreshTokenRows(nil, nil, nil, time.Now().Add(-time.Minute)),
+		},
+		{
+			name:     "token of another client",
+			rows:     refreshTokenRows(2, nil, nil, time.Now().Add(time.Hour)),
+			clientID: sql.NullInt64{Int64: 3, Valid: true},
+		},
+		{
+			name: "token of a client presented by the first party",
+			rows: refreshTokenRows(2, nil, nil, time.Now().Add(time.Hour)),
+		},
+		{
+			name:     "first party token presented by a client",
+			rows:     refreshTokenRows(nil, nil, nil, time.Now().Add(time.Hour)),
+			clientID: sql.NullInt64{Int64: 2, Valid: true},
+		},
+	}
+	for _, test := range tests {
+		// the token is neither consumed nor replaced
+		mock.ExpectBegin()
+		mock.ExpectQuery("FROM refresh_tokens").WillReturnRows(test.rows)
+		mock.ExpectRollback()
+
+		_, _, newToken, err := RotateRefreshToken("token", test.clientID, db)
+		if status.Code(err) != codes.Unauthenticated || errors.Is(err, ErrRefreshTokenReuse) {
+			t.Errorf("%s: expected Unauthenticated, got %v", test.name, err)
+		}
+		if newToken != "" {
+			t.Errorf("%s: expected no new token", test.name)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,472 @@
+package actions
+
+import (
+	"database/sql"
+	"errors"
+
+	sq "github.com/Masterminds/squirrel"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/consts"
+	"github.com/isaacwassouf/authentication-service/models"
+)
+
+// CreateRole creates a role without any permission
+func CreateRole(name string, description string, db *sql.DB) (int, error) {
+	return insertUniqueName("roles", "role", name, description, db)
+}
+
+// ListRoles returns the roles along with the permissions granted to them
+func ListRoles(db *sql.DB) ([]models.Role, error) {
+	rows, err := sq.Select("id", "name", "description", "created_at").
+		From("roles").
+		OrderBy("name").
+		RunWith(db).
+		Query()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+	defer rows.Close()
+
+	var roles []models.Role
+	index := map[int]int{}
+	for rows.Next() {
+		var role models.Role
+		if err := rows.Scan(&role.ID, &role.Name, &role.Description, &role.CreatedAt); err != nil {
+			return nil, status.Error(codes.Internal, "failed to scan the role")
+		}
+		index[role.ID] = len(roles)
+		roles = append(roles, role)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	grants, err := sq.Select("role_permissions.role_id", "permissions.name").
+		From("role_permissions").
+		InnerJoin("permissions ON permissions.id = role_permissions.permission_id").
+		OrderBy("permissions.name").
+		RunWith(db).
+		Query()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+	defer grants.Close()
+
+	for grants.Next() {
+		var roleID int
+		var permission string
+		if err := grants.Scan(&roleID, &permission); err != nil {
+			return nil, status.Error(codes.Internal, "failed to scan the permission")
+		}
+		if i, ok := index[roleID]; ok {
+			roles[i].Permissions = append(roles[i].Permissions, permission)
+		}
+	}
+	if err := grants.Err(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	return roles, nil
+}
+
+// DeleteRole deletes a role, the users it was assigned to lose its permissions. A role the MFA
+// policies still apply to can not be deleted. The tokens of the users it was assigned to are
+// revoked and their ids are returned.
+func DeleteRole(name string, db *sql.DB) ([]int, error) {
+	var count int
+	err := sq.Select("COUNT(*)").
+		From("mfa_policies").
+		Where(sq.Eq{"scope": consts.MFA_SCOPE_ROLE, "scope_value": name}).
+		RunWith(db).
+		QueryRow().
+		Scan(&count)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+	if count > 0 {
+		return nil, status.Error(codes.FailedPrecondition, "role is used by a MFA policy")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	roleID, err := getIDByName("roles", "role", name, tx)
+	if err != nil {
+		return nil, err
+	}
+	userIDs, err := revokeRoleHolderTokens(sq.Eq{"role_id": roleID}, tx)
+	if err != nil {
+		return nil, err
+	}
+	if err := deleteByName("roles", "role", name, tx); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to commit transaction")
+	}
+	return userIDs, nil
+}
+
+// CreatePermission creates a permission that can then be granted to the roles
+func CreatePermission(name string, description string, db *sql.DB) (int, error) {
+	return insertUniqueName("permissions", "permission", name, description, db)
+}
+
+// ListPermissions returns the permissions
+func ListPermissions(db *sql.DB) ([]models.Permission, error) {
+	rows, err := sq.Select("id", "name", "description", "created_at").
+		From("permissions").
+		OrderBy("name").
+		RunWith(db).
+		Query()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+	defer rows.Close()
+
+	var permissions []models.Permission
+	for rows.Next() {
+		var permission models.Permission
+		if err := rows.Scan(&permission.ID, &permission.Name, &permission.Description, &permission.CreatedAt); err != nil {
+			return nil, status.Error(codes.Internal, "failed to scan the permission")
+		}
+		permissions = append(permissions, permission)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	return permissions, nil
+}
+
+// DeletePermission deletes a permission and revokes it from every role, the tokens of the users
+// it was granted to are revoked and their ids are returned
+func DeletePermission(name string, db *sql.DB) ([]int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	permissionID, err := getIDByName("permissions", "permission", name, tx)
+	if err != nil {
+		return nil, err
+	}
+	grants := sq.Select("role_id").From("role_permissions").Where(sq.Eq{"permission_id": permissionID})
+	userIDs, err := revokeRoleHolderTokens(sq.Expr("role_id IN (?)", grants), tx)
+	if err != nil {
+		return nil, err
+	}
+	if err := deleteByName("permissions", "permission", name, tx); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to commit transaction")
+	}
+	return userIDs, nil
+}
+
+// GrantPermission grants a permission to a role, granting it twice is not an error
+func GrantPermission(role string, permission string, db *sql.DB) error {
+	roleID, err := getIDByName("roles", "role", role, db)
+	if err != nil {
+		return err
+	}
+	permissionID, err := getIDByName("permissions", "permission", permission, db)
+	if err != nil {
+		return err
+	}
+
+	_, err = sq.Insert("role_permissions").
+		Options("IGNORE").
+		Columns("role_id", "permission_id").
+		Values(roleID, permissionID).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to grant the permission")
+	}
+	return nil
+}
+
+// RevokePermission revokes a permission from a role, the tokens of the users the role is assigned
+// to are revoked and their ids are returned
+func RevokePermission(role string, permission string, db *sql.DB) ([]int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	roleID, err := getIDByName("roles", "role", role, tx)
+	if err != nil {
+		return nil, err
+	}
+	permissionID, err := getIDByName("permissions", "permission", permission, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := sq.Delete("role_permissions").
+		Where(sq.Eq{"role_id": roleID, "permission_id": permissionID}).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to revoke the permission")
+	}
+	revoked, err := result.RowsAffected()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to revoke the permission")
+	}
+	// the permission was not granted to the role, no token carries it
+	if revoked == 0 {
+		return nil, nil
+	}
+
+	userIDs, err := revokeRoleHolderTokens(sq.Eq{"role_id": roleID}, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to commit transaction")
+	}
+	return userIDs, nil
+}
+
+// AssignRole assigns a role to a user, assigning it twice is not an error
+func AssignRole(userID int, role string, db *sql.DB) error {
+	roleID, err := getIDByName("roles", "role", role, db)
+	if err != nil {
+		return err
+	}
+
+	var count int
+	err = sq.Select("COUNT(*)").
+		From("users").
+		Where(sq.Eq{"id": userID}).
+		RunWith(db).
+		QueryRow().
+		Scan(&count)
+	if err != nil {
+		return status.Error(codes.Internal, "failed to query the database")
+	}
+	if count == 0 {
+		return status.Error(codes.NotFound, "user not found")
+	}
+
+	_, err = sq.Insert("user_roles").
+		Options("IGNORE").
+		Columns("user_id", "role_id").
+		Values(userID, roleID).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to assign the role")
+	}
+	return nil
+}
+
+// UnassignRole removes a role from a user and revokes the tokens that carry it
+func UnassignRole(userID int, role string, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	roleID, err := getIDByName("roles", "role", role, tx)
+	if err != nil {
+		return err
+	}
+
+	result, err := sq.Delete("user_roles").
+		Where(sq.Eq{"user_id": userID, "role_id": roleID}).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to unassign the role")
+	}
+	unassigned, err := result.RowsAffected()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to unassign the role")
+	}
+	// the role was not assigned to the user, no token carries it
+	if unassigned == 0 {
+		return nil
+	}
+
+	if err := bumpTokenVersions([]int{userID}, tx); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return status.Error(codes.Internal, "failed to commit transaction")
+	}
+	return nil
+}
+
+// GetUserRoles returns the roles assigned to the user and the permissions they grant
+func GetUserRoles(userID int, db *sql.DB) ([]string, []string, error) {
+	rows, err := sq.Select("roles.name", "permissions.name").
+		From("user_roles").
+		InnerJoin("roles ON roles.id = user_roles.role_id").
+		LeftJoin("role_permissions ON role_permissions.role_id = roles.id").
+		LeftJoin("permissions ON permissions.id = role_permissions.permission_id").
+		Where(sq.Eq{"user_roles.user_id": userID}).
+		OrderBy("roles.name", "permissions.name").
+		RunWith(db).
+		Query()
+	if err != nil {
+		return nil, nil, status.Error(codes.Internal, "failed to query the database")
+	}
+	defer rows.Close()
+
+	var roles, permissions []string
+	seenRoles, seenPermissions := map[string]bool{}, map[string]bool{}
+	for rows.Next() {
+		var role string
+		var permission sql.NullString
+		if err := rows.Scan(&role, &permission); err != nil {
+			return nil, nil, status.Error(codes.Internal, "failed to scan the role")
+		}
+		if !seenRoles[role] {
+			seenRoles[role] = true
+			roles = append(roles, role)
+		}
+		// a permission may be granted by several roles
+		if permission.Valid && !seenPermissions[permission.String] {
+			seenPermissions[permission.String] = true
+			permissions = append(permissions, permission.String)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	return roles, permissions, nil
+}
+
+// revokeRoleHolderTokens revokes the tokens of the users assigned to the roles that match the
+// condition on user_roles.role_id and returns their ids, it runs before the roles lose their
+// permissions so that the new tokens are only issued afterwards
+func revokeRoleHolderTokens(roles sq.Sqlizer, runner sq.BaseRunner) ([]int, error) {
+	rows, err := sq.Select("DISTINCT user_id").
+		From("user_roles").
+		Where(roles).
+		RunWith(runner).
+		Query()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+	defer rows.Close()
+
+	var userIDs []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, status.Error(codes.Internal, "failed to scan the user")
+		}
+		userIDs = append(userIDs, userID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	if err := bumpTokenVersions(userIDs, runner); err != nil {
+		return nil, err
+	}
+	return userIDs, nil
+}
+
+// bumpTokenVersions revokes the access tokens of the users, the refresh tokens are kept so that
+// the users get tokens with their new roles
+func bumpTokenVersions(userIDs []int, runner sq.BaseRunner) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	_, err := sq.Update("users").
+		Set("token_version", sq.Expr("token_version + 1")).
+		Where(sq.Eq{"id": userIDs}).
+		RunWith(runner).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to revoke the tokens")
+	}
+	return nil
+}
+
+func insertUniqueName(table string, kind string, name string, description string, db *sql.DB) (int, error) {
+	var count int
+	err := sq.Select("COUNT(*)").
+		From(table).
+		Where(sq.Eq{"name": name}).
+		RunWith(db).
+		QueryRow().
+		Scan(&count)
+	if err != nil {
+		return 0, status.Error(codes.Internal, "failed to query the database")
+	}
+	if count > 0 {
+		return 0, status.Error(codes.AlreadyExists, kind+" already exists")
+	}
+
+	result, err := sq.Insert(table).
+		Columns("name", "description").
+		Values(name, description).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return 0, status.Error(codes.Internal, "failed to save the "+kind)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, status.Error(codes.Internal, "failed to get the last inserted id")
+	}
+	return int(id), nil
+}
+
+func deleteByName(table string, kind string, name string, runner sq.BaseRunner) error {
+	result, err := sq.Delete(table).
+		Where(sq.Eq{"name": name}).
+		RunWith(runner).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to delete the "+kind)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to delete the "+kind)
+	}
+	if deleted == 0 {
+		return status.Error(codes.NotFound, kind+" not found")
+	}
+	return nil
+}
+
+func getIDByName(table string, kind string, name string, runner sq.BaseRunner) (int, error) {
+	var id int
+	err := sq.Select("id").
+		From(table).
+		Where(sq.Eq{"name": name}).
+		RunWith(runner).
+		QueryRow().
+		Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, status.Error(codes.NotFound, kind+" not found")
+		}
+		return 0, status.Error(codes.Internal, "failed to query the database")
+	}
+	return id, nil
+}
@@ -0,0 +1,239 @@
+package actions
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/matoous/go-nanoid/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/models"
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+// errInvalidServiceAccount is returned for unknown client ids and wrong secrets alike
+var errInvalidServiceAccount = status.Error(codes.Unauthenticated, "invalid client id or secret")
+
+// CreateServiceAccount creates a service account and its first secret, the secret is returned once
+// and only stored hashed
+func CreateServiceAccount(name string, owner string, scopes []string, db *sql.DB) (string, string, error) {
+	clientID, err := gonanoid.New(32)
+	if err != nil {
+		return "", "", status.Error(codes.Internal, "failed to generate the client id")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", "", status.Error(codes.Internal, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	result, err := sq.Insert("service_accounts").
+		Columns("client_id", "name", "owner", "scopes").
+		Values(clientID, name, owner, strings.Join(scopes, " ")).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return "", "", status.Error(codes.Internal, "failed to save the service account")
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return "", "", status.Error(codes.Internal, "failed to get the last inserted id")
+	}
+
+	secret, err := createServiceAccountSecret(int(id), tx)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", "", status.Error(codes.Internal, "failed to commit transaction")
+	}
+	return clientID, secret, nil
+}
+
+// ListServiceAccounts returns the service accounts, the most recent first
+func ListServiceAccounts(db *sql.DB) ([]models.ServiceAccount, error) {
+	rows, err := selectServiceAccounts().
+		OrderBy("id DESC").
+		RunWith(db).
+		Query()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+	defer rows.Close()
+
+	var accounts []models.ServiceAccount
+	for rows.Next() {
+		account, err := scanServiceAccount(rows)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "failed to scan the service account")
+		}
+		accounts = append(accounts, account)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	return accounts, nil
+}
+
+// AuthenticateServiceAccount returns the service account of the client id when the secret is one
+// of its secrets that did not expire yet. A rotated secret is accepted until its overlap ends.
+func AuthenticateServiceAccount(clientID string, secret string, db *sql.DB) (models.ServiceAccount, error) {
+	var account models.ServiceAccount
+	if clientID == "" || secret == "" {
+		return account, errInvalidServiceAccount
+	}
+
+	hashedSecret, err := utils.HashMFACode(secret)
+	if err != nil {
+		return account, status.Error(codes.Internal, "failed to hash the secret")
+	}
+
+	account, err = scanServiceAccount(
+		selectServiceAccounts().
+			Join("service_account_secrets ON service_account_secrets.service_account_id = service_accounts.id").
+			Where(sq.Eq{"service_accounts.client_id": clientID, "service_account_secrets.secret": hashedSecret}).
+			Where(sq.Or{
+				sq.Eq{"service_account_secrets.expires_at": nil},
+				sq.Gt{"service_account_secrets.expires_at": time.Now()},
+			}).
+			RunWith(db).
+			QueryRow(),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return account, errInvalidServiceAccount
+		}
+		return account, status.Error(codes.Internal, "failed to query the database")
+	}
+	return account, nil
+}
+
+// RotateServiceAccountSecret issues a new secret to the service account. The current secrets keep
+// working for the overlap so that the deployments using them can be updated, the returned time is
+// when they stop working.
+func RotateServiceAccountSecret(clientID string, overlap time.Duration, db *sql.DB) (string, time.Time, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", time.Time{}, status.Error(codes.Internal, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = sq.Select("id").
+		From("service_accounts").
+		Where(sq.Eq{"client_id": clientID}).
+		Suffix("FOR UPDATE").
+		RunWith(tx).
+		QueryRow().
+		Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", time.Time{}, status.Error(codes.NotFound, "service account not found")
+		}
+		return "", time.Time{}, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(overlap)
+
+	// the secrets already rotated keep their earlier expiry
+	_, err = sq.Update("service_account_secrets").
+		Set("expires_at", expiresAt).
+		Where(sq.Eq{"service_account_id": id}).
+		Where(sq.Or{sq.Eq{"expires_at": nil}, sq.Gt{"expires_at": expiresAt}}).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return "", time.Time{}, status.Error(codes.Internal, "failed to expire the current secrets")
+	}
+
+	_, err = sq.Delete("service_account_secrets").
+		Where(sq.Eq{"service_account_id": id}).
+		Where(sq.LtOrEq{"expires_at": now}).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return "", time.Time{}, status.Error(codes.Internal, "failed to delete the expired secrets")
+	}
+
+	secret, err := createServiceAccountSecret(id, tx)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", time.Time{}, status.Error(codes.Internal, "failed to commit transaction")
+	}
+	return secret, expiresAt, nil
+}
+
+// DeleteServiceAccount deletes a service account and its secrets, the tokens it already obtained
+// expire on their own
+func DeleteServiceAccount(clientID string, db *sql.DB) error {
+	result, err := sq.Delete("service_accounts").
+		Where(sq.Eq{"client_id": clientID}).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to delete the service account")
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to delete the service account")
+	}
+	if deleted == 0 {
+		return status.Error(codes.NotFound, "service account not found")
+	}
+	return nil
+}
+
+func createServiceAccountSecret(serviceAccountID int, runner sq.BaseRunner) (string, error) {
+	secret, err := gonanoid.New(48)
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to generate the secret")
+	}
+
+	hashedSecret, err := utils.HashMFACode(secret)
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to hash the secret")
+	}
+
+	_, err = sq.Insert("service_account_secrets").
+		Columns("service_account_id", "secret").
+		Values(serviceAccountID, hashedSecret).
+		RunWith(runner).
+		Exec()
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to save the secret")
+	}
+	return secret, nil
+}
+
+func selectServiceAccounts() sq.SelectBuilder {
+	return sq.Select(
+		"service_accounts.id",
+		"service_accounts.client_id",
+		"service_accounts.name",
+		"service_accounts.owner",
+		"service_accounts.scopes",
+		"service_accounts.created_at",
+	).
+		From("service_accounts")
+}
+
+func scanServiceAccount(row sq.RowScanner) (models.ServiceAccount, error) {
+	var account models.ServiceAccount
+	var scopes string
+	err := row.Scan(&account.ID, &account.ClientID, &account.Name, &account.Owner, &scopes, &account.CreatedAt)
+	account.Scopes = strings.Fields(scopes)
+	return account, err
+}
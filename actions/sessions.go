@@ -0,0 +1,330 @@
+package actions
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/models"
+)
+
+// blacklistFallbackTTL is the longest lifetime an access token was issued with
+const blacklistFallbackTTL = time.Hour * 72
+
+// CreateSession records an access token issued to the user
+func CreateSession(session models.Session, db *sql.DB) error {
+	_, err := sq.Insert("sessions").
+		Columns("jti", "user_id", "family_id", "auth_method", "scope", "ip", "user_agent", "issued_at", "expires_at").
+		Values(
+			session.JTI,
+			session.UserID,
+			session.FamilyID,
+			session.AuthMethod,
+			session.Scope,
+			session.IP,
+			truncate(session.UserAgent, 512),
+			session.IssuedAt,
+			session.ExpiresAt,
+		).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to save the session")
+	}
+	return nil
+}
+
+// GetSessionGrant returns how the user logged in to the session of a refresh token family and the
+// scopes granted to it, the access tokens issued on refresh keep both
+func GetSessionGrant(familyID string, db *sql.DB) (string, string, error) {
+	var authMethod, scope string
+	err := sq.Select("auth_method", "scope").
+		From("sessions").
+		Where(sq.Eq{"family_id": familyID}).
+		OrderBy("id DESC").
+		Limit(1).
+		RunWith(db).
+		QueryRow().
+		Scan(&authMethod, &scope)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", "", status.Error(codes.Internal, "failed to query the database")
+	}
+	return authMethod, scope, nil
+}
+
+// ListSessions returns the active sessions of the user, the most recently active first. A session
+// is represented by the last access token of its login and stays active as long as the access
+// token or the refresh token of the login can still be used.
+func ListSessions(userID int, db *sql.DB) ([]models.Session, error) {
+	now := time.Now()
+	rows, err := sq.Select(
+		"id",
+		"jti",
+		"user_id",
+		"family_id",
+		"auth_method",
+		"ip",
+		"user_agent",
+		"issued_at",
+		"expires_at",
+		"revoked_at",
+		"created_at",
+	).
+		From("sessions").
+		Where("id IN (SELECT MAX(id) FROM sessions WHERE user_id = ? GROUP BY family_id)", userID).
+		Where(sq.Eq{"revoked_at": nil}).
+		Where(sq.Or{
+			sq.Gt{"expires_at": now},
+			sq.Expr(
+				"EXISTS (SELECT 1 FROM refresh_tokens WHERE refresh_tokens.family_id = sessions.family_id AND refresh_tokens.used_at IS NULL AND refresh_tokens.revoked_at IS NULL AND refresh_tokens.expires_at > ?)",
+				now,
+			),
+		}).
+		OrderBy("issued_at DESC").
+		RunWith(db).
+		Query()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+	defer rows.Close()
+
+	var sessions []models.Session
+	for rows.Next() {
+		var session models.Session
+		err := rows.Scan(
+			&session.ID,
+			&session.JTI,
+			&session.UserID,
+			&session.FamilyID,
+			&session.AuthMethod,
+			&session.IP,
+			&session.UserAgent,
+			&session.IssuedAt,
+			&session.ExpiresAt,
+			&session.RevokedAt,
+			&session.CreatedAt,
+		)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "failed to scan the session")
+		}
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	return sessions, nil
+}
+
+// RevokeSession logs the user out of a session, the access tokens of the login are blacklisted and
+// its refresh tokens revoked. The blacklisted tokens are returned for the revocation cache.
+func RevokeSession(userID int, id int, db *sql.DB) ([]models.BlacklistedToken, error) {
+	var familyID string
+	err := sq.Select("family_id").
+		From("sessions").
+		Where(sq.Eq{"id": id, "user_id": userID}).
+		RunWith(db).
+		QueryRow().
+		Scan(&familyID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, status.Error(codes.NotFound, "session not found")
+		}
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	return RevokeSessionFamily(userID, familyID, db)
+}
+
+// BlacklistToken revokes an access token presented by the user, it expires when the token does.
+// The tokens issued before the sessions were recorded are kept for the longest token lifetime.
+func BlacklistToken(userID int, jti string, db *sql.DB) (models.BlacklistedToken, error) {
+	token := models.BlacklistedToken{JTI: jti, UserID: userID, ExpiresAt: time.Now().Add(blacklistFallbackTTL)}
+
+	err := sq.Select("expires_at").
+		From("sessions").
+		Where(sq.Eq{"jti": jti, "user_id": userID}).
+		RunWith(db).
+		QueryRow().
+		Scan(&token.ExpiresAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return token, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	_, err = sq.Insert("tokens_blacklist").
+		Options("IGNORE").
+		Columns("user_id", "jti", "expires_at").
+		Values(token.UserID, token.JTI, token.ExpiresAt).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return token, status.Error(codes.Internal, "failed to blacklist the token")
+	}
+	return token, nil
+}
+
+// RevokeSessionByJTI logs the user out of the session an access token belongs to, tokens issued
+// before the sessions were recorded are ignored
+func RevokeSessionByJTI(userID int, jti string, db *sql.DB) ([]models.BlacklistedToken, error) {
+	var familyID string
+	err := sq.Select("family_id").
+		From("sessions").
+		Where(sq.Eq{"jti": jti, "user_id": userID}).
+		RunWith(db).
+		QueryRow().
+		Scan(&familyID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	return RevokeSessionFamily(userID, familyID, db)
+}
+
+// RevokeAllSessions logs the user out everywhere. The token version of the user is bumped so that
+// the tokens issued before the sessions were recorded are revoked as well.
+func RevokeAllSessions(userID int, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	if err := revokeAllSessions(userID, tx); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return status.Error(codes.Internal, "failed to commit transaction")
+	}
+	return nil
+}
+
+// RevokeSessionFamily logs the user out of the session of a refresh token family
+func RevokeSessionFamily(userID int, familyID string, db *sql.DB) ([]models.BlacklistedToken, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	tokens, err := revokeSessions(sq.Eq{"user_id": userID, "family_id": familyID}, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := RevokeRefreshTokenFamily(familyID, tx); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to commit transaction")
+	}
+	return tokens, nil
+}
+
+// revokeAllSessions is RevokeAllSessions within the transaction of a change that logs the user out
+func revokeAllSessions(userID int, runner sq.BaseRunner) error {
+	_, err := sq.Update("users").
+		Set("token_version", sq.Expr("token_version + 1")).
+		Where(sq.Eq{"id": userID}).
+		RunWith(runner).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to revoke the tokens")
+	}
+
+	if _, err := revokeSessions(sq.Eq{"user_id": userID}, runner); err != nil {
+		return err
+	}
+
+	_, err = sq.Update("refresh_tokens").
+		Set("revoked_at", time.Now()).
+		Where(sq.Eq{"user_id": userID, "revoked_at": nil}).
+		RunWith(runner).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to revoke the refresh tokens")
+	}
+	return nil
+}
+
+// revokeSessions blacklists the access tokens of the matching sessions that did not expire yet,
+// VerifyTokenRevoation then reports them as revoked
+func revokeSessions(condition sq.Eq, runner sq.BaseRunner) ([]models.BlacklistedToken, error) {
+	active := sq.And{condition, sq.Eq{"revoked_at": nil}}
+
+	rows, err := sq.Select("jti", "user_id", "expires_at").
+		From("sessions").
+		Where(active).
+		Where(sq.Gt{"expires_at": time.Now()}).
+		RunWith(runner).
+		Query()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+	defer rows.Close()
+
+	var tokens []models.BlacklistedToken
+	for rows.Next() {
+		var token models.BlacklistedToken
+		if err := rows.Scan(&token.JTI, &token.UserID, &token.ExpiresAt); err != nil {
+			return nil, status.Error(codes.Internal, "failed to scan the session")
+		}
+		tokens = append(tokens, token)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	if len(tokens) > 0 {
+		insert := sq.Insert("tokens_blacklist").
+			Options("IGNORE").
+			Columns("user_id", "jti", "expires_at")
+		for _, token := range tokens {
+			insert = insert.Values(token.UserID, token.JTI, token.ExpiresAt)
+		}
+		if _, err := insert.RunWith(runner).Exec(); err != nil {
+			return nil, status.Error(codes.Internal, "failed to blacklist the tokens")
+		}
+	}
+
+	_, err = sq.Update("sessions").
+		Set("revoked_at", time.Now()).
+		Where(active).
+		RunWith(runner).
+		Exec()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to revoke the sessions")
+	}
+	return tokens, nil
+}
+
+// GetSessionLogin returns how and when the user logged in to the session an access token belongs
+// to, the login time is the one of the first token of the session
+func GetSessionLogin(userID int, jti string, db *sql.DB) (string, time.Time, error) {
+	var authMethod string
+	var authTime time.Time
+	err := sq.Select(
+		"auth_method",
+		"(SELECT MIN(login.issued_at) FROM sessions AS login WHERE login.family_id = sessions.family_id)",
+	).
+		From("sessions").
+		Where(sq.Eq{"jti": jti, "user_id": userID, "revoked_at": nil}).
+		RunWith(db).
+		QueryRow().
+		Scan(&authMethod, &authTime)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", authTime, status.Error(codes.FailedPrecondition, "session not found, log in again")
+		}
+		return "", authTime, status.Error(codes.Internal, "failed to query the database")
+	}
+	return authMethod, authTime, nil
+}
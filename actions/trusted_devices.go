@@ -0,0 +1,154 @@
+package actions
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/matoous/go-nanoid/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/models"
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+// CreateTrustedDevice remembers the device a user completed the MFA on. The returned device id is
+// the opaque device token, it is only stored hashed and does not depend on the signing keys so that
+// it outlives their rotations.
+func CreateTrustedDevice(userID int, userAgent string, ip string, ttl time.Duration, db *sql.DB) (string, error) {
+	deviceID, err := gonanoid.New(64)
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to generate the device id")
+	}
+
+	hashedDeviceID, err := utils.HashMFACode(deviceID)
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to hash the device id")
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	_, err = sq.Insert("trusted_devices").
+		Columns("user_id", "device_id", "user_agent", "ip", "expires_at").
+		Values(userID, hashedDeviceID, truncate(userAgent, 512), ip, expiresAt).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to save the trusted device")
+	}
+
+	// clean up the devices that are no longer trusted
+	_, err = sq.Delete("trusted_devices").
+		Where(sq.Lt{"expires_at": time.Now()}).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to delete the expired trusted devices")
+	}
+
+	return deviceID, nil
+}
+
+// CheckTrustedDevice reports whether the device token is still trusted for the user and records
+// that the device was seen again, a token issued to another user is not trusted
+func CheckTrustedDevice(userID int, deviceID string, userAgent string, ip string, db *sql.DB) (bool, error) {
+	hashedDeviceID, err := utils.HashMFACode(deviceID)
+	if err != nil {
+		return false, status.Error(codes.Internal, "failed to hash the device id")
+	}
+
+	var id int
+	err = sq.Select("id").
+		From("trusted_devices").
+		Where(sq.Eq{"device_id": hashedDeviceID, "user_id": userID}).
+		Where(sq.Gt{"expires_at": time.Now()}).
+		RunWith(db).
+		QueryRow().
+		Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	_, err = sq.Update("trusted_devices").
+		Set("user_agent", truncate(userAgent, 512)).
+		Set("ip", ip).
+		Set("last_seen_at", time.Now()).
+		Where(sq.Eq{"id": id}).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return false, status.Error(codes.Internal, "failed to update the trusted device")
+	}
+
+	return true, nil
+}
+
+// ListTrustedDevices returns the devices the user is still trusted on, the last seen first
+func ListTrustedDevices(userID int, db *sql.DB) ([]models.TrustedDevice, error) {
+	rows, err := sq.Select("id", "user_id", "device_id", "user_agent", "ip", "last_seen_at", "expires_at", "created_at").
+		From("trusted_devices").
+		Where(sq.Eq{"user_id": userID}).
+		Where(sq.Gt{"expires_at": time.Now()}).
+		OrderBy("last_seen_at DESC").
+		RunWith(db).
+		Query()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+	defer rows.Close()
+
+	var devices []models.TrustedDevice
+	for rows.Next() {
+		var device models.TrustedDevice
+		err := rows.Scan(
+			&device.ID,
+			&device.UserID,
+			&device.DeviceID,
+			&device.UserAgent,
+			&device.IP,
+			&device.LastSeenAt,
+			&device.ExpiresAt,
+			&device.CreatedAt,
+		)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "failed to scan the trusted device")
+		}
+		devices = append(devices, device)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	return devices, nil
+}
+
+// RevokeTrustedDevice removes a trusted device of the user, its token then no longer skips the MFA
+func RevokeTrustedDevice(userID int, id int, db *sql.DB) error {
+	result, err := sq.Delete("trusted_devices").
+		Where(sq.Eq{"id": id, "user_id": userID}).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to revoke the trusted device")
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to revoke the trusted device")
+	}
+	if deleted == 0 {
+		return status.Error(codes.NotFound, "trusted device not found")
+	}
+	return nil
+}
+
+func truncate(value string, length int) string {
+	if len(value) > length {
+		return value[:length]
+	}
+	return value
+}
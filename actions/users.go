@@ -0,0 +1,232 @@
+package actions
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GetTokenVersion returns the version the tokens issued to the user carry, a suspended user can
+// not get any token
+func GetTokenVersion(userID int, db *sql.DB) (int, error) {
+	var tokenVersion int
+	var suspendedAt sql.NullTime
+	err := sq.Select("token_version", "suspended_at").
+		From("users").
+		Where(sq.Eq{"id": userID}).
+		RunWith(db).
+		QueryRow().
+		Scan(&tokenVersion, &suspendedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, status.Error(codes.NotFound, "user not found")
+		}
+		return 0, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	if suspendedAt.Valid {
+		return 0, status.Error(codes.PermissionDenied, "account is suspended")
+	}
+	return tokenVersion, nil
+}
+
+// ChangePassword replaces the password of the user and logs them out everywhere
+func ChangePassword(userID int, hashedPassword string, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	if err := changePassword(userID, hashedPassword, tx); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return status.Error(codes.Internal, "failed to commit transaction")
+	}
+	return nil
+}
+
+// ResetPassword replaces the password of the user with the one set through the reset code, the
+// code is consumed and the user is logged out everywhere
+func ResetPassword(userID int, hashedPassword string, hashedCode string, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	result, err := sq.Delete("passwords_reset").
+		Where(sq.Eq{"user_id": userID, "code": hashedCode}).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to delete the password reset code")
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to delete the password reset code")
+	}
+	// the code was used by a concurrent reset
+	if deleted == 0 {
+		return status.Error(codes.NotFound, "code not found")
+	}
+
+	if err := changePassword(userID, hashedPassword, tx); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return status.Error(codes.Internal, "failed to commit transaction")
+	}
+	return nil
+}
+
+// changePassword replaces the password within the transaction and revokes the sessions of the user
+func changePassword(userID int, hashedPassword string, runner sq.BaseRunner) error {
+	result, err := sq.Update("users_password").
+		Set("password", hashedPassword).
+		Set("updated_at", time.Now()).
+		Where(sq.Eq{"user_id": userID}).
+		RunWith(runner).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to update the password")
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to update the password")
+	}
+	if updated == 0 {
+		return status.Error(codes.FailedPrecondition, "user does not have a password")
+	}
+
+	return revokeAllSessions(userID, runner)
+}
+
+// ChangeEmail replaces the email of the user, the new email has to be verified again. The user is
+// logged out everywhere since the tokens carry the old email.
+func ChangeEmail(userID int, email string, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	// the email of the password logins has to be unique
+	var count int
+	err = sq.Select("COUNT(*)").
+		From("users_email").
+		InnerJoin("users_password ON users_email.user_id = users_password.user_id").
+		Where(sq.Eq{"users_email.email": email}).
+		Where(sq.NotEq{"users_email.user_id": userID}).
+		RunWith(tx).
+		QueryRow().
+		Scan(&count)
+	if err != nil {
+		return status.Error(codes.Internal, "failed to query the database")
+	}
+	if count != 0 {
+		return status.Error(codes.AlreadyExists, "email already registered")
+	}
+
+	result, err := sq.Update("users_email").
+		Set("email", email).
+		Set("is_verified", false).
+		Set("updated_at", time.Now()).
+		Where(sq.Eq{"user_id": userID}).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to update the email")
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to update the email")
+	}
+	if updated == 0 {
+		return status.Error(codes.NotFound, "user not found")
+	}
+
+	// the codes sent to the old email must not verify the new one
+	_, err = sq.Delete("email_verification").
+		Where(sq.Eq{"user_id": userID}).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to delete the email verification codes")
+	}
+
+	if err := revokeAllSessions(userID, tx); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return status.Error(codes.Internal, "failed to commit transaction")
+	}
+	return nil
+}
+
+// SuspendUser blocks the logins of the user and revokes their tokens until they are reinstated
+func SuspendUser(userID int, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	result, err := sq.Update("users").
+		Set("suspended_at", time.Now()).
+		Where(sq.Eq{"id": userID, "suspended_at": nil}).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to suspend the user")
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to suspend the user")
+	}
+	if updated == 0 {
+		return status.Error(codes.FailedPrecondition, "user not found or already suspended")
+	}
+
+	if err := revokeAllSessions(userID, tx); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return status.Error(codes.Internal, "failed to commit transaction")
+	}
+	return nil
+}
+
+// ReinstateUser lifts the suspension of the user, the tokens revoked by it stay revoked
+func ReinstateUser(userID int, db *sql.DB) error {
+	result, err := sq.Update("users").
+		Set("suspended_at", nil).
+		Where(sq.Eq{"id": userID}).
+		Where(sq.NotEq{"suspended_at": nil}).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to reinstate the user")
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to reinstate the user")
+	}
+	if updated == 0 {
+		return status.Error(codes.FailedPrecondition, "user not found or not suspended")
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+package actions
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/matoous/go-nanoid/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/models"
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+// WebAuthnSessionTTL is the time the user has to complete a ceremony with their authenticator
+const WebAuthnSessionTTL = time.Minute * 5
+
+// CreateWebAuthnSession stores the state of a registration or login ceremony until the
+// authenticator response comes back. The user id is 0 for the discoverable logins.
+func CreateWebAuthnSession(ceremony string, userID int, data *webauthn.SessionData, db *sql.DB) (string, error) {
+	sessionID, err := gonanoid.New(32)
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to generate the WebAuthn session")
+	}
+
+	hashedSessionID, err := utils.HashMFACode(sessionID)
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to hash the WebAuthn session")
+	}
+
+	encodedData, err := json.Marshal(data)
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to encode the WebAuthn session")
+	}
+
+	_, err = sq.Insert("webauthn_sessions").
+		Columns("session", "ceremony", "user_id", "data", "expires_at").
+		Values(
+			hashedSessionID,
+			ceremony,
+			sql.NullInt64{Int64: int64(userID), Valid: userID != 0},
+			string(encodedData),
+			time.Now().Add(WebAuthnSessionTTL),
+		).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to save the WebAuthn session")
+	}
+
+	// clean up the ceremonies that were never completed
+	_, err = sq.Delete("webauthn_sessions").
+		Where(sq.Lt{"expires_at": time.Now()}).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to delete the expired WebAuthn sessions")
+	}
+
+	return sessionID, nil
+}
+
+// ConsumeWebAuthnSession returns the state of a ceremony and deletes it, a session can only be
+// finished once and only for the ceremony it was started for
+func ConsumeWebAuthnSession(sessionID string, ceremony string, db *sql.DB) (models.WebAuthnSession, webauthn.SessionData, error) {
+	var session models.WebAuthnSession
+	var data webauthn.SessionData
+
+	if sessionID == "" {
+		return session, data, status.Error(codes.InvalidArgument, "WebAuthn session is required")
+	}
+
+	hashedSessionID, err := utils.HashMFACode(sessionID)
+	if err != nil {
+		return session, data, status.Error(codes.Internal, "failed to hash the WebAuthn session")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return session, data, status.Error(codes.Internal, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	err = sq.Select("id", "session", "ceremony", "user_id", "data", "expires_at", "created_at").
+		From("webauthn_sessions").
+		Where(sq.Eq{"session": hashedSessionID, "ceremony": ceremony}).
+		Suffix("FOR UPDATE").
+		RunWith(tx).
+		QueryRow().
+		Scan(&session.ID, &session.Session, &session.Ceremony, &session.UserID, &session.Data, &session.ExpiresAt, &session.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return session, data, status.Error(codes.InvalidArgument, "unknown WebAuthn session")
+		}
+		return session, data, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	_, err = sq.Delete("webauthn_sessions").
+		Where(sq.Eq{"id": session.ID}).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return session, data, status.Error(codes.Internal, "failed to delete the WebAuthn session")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return session, data, status.Error(codes.Internal, "failed to commit transaction")
+	}
+
+	if time.Now().After(session.ExpiresAt) {
+		return session, data, status.Error(codes.InvalidArgument, "WebAuthn session is expired")
+	}
+
+	if err := json.Unmarshal([]byte(session.Data), &data); err != nil {
+		return session, data, status.Error(codes.Internal, "failed to decode the WebAuthn session")
+	}
+
+	return session, data, nil
+}
+
+// GetWebAuthnCredentials returns the credentials of the user in the form the WebAuthn library
+// verifies the assertions with
+func GetWebAuthnCredentials(userID int, db *sql.DB) ([]webauthn.Credential, error) {
+	registered, err := ListWebAuthnCredentials(userID, db)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials := make([]webauthn.Credential, 0, len(registered))
+	for _, credential := range registered {
+		credentialID, err := base64.RawURLEncoding.DecodeString(credential.CredentialID)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "failed to decode the credential id")
+		}
+
+		var transports []protocol.AuthenticatorTransport
+		for _, transport := range strings.Split(credential.Transports, ",") {
+			if transport != "" {
+				transports = append(transports, protocol.AuthenticatorTransport(transport))
+			}
+		}
+
+		credentials = append(credentials, webauthn.Credential{
+			ID:              credentialID,
+			PublicKey:       credential.PublicKey,
+			AttestationType: credential.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: credential.BackupEligible,
+				BackupState:    credential.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    credential.AAGUID,
+				SignCount: credential.SignCount,
+			},
+		})
+	}
+	return credentials, nil
+}
+
+// ListWebAuthnCredentials returns the credentials registered by the user
+func ListWebAuthnCredentials(userID int, db *sql.DB) ([]models.WebAuthnCredential, error) {
+	rows, err := sq.Select(
+		"id",
+		"user_id",
+		"credential_id",
+		"name",
+		"public_key",
+		"attestation_type",
+		"aaguid",
+		"sign_count",
+		"transports",
+		"backup_eligible",
+		"backup_state",
+		"last_used_at",
+		"created_at",
+	).
+		From("users_webauthn_credentials").
+		Where(sq.Eq{"user_id": userID}).
+		OrderBy("id").
+		RunWith(db).
+		Query()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+	defer rows.Close()
+
+	var credentials []models.WebAuthnCredential
+	for rows.Next() {
+		var credential models.WebAuthnCredential
+		err := rows.Scan(
+			&credential.ID,
+			&credential.UserID,
+			&credential.CredentialID,
+			&credential.Name,
+			&credential.PublicKey,
+			&credential.AttestationType,
+			&credential.AAGUID,
+			&credential.SignCount,
+			&credential.Transports,
+			&credential.BackupEligible,
+			&credential.BackupState,
+			&credential.LastUsedAt,
+			&credential.CreatedAt,
+		)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "failed to scan the credential")
+		}
+		credentials = append(credentials, credential)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	return credentials, nil
+}
+
+// CreateWebAuthnCredential stores a credential verified by a registration ceremony
+func CreateWebAuthnCredential(userID int, name string, credential *webauthn.Credential, db *sql.DB) error {
+	transports := make([]string, 0, len(credential.Transport))
+	for _, transport := range credential.Transport {
+		transports = append(transports, string(transport))
+	}
+
+	_, err := sq.Insert("users_webauthn_credentials").
+		Columns(
+			"user_id",
+			"credential_id",
+			"name",
+			"public_key",
+			"attestation_type",
+			"aaguid",
+			"sign_count",
+			"transports",
+			"backup_eligible",
+			"backup_state",
+		).
+		Values(
+			userID,
+			base64.RawURLEncoding.EncodeToString(credential.ID),
+			name,
+			credential.PublicKey,
+			credential.AttestationType,
+			credential.Authenticator.AAGUID,
+			credential.Authenticator.SignCount,
+			strings.Join(transports, ","),
+			credential.Flags.BackupEligible,
+			credential.Flags.BackupState,
+		).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to save the credential")
+	}
+	return nil
+}
+
+// UpdateWebAuthnCredentialUsage stores the sign count and backup state reported by the last
+// assertion of a credential
+func UpdateWebAuthnCredentialUsage(credential *webauthn.Credential, db *sql.DB) error {
+	_, err := sq.Update("users_webauthn_credentials").
+		Set("sign_count", credential.Authenticator.SignCount).
+		Set("backup_state", credential.Flags.BackupState).
+		Set("last_used_at", time.Now()).
+		Where(sq.Eq{"credential_id": base64.RawURLEncoding.EncodeToString(credential.ID)}).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to update the credential")
+	}
+	return nil
+}
+
+// DeleteWebAuthnCredential removes a credential of the user
+func DeleteWebAuthnCredential(userID int, id int, db *sql.DB) error {
+	result, err := sq.Delete("users_webauthn_credentials").
+		Where(sq.Eq{"id": id, "user_id": userID}).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to delete the credential")
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to delete the credential")
+	}
+	if deleted == 0 {
+		return status.Error(codes.NotFound, "credential not found")
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+// Package authclient authenticates the requests of the services behind the gateway with the
+// access tokens issued by the authentication service. The tokens are validated by the ValidateToken
+// RPC, which checks their signature, expiry, audience and revocation in one call.
+//
+//	client := authclient.New(
+//		conn,
+//		authclient.WithServiceAccount(clientID, clientSecret),
+//		authclient.WithPublicMethods("/orders.Orders/ListProducts"),
+//	)
+//	server := grpc.NewServer(
+//		grpc.UnaryInterceptor(client.UnaryServerInterceptor()),
+//		grpc.StreamInterceptor(client.StreamServerInterceptor()),
+//	)
+//
+// The handlers then get the caller with FromContext. ValidateToken is only open to the service
+// accounts, the client authenticates with the credentials given with WithServiceAccount.
+package authclient
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
+)
+
+type contextKey struct{}
+
+// Client validates the access tokens with the authentication service
+type Client struct {
+	client        pb.UserManagerClient
+	audience      string
+	publicMethods map[string]bool
+
+	clientID     string
+	clientSecret string
+	mu           sync.Mutex
+	token        string
+	issuedAt     time.Time
+	expiresAt    time.Time
+}
+
+type Option func(*Client)
+
+// WithAudience sets the audience the tokens must be issued for, the audience of the access tokens
+// configured on the authentication service is used by default
+func WithAudience(audience string) Option {
+	return func(c *Client) {
+		c.audience = audience
+	}
+}
+
+// WithServiceAccount sets the credentials of the service account the client validates the tokens
+// as, its token is requested with the client credentials grant and reused until it expires
+func WithServiceAccount(clientID string, clientSecret string) Option {
+	return func(c *Client) {
+		c.clientID = clientID
+		c.clientSecret = clientSecret
+	}
+}
+
+// WithPublicMethods lets the calls to the full methods, e.g., /package.Service/Method, through
+// without a token. A token sent to a public method is still validated.
+func WithPublicMethods(methods ...string) Option {
+	return func(c *Client) {
+		for _, method := range methods {
+			c.publicMethods[method] = true
+		}
+	}
+}
+
+// New returns a client of the authentication service reachable through the connection
+func New(conn grpc.ClientConnInterface, opts ...Option) *Client {
+	c := &Client{
+		client:        pb.NewUserManagerClient(conn),
+		publicMethods: map[string]bool{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Validate validates an access token and returns the user, the admin or the service account it was
+// issued to
+func (c *Client) Validate(ctx context.Context, token string) (*pb.ValidateTokenResponse, error) {
+	serviceToken, fresh, err := c.serviceAccountToken(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, "failed to authenticate with the authentication service")
+	}
+
+	response, err := c.validate(ctx, serviceToken, token)
+	// the token of the service account may have been rejected rather than the token of the caller,
+	// e.g., once the account was deleted, it is replaced and the token validated again
+	if code := status.Code(err); !fresh && (code == codes.Unauthenticated || code == codes.PermissionDenied) {
+		c.dropServiceAccountToken(serviceToken)
+		if serviceToken, _, err = c.serviceAccountToken(ctx); err != nil {
+			return nil, status.Error(codes.Unavailable, "failed to authenticate with the authentication service")
+		}
+		response, err = c.validate(ctx, serviceToken, token)
+	}
+
+	if err != nil {
+		switch status.Code(err) {
+		case codes.Unauthenticated, codes.InvalidArgument:
+			return nil, status.Error(codes.Unauthenticated, "invalid token")
+		case codes.PermissionDenied:
+			// only the service account can be denied the validation
+			return nil, status.Error(codes.Unavailable, "failed to authenticate with the authentication service")
+		default:
+			return nil, status.Error(codes.Unavailable, "failed to validate the token")
+		}
+	}
+	// the user tokens issued to the OpenID Connect clients are only granted their scopes, they do
+	// not carry the rights of the user
+	if response.User != nil && response.Scope != "" {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+	return response, nil
+}
+
+func (c *Client) validate(ctx context.Context, serviceToken string, token string) (*pb.ValidateTokenResponse, error) {
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+serviceToken)
+	return c.client.ValidateToken(ctx, &pb.ValidateTokenRequest{Token: token, Audience: c.audience})
+}
+
+// Authenticate validates the bearer token in the authorization metadata of an incoming call and
+// returns the context of the call with the caller attached
+func (c *Client) Authenticate(ctx context.Context, fullMethod string) (context.Context, error) {
+	token := bearerToken(ctx)
+	if token == "" {
+		if c.publicMethods[fullMethod] {
+			return ctx, nil
+		}
+		return nil, status.Error(codes.Unauthenticated, "bearer token is required")
+	}
+
+	caller, err := c.Validate(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	return context.WithValue(ctx, contextKey{}, caller), nil
+}
+
+// UnaryServerInterceptor authenticates the unary calls
+func (c *Client) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := c.Authenticate(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor authenticates the streaming calls
+func (c *Client) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := c.Authenticate(stream.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+// FromContext returns the caller authenticated by the interceptors, there is none for the calls to
+// the public methods made without a token
+func FromContext(ctx context.Context) (*pb.ValidateTokenResponse, bool) {
+	caller, ok := ctx.Value(contextKey{}).(*pb.ValidateTokenResponse)
+	return caller, ok
+}
+
+// serviceAccountToken returns the token of the service account of the client, a new one is requested
+// shortly before the current one expires. A token requested within the last minute is fresh, its
+// rejection is not retried so that the invalid tokens of the callers do not renew it on every call.
+func (c *Client) serviceAccountToken(ctx context.Context) (string, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Until(c.expiresAt) > time.Minute {
+		return c.token, time.Since(c.issuedAt) < time.Minute, nil
+	}
+
+	response, err := c.client.GetServiceAccountToken(ctx, &pb.GetServiceAccountTokenRequest{
+		ClientId:     c.clientID,
+		ClientSecret: c.clientSecret,
+	})
+	if err != nil {
+		return "", false, err
+	}
+	expiresAt, err := time.Parse(time.RFC3339, response.ExpiresAt)
+	if err != nil {
+		return "", false, err
+	}
+
+	c.token, c.issuedAt, c.expiresAt = response.Token, time.Now(), expiresAt
+	return c.token, true, nil
+}
+
+// dropServiceAccountToken forgets the rejected token of the service account, unless another call
+// replaced it already
+func (c *Client) dropServiceAccountToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token == token {
+		c.token = ""
+	}
+}
+
+// HasPermission reports whether the user authenticated by the interceptors was granted the
+// permission through one of their roles
+func HasPermission(ctx context.Context, permission string) bool {
+	caller, ok := FromContext(ctx)
+	if !ok || caller.User == nil {
+		return false
+	}
+	for _, granted := range caller.User.Permissions {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRole reports whether the user authenticated by the interceptors was assigned the role
+func HasRole(ctx context.Context, role string) bool {
+	caller, ok := FromContext(ctx)
+	if !ok || caller.User == nil {
+		return false
+	}
+	for _, assigned := range caller.User.Roles {
+		if assigned == role {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticatedStream carries the context with the caller to the stream handlers
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+func bearerToken(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return ""
+	}
+
+	scheme, token, found := strings.Cut(values[0], " ")
+	if !found || !strings.EqualFold(scheme, "bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
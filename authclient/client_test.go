@@ -0,0 +1,145 @@
+package authclient
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
+)
+
+// fakeUserManager issues numbered service account tokens and only accepts the valid ones
+type fakeUserManager struct {
+	pb.UserManagerClient
+	issued      int
+	deleted     bool
+	validTokens map[string]bool
+	// validServiceTokens is nil when every issued service account token is accepted
+	validServiceTokens map[string]bool
+}
+
+func (m *fakeUserManager) GetServiceAccountToken(
+	ctx context.Context,
+	in *pb.GetServiceAccountTokenRequest,
+	opts ...grpc.CallOption,
+) (*pb.GetServiceAccountTokenResponse, error) {
+	if m.deleted {
+		return nil, status.Error(codes.Unauthenticated, "invalid client credentials")
+	}
+	m.issued++
+	return &pb.GetServiceAccountTokenResponse{
+		Token:     "service-" + strconv.Itoa(m.issued),
+		ExpiresAt: time.Now().Add(time.Hour).Format(time.RFC3339),
+	}, nil
+}
+
+func (m *fakeUserManager) ValidateToken(
+	ctx context.Context,
+	in *pb.ValidateTokenRequest,
+	opts ...grpc.CallOption,
+) (*pb.ValidateTokenResponse, error) {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	serviceToken := md.Get("authorization")[0][len("Bearer "):]
+	if m.validServiceTokens != nil && !m.validServiceTokens[serviceToken] {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+	if !m.validTokens[in.Token] {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+	return &pb.ValidateTokenResponse{Jti: in.Token}, nil
+}
+
+func newTestClient(manager *fakeUserManager) *Client {
+	c := New(nil, WithServiceAccount("client", "secret"))
+	c.client = manager
+	return c
+}
+
+func TestValidateRenewsRejectedServiceAccountToken(t *testing.T) {
+	manager := &fakeUserManager{validTokens: map[string]bool{"user": true}}
+	c := newTestClient(manager)
+	ctx := context.Background()
+
+	if _, err := c.Validate(ctx, "user"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first token of the service account is rejected once it is no longer fresh
+	c.issuedAt = time.Now().Add(-time.Hour)
+	manager.validServiceTokens = map[string]bool{"service-2": true}
+	if _, err := c.Validate(ctx, "user"); err != nil {
+		t.Fatalf("expected the token to be validated with a new service account token, got %v", err)
+	}
+	if manager.issued != 2 || c.token != "service-2" {
+		t.Fatalf("expected the service account token to be renewed once, got %d %s", manager.issued, c.token)
+	}
+}
+
+func TestValidateReportsDeletedServiceAccount(t *testing.T) {
+	manager := &fakeUserManager{validTokens: map[string]bool{"user": true}}
+	c := newTestClient(manager)
+	ctx := context.Background()
+
+	if _, err := c.Validate(ctx, "user"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the caller is not blamed for the rejection of the service account
+	c.issuedAt = time.Now().Add(-time.Hour)
+	manager.deleted = true
+	manager.validServiceTokens = map[string]bool{}
+	if _, err := c.Validate(ctx, "user"); status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected Unavailable, got %v", err)
+	}
+	if c.token != "" {
+		t.Fatal("expected the rejected service account token to be dropped")
+	}
+}
+
+func TestValidateRejectsInvalidToken(t *testing.T) {
+	manager := &fakeUserManager{validTokens: map[string]bool{"user": true}}
+	c := newTestClient(manager)
+	ctx := context.Background()
+
+	if _, err := c.Validate(ctx, "user"); err != nil {
+		t.Fatal(err)
+	}
+	// the fresh service account token is not renewed for the invalid tokens of the callers
+	for i := 0; i < 3; i++ {
+		if _, err := c.Validate(ctx, "other"); status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("expected Unauthenticated, got %v", err)
+		}
+	}
+	if manager.issued != 1 {
+		t.Fatalf("expected a single service account token, got %d", manager.issued)
+	}
+}
+
+func TestValidateRejectsOIDCClientTokens(t *testing.T) {
+	manager := &scopedUserManager{}
+	c := newTestClient(&manager.fakeUserManager)
+	c.client = manager
+
+	if _, err := c.Validate(context.Background(), "client"); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected Unauthenticated, got %v", err)
+	}
+}
+
+// scopedUserManager validates every token as a user token issued to an OpenID Connect client
+type scopedUserManager struct {
+	fakeUserManager
+}
+
+func (m *scopedUserManager) ValidateToken(
+	ctx context.Context,
+	in *pb.ValidateTokenRequest,
+	opts ...grpc.CallOption,
+) (*pb.ValidateTokenResponse, error) {
+	return &pb.ValidateTokenResponse{Jti: in.Token, Scope: "openid", User: &pb.UserPayload{Id: 1}}, nil
+}
@@ -0,0 +1,31 @@
+package consts
+
+// the security-relevant events recorded in the audit log
+const (
+	AUDIT_USER_LOGIN                    = "user.login"
+	AUDIT_ADMIN_LOGIN                   = "admin.login"
+	AUDIT_PASSWORD_RESET                = "user.password_reset"
+	AUDIT_EMAIL_VERIFIED                = "user.email_verified"
+	AUDIT_AUTH_PROVIDER_CREDENTIALS_SET = "auth_provider.credentials_set"
+	AUDIT_AUTH_PROVIDER_ENABLED         = "auth_provider.enabled"
+	AUDIT_AUTH_PROVIDER_DISABLED        = "auth_provider.disabled"
+	AUDIT_MFA_TOGGLED                   = "mfa.toggled"
+	AUDIT_MFA_POLICY_SET                = "mfa_policy.set"
+	AUDIT_MFA_POLICY_DELETED            = "mfa_policy.deleted"
+)
+
+// who performed an audited action
+const (
+	AUDIT_ACTOR_USER  = "user"
+	AUDIT_ACTOR_ADMIN = "admin"
+	// AUDIT_ACTOR_ANONYMOUS is the holder of an emailed code, e.g., a password reset code
+	AUDIT_ACTOR_ANONYMOUS = "anonymous"
+)
+
+// how an audited action ended
+const (
+	AUDIT_OUTCOME_SUCCESS = "success"
+	AUDIT_OUTCOME_FAILURE = "failure"
+	// AUDIT_OUTCOME_MFA_REQUIRED is a login that passed the first factor and awaits the second one
+	AUDIT_OUTCOME_MFA_REQUIRED = "mfa_required"
+)
@@ -1,6 +1,33 @@
 package consts
 
+// the second factors a MFA challenge can be satisfied with
 const (
-	ENABLED  = "enabled"
-	DISABLED = "disabled"
+	MFA_METHOD_EMAIL         = "email"
+	MFA_METHOD_TOTP          = "totp"
+	MFA_METHOD_WEBAUTHN      = "webauthn"
+	MFA_METHOD_RECOVERY_CODE = "recovery_code"
+	// MFA_METHOD_TRUSTED_DEVICE is recorded in the sessions of the logins that skipped the MFA on a
+	// device the user trusted
+	MFA_METHOD_TRUSTED_DEVICE = "trusted_device"
+)
+
+// the WebAuthn ceremonies a session can be started for
+const (
+	WEBAUTHN_REGISTRATION = "registration"
+	WEBAUTHN_LOGIN        = "login"
+)
+
+// the modes of a MFA policy
+const (
+	MFA_REQUIRED = "required"
+	MFA_OPTIONAL = "optional"
+	MFA_OFF      = "off"
+)
+
+// the scopes a MFA policy applies to, from the least to the most specific
+const (
+	MFA_SCOPE_GLOBAL   = "global"
+	MFA_SCOPE_PROVIDER = "provider"
+	MFA_SCOPE_ROLE     = "role"
+	MFA_SCOPE_USER     = "user"
 )
@@ -0,0 +1,9 @@
+package consts
+
+// the scopes the clients of the OpenID Connect provider can request
+const (
+	OIDC_SCOPE_OPENID         = "openid"
+	OIDC_SCOPE_PROFILE        = "profile"
+	OIDC_SCOPE_EMAIL          = "email"
+	OIDC_SCOPE_OFFLINE_ACCESS = "offline_access"
+)
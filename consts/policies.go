@@ -0,0 +1,13 @@
+package consts
+
+// the callers an RPC is open to, see the method policies of the authorization interceptor
+const (
+	// POLICY_PUBLIC lets anyone call, e.g., the logins
+	POLICY_PUBLIC = "public"
+	// POLICY_USER requires the token of the user the request is about
+	POLICY_USER = "user"
+	// POLICY_ADMIN requires an admin token
+	POLICY_ADMIN = "admin"
+	// POLICY_INTERNAL requires the token of a service account, e.g., the gateway
+	POLICY_INTERNAL = "internal"
+)
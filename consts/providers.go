@@ -3,4 +3,8 @@ package consts
 const (
 	GOOGLE = "google"
 	GITHUB = "github"
+	// OIDC is the type of the generic OpenID Connect providers registered by the admins
+	OIDC = "oidc"
+	// PASSWORD is the provider of the logins with an email and a password, e.g., in the MFA policies
+	PASSWORD = "password"
 )
@@ -0,0 +1,7 @@
+package consts
+
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+	EDDSA = "EdDSA"
+)
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net"
+	"net/http"
+	"time"
 
 	"github.com/pressly/goose"
 	"google.golang.org/grpc"
@@ -10,6 +13,7 @@ import (
 	"github.com/isaacwassouf/authentication-service/database"
 	"github.com/isaacwassouf/authentication-service/modules"
 	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
+	"github.com/isaacwassouf/authentication-service/revocation"
 	"github.com/isaacwassouf/authentication-service/utils"
 )
 
@@ -53,23 +57,71 @@ func main() {
 	if err := goose.Up(gooseDB, "migrations"); err != nil {
 		log.Fatalf("failed to run the migrations: %v", err)
 	}
-	//
+
+	// load the signing keys, the first key is generated on the first run
+	keyManager, err := utils.NewKeyManager(db.DB, cryptographyServiceClient)
+	if err != nil {
+		log.Fatalf("failed to create the key manager: %v", err)
+	}
+	if err := keyManager.Load(context.Background()); err != nil {
+		log.Fatalf("failed to load the signing keys: %v", err)
+	}
+	// rotate the signing keys in the background
+	go keyManager.Run(context.Background(), time.Hour)
+
+	// answer the token revocation checks from memory, the revocations are broadcast to the other
+	// instances and the expired tokens pruned from the blacklist in the background
+	revocationPubSub, err := revocation.NewPubSub(db.DB)
+	if err != nil {
+		log.Fatalf("failed to configure the revocation pub/sub: %v", err)
+	}
+	revocationCache := revocation.NewCache(db.DB, revocationPubSub)
+	if err := revocationCache.Load(context.Background()); err != nil {
+		log.Fatalf("failed to load the revocation cache: %v", err)
+	}
+	go revocationCache.Run(context.Background(), time.Minute*10)
+
+	// the relying party of the passkey registrations and logins
+	webAuthn, err := utils.NewWebAuthn()
+	if err != nil {
+		log.Fatalf("failed to configure WebAuthn: %v", err)
+	}
+
 	// Create a listener on TCP port 50051
 	lis, err := net.Listen("tcp", ":50051")
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
-	// Create a gRPC server object
-	s := grpc.NewServer()
-	// Attach the UserManager service to the server
-	pb.RegisterUserManagerServer(
-		s,
-		&modules.UserManagementService{
-			UserManagementServiceDB:   db,
-			EmailServiceClient:        &emailServiceClient,
-			CryptographyServiceClient: &cryptographyServiceClient,
-		},
+	// every RPC is declared public, user, admin or internal
+	if err := modules.CheckMethodPolicies(pb.UserManager_ServiceDesc); err != nil {
+		log.Fatalf("failed to check the authorization policies: %v", err)
+	}
+
+	userManagementService := &modules.UserManagementService{
+		UserManagementServiceDB:   db,
+		EmailServiceClient:        &emailServiceClient,
+		CryptographyServiceClient: &cryptographyServiceClient,
+		KeyManager:                keyManager,
+		WebAuthn:                  webAuthn,
+		RevocationCache:           revocationCache,
+	}
+	// Create a gRPC server object, the calls are authorized against the policy of their method
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(userManagementService.UnaryServerInterceptor()),
+		grpc.StreamInterceptor(userManagementService.StreamServerInterceptor()),
 	)
+	// Attach the UserManager service to the server
+	pb.RegisterUserManagerServer(s, userManagementService)
+
+	// serve the HTTP endpoints, e.g., the JWKS document, next to the gRPC server
+	httpAddr := ":" + utils.GetEnvVar("HTTP_PORT", "8081")
+	go func() {
+		log.Printf("HTTP server listening at %v", httpAddr)
+		if err := http.ListenAndServe(httpAddr, userManagementService.NewHTTPHandler()); err != nil {
+			log.Fatalf("failed to serve HTTP: %v", err)
+		}
+	}()
+
 	log.Printf("Server listening at %v", lis.Addr())
 
 	if err := s.Serve(lis); err != nil {
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE oauth_states (
+    id SERIAL PRIMARY KEY,
+    state VARCHAR(255) NOT NULL UNIQUE,
+    auth_provider_id BIGINT UNSIGNED NOT NULL,
+    code_verifier VARCHAR(255) NOT NULL,
+    nonce VARCHAR(255) NOT NULL,
+    redirect_url TEXT,
+    used_at TIMESTAMP NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (auth_provider_id) REFERENCES auth_providers (id) ON DELETE CASCADE
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS oauth_states;
+-- +goose StatementEnd
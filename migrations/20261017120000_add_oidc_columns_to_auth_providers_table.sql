@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE auth_providers ADD COLUMN type VARCHAR(32) NOT NULL DEFAULT 'oidc' AFTER name;
+ALTER TABLE auth_providers ADD COLUMN issuer_url TEXT AFTER type;
+ALTER TABLE auth_providers ADD COLUMN scopes VARCHAR(255) AFTER issuer_url;
+
+UPDATE auth_providers SET type = 'google' WHERE name = 'google';
+UPDATE auth_providers SET type = 'github' WHERE name = 'github';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM auth_providers WHERE type = 'oidc';
+
+ALTER TABLE auth_providers DROP COLUMN scopes;
+ALTER TABLE auth_providers DROP COLUMN issuer_url;
+ALTER TABLE auth_providers DROP COLUMN type;
+-- +goose StatementEnd
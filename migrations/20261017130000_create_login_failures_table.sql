@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE login_failures (
+    id SERIAL PRIMARY KEY,
+    subject VARCHAR(255) NOT NULL UNIQUE,
+    failed_count INT UNSIGNED NOT NULL DEFAULT 0,
+    last_failed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    locked_until TIMESTAMP NULL
+);
+
+INSERT INTO settings (name, value) VALUES ('LOGIN_MAX_FAILED_ATTEMPTS', '5');
+INSERT INTO settings (name, value) VALUES ('LOGIN_MAX_FAILED_ATTEMPTS_PER_IP', '50');
+INSERT INTO settings (name, value) VALUES ('LOGIN_FAILED_ATTEMPTS_WINDOW', '15m');
+INSERT INTO settings (name, value) VALUES ('LOGIN_LOCKOUT_DURATION', '15m');
+INSERT INTO settings (name, value) VALUES ('LOGIN_PROGRESSIVE_DELAY', '1s');
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM settings WHERE name = 'LOGIN_MAX_FAILED_ATTEMPTS';
+DELETE FROM settings WHERE name = 'LOGIN_MAX_FAILED_ATTEMPTS_PER_IP';
+DELETE FROM settings WHERE name = 'LOGIN_FAILED_ATTEMPTS_WINDOW';
+DELETE FROM settings WHERE name = 'LOGIN_LOCKOUT_DURATION';
+DELETE FROM settings WHERE name = 'LOGIN_PROGRESSIVE_DELAY';
+
+DROP TABLE IF EXISTS login_failures;
+-- +goose StatementEnd
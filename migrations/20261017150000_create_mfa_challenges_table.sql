@@ -0,0 +1,37 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE mfa_challenges (
+    id SERIAL PRIMARY KEY,
+    challenge VARCHAR(255) NOT NULL UNIQUE,
+    user_id BIGINT UNSIGNED NOT NULL,
+    methods VARCHAR(255) NOT NULL,
+    email_code VARCHAR(255) NULL,
+    attempts INT UNSIGNED NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP NOT NULL,
+    completed_at TIMESTAMP NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- the emailed codes are now bound to the challenge of the login that requested them
+DROP TABLE IF EXISTS mfa_verification;
+
+INSERT INTO settings (name, value) VALUES ('MFA_MAX_ATTEMPTS', '5');
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM settings WHERE name = 'MFA_MAX_ATTEMPTS';
+
+CREATE TABLE IF NOT EXISTS mfa_verification (
+    id SERIAL PRIMARY KEY,
+    user_id BIGINT UNSIGNED NOT NULL,
+    code VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+DROP TABLE IF EXISTS mfa_challenges;
+-- +goose StatementEnd
@@ -0,0 +1,43 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE users_webauthn_credentials (
+    id SERIAL PRIMARY KEY,
+    user_id BIGINT UNSIGNED NOT NULL,
+    credential_id VARCHAR(255) NOT NULL UNIQUE,
+    name VARCHAR(255) NOT NULL,
+    public_key BLOB NOT NULL,
+    attestation_type VARCHAR(64) NOT NULL,
+    aaguid VARBINARY(16),
+    sign_count INT UNSIGNED NOT NULL DEFAULT 0,
+    transports VARCHAR(255) NOT NULL DEFAULT '',
+    backup_eligible BOOLEAN NOT NULL DEFAULT FALSE,
+    backup_state BOOLEAN NOT NULL DEFAULT FALSE,
+    last_used_at TIMESTAMP NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE webauthn_sessions (
+    id SERIAL PRIMARY KEY,
+    session VARCHAR(255) NOT NULL UNIQUE,
+    ceremony VARCHAR(32) NOT NULL,
+    user_id BIGINT UNSIGNED NULL,
+    data TEXT NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- the assertion options sent when a passkey is used as a second factor
+ALTER TABLE mfa_challenges ADD COLUMN webauthn_session TEXT NULL AFTER email_code;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE mfa_challenges DROP COLUMN webauthn_session;
+
+DROP TABLE IF EXISTS webauthn_sessions;
+DROP TABLE IF EXISTS users_webauthn_credentials;
+-- +goose StatementEnd
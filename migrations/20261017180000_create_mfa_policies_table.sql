@@ -0,0 +1,31 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE mfa_policies (
+    id SERIAL PRIMARY KEY,
+    scope ENUM('global', 'provider', 'role', 'user') NOT NULL,
+    scope_value VARCHAR(255) NOT NULL DEFAULT '',
+    mode ENUM('required', 'optional', 'off') NOT NULL,
+    grace_period_hours INT UNSIGNED NOT NULL DEFAULT 0,
+    -- the grace period of the users without a second factor starts when the mode became required
+    enforced_since TIMESTAMP NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+
+    UNIQUE (scope, scope_value)
+);
+
+-- the global toggle becomes the global policy
+INSERT INTO mfa_policies (scope, scope_value, mode, enforced_since)
+SELECT 'global', '', IF(value = 'enabled', 'required', 'optional'), IF(value = 'enabled', CURRENT_TIMESTAMP, NULL)
+FROM settings WHERE name = 'mfa';
+
+DELETE FROM settings WHERE name = 'mfa';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+INSERT INTO settings (name, value)
+SELECT 'mfa', IF(mode = 'required', 'enabled', 'disabled') FROM mfa_policies WHERE scope = 'global';
+
+DROP TABLE IF EXISTS mfa_policies;
+-- +goose StatementEnd
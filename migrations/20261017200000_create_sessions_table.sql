@@ -0,0 +1,28 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE sessions (
+    id SERIAL PRIMARY KEY,
+    jti VARCHAR(255) NOT NULL UNIQUE,
+    user_id BIGINT UNSIGNED NOT NULL,
+    family_id VARCHAR(255) NOT NULL,
+    auth_method VARCHAR(255) NOT NULL,
+    ip VARCHAR(64) NOT NULL DEFAULT '',
+    user_agent VARCHAR(512) NOT NULL DEFAULT '',
+    issued_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    INDEX (family_id),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- the provider of the first factor is recorded as part of the auth method of the session
+ALTER TABLE mfa_challenges ADD COLUMN provider VARCHAR(255) NOT NULL DEFAULT '' AFTER user_id;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE mfa_challenges DROP COLUMN provider;
+DROP TABLE IF EXISTS sessions;
+-- +goose StatementEnd
@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+-- the tokens carry the version of the user they were issued at, bumping it revokes them all
+ALTER TABLE users ADD COLUMN token_version INT UNSIGNED NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN suspended_at TIMESTAMP NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users DROP COLUMN suspended_at;
+ALTER TABLE users DROP COLUMN token_version;
+-- +goose StatementEnd
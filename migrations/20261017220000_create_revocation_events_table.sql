@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+-- the blacklisted tokens are pruned once they expire, the tokens blacklisted so far expire at the
+-- latest 72 hours after they were issued
+ALTER TABLE tokens_blacklist ADD COLUMN expires_at TIMESTAMP NULL;
+UPDATE tokens_blacklist SET expires_at = created_at + INTERVAL 72 HOUR;
+ALTER TABLE tokens_blacklist MODIFY COLUMN expires_at TIMESTAMP NOT NULL;
+CREATE INDEX tokens_blacklist_expires_at ON tokens_blacklist (expires_at);
+
+-- the revocations are broadcast to the revocation caches of the other instances through this table
+CREATE TABLE revocation_events (
+    id SERIAL PRIMARY KEY,
+    kind VARCHAR(32) NOT NULL,
+    jti VARCHAR(255) NOT NULL DEFAULT '',
+    user_id BIGINT UNSIGNED NOT NULL,
+    expires_at TIMESTAMP NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX revocation_events_created_at ON revocation_events (created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS revocation_events;
+DROP INDEX tokens_blacklist_expires_at ON tokens_blacklist;
+ALTER TABLE tokens_blacklist DROP COLUMN expires_at;
+-- +goose StatementEnd
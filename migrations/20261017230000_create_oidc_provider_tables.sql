@@ -0,0 +1,68 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE oidc_clients (
+    id SERIAL PRIMARY KEY,
+    client_id VARCHAR(255) NOT NULL UNIQUE,
+    -- the secret is only stored hashed, the public clients have none and rely on PKCE
+    client_secret VARCHAR(255) NULL,
+    name VARCHAR(255) NOT NULL,
+    -- the redirect URIs separated by spaces, they are matched exactly
+    redirect_uris TEXT NOT NULL,
+    scopes VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE oidc_authorizations (
+    id SERIAL PRIMARY KEY,
+    request_id VARCHAR(255) NOT NULL UNIQUE,
+    client_id BIGINT UNSIGNED NOT NULL,
+    redirect_uri TEXT NOT NULL,
+    scope VARCHAR(255) NOT NULL,
+    state VARCHAR(512) NOT NULL DEFAULT '',
+    nonce VARCHAR(512) NOT NULL DEFAULT '',
+    code_challenge VARCHAR(255) NOT NULL,
+    -- set once the user approved the request, the code is only stored hashed
+    user_id BIGINT UNSIGNED NULL,
+    code VARCHAR(255) NULL UNIQUE,
+    auth_method VARCHAR(255) NOT NULL DEFAULT '',
+    auth_time TIMESTAMP NULL,
+    approved_at TIMESTAMP NULL,
+    used_at TIMESTAMP NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (client_id) REFERENCES oidc_clients (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE oidc_consents (
+    id SERIAL PRIMARY KEY,
+    user_id BIGINT UNSIGNED NOT NULL,
+    client_id BIGINT UNSIGNED NOT NULL,
+    scope VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+
+    UNIQUE (user_id, client_id),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (client_id) REFERENCES oidc_clients (id) ON DELETE CASCADE
+);
+
+-- the refresh tokens issued through the token endpoint can only be refreshed by the same client
+ALTER TABLE refresh_tokens ADD COLUMN client_id BIGINT UNSIGNED NULL AFTER family_id;
+ALTER TABLE refresh_tokens ADD CONSTRAINT refresh_tokens_client_id_fk
+    FOREIGN KEY (client_id) REFERENCES oidc_clients (id) ON DELETE CASCADE;
+
+-- the scopes granted to the client are kept by the access tokens issued on refresh
+ALTER TABLE sessions ADD COLUMN scope VARCHAR(255) NOT NULL DEFAULT '' AFTER auth_method;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE sessions DROP COLUMN scope;
+ALTER TABLE refresh_tokens DROP FOREIGN KEY refresh_tokens_client_id_fk;
+ALTER TABLE refresh_tokens DROP COLUMN client_id;
+DROP TABLE IF EXISTS oidc_consents;
+DROP TABLE IF EXISTS oidc_authorizations;
+DROP TABLE IF EXISTS oidc_clients;
+-- +goose StatementEnd
@@ -0,0 +1,33 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE service_accounts (
+    id SERIAL PRIMARY KEY,
+    client_id VARCHAR(255) NOT NULL UNIQUE,
+    name VARCHAR(255) NOT NULL,
+    -- the team or the person responsible for the account
+    owner VARCHAR(255) NOT NULL,
+    -- the scopes separated by spaces
+    scopes VARCHAR(1024) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE service_account_secrets (
+    id SERIAL PRIMARY KEY,
+    service_account_id BIGINT UNSIGNED NOT NULL,
+    secret VARCHAR(255) NOT NULL UNIQUE,
+    -- set when the secret is rotated, the secret keeps working until then
+    expires_at TIMESTAMP NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (service_account_id) REFERENCES service_accounts (id) ON DELETE CASCADE
+);
+
+INSERT INTO settings (name, value) VALUES ('SERVICE_ACCOUNT_SECRET_OVERLAP', '24h');
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM settings WHERE name = 'SERVICE_ACCOUNT_SECRET_OVERLAP';
+DROP TABLE IF EXISTS service_account_secrets;
+DROP TABLE IF EXISTS service_accounts;
+-- +goose StatementEnd
@@ -0,0 +1,28 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE admins ADD COLUMN deactivated_at TIMESTAMP NULL AFTER password;
+ALTER TABLE admins ADD UNIQUE (email);
+
+CREATE TABLE admin_invitations (
+    id SERIAL PRIMARY KEY,
+    email VARCHAR(255) NOT NULL,
+    code VARCHAR(255) NOT NULL UNIQUE,
+    invited_by BIGINT UNSIGNED NULL,
+    expires_at TIMESTAMP NOT NULL,
+    accepted_at TIMESTAMP NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    INDEX (email),
+    FOREIGN KEY (invited_by) REFERENCES admins (id) ON DELETE SET NULL
+);
+
+INSERT INTO settings (name, value) VALUES ('ADMIN_INVITATION_HOURS', '72');
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM settings WHERE name = 'ADMIN_INVITATION_HOURS';
+DROP TABLE IF EXISTS admin_invitations;
+ALTER TABLE admins DROP INDEX email;
+ALTER TABLE admins DROP COLUMN deactivated_at;
+-- +goose StatementEnd
@@ -0,0 +1,45 @@
+-- +goose Up
+-- +goose StatementBegin
+-- the admin tokens are blacklisted in the same table as the user tokens so that the revocation
+-- cache holds both, a row belongs to either a user or an admin
+ALTER TABLE tokens_blacklist MODIFY COLUMN user_id BIGINT UNSIGNED NULL;
+ALTER TABLE tokens_blacklist ADD COLUMN admin_id BIGINT UNSIGNED NULL AFTER user_id;
+ALTER TABLE tokens_blacklist ADD CONSTRAINT tokens_blacklist_admin_id_fk FOREIGN KEY (admin_id) REFERENCES admins (id) ON DELETE CASCADE;
+
+-- the admin tokens carry the version, a password change revokes the tokens issued before it
+ALTER TABLE admins ADD COLUMN token_version INT UNSIGNED NOT NULL DEFAULT 1;
+
+-- the admin logins go through the same MFA challenges as the user logins
+ALTER TABLE mfa_challenges MODIFY COLUMN user_id BIGINT UNSIGNED NULL;
+ALTER TABLE mfa_challenges ADD COLUMN admin_id BIGINT UNSIGNED NULL AFTER user_id;
+ALTER TABLE mfa_challenges ADD CONSTRAINT mfa_challenges_admin_id_fk FOREIGN KEY (admin_id) REFERENCES admins (id) ON DELETE CASCADE;
+
+CREATE TABLE admins_totp (
+    id SERIAL PRIMARY KEY,
+    admin_id BIGINT UNSIGNED NOT NULL UNIQUE,
+    secret TEXT NOT NULL,
+    confirmed BOOLEAN NOT NULL DEFAULT FALSE,
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    confirmed_at TIMESTAMP NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (admin_id) REFERENCES admins (id) ON DELETE CASCADE
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS admins_totp;
+
+DELETE FROM mfa_challenges WHERE admin_id IS NOT NULL;
+ALTER TABLE mfa_challenges DROP FOREIGN KEY mfa_challenges_admin_id_fk;
+ALTER TABLE mfa_challenges DROP COLUMN admin_id;
+ALTER TABLE mfa_challenges MODIFY COLUMN user_id BIGINT UNSIGNED NOT NULL;
+
+ALTER TABLE admins DROP COLUMN token_version;
+
+DELETE FROM tokens_blacklist WHERE admin_id IS NOT NULL;
+ALTER TABLE tokens_blacklist DROP FOREIGN KEY tokens_blacklist_admin_id_fk;
+ALTER TABLE tokens_blacklist DROP COLUMN admin_id;
+ALTER TABLE tokens_blacklist MODIFY COLUMN user_id BIGINT UNSIGNED NOT NULL;
+-- +goose StatementEnd
@@ -0,0 +1,43 @@
+-- +goose Up
+-- +goose StatementBegin
+-- every event carries the hash of the previous one, editing or deleting an event breaks the chain
+CREATE TABLE audit_events (
+    id SERIAL PRIMARY KEY,
+    event_type VARCHAR(64) NOT NULL,
+    actor_type VARCHAR(32) NOT NULL,
+    actor_id BIGINT UNSIGNED NULL,
+    actor VARCHAR(255) NOT NULL DEFAULT '',
+    target VARCHAR(255) NOT NULL DEFAULT '',
+    ip VARCHAR(45) NOT NULL DEFAULT '',
+    outcome VARCHAR(32) NOT NULL,
+    metadata TEXT NOT NULL,
+    prev_hash CHAR(64) NOT NULL,
+    hash CHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    INDEX (event_type, id),
+    INDEX (actor_type, actor_id, id),
+    INDEX (created_at)
+);
+
+-- the head of the chain, its lock orders the concurrent events
+CREATE TABLE audit_chain (
+    id TINYINT UNSIGNED PRIMARY KEY,
+    hash CHAR(64) NOT NULL
+);
+INSERT INTO audit_chain (id, hash) VALUES (1, REPEAT('0', 64));
+
+CREATE TRIGGER audit_events_no_update BEFORE UPDATE ON audit_events
+FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'audit events are immutable';
+
+CREATE TRIGGER audit_events_no_delete BEFORE DELETE ON audit_events
+FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'audit events are immutable';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS audit_events_no_delete;
+DROP TRIGGER IF EXISTS audit_events_no_update;
+DROP TABLE IF EXISTS audit_chain;
+DROP TABLE IF EXISTS audit_events;
+-- +goose StatementEnd
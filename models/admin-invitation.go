@@ -0,0 +1,17 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// AdminInvitation lets the invited email create an admin account with the emailed code
+type AdminInvitation struct {
+	ID         int           `json:"id"`
+	Email      string        `json:"email"`
+	Code       string        `json:"code"`
+	InvitedBy  sql.NullInt64 `json:"invited_by"`
+	ExpiresAt  time.Time     `json:"expires_at"`
+	AcceptedAt sql.NullTime  `json:"accepted_at"`
+	CreatedAt  time.Time     `json:"created_at"`
+}
@@ -0,0 +1,26 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// AuditEvent records a security-relevant action, the hash covers the event and the hash of the
+// previous event
+type AuditEvent struct {
+	ID        int               `json:"id"`
+	EventType string            `json:"event_type"`
+	ActorType string            `json:"actor_type"`
+	ActorID   sql.NullInt64     `json:"actor_id"`
+	Actor     string            `json:"actor"`
+	Target    string            `json:"target"`
+	IP        string            `json:"ip"`
+	Outcome   string            `json:"outcome"`
+	Metadata  map[string]string `json:"metadata"`
+	PrevHash  string            `json:"prev_hash"`
+	Hash      string            `json:"hash"`
+	CreatedAt time.Time         `json:"created_at"`
+	// Verified is whether the hash matches the event and links to the previous event, it is only
+	// set on the listed events
+	Verified bool `json:"verified"`
+}
@@ -0,0 +1,18 @@
+package models
+
+type AuthProvider struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	IssuerURL   string `json:"issuer_url"`
+	Scopes      string `json:"scopes"`
+	ClientID    string `json:"client_id"`
+	RedirectURL string `json:"redirect_url"`
+	Active      bool   `json:"active"`
+}
+
+type AuthProviderCredentials struct {
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RedirectURL  string `json:"redirect_url"`
+}
@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+type BlacklistedToken struct {
+	ID     int    `json:"id"`
+	JTI    string `json:"jti"`
+	UserID int    `json:"user_id"`
+	// AdminID is set instead of the user for the tokens of the admins
+	AdminID   int       `json:"admin_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,9 @@
+package models
+
+// ExternalIdentity is the identity of a user as verified with an external auth provider
+type ExternalIdentity struct {
+	Identifier    string `json:"identifier"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+}
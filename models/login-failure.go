@@ -0,0 +1,14 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+type LoginFailure struct {
+	ID           int          `json:"id"`
+	Subject      string       `json:"subject"`
+	FailedCount  int          `json:"failed_count"`
+	LastFailedAt time.Time    `json:"last_failed_at"`
+	LockedUntil  sql.NullTime `json:"locked_until"`
+}
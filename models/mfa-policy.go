@@ -0,0 +1,17 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+type MFAPolicy struct {
+	ID               int          `json:"id"`
+	Scope            string       `json:"scope"`
+	ScopeValue       string       `json:"scope_value"`
+	Mode             string       `json:"mode"`
+	GracePeriodHours int          `json:"grace_period_hours"`
+	EnforcedSince    sql.NullTime `json:"enforced_since"`
+	CreatedAt        time.Time    `json:"created_at"`
+	UpdatedAt        time.Time    `json:"updated_at"`
+}
@@ -1,10 +1,31 @@
 package models
 
-import "time"
+import (
+	"database/sql"
+	"time"
+)
 
-type MFAVerifiction struct {
-	ID        int       `json:"id"`
-	UserID    string    `json:"user_id"`
-	Code      string    `json:"code"`
-	CreatedAt time.Time `json:"created_at"`
+type MFAChallenge struct {
+	ID        int    `json:"id"`
+	Challenge string `json:"challenge"`
+	UserID    int    `json:"user_id"`
+	// AdminID is set instead of the user for the challenges of the admin logins
+	AdminID   sql.NullInt64  `json:"admin_id"`
+	Provider  string         `json:"provider"`
+	Methods   string         `json:"methods"`
+	EmailCode sql.NullString `json:"email_code"`
+	// WebAuthnSession holds the assertion options sent when a passkey is used as the second factor
+	WebAuthnSession sql.NullString `json:"webauthn_session"`
+	Attempts        int            `json:"attempts"`
+	ExpiresAt       time.Time      `json:"expires_at"`
+	CompletedAt     sql.NullTime   `json:"completed_at"`
+	CreatedAt       time.Time      `json:"created_at"`
+}
+
+type MFARecoveryCode struct {
+	ID        int          `json:"id"`
+	UserID    int          `json:"user_id"`
+	Code      string       `json:"code"`
+	UsedAt    sql.NullTime `json:"used_at"`
+	CreatedAt time.Time    `json:"created_at"`
 }
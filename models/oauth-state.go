@@ -0,0 +1,18 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+type OAuthState struct {
+	ID             int            `json:"id"`
+	State          string         `json:"state"`
+	AuthProviderID int            `json:"auth_provider_id"`
+	CodeVerifier   string         `json:"code_verifier"`
+	Nonce          string         `json:"nonce"`
+	RedirectURL    sql.NullString `json:"redirect_url"`
+	UsedAt         sql.NullTime   `json:"used_at"`
+	ExpiresAt      time.Time      `json:"expires_at"`
+	CreatedAt      time.Time      `json:"created_at"`
+}
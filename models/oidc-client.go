@@ -0,0 +1,42 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// OIDCClient is an application that logs its users in against the service
+type OIDCClient struct {
+	ID           int            `json:"id"`
+	ClientID     string         `json:"client_id"`
+	ClientSecret sql.NullString `json:"-"`
+	Name         string         `json:"name"`
+	RedirectURIs []string       `json:"redirect_uris"`
+	Scopes       []string       `json:"scopes"`
+	CreatedAt    time.Time      `json:"created_at"`
+}
+
+// IsPublic reports whether the client can not keep a secret, e.g., a single page application
+func (c OIDCClient) IsPublic() bool {
+	return !c.ClientSecret.Valid
+}
+
+// OIDCAuthorization is an authorization request of a client, it carries the authorization code
+// once the user approved it
+type OIDCAuthorization struct {
+	ID            int           `json:"id"`
+	RequestID     string        `json:"request_id"`
+	ClientID      int           `json:"client_id"`
+	RedirectURI   string        `json:"redirect_uri"`
+	Scope         string        `json:"scope"`
+	State         string        `json:"state"`
+	Nonce         string        `json:"nonce"`
+	CodeChallenge string        `json:"code_challenge"`
+	UserID        sql.NullInt64 `json:"user_id"`
+	AuthMethod    string        `json:"auth_method"`
+	AuthTime      sql.NullTime  `json:"auth_time"`
+	ApprovedAt    sql.NullTime  `json:"approved_at"`
+	UsedAt        sql.NullTime  `json:"used_at"`
+	ExpiresAt     time.Time     `json:"expires_at"`
+	CreatedAt     time.Time     `json:"created_at"`
+}
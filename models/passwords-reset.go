@@ -4,7 +4,7 @@ import "time"
 
 type PasswordReset struct {
 	ID        int       `json:"id"`
-	UserID    string    `json:"user_id"`
+	UserID    int       `json:"user_id"`
 	Code      string    `json:"code"`
 	CreatedAt time.Time `json:"created_at"`
 }
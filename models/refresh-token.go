@@ -0,0 +1,19 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+type RefreshToken struct {
+	ID       int    `json:"id"`
+	UserID   int    `json:"user_id"`
+	FamilyID string `json:"family_id"`
+	// ClientID is the OpenID Connect client the token was issued to, if any
+	ClientID  sql.NullInt64 `json:"client_id"`
+	Token     string        `json:"token"`
+	UsedAt    sql.NullTime  `json:"used_at"`
+	RevokedAt sql.NullTime  `json:"revoked_at"`
+	ExpiresAt time.Time     `json:"expires_at"`
+	CreatedAt time.Time     `json:"created_at"`
+}
@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// ServiceAccount is a machine client that obtains its tokens with the client credentials grant
+type ServiceAccount struct {
+	ID        int       `json:"id"`
+	ClientID  string    `json:"client_id"`
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Session records an access token issued to a user, the tokens issued from the same login share
+// the family of their refresh tokens
+type Session struct {
+	ID         int    `json:"id"`
+	JTI        string `json:"jti"`
+	UserID     int    `json:"user_id"`
+	FamilyID   string `json:"family_id"`
+	AuthMethod string `json:"auth_method"`
+	// Scope holds the scopes granted to the OpenID Connect client the tokens were issued to
+	Scope     string       `json:"scope"`
+	IP        string       `json:"ip"`
+	UserAgent string       `json:"user_agent"`
+	IssuedAt  time.Time    `json:"issued_at"`
+	ExpiresAt time.Time    `json:"expires_at"`
+	RevokedAt sql.NullTime `json:"revoked_at"`
+	CreatedAt time.Time    `json:"created_at"`
+}
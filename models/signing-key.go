@@ -0,0 +1,17 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+type SigningKey struct {
+	ID         int          `json:"id"`
+	KID        string       `json:"kid"`
+	Algorithm  string       `json:"algorithm"`
+	PrivateKey string       `json:"private_key"`
+	PublicKey  string       `json:"public_key"`
+	Active     bool         `json:"active"`
+	CreatedAt  time.Time    `json:"created_at"`
+	RetiresAt  sql.NullTime `json:"retires_at"`
+}
@@ -0,0 +1,26 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+type UserTOTP struct {
+	ID           int          `json:"id"`
+	UserID       int          `json:"user_id"`
+	Secret       string       `json:"secret"`
+	Confirmed    bool         `json:"confirmed"`
+	LastUsedStep int64        `json:"last_used_step"`
+	ConfirmedAt  sql.NullTime `json:"confirmed_at"`
+	CreatedAt    time.Time    `json:"created_at"`
+}
+
+type AdminTOTP struct {
+	ID           int          `json:"id"`
+	AdminID      int          `json:"admin_id"`
+	Secret       string       `json:"secret"`
+	Confirmed    bool         `json:"confirmed"`
+	LastUsedStep int64        `json:"last_used_step"`
+	ConfirmedAt  sql.NullTime `json:"confirmed_at"`
+	CreatedAt    time.Time    `json:"created_at"`
+}
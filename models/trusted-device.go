@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+type TrustedDevice struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"user_id"`
+	DeviceID   string    `json:"device_id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	CreatedAt  time.Time `json:"created_at"`
+}
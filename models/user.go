@@ -1,18 +1,30 @@
 package models
 
+import (
+	"database/sql"
+	"time"
+)
+
 type User struct {
-	ID        int    `json:"id"`
-	Name      string `json:"name"`
-	Email     string `json:"email"`
-	Password  string `json:"password"`
-	Verified  bool   `json:"verified"`
-	Provider  string `json:"provider"`
-	CreatedAt string `json:"created_at"`
-	UpdatedAt string `json:"updated_at"`
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	Email        string `json:"email"`
+	Password     string `json:"password"`
+	Verified     bool   `json:"verified"`
+	Provider     string `json:"provider"`
+	TokenVersion int    `json:"token_version"`
+	// the roles assigned to the user and the permissions they grant, embedded in the tokens
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+	CreatedAt   string   `json:"created_at"`
+	UpdatedAt   string   `json:"updated_at"`
 }
 
 type Admin struct {
-	ID       int    `json:"id"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	ID            int          `json:"id"`
+	Email         string       `json:"email"`
+	Password      string       `json:"password"`
+	TokenVersion  int          `json:"token_version"`
+	DeactivatedAt sql.NullTime `json:"deactivated_at"`
+	CreatedAt     time.Time    `json:"created_at"`
 }
@@ -0,0 +1,32 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+type WebAuthnCredential struct {
+	ID              int          `json:"id"`
+	UserID          int          `json:"user_id"`
+	CredentialID    string       `json:"credential_id"`
+	Name            string       `json:"name"`
+	PublicKey       []byte       `json:"public_key"`
+	AttestationType string       `json:"attestation_type"`
+	AAGUID          []byte       `json:"aaguid"`
+	SignCount       uint32       `json:"sign_count"`
+	Transports      string       `json:"transports"`
+	BackupEligible  bool         `json:"backup_eligible"`
+	BackupState     bool         `json:"backup_state"`
+	LastUsedAt      sql.NullTime `json:"last_used_at"`
+	CreatedAt       time.Time    `json:"created_at"`
+}
+
+type WebAuthnSession struct {
+	ID        int           `json:"id"`
+	Session   string        `json:"session"`
+	Ceremony  string        `json:"ceremony"`
+	UserID    sql.NullInt64 `json:"user_id"`
+	Data      string        `json:"data"`
+	ExpiresAt time.Time     `json:"expires_at"`
+	CreatedAt time.Time     `json:"created_at"`
+}
@@ -0,0 +1,345 @@
+package modules
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/isaacwassouf/authentication-service/actions"
+	"github.com/isaacwassouf/authentication-service/consts"
+	"github.com/isaacwassouf/authentication-service/models"
+	pbcryptography "github.com/isaacwassouf/authentication-service/protobufs/cryptography_service"
+	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+// startAdminMFAChallenge answers an admin login that passed the password with a MFA challenge, the
+// second factor is mandatory for the admins. The emailed code is the second factor of the admins
+// who did not enroll TOTP and it is sent right away to them.
+func (s *UserManagementService) startAdminMFAChallenge(ctx context.Context, admin models.Admin) (*pb.LoginResponse, error) {
+	totpEnabled, err := s.hasAdminTOTP(admin.ID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to get the TOTP status")
+	}
+
+	methods := []string{consts.MFA_METHOD_EMAIL}
+	if totpEnabled {
+		methods = []string{consts.MFA_METHOD_TOTP, consts.MFA_METHOD_EMAIL}
+	}
+
+	challengeID, err := actions.CreateAdminMFAChallenge(admin.ID, methods, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &pb.LoginResponse{
+		Message:        "MFA required",
+		MfaRequired:    true,
+		MfaChallengeId: challengeID,
+		MfaMethods:     methods,
+	}
+
+	if !totpEnabled {
+		if err := s.sendMFAEmailCode(ctx, admin.Email, challengeID); err != nil {
+			return nil, err
+		}
+		response.Message = "MFA token sent successfully"
+	}
+
+	return response, nil
+}
+
+// SendAdminMFAEmailCode emails a code for the MFA challenge of an admin login, it is the fallback
+// when the authenticator app is not at hand
+func (s *UserManagementService) SendAdminMFAEmailCode(
+	ctx context.Context,
+	in *pb.SendMFAEmailCodeRequest,
+) (*pb.SendMFAEmailCodeResponse, error) {
+	maxAttempts, err := s.getMFAMaxAttempts()
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, err := actions.GetAdminMFAChallenge(in.MfaChallengeId, maxAttempts, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	admin, err := actions.GetAdmin(int(challenge.AdminID.Int64), s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.sendMFAEmailCode(ctx, admin.Email, in.MfaChallengeId); err != nil {
+		return nil, err
+	}
+
+	return &pb.SendMFAEmailCodeResponse{Message: "MFA token sent successfully"}, nil
+}
+
+// ConfirmAdminMFA completes the MFA challenge of an admin login and issues the admin token
+func (s *UserManagementService) ConfirmAdminMFA(
+	ctx context.Context,
+	in *pb.ConfirmAdminMFARequest,
+) (response *pb.ConfirmAdminMFAResponse, err error) {
+	method := in.Method
+	if method == "" {
+		method = consts.MFA_METHOD_EMAIL
+	}
+
+	// the login is audited again with the outcome of the second factor
+	event := models.AuditEvent{
+		EventType: consts.AUDIT_ADMIN_LOGIN,
+		ActorType: consts.AUDIT_ACTOR_ADMIN,
+		Metadata:  map[string]string{"mfa_method": method},
+	}
+	defer func() { s.recordAuditEvent(ctx, event, err) }()
+
+	if in.Code == "" {
+		return nil, status.Error(codes.InvalidArgument, "code is required")
+	}
+
+	maxAttempts, err := s.getMFAMaxAttempts()
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, err := actions.CompleteAdminMFAChallenge(
+		in.MfaChallengeId,
+		method,
+		maxAttempts,
+		func(challenge models.MFAChallenge) (bool, error) {
+			switch method {
+			case consts.MFA_METHOD_TOTP:
+				return s.verifyAdminTOTP(ctx, int(challenge.AdminID.Int64), in.Code)
+			case consts.MFA_METHOD_EMAIL:
+				return actions.CheckMFAEmailCode(challenge, in.Code)
+			default:
+				return false, status.Error(codes.InvalidArgument, "unknown MFA method")
+			}
+		},
+		s.UserManagementServiceDB.DB,
+	)
+	event.ActorID = challenge.AdminID
+	if err != nil {
+		return nil, err
+	}
+
+	// the admin may have been deactivated while completing the challenge
+	admin, err := actions.GetAdmin(int(challenge.AdminID.Int64), s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+	event.Actor = admin.Email
+	if admin.DeactivatedAt.Valid {
+		return nil, status.Error(codes.PermissionDenied, "account is deactivated")
+	}
+
+	token, err := utils.GenerateAdminToken(admin, s.KeyManager)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to generate token")
+	}
+
+	return &pb.ConfirmAdminMFAResponse{Message: "Logged in successfully", Token: token}, nil
+}
+
+// BeginAdminTOTPEnrollment generates a new TOTP secret for the calling admin, the enrollment is only
+// effective once a code generated from it is confirmed
+func (s *UserManagementService) BeginAdminTOTPEnrollment(
+	ctx context.Context,
+	in *emptypb.Empty,
+) (*pb.BeginTOTPEnrollmentResponse, error) {
+	caller, ok := callerFromContext(ctx)
+	if !ok || caller.Admin == nil {
+		return nil, status.Error(codes.PermissionDenied, "an admin token is required")
+	}
+
+	totp, err := s.getAdminTOTP(int(caller.Admin.Id))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+	if err == nil && totp.Confirmed {
+		return nil, status.Error(codes.FailedPrecondition, "TOTP is already enabled")
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to generate the TOTP secret")
+	}
+
+	encryptedSecret, err := (*s.CryptographyServiceClient).Encrypt(ctx, &pbcryptography.EncryptRequest{Plaintext: secret})
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to encrypt the TOTP secret")
+	}
+
+	// restarting an enrollment replaces the unconfirmed secret
+	_, err = sq.Insert("admins_totp").
+		Columns("admin_id", "secret").
+		Values(caller.Admin.Id, encryptedSecret.Ciphertext).
+		Suffix("ON DUPLICATE KEY UPDATE secret = VALUES(secret), confirmed = FALSE, last_used_step = 0, created_at = CURRENT_TIMESTAMP").
+		RunWith(s.UserManagementServiceDB.DB).
+		Exec()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to save the TOTP secret")
+	}
+
+	return &pb.BeginTOTPEnrollmentResponse{
+		Secret: secret,
+		Uri:    utils.TOTPURI(utils.GetEnvVar("TOTP_ISSUER", "authentication-service"), caller.Admin.Email, secret),
+	}, nil
+}
+
+// ConfirmAdminTOTPEnrollment enables TOTP for the calling admin once they prove their
+// authenticator app generates valid codes
+func (s *UserManagementService) ConfirmAdminTOTPEnrollment(
+	ctx context.Context,
+	in *pb.ConfirmAdminTOTPEnrollmentRequest,
+) (*pb.ConfirmTOTPEnrollmentResponse, error) {
+	if in.Code == "" {
+		return nil, status.Error(codes.InvalidArgument, "code is required")
+	}
+
+	caller, ok := callerFromContext(ctx)
+	if !ok || caller.Admin == nil {
+		return nil, status.Error(codes.PermissionDenied, "an admin token is required")
+	}
+
+	totp, err := s.getAdminTOTP(int(caller.Admin.Id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, status.Error(codes.NotFound, "TOTP enrollment not found")
+		}
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+	if totp.Confirmed {
+		return nil, status.Error(codes.FailedPrecondition, "TOTP is already enabled")
+	}
+
+	step, valid, err := s.validateTOTPCode(ctx, totp.Secret, totp.LastUsedStep, in.Code)
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		return nil, status.Error(codes.InvalidArgument, "invalid code")
+	}
+
+	_, err = sq.Update("admins_totp").
+		Set("confirmed", true).
+		Set("confirmed_at", time.Now()).
+		Set("last_used_step", step).
+		Where(sq.Eq{"id": totp.ID}).
+		RunWith(s.UserManagementServiceDB.DB).
+		Exec()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to enable TOTP")
+	}
+
+	return &pb.ConfirmTOTPEnrollmentResponse{Message: "TOTP enabled successfully"}, nil
+}
+
+// DisableAdminTOTP removes the TOTP secret of the calling admin, who falls back to the emailed
+// codes. A current code is required so that a stolen token is not enough to remove it.
+func (s *UserManagementService) DisableAdminTOTP(
+	ctx context.Context,
+	in *pb.DisableAdminTOTPRequest,
+) (*pb.DisableTOTPResponse, error) {
+	if in.Code == "" {
+		return nil, status.Error(codes.InvalidArgument, "code is required")
+	}
+
+	caller, ok := callerFromContext(ctx)
+	if !ok || caller.Admin == nil {
+		return nil, status.Error(codes.PermissionDenied, "an admin token is required")
+	}
+
+	totp, err := s.getAdminTOTP(int(caller.Admin.Id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, status.Error(codes.NotFound, "TOTP is not enabled")
+		}
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	_, valid, err := s.validateTOTPCode(ctx, totp.Secret, totp.LastUsedStep, in.Code)
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		return nil, status.Error(codes.InvalidArgument, "invalid code")
+	}
+
+	_, err = sq.Delete("admins_totp").
+		Where(sq.Eq{"id": totp.ID}).
+		RunWith(s.UserManagementServiceDB.DB).
+		Exec()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to disable TOTP")
+	}
+
+	return &pb.DisableTOTPResponse{Message: "TOTP disabled successfully"}, nil
+}
+
+// verifyAdminTOTP checks a code against the confirmed TOTP secret of the admin and marks its time
+// step as used so that the code can not be replayed
+func (s *UserManagementService) verifyAdminTOTP(ctx context.Context, adminID int, code string) (bool, error) {
+	totp, err := s.getAdminTOTP(adminID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, status.Error(codes.Internal, "failed to query the database")
+	}
+	if !totp.Confirmed {
+		return false, nil
+	}
+
+	step, valid, err := s.validateTOTPCode(ctx, totp.Secret, totp.LastUsedStep, code)
+	if err != nil || !valid {
+		return false, err
+	}
+
+	result, err := sq.Update("admins_totp").
+		Set("last_used_step", step).
+		Where(sq.Eq{"id": totp.ID}).
+		Where(sq.Lt{"last_used_step": step}).
+		RunWith(s.UserManagementServiceDB.DB).
+		Exec()
+	if err != nil {
+		return false, status.Error(codes.Internal, "failed to update the TOTP")
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, status.Error(codes.Internal, "failed to update the TOTP")
+	}
+
+	return updated == 1, nil
+}
+
+// hasAdminTOTP reports whether the admin completed the TOTP enrollment
+func (s *UserManagementService) hasAdminTOTP(adminID int) (bool, error) {
+	totp, err := s.getAdminTOTP(adminID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	return totp.Confirmed, nil
+}
+
+func (s *UserManagementService) getAdminTOTP(adminID int) (models.AdminTOTP, error) {
+	var totp models.AdminTOTP
+	err := sq.Select("id", "admin_id", "secret", "confirmed", "last_used_step", "confirmed_at", "created_at").
+		From("admins_totp").
+		Where(sq.Eq{"admin_id": adminID}).
+		RunWith(s.UserManagementServiceDB.DB).
+		QueryRow().
+		Scan(&totp.ID, &totp.AdminID, &totp.Secret, &totp.Confirmed, &totp.LastUsedStep, &totp.ConfirmedAt, &totp.CreatedAt)
+	return totp, err
+}
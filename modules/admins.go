@@ -2,32 +2,97 @@ package modules
 
 import (
 	"context"
+	"crypto/subtle"
 	"database/sql"
 	"errors"
+	"time"
 
 	sq "github.com/Masterminds/squirrel"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
 
+	"github.com/isaacwassouf/authentication-service/actions"
+	"github.com/isaacwassouf/authentication-service/consts"
 	"github.com/isaacwassouf/authentication-service/models"
+	pbEmail "github.com/isaacwassouf/authentication-service/protobufs/email_management_service"
 	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
 	"github.com/isaacwassouf/authentication-service/utils"
 )
 
+// RegisterAdmin creates the first admin of the service, it is refused once an admin exists and the
+// other admins are invited. When ADMIN_BOOTSTRAP_TOKEN is set the request has to carry it.
 func (s *UserManagementService) RegisterAdmin(ctx context.Context, in *pb.RegisterAdminRequest) (*pb.RegisterAdminResponse, error) {
-	var count int
-	err := sq.Select("count(*)").
-		From("admins").
-		Where(sq.Eq{"email": in.Email}).
-		RunWith(s.UserManagementServiceDB.DB).
-		QueryRow().
-		Scan(&count)
+	bootstrapToken := utils.GetEnvVar("ADMIN_BOOTSTRAP_TOKEN", "")
+	if bootstrapToken != "" && subtle.ConstantTimeCompare([]byte(bootstrapToken), []byte(in.BootstrapToken)) != 1 {
+		return nil, status.Error(codes.PermissionDenied, "invalid bootstrap token")
+	}
+
+	if in.Email == "" || in.Password == "" {
+		return nil, status.Error(codes.InvalidArgument, "email and password are required")
+	}
+
+	hashedPassword, err := utils.HashPassword(in.Password)
 	if err != nil {
-		return nil, status.Error(codes.Internal, "failed to query the database")
+		return nil, status.Error(codes.Internal, "failed to hash the password")
+	}
+
+	if err := actions.CreateFirstAdmin(in.Email, hashedPassword, s.UserManagementServiceDB.DB); err != nil {
+		return nil, err
+	}
+
+	return &pb.RegisterAdminResponse{Message: "successfully registered admin"}, nil
+}
+
+// InviteAdmin emails an invitation code to a new admin, the invitee sets their password with it
+func (s *UserManagementService) InviteAdmin(ctx context.Context, in *pb.InviteAdminRequest) (*pb.InviteAdminResponse, error) {
+	if in.Email == "" {
+		return nil, status.Error(codes.InvalidArgument, "email is required")
+	}
+
+	caller, ok := callerFromContext(ctx)
+	if !ok || caller.Admin == nil {
+		return nil, status.Error(codes.PermissionDenied, "an admin token is required")
+	}
+
+	hours, err := utils.GetIntSetting("ADMIN_INVITATION_HOURS", 72, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to get the invitation settings")
+	}
+
+	code, err := actions.CreateAdminInvitation(
+		in.Email,
+		int(caller.Admin.Id),
+		time.Duration(hours)*time.Hour,
+		s.UserManagementServiceDB.DB,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// the email service has no template for the invitations, the code is used the same way as a
+	// password reset code
+	_, err = (*s.EmailServiceClient).SendPasswordResetEmail(context.Background(), &pbEmail.SendEmailRequest{To: in.Email, Token: code})
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to send the invitation email")
 	}
 
-	if count > 0 {
-		return nil, status.Error(codes.AlreadyExists, "admin already exists")
+	return &pb.InviteAdminResponse{Message: "Invitation sent successfully"}, nil
+}
+
+// AcceptAdminInvitation creates the admin account of an invitation with the password of the invitee
+func (s *UserManagementService) AcceptAdminInvitation(
+	ctx context.Context,
+	in *pb.AcceptAdminInvitationRequest,
+) (*pb.AcceptAdminInvitationResponse, error) {
+	if in.Code == "" {
+		return nil, status.Error(codes.InvalidArgument, "code is required")
+	}
+	if in.Password == "" {
+		return nil, status.Error(codes.InvalidArgument, "password is required")
+	}
+	if in.Password != in.PasswordConfirmation {
+		return nil, status.Error(codes.InvalidArgument, "passwords do not match")
 	}
 
 	hashedPassword, err := utils.HashPassword(in.Password)
@@ -35,41 +100,258 @@ func (s *UserManagementService) RegisterAdmin(ctx context.Context, in *pb.Regist
 		return nil, status.Error(codes.Internal, "failed to hash the password")
 	}
 
-	_, err = sq.Insert("admins").
-		Columns("email", "password").
-		Values(in.Email, hashedPassword).
-		RunWith(s.UserManagementServiceDB.DB).
-		Exec()
+	email, err := actions.AcceptAdminInvitation(in.Code, hashedPassword, s.UserManagementServiceDB.DB)
 	if err != nil {
-		return nil, status.Error(codes.Internal, "failed to insert admin in the database")
+		return nil, err
 	}
 
-	return &pb.RegisterAdminResponse{Message: "successfully registered admin"}, nil
+	return &pb.AcceptAdminInvitationResponse{Message: "Admin registered successfully", Email: email}, nil
 }
 
-func (s *UserManagementService) LoginAdmin(ctx context.Context, in *pb.LoginRequest) (*pb.LoginResponse, error) {
-	var admin models.Admin
-	err := sq.Select("id", "email", "password").
+// ListAdmins returns the admins of the service, the deactivated ones included
+func (s *UserManagementService) ListAdmins(ctx context.Context, in *emptypb.Empty) (*pb.ListAdminsResponse, error) {
+	admins, err := actions.ListAdmins(s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &pb.ListAdminsResponse{}
+	for _, admin := range admins {
+		response.Admins = append(response.Admins, &pb.Admin{
+			Id:        uint64(admin.ID),
+			Email:     admin.Email,
+			Active:    !admin.DeactivatedAt.Valid,
+			CreatedAt: admin.CreatedAt.Format(time.RFC3339),
+		})
+	}
+
+	return response, nil
+}
+
+// DeactivateAdmin blocks the logins of another admin and revokes their tokens
+func (s *UserManagementService) DeactivateAdmin(ctx context.Context, in *pb.DeactivateAdminRequest) (*pb.DeactivateAdminResponse, error) {
+	if err := checkOtherAdmin(ctx, in.AdminId); err != nil {
+		return nil, err
+	}
+
+	if err := actions.DeactivateAdmin(int(in.AdminId), s.UserManagementServiceDB.DB); err != nil {
+		return nil, err
+	}
+	if err := s.invalidateAdminTokens(ctx, int(in.AdminId)); err != nil {
+		return nil, err
+	}
+
+	return &pb.DeactivateAdminResponse{Message: "Admin deactivated successfully"}, nil
+}
+
+// DeleteAdmin deletes another admin, the invitations they sent stay valid
+func (s *UserManagementService) DeleteAdmin(ctx context.Context, in *pb.DeleteAdminRequest) (*pb.DeleteAdminResponse, error) {
+	if err := checkOtherAdmin(ctx, in.AdminId); err != nil {
+		return nil, err
+	}
+
+	if err := actions.DeleteAdmin(int(in.AdminId), s.UserManagementServiceDB.DB); err != nil {
+		return nil, err
+	}
+	if err := s.invalidateAdminTokens(ctx, int(in.AdminId)); err != nil {
+		return nil, err
+	}
+
+	return &pb.DeleteAdminResponse{Message: "Admin deleted successfully"}, nil
+}
+
+// ChangeAdminPassword replaces the password of the calling admin who knows their current one, the
+// tokens issued to the admin are revoked
+func (s *UserManagementService) ChangeAdminPassword(
+	ctx context.Context,
+	in *pb.ChangeAdminPasswordRequest,
+) (*pb.ChangeAdminPasswordResponse, error) {
+	if in.NewPassword == "" {
+		return nil, status.Error(codes.InvalidArgument, "new password is required")
+	}
+	if in.NewPassword != in.NewPasswordConfirmation {
+		return nil, status.Error(codes.InvalidArgument, "passwords do not match")
+	}
+
+	caller, ok := callerFromContext(ctx)
+	if !ok || caller.Admin == nil {
+		return nil, status.Error(codes.PermissionDenied, "an admin token is required")
+	}
+
+	var password string
+	err := sq.Select("password").
 		From("admins").
-		Where(sq.Eq{"email": in.Email}).
+		Where(sq.Eq{"id": caller.Admin.Id}).
 		RunWith(s.UserManagementServiceDB.DB).
 		QueryRow().
-		Scan(&admin.ID, &admin.Email, &admin.Password)
+		Scan(&password)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, status.Error(codes.NotFound, "admin not found")
 		}
 		return nil, status.Error(codes.Internal, "failed to query the database")
 	}
+	if !utils.CheckPasswordHash(in.CurrentPassword, password) {
+		return nil, errInvalidCredentials
+	}
 
-	if !utils.CheckPasswordHash(in.Password, admin.Password) {
-		return nil, status.Error(codes.InvalidArgument, "incorrect password")
+	hashedPassword, err := utils.HashPassword(in.NewPassword)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to hash the password")
+	}
+
+	if err := actions.ChangeAdminPassword(int(caller.Admin.Id), hashedPassword, s.UserManagementServiceDB.DB); err != nil {
+		return nil, err
 	}
+	// log out everywhere, whoever stole a token of the admin loses access
+	if err := s.invalidateAdminTokens(ctx, int(caller.Admin.Id)); err != nil {
+		return nil, err
+	}
+
+	return &pb.ChangeAdminPasswordResponse{Message: "Password changed successfully"}, nil
+}
+
+func (s *UserManagementService) LoginAdmin(ctx context.Context, in *pb.LoginRequest) (response *pb.LoginResponse, err error) {
+	event := models.AuditEvent{EventType: consts.AUDIT_ADMIN_LOGIN, ActorType: consts.AUDIT_ACTOR_ADMIN, Actor: in.Email}
+	defer func() {
+		if response != nil && response.MfaRequired {
+			event.Outcome = consts.AUDIT_OUTCOME_MFA_REQUIRED
+		}
+		s.recordAuditEvent(ctx, event, err)
+	}()
 
-	token, err := utils.GenerateAdminToken(admin)
+	// reject the attempt while the account or the IP is locked
+	throttle, err := actions.GetLoginThrottle(s.UserManagementServiceDB.DB)
 	if err != nil {
-		return nil, status.Error(codes.Internal, "failed to generate token")
+		return nil, status.Error(codes.Internal, "failed to get the login settings")
+	}
+	subjects := actions.NewLoginSubjects("admin", in.Email, utils.GetClientIP(ctx))
+	if err := actions.CheckLoginAllowed(subjects, throttle, s.UserManagementServiceDB.DB); err != nil {
+		return nil, err
+	}
+
+	var admin models.Admin
+	err = sq.Select("id", "email", "password", "deactivated_at").
+		From("admins").
+		Where(sq.Eq{"email": in.Email}).
+		RunWith(s.UserManagementServiceDB.DB).
+		QueryRow().
+		Scan(&admin.ID, &admin.Email, &admin.Password, &admin.DeactivatedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+	if err == nil {
+		event.ActorID = sql.NullInt64{Int64: int64(admin.ID), Valid: true}
+	}
+
+	// an unknown email fails the same way as a wrong password
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.CheckDummyPasswordHash(in.Password)
+	}
+	if errors.Is(err, sql.ErrNoRows) || !utils.CheckPasswordHash(in.Password, admin.Password) {
+		if err := actions.RecordLoginFailure(subjects, throttle, s.UserManagementServiceDB.DB); err != nil {
+			return nil, err
+		}
+		return nil, errInvalidCredentials
+	}
+
+	if err := actions.ClearLoginFailures(subjects, s.UserManagementServiceDB.DB); err != nil {
+		return nil, err
+	}
+
+	// only the admins who know the password learn that the account is deactivated
+	if admin.DeactivatedAt.Valid {
+		return nil, status.Error(codes.PermissionDenied, "account is deactivated")
+	}
+
+	// the admin token is only issued once ConfirmAdminMFA completes the second factor
+	return s.startAdminMFAChallenge(ctx, admin)
+}
+
+// LogoutAdmin revokes the token the admin called with
+func (s *UserManagementService) LogoutAdmin(ctx context.Context, in *emptypb.Empty) (*emptypb.Empty, error) {
+	caller, ok := callerFromContext(ctx)
+	if !ok || caller.Admin == nil {
+		return nil, status.Error(codes.PermissionDenied, "an admin token is required")
 	}
 
-	return &pb.LoginResponse{Message: "Logged in successfully", Token: token}, nil
+	expiresAt, err := time.Parse(time.RFC3339, caller.ExpiresAt)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to parse the token expiry")
+	}
+
+	token, err := actions.BlacklistAdminToken(int(caller.Admin.Id), caller.Jti, expiresAt, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.revokeTokens(ctx, token); err != nil {
+		return nil, err
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// UnlockUser removes the lockouts of an account, and optionally of an IP, before they expire
+func (s *UserManagementService) UnlockUser(ctx context.Context, in *pb.UnlockUserRequest) (*pb.UnlockUserResponse, error) {
+	if in.Email == "" && in.Ip == "" {
+		return nil, status.Error(codes.InvalidArgument, "email or ip is required")
+	}
+
+	var subjects []string
+	if in.Email != "" {
+		// the same email may be locked as a user and as an admin
+		subjects = append(subjects,
+			actions.NewLoginSubjects("user", in.Email, "").Account,
+			actions.NewLoginSubjects("admin", in.Email, "").Account,
+		)
+	}
+	if in.Ip != "" {
+		subjects = append(subjects, actions.NewLoginSubjects("", "", in.Ip).IP)
+	}
+
+	unlocked, err := actions.UnlockLoginSubjects(subjects, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+	if unlocked == 0 {
+		return &pb.UnlockUserResponse{Message: "nothing to unlock"}, nil
+	}
+
+	return &pb.UnlockUserResponse{Message: "successfully unlocked"}, nil
+}
+
+// SuspendUser blocks the logins of a user and revokes the tokens they were issued
+func (s *UserManagementService) SuspendUser(ctx context.Context, in *pb.SuspendUserRequest) (*pb.SuspendUserResponse, error) {
+	if err := actions.SuspendUser(int(in.UserId), s.UserManagementServiceDB.DB); err != nil {
+		return nil, err
+	}
+	if err := s.invalidateUserTokens(ctx, int(in.UserId)); err != nil {
+		return nil, err
+	}
+
+	return &pb.SuspendUserResponse{Message: "User suspended successfully"}, nil
+}
+
+// ReinstateUser lets a suspended user log in again
+func (s *UserManagementService) ReinstateUser(ctx context.Context, in *pb.ReinstateUserRequest) (*pb.ReinstateUserResponse, error) {
+	if err := actions.ReinstateUser(int(in.UserId), s.UserManagementServiceDB.DB); err != nil {
+		return nil, err
+	}
+	if err := s.invalidateUserTokens(ctx, int(in.UserId)); err != nil {
+		return nil, err
+	}
+
+	return &pb.ReinstateUserResponse{Message: "User reinstated successfully"}, nil
+}
+
+// checkOtherAdmin keeps the calling admin from deactivating or deleting their own account
+func checkOtherAdmin(ctx context.Context, adminID uint64) error {
+	caller, ok := callerFromContext(ctx)
+	if !ok || caller.Admin == nil {
+		return status.Error(codes.PermissionDenied, "an admin token is required")
+	}
+	if caller.Admin.Id == adminID {
+		return status.Error(codes.FailedPrecondition, "an admin can not remove their own account")
+	}
+	return nil
 }
@@ -0,0 +1,157 @@
+package modules
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/actions"
+	"github.com/isaacwassouf/authentication-service/consts"
+	"github.com/isaacwassouf/authentication-service/models"
+	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+const (
+	defaultAuditPageSize = 50
+	maxAuditPageSize     = 200
+)
+
+// newAdminAuditEvent starts the audit event of an action performed by the calling admin
+func newAdminAuditEvent(ctx context.Context, eventType string) models.AuditEvent {
+	event := models.AuditEvent{EventType: eventType, ActorType: consts.AUDIT_ACTOR_ADMIN, Metadata: map[string]string{}}
+	if caller, ok := callerFromContext(ctx); ok && caller.Admin != nil {
+		event.ActorID = sql.NullInt64{Int64: int64(caller.Admin.Id), Valid: true}
+		event.Actor = caller.Admin.Email
+	}
+	return event
+}
+
+// recordAuditEvent appends the outcome of an action to the audit log along with the IP of the
+// caller. A failure to record is logged rather than returned, the audit log being unavailable does
+// not lock everyone out.
+func (s *UserManagementService) recordAuditEvent(ctx context.Context, event models.AuditEvent, err error) {
+	if event.Metadata == nil {
+		event.Metadata = map[string]string{}
+	}
+	event.IP = utils.GetClientIP(ctx)
+
+	if err != nil {
+		event.Outcome = consts.AUDIT_OUTCOME_FAILURE
+		event.Metadata["error"] = status.Convert(err).Message()
+	} else if event.Outcome == "" {
+		event.Outcome = consts.AUDIT_OUTCOME_SUCCESS
+	}
+
+	if err := actions.RecordAuditEvent(event, s.UserManagementServiceDB.DB); err != nil {
+		log.Printf("failed to record the %s audit event: %v", event.EventType, err)
+	}
+}
+
+// ListAuditEvents returns a page of the audit log, the most recent events first. The next page is
+// requested with the returned page token. The first page carries the head of the chain, which
+// flags the events removed from the end of the log.
+func (s *UserManagementService) ListAuditEvents(ctx context.Context, in *pb.ListAuditEventsRequest) (*pb.ListAuditEventsResponse, error) {
+	pageSize := int(in.PageSize)
+	if pageSize <= 0 {
+		pageSize = defaultAuditPageSize
+	}
+	if pageSize > maxAuditPageSize {
+		pageSize = maxAuditPageSize
+	}
+
+	filter := actions.AuditEventFilter{
+		EventType: in.EventType,
+		ActorType: in.ActorType,
+		ActorID:   int(in.ActorId),
+		Outcome:   in.Outcome,
+	}
+
+	var err error
+	if in.PageToken != "" {
+		if filter.BeforeID, err = strconv.Atoi(in.PageToken); err != nil || filter.BeforeID <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "invalid page token")
+		}
+	}
+	if in.Since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, in.Since); err != nil {
+			return nil, status.Error(codes.InvalidArgument, "since must be an RFC 3339 time")
+		}
+	}
+	if in.Until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, in.Until); err != nil {
+			return nil, status.Error(codes.InvalidArgument, "until must be an RFC 3339 time")
+		}
+	}
+
+	events, err := actions.ListAuditEvents(filter, pageSize, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &pb.ListAuditEventsResponse{}
+	if in.PageToken == "" {
+		response.HeadHash, response.HeadVerified, err = actions.GetAuditChainHead(s.UserManagementServiceDB.DB)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, event := range events {
+		response.Events = append(response.Events, &pb.AuditEvent{
+			Id:        uint64(event.ID),
+			EventType: event.EventType,
+			ActorType: event.ActorType,
+			ActorId:   uint64(event.ActorID.Int64),
+			Actor:     event.Actor,
+			Target:    event.Target,
+			Ip:        event.IP,
+			Outcome:   event.Outcome,
+			Metadata:  event.Metadata,
+			PrevHash:  event.PrevHash,
+			Hash:      event.Hash,
+			CreatedAt: event.CreatedAt.Format(time.RFC3339),
+			Verified:  event.Verified,
+		})
+	}
+	if len(events) == pageSize {
+		response.NextPageToken = strconv.Itoa(events[len(events)-1].ID)
+	}
+
+	return response, nil
+}
+
+// newUserLoginAuditEvent starts the audit event of a user login through the provider, the user is
+// set with setAuditUser once known
+func newUserLoginAuditEvent(provider string) models.AuditEvent {
+	return models.AuditEvent{
+		EventType: consts.AUDIT_USER_LOGIN,
+		ActorType: consts.AUDIT_ACTOR_USER,
+		Metadata:  map[string]string{"provider": provider},
+	}
+}
+
+func setAuditUser(event *models.AuditEvent, user models.User) {
+	event.ActorID = sql.NullInt64{Int64: int64(user.ID), Valid: true}
+	event.Actor = user.Email
+	event.Target = auditUserTarget(user.ID)
+}
+
+func auditUserTarget(userID int) string {
+	return "user:" + strconv.Itoa(userID)
+}
+
+func auditAuthProviderTarget(authProviderID uint64) string {
+	return "auth_provider:" + strconv.FormatUint(authProviderID, 10)
+}
+
+func auditMFAPolicyTarget(scope string, scopeValue string) string {
+	if scopeValue == "" {
+		return "mfa_policy:" + scope
+	}
+	return "mfa_policy:" + scope + ":" + scopeValue
+}
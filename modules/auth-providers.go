@@ -5,17 +5,15 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"net/url"
 	"time"
 
 	sq "github.com/Masterminds/squirrel"
-	"github.com/matoous/go-nanoid/v2"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
 
-	"github.com/isaacwassouf/authentication-service/actions"
 	"github.com/isaacwassouf/authentication-service/consts"
+	"github.com/isaacwassouf/authentication-service/models"
 	pbcryptography "github.com/isaacwassouf/authentication-service/protobufs/cryptography_service"
 	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
 	"github.com/isaacwassouf/authentication-service/utils"
@@ -26,6 +24,8 @@ func (s *UserManagementService) ListAuthProviders(ctx context.Context, in *empty
 	rows, err := sq.Select(
 		"auth_providers.id",
 		"auth_providers.name",
+		"auth_providers.type",
+		"auth_providers.issuer_url",
 		"auth_providers_details.client_id",
 		"auth_providers_details.redirect_url",
 		"auth_providers_details.active",
@@ -41,11 +41,12 @@ func (s *UserManagementService) ListAuthProviders(ctx context.Context, in *empty
 	var authProviders []*pb.AuthProvider
 	for rows.Next() {
 		var id uint64
-		var name string
+		var name, providerType string
+		var issuerUrl sql.NullString
 		var clientId sql.NullString
 		var redirectUrl sql.NullString
 		var active bool
-		err := rows.Scan(&id, &name, &clientId, &redirectUrl, &active)
+		err := rows.Scan(&id, &name, &providerType, &issuerUrl, &clientId, &redirectUrl, &active)
 		if err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
@@ -53,6 +54,8 @@ func (s *UserManagementService) ListAuthProviders(ctx context.Context, in *empty
 		authProvider := pb.AuthProvider{
 			Id:          id,
 			Name:        name,
+			Type:        providerType,
+			IssuerUrl:   issuerUrl.String,
 			ClientId:    clientId.String,
 			RedirectUri: redirectUrl.String,
 			Active:      active,
@@ -69,10 +72,13 @@ func (s *UserManagementService) GetAuthProviderCredentials(ctx context.Context,
 
 	var authProviderName string
 
-	switch in.AuthProvider {
-	case pb.AuthProviderName_GOOGLE:
+	// the providers registered at runtime are only known by their name
+	switch {
+	case in.Name != "":
+		authProviderName = in.Name
+	case in.AuthProvider == pb.AuthProviderName_GOOGLE:
 		authProviderName = consts.GOOGLE
-	case pb.AuthProviderName_GITHUB:
+	case in.AuthProvider == pb.AuthProviderName_GITHUB:
 		authProviderName = consts.GITHUB
 	default:
 		return nil, status.Error(codes.InvalidArgument, "Invalid auth provider")
@@ -80,51 +86,82 @@ func (s *UserManagementService) GetAuthProviderCredentials(ctx context.Context,
 
 	active, err := utils.CheckAuthProviderIsActive(authProviderName, s.UserManagementServiceDB.DB)
 	if err != nil {
-		return nil, status.Error(codes.Internal, "Failed to check if GitHub is enabled")
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, status.Error(codes.NotFound, "Auth provider not found")
+		}
+		return nil, status.Error(codes.Internal, "Failed to check if the auth provider is enabled")
 	}
 
 	if !active {
 		return nil, status.Error(codes.PermissionDenied, "Auth provider is not enabled")
 	}
 
+	credentials, err := s.getAuthProviderCredentials(ctx, authProviderName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.GetAuthProviderCredentialsResponse{
+		ClientId:     credentials.ClientID,
+		ClientSecret: credentials.ClientSecret,
+		RedirectUri:  credentials.RedirectURL,
+	}, nil
+}
+
+// getAuthProviderCredentials gets the credentials of an auth provider with the client_secret decrypted
+func (s *UserManagementService) getAuthProviderCredentials(
+	ctx context.Context,
+	authProviderName string,
+) (models.AuthProviderCredentials, error) {
+	var credentials models.AuthProviderCredentials
 	// get the client_id and client_secret for the auth provider
 	var clientId sql.NullString
 	var clientSecret sql.NullString
 	var redirectUrl sql.NullString
 
-	err = sq.Select("client_id", "client_secret", "redirect_url").
+	err := sq.Select("client_id", "client_secret", "redirect_url").
 		From("auth_providers_details").
 		Join("auth_providers ON auth_providers.id = auth_providers_details.auth_provider_id").
 		Where(sq.Eq{"auth_providers.name": authProviderName}).RunWith(s.UserManagementServiceDB.DB).Scan(&clientId, &clientSecret, &redirectUrl)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, status.Error(codes.NotFound, "Auth provider not found")
+			return credentials, status.Error(codes.NotFound, "Auth provider not found")
 		}
-		return nil, status.Error(codes.Internal, "Failed to get the credentials")
+		return credentials, status.Error(codes.Internal, "Failed to get the credentials")
 	}
 
 	// check if the client_id and client_secret are set
 	if !clientId.Valid || !clientSecret.Valid || !redirectUrl.Valid {
-		return nil, status.Error(codes.InvalidArgument, "Client ID, Client Secret, or redirectURL are not set")
+		return credentials, status.Error(codes.InvalidArgument, "Client ID, Client Secret, or redirectURL are not set")
 	}
 
 	// decrypt the client_secret
 	decryptedClientSecret, err := (*s.CryptographyServiceClient).Decrypt(ctx, &pbcryptography.DecryptRequest{Ciphertext: clientSecret.String})
 	if err != nil {
-		return nil, status.Error(codes.Internal, "Failed to decrypt the client secret")
+		return credentials, status.Error(codes.Internal, "Failed to decrypt the client secret")
 	}
 
-	return &pb.GetAuthProviderCredentialsResponse{ClientId: clientId.String, ClientSecret: decryptedClientSecret.Plaintext, RedirectUri: redirectUrl.String}, nil
+	credentials.ClientID = clientId.String
+	credentials.ClientSecret = decryptedClientSecret.Plaintext
+	credentials.RedirectURL = redirectUrl.String
+	return credentials, nil
 }
 
 // SetAuthProviderCredentials sets the client_id and client_secret for an external auth provider
 func (s *UserManagementService) SetAuthProviderCredentials(
 	ctx context.Context,
 	in *pb.SetAuthProviderCredentialsRequest,
-) (*pb.SetAuthProviderCredentialsResponse, error) {
+) (response *pb.SetAuthProviderCredentialsResponse, err error) {
+	// the client secret is never recorded
+	event := newAdminAuditEvent(ctx, consts.AUDIT_AUTH_PROVIDER_CREDENTIALS_SET)
+	event.Target = auditAuthProviderTarget(in.AuthProviderId)
+	event.Metadata["client_id"] = in.ClientId
+	event.Metadata["redirect_uri"] = in.RedirectUri
+	defer func() { s.recordAuditEvent(ctx, event, err) }()
+
 	// check if the provider exists
 	var count int
-	err := sq.Select("COUNT(*)").
+	err = sq.Select("COUNT(*)").
 		From("auth_providers").
 		Where(sq.Eq{"id": in.AuthProviderId}).
 		RunWith(s.UserManagementServiceDB.DB).
@@ -164,9 +201,13 @@ func (s *UserManagementService) SetAuthProviderCredentials(
 func (s *UserManagementService) EnableAuthProvider(
 	ctx context.Context,
 	in *pb.EnableAuthProviderRequest,
-) (*pb.EnableAuthProviderResponse, error) {
+) (response *pb.EnableAuthProviderResponse, err error) {
+	event := newAdminAuditEvent(ctx, consts.AUDIT_AUTH_PROVIDER_ENABLED)
+	event.Target = auditAuthProviderTarget(in.AuthProviderId)
+	defer func() { s.recordAuditEvent(ctx, event, err) }()
+
 	var clientid, clientsecret, redirectURL sql.NullString
-	err := sq.Select("client_id", "client_secret", "redirect_url").
+	err = sq.Select("client_id", "client_secret", "redirect_url").
 		From("auth_providers_details").
 		Where(sq.Eq{"auth_provider_id": in.AuthProviderId}).
 		RunWith(s.UserManagementServiceDB.DB).
@@ -202,10 +243,14 @@ func (s *UserManagementService) EnableAuthProvider(
 func (s *UserManagementService) DisableAuthProvider(
 	ctx context.Context,
 	in *pb.DisableAuthProviderRequest,
-) (*pb.DisableAuthProviderResponse, error) {
+) (response *pb.DisableAuthProviderResponse, err error) {
+	event := newAdminAuditEvent(ctx, consts.AUDIT_AUTH_PROVIDER_DISABLED)
+	event.Target = auditAuthProviderTarget(in.AuthProviderId)
+	defer func() { s.recordAuditEvent(ctx, event, err) }()
+
 	// check if the provider exists
 	var count int
-	err := sq.Select("COUNT(*)").
+	err = sq.Select("COUNT(*)").
 		From("auth_providers").
 		Where(sq.Eq{"id": in.AuthProviderId}).
 		RunWith(s.UserManagementServiceDB.DB).
@@ -234,192 +279,103 @@ func (s *UserManagementService) DisableAuthProvider(
 	return &pb.DisableAuthProviderResponse{Message: "Auth provider disabled successfully"}, nil
 }
 
+// GetGoogleAuthorizationUrl builds the Google authorization URL
 func (s *UserManagementService) GetGoogleAuthorizationUrl(
 	ctx context.Context,
-	in *emptypb.Empty,
+	in *pb.AuthorizationUrlRequest,
 ) (*pb.GoogleAuthorizationUrlResponse, error) {
-	// set the base url for the google authorization url
-	baseURL, err := url.ParseRequestURI("https://accounts.google.com/o/oauth2/v2/auth")
+	authorizationURL, state, err := s.authorizationURL(ctx, consts.GOOGLE, in.RedirectUrl)
 	if err != nil {
-		return nil, status.Error(codes.Internal, "Failed to parse the base url")
+		return nil, err
 	}
 
-	var clientId, redirectURL sql.NullString
-	var active bool
-	// get the client_id and active fields from the auth_providers_details table
-	query := sq.Select("auth_providers_details.client_id", "auth_providers_details.redirect_url", "auth_providers_details.active").
-		From("auth_providers").
-		Join("auth_providers_details ON auth_providers.id = auth_providers_details.auth_provider_id").
-		Where(sq.Eq{"auth_providers.name": consts.GOOGLE})
-
-	err = query.RunWith(s.UserManagementServiceDB.DB).QueryRow().Scan(&clientId, &redirectURL, &active)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, status.Error(codes.NotFound, "Auth provider not found")
-		}
-		return nil, status.Error(codes.Internal, "Failed to query the database")
-	}
-
-	// check if the client_id and the redirect_url are set
-	if !clientId.Valid || !redirectURL.Valid {
-		return nil, status.Error(codes.InvalidArgument, "Client ID or redirect URL are not set")
-	}
-
-	// check if the auth provider is active
-	if !active {
-		return nil, status.Error(codes.PermissionDenied, "Auth provider is not active")
-	}
-
-	// generate a random state
-	state, err := gonanoid.New()
-	if err != nil {
-		return nil, status.Error(codes.Internal, "Failed to generate a random state")
-	}
-
-	params := url.Values{}
-	params.Add("client_id", clientId.String)
-	params.Add("response_type", "code")
-	params.Add("scope", "openid email profile")
-	params.Add("state", state)
-	params.Add("redirect_uri", redirectURL.String)
-
-	baseURL.RawQuery = params.Encode()
-
-	return &pb.GoogleAuthorizationUrlResponse{Url: baseURL.String(), State: state}, nil
+	return &pb.GoogleAuthorizationUrlResponse{Url: authorizationURL, State: state}, nil
 }
 
+// HandleGoogleLogin logs in a user with the authorization code returned by Google
 func (s *UserManagementService) HandleGoogleLogin(
 	ctx context.Context,
 	in *pb.GoogleLoginRequest,
-) (*pb.GoogleLoginResponse, error) {
-	// check if Google is enabled
-	active, err := utils.CheckAuthProviderIsActive(consts.GOOGLE, s.UserManagementServiceDB.DB)
-	if err != nil {
-		return nil, status.Error(codes.Internal, "Failed to check if Google is enabled")
-	}
-	if !active {
-		return nil, status.Error(codes.PermissionDenied, "Google is not enabled")
-	}
-
-	// get the external auth user by email
-	user, err := utils.GetExternalAuthUserByEmail(consts.GOOGLE, in.Email, s.UserManagementServiceDB.DB)
-	if err != nil {
-		// the user does not exist, create a new user
-		if errors.Is(err, sql.ErrNoRows) {
-			id, err := actions.CreateGoogleUser(in, s.UserManagementServiceDB.DB)
-			if err != nil {
-				return nil, err
-			}
-			// get the user from the database from its id
-			user, err = utils.GetExternalAuthUserByID(consts.GOOGLE, id, s.UserManagementServiceDB.DB)
-			if err != nil {
-				return nil, status.Error(codes.Internal, "Failed to get the user")
-			}
-
-			// generate a JWT token
-			token, err := utils.GenerateToken(user)
-			if err != nil {
-				return nil, status.Error(codes.Internal, "Failed to generate token")
-			}
-
-			return &pb.GoogleLoginResponse{Message: "Logged in successfully", Token: token}, nil
+) (response *pb.GoogleLoginResponse, err error) {
+	event := newUserLoginAuditEvent(consts.GOOGLE)
+	defer func() {
+		if response != nil && response.MfaRequired {
+			event.Outcome = consts.AUDIT_OUTCOME_MFA_REQUIRED
 		}
-		return nil, status.Error(codes.Internal, "Failed to get the user")
-	}
+		s.recordAuditEvent(ctx, event, err)
+	}()
 
-	// generate a JWT token
-	token, err := utils.GenerateToken(user)
+	user, redirectURL, err := s.externalLogin(ctx, consts.GOOGLE, in.Code, in.State)
 	if err != nil {
-		return nil, status.Error(codes.Internal, "Failed to generate token")
+		return nil, err
 	}
+	setAuditUser(&event, user)
 
-	return &pb.GoogleLoginResponse{Message: "Logged in successfully", Token: token}, nil
+	// the external logins honour the MFA policy like the password logins
+	login, err := s.completeLogin(ctx, user, consts.GOOGLE, in.DeviceToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.GoogleLoginResponse{
+		Message:               login.Message,
+		Token:                 login.Token,
+		RefreshToken:          login.RefreshToken,
+		RedirectUrl:           redirectURL,
+		MfaRequired:           login.MfaRequired,
+		MfaChallengeId:        login.MfaChallengeId,
+		MfaMethods:            login.MfaMethods,
+		MfaEnrollmentRequired: login.MfaEnrollmentRequired,
+		MfaEnrollmentDeadline: login.MfaEnrollmentDeadline,
+	}, nil
 }
 
+// GetGitHubAuthorizationUrl builds the GitHub authorization URL
 func (s *UserManagementService) GetGitHubAuthorizationUrl(
-	ctx context.Context, in *emptypb.Empty,
+	ctx context.Context, in *pb.AuthorizationUrlRequest,
 ) (*pb.GitHubAuthorizationUrlResponse, error) {
-	// set the base url for the github authorization url
-	baseURL, err := url.ParseRequestURI("https://github.com/login/oauth/authorize")
+	authorizationURL, state, err := s.authorizationURL(ctx, consts.GITHUB, in.RedirectUrl)
 	if err != nil {
-		return nil, status.Error(codes.Internal, "Failed to parse the base url")
+		return nil, err
 	}
 
-	var clientID, redirectURL sql.NullString
-	var active bool
-	query := sq.Select("auth_providers_details.client_id", "auth_providers_details.redirect_url", "auth_providers_details.active").
-		From("auth_providers").
-		Join("auth_providers_details ON auth_providers.id = auth_providers_details.auth_provider_id").
-		Where(sq.Eq{"auth_providers.name": consts.GITHUB})
-
-	err = query.RunWith(s.UserManagementServiceDB.DB).QueryRow().Scan(&clientID, &redirectURL, &active)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, status.Error(codes.NotFound, "Auth provider not found")
-		}
-		return nil, status.Error(codes.Internal, "Failed to query the database")
-	}
-
-	if !clientID.Valid || !redirectURL.Valid {
-		return nil, status.Error(codes.Internal, "Client ID or Redirect URL are not set")
-	}
-
-	if !active {
-		return nil, status.Error(codes.PermissionDenied, "Auth provider is not active")
-	}
-
-	params := url.Values{}
-	params.Add("client_id", clientID.String)
-	params.Add("scope", "read:user user:email")
-	params.Add("state", "random_state")
-	params.Add("redirect_uri", redirectURL.String)
-
-	baseURL.RawQuery = params.Encode()
-
-	return &pb.GitHubAuthorizationUrlResponse{Url: baseURL.String()}, nil
+	return &pb.GitHubAuthorizationUrlResponse{Url: authorizationURL, State: state}, nil
 }
 
-func (s *UserManagementService) HandleGitHubLogin(ctx context.Context, in *pb.GitHubLoginRequest) (*pb.GitHubLoginResponse, error) {
-	// check if GitHub is enabled
-	active, err := utils.CheckAuthProviderIsActive(consts.GITHUB, s.UserManagementServiceDB.DB)
-	if err != nil {
-		return nil, status.Error(codes.Internal, "Failed to check if GitHub is enabled")
-	}
-	if !active {
-		return nil, status.Error(codes.PermissionDenied, "GitHub is not enabled")
-	}
-
-	// get the external auth user by email
-	user, err := utils.GetExternalAuthUserByEmail(consts.GITHUB, in.Email, s.UserManagementServiceDB.DB)
-	if err != nil {
-		// the user does not exist, create a new user
-		if errors.Is(err, sql.ErrNoRows) {
-			id, err := actions.CreateGitHubUser(in, s.UserManagementServiceDB.DB)
-			if err != nil {
-				return nil, err
-			}
-			// get the user from the database from its id
-			user, err = utils.GetExternalAuthUserByID(consts.GITHUB, id, s.UserManagementServiceDB.DB)
-			if err != nil {
-				return nil, status.Error(codes.Internal, "Failed to get the user")
-			}
-
-			// generate a JWT token
-			token, err := utils.GenerateToken(user)
-			if err != nil {
-				return nil, status.Error(codes.Internal, "Failed to generate token")
-			}
-
-			return &pb.GitHubLoginResponse{Message: "Logged in successfully", Token: token}, nil
+// HandleGitHubLogin logs in a user with the authorization code returned by GitHub
+func (s *UserManagementService) HandleGitHubLogin(
+	ctx context.Context,
+	in *pb.GitHubLoginRequest,
+) (response *pb.GitHubLoginResponse, err error) {
+	event := newUserLoginAuditEvent(consts.GITHUB)
+	defer func() {
+		if response != nil && response.MfaRequired {
+			event.Outcome = consts.AUDIT_OUTCOME_MFA_REQUIRED
 		}
-		return nil, status.Error(codes.Internal, "Failed to get the user")
-	}
+		s.recordAuditEvent(ctx, event, err)
+	}()
 
-	// generate a JWT token
-	token, err := utils.GenerateToken(user)
+	user, redirectURL, err := s.externalLogin(ctx, consts.GITHUB, in.Code, in.State)
 	if err != nil {
-		return nil, status.Error(codes.Internal, "Failed to generate token")
+		return nil, err
 	}
+	setAuditUser(&event, user)
 
-	return &pb.GitHubLoginResponse{Message: "Logged in successfully", Token: token}, nil
+	// the external logins honour the MFA policy like the password logins
+	login, err := s.completeLogin(ctx, user, consts.GITHUB, in.DeviceToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.GitHubLoginResponse{
+		Message:               login.Message,
+		Token:                 login.Token,
+		RefreshToken:          login.RefreshToken,
+		RedirectUrl:           redirectURL,
+		MfaRequired:           login.MfaRequired,
+		MfaChallengeId:        login.MfaChallengeId,
+		MfaMethods:            login.MfaMethods,
+		MfaEnrollmentRequired: login.MfaEnrollmentRequired,
+		MfaEnrollmentDeadline: login.MfaEnrollmentDeadline,
+	}, nil
 }
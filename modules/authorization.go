@@ -0,0 +1,243 @@
+package modules
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/consts"
+	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+// methodPolicies declares who may call each RPC, the calls to a method missing from the table are
+// denied
+var methodPolicies = map[string]string{
+	// the logins, the registration and the flows of the users who are not logged in yet
+	pb.UserManager_RegisterUser_FullMethodName:              consts.POLICY_PUBLIC,
+	pb.UserManager_LoginUser_FullMethodName:                 consts.POLICY_PUBLIC,
+	pb.UserManager_LoginAdmin_FullMethodName:                consts.POLICY_PUBLIC,
+	pb.UserManager_RefreshToken_FullMethodName:              consts.POLICY_PUBLIC,
+	pb.UserManager_ConfirmMFA_FullMethodName:                consts.POLICY_PUBLIC,
+	pb.UserManager_SendMFAEmailCode_FullMethodName:          consts.POLICY_PUBLIC,
+	pb.UserManager_BeginWebAuthnMFA_FullMethodName:          consts.POLICY_PUBLIC,
+	pb.UserManager_BeginWebAuthnLogin_FullMethodName:        consts.POLICY_PUBLIC,
+	pb.UserManager_FinishWebAuthnLogin_FullMethodName:       consts.POLICY_PUBLIC,
+	pb.UserManager_RequestPasswordReset_FullMethodName:      consts.POLICY_PUBLIC,
+	pb.UserManager_ConfirmPasswordReset_FullMethodName:      consts.POLICY_PUBLIC,
+	pb.UserManager_RequestEmailVerification_FullMethodName:  consts.POLICY_PUBLIC,
+	pb.UserManager_VerifyEmail_FullMethodName:               consts.POLICY_PUBLIC,
+	pb.UserManager_ListAuthProviders_FullMethodName:         consts.POLICY_PUBLIC,
+	pb.UserManager_GetAuthorizationUrl_FullMethodName:       consts.POLICY_PUBLIC,
+	pb.UserManager_HandleExternalLogin_FullMethodName:       consts.POLICY_PUBLIC,
+	pb.UserManager_GetGoogleAuthorizationUrl_FullMethodName: consts.POLICY_PUBLIC,
+	pb.UserManager_HandleGoogleLogin_FullMethodName:         consts.POLICY_PUBLIC,
+	pb.UserManager_GetGitHubAuthorizationUrl_FullMethodName: consts.POLICY_PUBLIC,
+	pb.UserManager_HandleGitHubLogin_FullMethodName:         consts.POLICY_PUBLIC,
+	pb.UserManager_GetJWKS_FullMethodName:                   consts.POLICY_PUBLIC,
+	pb.UserManager_GetServiceAccountToken_FullMethodName:    consts.POLICY_PUBLIC,
+	pb.UserManager_RegisterAdmin_FullMethodName:             consts.POLICY_PUBLIC,
+	pb.UserManager_AcceptAdminInvitation_FullMethodName:     consts.POLICY_PUBLIC,
+	pb.UserManager_SendAdminMFAEmailCode_FullMethodName:     consts.POLICY_PUBLIC,
+	pb.UserManager_ConfirmAdminMFA_FullMethodName:           consts.POLICY_PUBLIC,
+
+	// the account of the logged in user
+	pb.UserManager_LogoutUser_FullMethodName:                 consts.POLICY_USER,
+	pb.UserManager_ChangePassword_FullMethodName:             consts.POLICY_USER,
+	pb.UserManager_ChangeEmail_FullMethodName:                consts.POLICY_USER,
+	pb.UserManager_BeginTOTPEnrollment_FullMethodName:        consts.POLICY_USER,
+	pb.UserManager_ConfirmTOTPEnrollment_FullMethodName:      consts.POLICY_USER,
+	pb.UserManager_DisableTOTP_FullMethodName:                consts.POLICY_USER,
+	pb.UserManager_BeginWebAuthnRegistration_FullMethodName:  consts.POLICY_USER,
+	pb.UserManager_FinishWebAuthnRegistration_FullMethodName: consts.POLICY_USER,
+	pb.UserManager_ListWebAuthnCredentials_FullMethodName:    consts.POLICY_USER,
+	pb.UserManager_DeleteWebAuthnCredential_FullMethodName:   consts.POLICY_USER,
+	pb.UserManager_GenerateRecoveryCodes_FullMethodName:      consts.POLICY_USER,
+	pb.UserManager_ListTrustedDevices_FullMethodName:         consts.POLICY_USER,
+	pb.UserManager_RevokeTrustedDevice_FullMethodName:        consts.POLICY_USER,
+	pb.UserManager_ListSessions_FullMethodName:               consts.POLICY_USER,
+	pb.UserManager_RevokeSession_FullMethodName:              consts.POLICY_USER,
+	pb.UserManager_RevokeAllSessions_FullMethodName:          consts.POLICY_USER,
+	pb.UserManager_GetOIDCAuthorization_FullMethodName:       consts.POLICY_USER,
+	pb.UserManager_CompleteOIDCAuthorization_FullMethodName:  consts.POLICY_USER,
+
+	// the administration of the service
+	pb.UserManager_InviteAdmin_FullMethodName:                consts.POLICY_ADMIN,
+	pb.UserManager_ListAdmins_FullMethodName:                 consts.POLICY_ADMIN,
+	pb.UserManager_DeactivateAdmin_FullMethodName:            consts.POLICY_ADMIN,
+	pb.UserManager_DeleteAdmin_FullMethodName:                consts.POLICY_ADMIN,
+	pb.UserManager_ChangeAdminPassword_FullMethodName:        consts.POLICY_ADMIN,
+	pb.UserManager_LogoutAdmin_FullMethodName:                consts.POLICY_ADMIN,
+	pb.UserManager_BeginAdminTOTPEnrollment_FullMethodName:   consts.POLICY_ADMIN,
+	pb.UserManager_ConfirmAdminTOTPEnrollment_FullMethodName: consts.POLICY_ADMIN,
+	pb.UserManager_DisableAdminTOTP_FullMethodName:           consts.POLICY_ADMIN,
+	pb.UserManager_ListAuditEvents_FullMethodName:            consts.POLICY_ADMIN,
+	pb.UserManager_ListUsers_FullMethodName:                  consts.POLICY_ADMIN,
+	pb.UserManager_UnlockUser_FullMethodName:                 consts.POLICY_ADMIN,
+	pb.UserManager_SuspendUser_FullMethodName:                consts.POLICY_ADMIN,
+	pb.UserManager_ReinstateUser_FullMethodName:              consts.POLICY_ADMIN,
+	pb.UserManager_GetMFA_FullMethodName:                     consts.POLICY_ADMIN,
+	pb.UserManager_ToggleMFA_FullMethodName:                  consts.POLICY_ADMIN,
+	pb.UserManager_SetMFAPolicy_FullMethodName:               consts.POLICY_ADMIN,
+	pb.UserManager_ListMFAPolicies_FullMethodName:            consts.POLICY_ADMIN,
+	pb.UserManager_DeleteMFAPolicy_FullMethodName:            consts.POLICY_ADMIN,
+	pb.UserManager_GetAuthProviderCredentials_FullMethodName: consts.POLICY_ADMIN,
+	pb.UserManager_SetAuthProviderCredentials_FullMethodName: consts.POLICY_ADMIN,
+	pb.UserManager_EnableAuthProvider_FullMethodName:         consts.POLICY_ADMIN,
+	pb.UserManager_DisableAuthProvider_FullMethodName:        consts.POLICY_ADMIN,
+	pb.UserManager_CreateAuthProvider_FullMethodName:         consts.POLICY_ADMIN,
+	pb.UserManager_DeleteAuthProvider_FullMethodName:         consts.POLICY_ADMIN,
+	pb.UserManager_RotateSigningKeys_FullMethodName:          consts.POLICY_ADMIN,
+	pb.UserManager_RegisterOIDCClient_FullMethodName:         consts.POLICY_ADMIN,
+	pb.UserManager_ListOIDCClients_FullMethodName:            consts.POLICY_ADMIN,
+	pb.UserManager_DeleteOIDCClient_FullMethodName:           consts.POLICY_ADMIN,
+	pb.UserManager_CreateServiceAccount_FullMethodName:       consts.POLICY_ADMIN,
+	pb.UserManager_ListServiceAccounts_FullMethodName:        consts.POLICY_ADMIN,
+	pb.UserManager_RotateServiceAccountSecret_FullMethodName: consts.POLICY_ADMIN,
+	pb.UserManager_DeleteServiceAccount_FullMethodName:       consts.POLICY_ADMIN,
+	pb.UserManager_CreateRole_FullMethodName:                 consts.POLICY_ADMIN,
+	pb.UserManager_ListRoles_FullMethodName:                  consts.POLICY_ADMIN,
+	pb.UserManager_DeleteRole_FullMethodName:                 consts.POLICY_ADMIN,
+	pb.UserManager_CreatePermission_FullMethodName:           consts.POLICY_ADMIN,
+	pb.UserManager_ListPermissions_FullMethodName:            consts.POLICY_ADMIN,
+	pb.UserManager_DeletePermission_FullMethodName:           consts.POLICY_ADMIN,
+	pb.UserManager_GrantPermission_FullMethodName:            consts.POLICY_ADMIN,
+	pb.UserManager_RevokePermission_FullMethodName:           consts.POLICY_ADMIN,
+	pb.UserManager_AssignRole_FullMethodName:                 consts.POLICY_ADMIN,
+	pb.UserManager_UnassignRole_FullMethodName:               consts.POLICY_ADMIN,
+	pb.UserManager_ListUserRoles_FullMethodName:              consts.POLICY_ADMIN,
+
+	// the checks of the gateway and the services behind it
+	pb.UserManager_VerifyTokenRevoation_FullMethodName: consts.POLICY_INTERNAL,
+	pb.UserManager_ValidateToken_FullMethodName:        consts.POLICY_INTERNAL,
+}
+
+// userRequest is implemented by the requests about a user, a user may only send their own
+type userRequest interface {
+	GetUserId() uint64
+}
+
+// jtiRequest is implemented by the requests about a token, a user may only send the one they
+// called with
+type jtiRequest interface {
+	GetJti() string
+}
+
+// CheckMethodPolicies makes sure every method of the service has a policy, the server refuses to
+// start otherwise rather than deny the calls to a new RPC at runtime
+func CheckMethodPolicies(desc grpc.ServiceDesc) error {
+	var missing []string
+	for _, method := range desc.Methods {
+		if _, ok := methodPolicies["/"+desc.ServiceName+"/"+method.MethodName]; !ok {
+			missing = append(missing, method.MethodName)
+		}
+	}
+	for _, stream := range desc.Streams {
+		if _, ok := methodPolicies["/"+desc.ServiceName+"/"+stream.StreamName]; !ok {
+			missing = append(missing, stream.StreamName)
+		}
+	}
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("no authorization policy for %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// UnaryServerInterceptor enforces the policy of the method on the unary calls
+func (s *UserManagementService) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := s.authorize(ctx, info.FullMethod, req)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor enforces the policy of the method on the streaming calls, the requests
+// of the streams are not inspected
+func (s *UserManagementService) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := s.authorize(stream.Context(), info.FullMethod, nil)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authorizedStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+// callerKey is the context key of the payload of the token the call was authorized with
+type callerKey struct{}
+
+// callerFromContext returns the payload of the token the call was authorized with, the public
+// methods have none
+func callerFromContext(ctx context.Context) (*pb.ValidateTokenResponse, bool) {
+	caller, ok := ctx.Value(callerKey{}).(*pb.ValidateTokenResponse)
+	return caller, ok
+}
+
+// authorizedStream carries the caller of a stream to its handler
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authorizedStream) Context() context.Context {
+	return s.ctx
+}
+
+// authorize validates the bearer token of the call against the policy of the method and returns
+// the context of the call with the caller
+func (s *UserManagementService) authorize(ctx context.Context, fullMethod string, req interface{}) (context.Context, error) {
+	policy, ok := methodPolicies[fullMethod]
+	if !ok {
+		return ctx, status.Error(codes.PermissionDenied, "method is not allowed")
+	}
+	if policy == consts.POLICY_PUBLIC {
+		return ctx, nil
+	}
+
+	token := utils.GetBearerToken(ctx)
+	if token == "" {
+		return ctx, status.Error(codes.Unauthenticated, "bearer token is required")
+	}
+	caller, err := s.ValidateToken(ctx, &pb.ValidateTokenRequest{Token: token})
+	if err != nil {
+		if status.Code(err) == codes.Internal {
+			return ctx, err
+		}
+		return ctx, status.Error(codes.Unauthenticated, "invalid token")
+	}
+
+	switch policy {
+	case consts.POLICY_USER:
+		// the tokens issued to the OpenID Connect clients only grant their scopes, not the account
+		if caller.User == nil || caller.Scope != "" {
+			return ctx, status.Error(codes.PermissionDenied, "a user token is required")
+		}
+		if r, ok := req.(userRequest); ok && r.GetUserId() != caller.User.Id {
+			return ctx, status.Error(codes.PermissionDenied, "the request is about another user")
+		}
+		if r, ok := req.(jtiRequest); ok && r.GetJti() != caller.Jti {
+			return ctx, status.Error(codes.PermissionDenied, "the request is about another token")
+		}
+	case consts.POLICY_ADMIN:
+		if caller.Admin == nil {
+			return ctx, status.Error(codes.PermissionDenied, "an admin token is required")
+		}
+	case consts.POLICY_INTERNAL:
+		if caller.ServiceAccount == nil {
+			return ctx, status.Error(codes.PermissionDenied, "a service account token is required")
+		}
+	default:
+		return ctx, status.Error(codes.PermissionDenied, "method is not allowed")
+	}
+	return context.WithValue(ctx, callerKey{}, caller), nil
+}
@@ -0,0 +1,226 @@
+package modules
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/consts"
+	"github.com/isaacwassouf/authentication-service/database"
+	"github.com/isaacwassouf/authentication-service/models"
+	pbcryptography "github.com/isaacwassouf/authentication-service/protobufs/cryptography_service"
+	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
+	"github.com/isaacwassouf/authentication-service/revocation"
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+// plaintextCryptography stores the private keys as they are
+type plaintextCryptography struct {
+	pbcryptography.CryptographyManagerClient
+}
+
+func (plaintextCryptography) Decrypt(
+	ctx context.Context,
+	in *pbcryptography.DecryptRequest,
+	opts ...grpc.CallOption,
+) (*pbcryptography.DecryptResponse, error) {
+	return &pbcryptography.DecryptResponse{Plaintext: in.Ciphertext}, nil
+}
+
+// newTestKeyManager loads a signing key generated for the test
+func newTestKeyManager(t *testing.T) *utils.KeyManager {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create the database mock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate the key: %v", err)
+	}
+	encodedPrivateKey, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatalf("failed to encode the private key: %v", err)
+	}
+	encodedPublicKey, err := x509.MarshalPKIXPublicKey(privateKey.Public())
+	if err != nil {
+		t.Fatalf("failed to encode the public key: %v", err)
+	}
+
+	mock.ExpectQuery("FROM signing_keys").WillReturnRows(
+		sqlmock.NewRows([]string{"kid", "algorithm", "private_key", "public_key", "active", "created_at"}).AddRow(
+			"kid", consts.ES256,
+			string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: encodedPrivateKey})),
+			string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: encodedPublicKey})),
+			true, time.Now(),
+		),
+	)
+
+	keys, err := utils.NewKeyManager(db, plaintextCryptography{})
+	if err != nil {
+		t.Fatalf("failed to create the key manager: %v", err)
+	}
+	if err := keys.Load(context.Background()); err != nil {
+		t.Fatalf("failed to load the keys: %v", err)
+	}
+	return keys
+}
+
+// newAuthorizationTest returns a service whose only user is active on its first token version
+func newAuthorizationTest(t *testing.T) *UserManagementService {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create the database mock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cache := revocation.NewCache(db, revocation.NewLocalPubSub())
+	mock.ExpectQuery("FROM tokens_blacklist").WillReturnRows(sqlmock.NewRows([]string{"jti", "expires_at"}))
+	if err := cache.Load(context.Background()); err != nil {
+		t.Fatalf("failed to load the cache: %v", err)
+	}
+	// the state of the user is cached after the first call
+	mock.ExpectQuery("FROM users").
+		WillReturnRows(sqlmock.NewRows([]string{"token_version", "suspended_at"}).AddRow(1, nil))
+
+	return &UserManagementService{
+		UserManagementServiceDB: &database.UserManagementServiceDB{DB: db},
+		KeyManager:              newTestKeyManager(t),
+		RevocationCache:         cache,
+	}
+}
+
+// testServerStream is a stream that only carries the context of the call
+type testServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *testServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// call runs the interceptor of the method with a handler that must not be reached
+func call(t *testing.T, s *UserManagementService, fullMethod string, ctx context.Context) error {
+	t.Helper()
+
+	for _, stream := range pb.UserManager_ServiceDesc.Streams {
+		if "/"+pb.UserManager_ServiceDesc.ServiceName+"/"+stream.StreamName == fullMethod {
+			return s.StreamServerInterceptor()(
+				nil,
+				&testServerStream{ctx: ctx},
+				&grpc.StreamServerInfo{FullMethod: fullMethod, IsServerStream: true},
+				func(srv interface{}, stream grpc.ServerStream) error {
+					t.Fatalf("%s: the handler was called", fullMethod)
+					return nil
+				},
+			)
+		}
+	}
+
+	_, err := s.UnaryServerInterceptor()(
+		ctx,
+		nil,
+		&grpc.UnaryServerInfo{FullMethod: fullMethod},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			t.Fatalf("%s: the handler was called", fullMethod)
+			return nil, nil
+		},
+	)
+	return err
+}
+
+func withBearerToken(token string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+}
+
+func TestAdminMethodsRejectOtherCallers(t *testing.T) {
+	s := newAuthorizationTest(t)
+
+	userToken, _, err := utils.GenerateToken(
+		models.User{ID: 1, Name: "Jane", Email: "jane@example.com", TokenVersion: 1}, "", s.KeyManager,
+	)
+	if err != nil {
+		t.Fatalf("failed to generate the user token: %v", err)
+	}
+	serviceAccountToken, _, err := utils.GenerateServiceAccountToken(
+		models.ServiceAccount{ID: 1, ClientID: "client", Name: "service"}, []string{"users:read"}, s.KeyManager,
+	)
+	if err != nil {
+		t.Fatalf("failed to generate the service account token: %v", err)
+	}
+
+	callers := []struct {
+		name     string
+		ctx      context.Context
+		expected codes.Code
+	}{
+		{name: "anonymous", ctx: context.Background(), expected: codes.Unauthenticated},
+		{name: "user", ctx: withBearerToken(userToken), expected: codes.PermissionDenied},
+		{name: "service account", ctx: withBearerToken(serviceAccountToken), expected: codes.PermissionDenied},
+	}
+
+	for method, policy := range methodPolicies {
+		if policy != consts.POLICY_ADMIN {
+			continue
+		}
+		for _, caller := range callers {
+			err := call(t, s, method, caller.ctx)
+			if status.Code(err) != caller.expected {
+				t.Errorf("%s called by the %s: expected %v, got %v", method, caller.name, caller.expected, err)
+			}
+		}
+	}
+}
+
+func TestCheckMethodPolicies(t *testing.T) {
+	if err := CheckMethodPolicies(pb.UserManager_ServiceDesc); err != nil {
+		t.Fatalf("expected every method to have a policy, got %v", err)
+	}
+
+	desc := pb.UserManager_ServiceDesc
+	desc.Methods = append([]grpc.MethodDesc{{MethodName: "Unregistered"}}, desc.Methods...)
+	err := CheckMethodPolicies(desc)
+	if err == nil || !strings.Contains(err.Error(), "Unregistered") {
+		t.Fatalf("expected the method without a policy to be reported, got %v", err)
+	}
+}
+
+func TestUserMethodsRejectOIDCClientTokens(t *testing.T) {
+	s := newAuthorizationTest(t)
+
+	// the token a relying party was granted for the user
+	clientToken, _, err := utils.GenerateToken(
+		models.User{ID: 1, Name: "Jane", Email: "jane@example.com", TokenVersion: 1}, "openid profile", s.KeyManager,
+	)
+	if err != nil {
+		t.Fatalf("failed to generate the client token: %v", err)
+	}
+
+	for method, policy := range methodPolicies {
+		if policy != consts.POLICY_USER && policy != consts.POLICY_ADMIN {
+			continue
+		}
+		err := call(t, s, method, withBearerToken(clientToken))
+		if code := status.Code(err); code != codes.Unauthenticated && code != codes.PermissionDenied {
+			t.Errorf("%s called with a client token: expected the call to be rejected, got %v", method, err)
+		}
+	}
+}
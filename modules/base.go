@@ -1,10 +1,16 @@
 package modules
 
 import (
+	"github.com/go-webauthn/webauthn/webauthn"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
 	"github.com/isaacwassouf/authentication-service/database"
 	pbcryptography "github.com/isaacwassouf/authentication-service/protobufs/cryptography_service"
 	pbEmail "github.com/isaacwassouf/authentication-service/protobufs/email_management_service"
 	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
+	"github.com/isaacwassouf/authentication-service/revocation"
+	"github.com/isaacwassouf/authentication-service/utils"
 )
 
 type UserManagementService struct {
@@ -12,4 +18,11 @@ type UserManagementService struct {
 	UserManagementServiceDB   *database.UserManagementServiceDB
 	EmailServiceClient        *pbEmail.EmailManagerClient
 	CryptographyServiceClient *pbcryptography.CryptographyManagerClient
+	KeyManager                *utils.KeyManager
+	WebAuthn                  *webauthn.WebAuthn
+	RevocationCache           *revocation.Cache
 }
+
+// errInvalidCredentials is returned for unknown emails and wrong passwords alike so that the
+// logins do not reveal which emails are registered
+var errInvalidCredentials = status.Error(codes.Unauthenticated, "invalid email or password")
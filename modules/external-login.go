@@ -0,0 +1,186 @@
+package modules
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/actions"
+	"github.com/isaacwassouf/authentication-service/consts"
+	"github.com/isaacwassouf/authentication-service/models"
+	"github.com/isaacwassouf/authentication-service/oauth"
+	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+// GetAuthorizationUrl builds the authorization URL of any external auth provider
+func (s *UserManagementService) GetAuthorizationUrl(
+	ctx context.Context,
+	in *pb.GetAuthorizationUrlRequest,
+) (*pb.AuthorizationUrlResponse, error) {
+	authorizationURL, state, err := s.authorizationURL(ctx, in.Provider, in.RedirectUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.AuthorizationUrlResponse{Url: authorizationURL, State: state}, nil
+}
+
+// HandleExternalLogin logs in a user with the authorization code returned by any external auth provider
+func (s *UserManagementService) HandleExternalLogin(
+	ctx context.Context,
+	in *pb.ExternalLoginRequest,
+) (response *pb.ExternalLoginResponse, err error) {
+	event := newUserLoginAuditEvent(in.Provider)
+	defer func() {
+		if response != nil && response.MfaRequired {
+			event.Outcome = consts.AUDIT_OUTCOME_MFA_REQUIRED
+		}
+		s.recordAuditEvent(ctx, event, err)
+	}()
+
+	user, redirectURL, err := s.externalLogin(ctx, in.Provider, in.Code, in.State)
+	if err != nil {
+		return nil, err
+	}
+	setAuditUser(&event, user)
+
+	// the external logins honour the MFA policy like the password logins
+	login, err := s.completeLogin(ctx, user, in.Provider, in.DeviceToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.ExternalLoginResponse{
+		Message:               login.Message,
+		Token:                 login.Token,
+		RefreshToken:          login.RefreshToken,
+		RedirectUrl:           redirectURL,
+		MfaRequired:           login.MfaRequired,
+		MfaChallengeId:        login.MfaChallengeId,
+		MfaMethods:            login.MfaMethods,
+		MfaEnrollmentRequired: login.MfaEnrollmentRequired,
+		MfaEnrollmentDeadline: login.MfaEnrollmentDeadline,
+	}, nil
+}
+
+// authorizationURL stores a new login attempt and builds the URL of the provider to start it
+func (s *UserManagementService) authorizationURL(ctx context.Context, name string, redirectURL string) (string, string, error) {
+	if redirectURL != "" && !utils.IsAllowedRedirectURL(redirectURL) {
+		return "", "", status.Error(codes.InvalidArgument, "Redirect URL is not allowed")
+	}
+
+	config, provider, err := s.getActiveAuthProvider(name)
+	if err != nil {
+		return "", "", err
+	}
+
+	// check if the client_id and the redirect_url are set
+	if config.ClientID == "" || config.RedirectURL == "" {
+		return "", "", status.Error(codes.InvalidArgument, "Client ID or redirect URL are not set")
+	}
+
+	// generate and store the state, the PKCE code verifier and the nonce
+	oauthState, err := actions.CreateOAuthState(config.Name, redirectURL, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return "", "", err
+	}
+
+	authorizationURL, err := provider.AuthorizationURL(ctx, config, oauth.AuthorizationRequest{
+		ClientID:     config.ClientID,
+		RedirectURL:  config.RedirectURL,
+		State:        oauthState.State,
+		Nonce:        oauthState.Nonce,
+		CodeVerifier: oauthState.CodeVerifier,
+	})
+	if err != nil {
+		log.Printf("failed to build the authorization url of %s: %v", config.Name, err)
+		return "", "", status.Error(codes.Unavailable, "Failed to build the authorization url")
+	}
+
+	return authorizationURL, oauthState.State, nil
+}
+
+// externalLogin verifies the authorization code with the provider and returns the logged in user
+// along with the redirect requested when the login started
+func (s *UserManagementService) externalLogin(ctx context.Context, name string, code string, state string) (models.User, string, error) {
+	if code == "" {
+		return models.User{}, "", status.Error(codes.InvalidArgument, "Code is required")
+	}
+
+	config, provider, err := s.getActiveAuthProvider(name)
+	if err != nil {
+		return models.User{}, "", err
+	}
+
+	// the state must have been issued by this service for this provider
+	oauthState, err := actions.ConsumeOAuthState(config.Name, state, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return models.User{}, "", err
+	}
+
+	credentials, err := s.getAuthProviderCredentials(ctx, config.Name)
+	if err != nil {
+		return models.User{}, "", err
+	}
+
+	identity, err := oauth.Authenticate(ctx, provider, config, credentials, code, oauthState.CodeVerifier, oauthState.Nonce)
+	if err != nil {
+		log.Printf("failed to verify the %s identity: %v", config.Name, err)
+		return models.User{}, "", status.Error(codes.Unauthenticated, "Failed to verify the identity")
+	}
+
+	user, err := s.getOrCreateExternalUser(config.Name, identity)
+	if err != nil {
+		return models.User{}, "", err
+	}
+
+	return user, oauthState.RedirectURL.String, nil
+}
+
+// getActiveAuthProvider gets an active auth provider along with its implementation
+func (s *UserManagementService) getActiveAuthProvider(name string) (models.AuthProvider, oauth.Provider, error) {
+	config, err := utils.GetAuthProvider(name, s.UserManagementServiceDB.DB)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return config, nil, status.Error(codes.NotFound, "Auth provider not found")
+		}
+		return config, nil, status.Error(codes.Internal, "Failed to query the database")
+	}
+
+	if !config.Active {
+		return config, nil, status.Error(codes.PermissionDenied, "Auth provider is not active")
+	}
+
+	provider, ok := oauth.Lookup(config.Type)
+	if !ok {
+		return config, nil, status.Error(codes.Unimplemented, "Auth provider type is not supported")
+	}
+	return config, provider, nil
+}
+
+// getOrCreateExternalUser gets the user linked to an external identity, creating it on its first login
+func (s *UserManagementService) getOrCreateExternalUser(provider string, identity models.ExternalIdentity) (models.User, error) {
+	user, err := utils.GetExternalAuthUserByIdentifier(provider, identity.Identifier, s.UserManagementServiceDB.DB)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return user, status.Error(codes.Internal, "Failed to get the user")
+	}
+
+	id, err := actions.CreateExternalUser(provider, identity, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return user, err
+	}
+
+	user, err = utils.GetExternalAuthUserByID(provider, id, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return user, status.Error(codes.Internal, "Failed to get the user")
+	}
+	return user, nil
+}
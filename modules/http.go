@@ -0,0 +1,40 @@
+package modules
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// NewHTTPHandler exposes the endpoints that are consumed over plain HTTP
+func (s *UserManagementService) NewHTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/jwks.json", s.handleJWKS)
+	mux.HandleFunc("GET /.well-known/openid-configuration", s.handleOpenIDConfiguration)
+	mux.HandleFunc("GET /oauth/authorize", s.handleAuthorize)
+	mux.HandleFunc("POST /oauth/token", s.handleToken)
+	mux.HandleFunc("GET /oauth/userinfo", s.handleUserInfo)
+	mux.HandleFunc("POST /oauth/userinfo", s.handleUserInfo)
+
+	// the introspection and revocation endpoints are only served to the configured clients
+	if len(getOAuthClients()) > 0 {
+		mux.HandleFunc("POST /oauth/introspect", s.handleIntrospect)
+		mux.HandleFunc("POST /oauth/revoke", s.handleRevoke)
+	} else {
+		log.Println("OAUTH_CLIENTS is not set, the introspection and revocation endpoints are disabled")
+	}
+	return mux
+}
+
+func (s *UserManagementService) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": s.KeyManager.JWKS()})
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("failed to write the response: %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+package modules
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
+)
+
+// GetJWKS returns the public keys used to verify the issued tokens
+func (s *UserManagementService) GetJWKS(ctx context.Context, in *emptypb.Empty) (*pb.GetJWKSResponse, error) {
+	var keys []*pb.JSONWebKey
+	for _, key := range s.KeyManager.JWKS() {
+		keys = append(keys, &pb.JSONWebKey{
+			Kty: key.Kty,
+			Use: key.Use,
+			Kid: key.Kid,
+			Alg: key.Alg,
+			N:   key.N,
+			E:   key.E,
+			Crv: key.Crv,
+			X:   key.X,
+			Y:   key.Y,
+		})
+	}
+
+	return &pb.GetJWKSResponse{Keys: keys}, nil
+}
+
+// RotateSigningKeys generates a new signing key ahead of the scheduled rotation
+func (s *UserManagementService) RotateSigningKeys(ctx context.Context, in *emptypb.Empty) (*emptypb.Empty, error) {
+	if err := s.KeyManager.Rotate(ctx); err != nil {
+		return nil, status.Error(codes.Internal, "failed to rotate the signing keys")
+	}
+
+	return &emptypb.Empty{}, nil
+}
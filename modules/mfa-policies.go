@@ -0,0 +1,79 @@
+package modules
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/isaacwassouf/authentication-service/actions"
+	"github.com/isaacwassouf/authentication-service/consts"
+	"github.com/isaacwassouf/authentication-service/models"
+	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
+)
+
+// SetMFAPolicy creates or replaces the MFA policy of the global, provider, role or user scope
+func (s *UserManagementService) SetMFAPolicy(ctx context.Context, in *pb.SetMFAPolicyRequest) (response *pb.SetMFAPolicyResponse, err error) {
+	event := newAdminAuditEvent(ctx, consts.AUDIT_MFA_POLICY_SET)
+	event.Target = auditMFAPolicyTarget(in.Scope, in.ScopeValue)
+	event.Metadata["scope"] = in.Scope
+	event.Metadata["scope_value"] = in.ScopeValue
+	event.Metadata["mode"] = in.Mode
+	event.Metadata["grace_period_hours"] = strconv.FormatUint(uint64(in.GracePeriodHours), 10)
+	defer func() { s.recordAuditEvent(ctx, event, err) }()
+
+	policy, err := actions.SetMFAPolicy(in.Scope, in.ScopeValue, in.Mode, int(in.GracePeriodHours), s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.SetMFAPolicyResponse{Policy: toPbMFAPolicy(policy), Message: "MFA policy set successfully"}, nil
+}
+
+// ListMFAPolicies lists the MFA policies from the least to the most specific scope
+func (s *UserManagementService) ListMFAPolicies(ctx context.Context, in *emptypb.Empty) (*pb.ListMFAPoliciesResponse, error) {
+	policies, err := actions.ListMFAPolicies(s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &pb.ListMFAPoliciesResponse{}
+	for _, policy := range policies {
+		response.Policies = append(response.Policies, toPbMFAPolicy(policy))
+	}
+	return response, nil
+}
+
+// DeleteMFAPolicy removes a MFA policy, the logins fall back to the less specific policies
+func (s *UserManagementService) DeleteMFAPolicy(ctx context.Context, in *pb.DeleteMFAPolicyRequest) (response *pb.DeleteMFAPolicyResponse, err error) {
+	event := newAdminAuditEvent(ctx, consts.AUDIT_MFA_POLICY_DELETED)
+	event.Metadata["id"] = strconv.FormatUint(in.Id, 10)
+	defer func() { s.recordAuditEvent(ctx, event, err) }()
+
+	policy, err := actions.DeleteMFAPolicy(int(in.Id), s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+	event.Target = auditMFAPolicyTarget(policy.Scope, policy.ScopeValue)
+	event.Metadata["scope"] = policy.Scope
+	event.Metadata["scope_value"] = policy.ScopeValue
+	event.Metadata["mode"] = policy.Mode
+
+	return &pb.DeleteMFAPolicyResponse{Message: "MFA policy deleted successfully"}, nil
+}
+
+func toPbMFAPolicy(policy models.MFAPolicy) *pb.MFAPolicy {
+	pbPolicy := &pb.MFAPolicy{
+		Id:               uint64(policy.ID),
+		Scope:            policy.Scope,
+		ScopeValue:       policy.ScopeValue,
+		Mode:             policy.Mode,
+		GracePeriodHours: uint32(policy.GracePeriodHours),
+		UpdatedAt:        policy.UpdatedAt.Format(time.RFC3339),
+	}
+	if policy.EnforcedSince.Valid {
+		pbPolicy.EnforcedSince = policy.EnforcedSince.Time.Format(time.RFC3339)
+	}
+	return pbPolicy
+}
@@ -0,0 +1,274 @@
+package modules
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/actions"
+	"github.com/isaacwassouf/authentication-service/consts"
+	"github.com/isaacwassouf/authentication-service/models"
+	pbEmail "github.com/isaacwassouf/authentication-service/protobufs/email_management_service"
+	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+// completeLogin finishes a login that passed the first factor through the provider. Depending on
+// the MFA policy that applies to the user the tokens are issued right away or a MFA challenge is
+// started, the external logins go through here as well. A device token of a device the user
+// trusted skips the challenge.
+func (s *UserManagementService) completeLogin(
+	ctx context.Context,
+	user models.User,
+	provider string,
+	deviceToken string,
+) (*pb.LoginResponse, error) {
+	// a suspended user is turned away before being asked for a second factor
+	if _, err := actions.GetTokenVersion(user.ID, s.UserManagementServiceDB.DB); err != nil {
+		return nil, err
+	}
+
+	policy, err := actions.ResolveMFAPolicy(user.ID, provider, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	var methods []string
+	if policy.Mode != consts.MFA_OFF {
+		// a second factor enrolled by the user is asked for even when the policy is optional
+		methods, err = s.getEnrolledMFAMethods(user)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var enrollmentDeadline string
+	if policy.Mode == consts.MFA_REQUIRED && len(methods) == 0 {
+		deadline, err := actions.GetMFAEnrollmentDeadline(policy, user.ID, s.UserManagementServiceDB.DB)
+		if err != nil {
+			return nil, err
+		}
+		enrollmentDeadline = deadline.Format(time.RFC3339)
+
+		// past the grace period the emailed code is the second factor until one is enrolled
+		if time.Now().After(deadline) {
+			if user.Email == "" {
+				return nil, status.Error(codes.FailedPrecondition, "MFA enrollment is required")
+			}
+			methods = []string{consts.MFA_METHOD_EMAIL}
+		}
+	}
+
+	authMethod := provider
+	if len(methods) > 0 && deviceToken != "" {
+		trusted, err := s.isTrustedDevice(ctx, user, deviceToken)
+		if err != nil {
+			return nil, err
+		}
+		if trusted {
+			methods = nil
+			authMethod = provider + "," + consts.MFA_METHOD_TRUSTED_DEVICE
+		}
+	}
+
+	if len(methods) == 0 {
+		// generate a JWT token and a refresh token
+		token, refreshToken, err := s.issueTokens(ctx, user, authMethod)
+		if err != nil {
+			return nil, err
+		}
+
+		return &pb.LoginResponse{
+			Message:               "Logged in successfully",
+			Token:                 token,
+			RefreshToken:          refreshToken,
+			MfaEnrollmentRequired: enrollmentDeadline != "",
+			MfaEnrollmentDeadline: enrollmentDeadline,
+		}, nil
+	}
+
+	response, err := s.startMFAChallenge(ctx, user, provider, methods)
+	if err != nil {
+		return nil, err
+	}
+	response.MfaEnrollmentRequired = enrollmentDeadline != ""
+	response.MfaEnrollmentDeadline = enrollmentDeadline
+	return response, nil
+}
+
+// getEnrolledMFAMethods returns the second factors enrolled by the user along with the fallbacks,
+// no methods are returned when the user did not enroll any
+func (s *UserManagementService) getEnrolledMFAMethods(user models.User) ([]string, error) {
+	var methods []string
+
+	webAuthnEnabled, err := s.hasWebAuthn(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if webAuthnEnabled {
+		methods = append(methods, consts.MFA_METHOD_WEBAUTHN)
+	}
+
+	totpEnabled, err := s.hasTOTP(user.ID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to get the TOTP status")
+	}
+	if totpEnabled {
+		methods = append(methods, consts.MFA_METHOD_TOTP)
+	}
+
+	if len(methods) == 0 {
+		return nil, nil
+	}
+
+	// the recovery codes stand in for a lost authenticator
+	recoveryCodes, err := actions.CountRecoveryCodes(user.ID, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+	if recoveryCodes > 0 {
+		methods = append(methods, consts.MFA_METHOD_RECOVERY_CODE)
+	}
+
+	// the emailed code is the fallback when the authenticator is not at hand
+	if user.Email != "" {
+		methods = append(methods, consts.MFA_METHOD_EMAIL)
+	}
+	return methods, nil
+}
+
+// GenerateRecoveryCodes returns a new batch of single-use recovery codes, the previous codes of the
+// user stop working. A current TOTP code or the password is asked for so that a stolen access token
+// is not enough to get a second factor.
+func (s *UserManagementService) GenerateRecoveryCodes(
+	ctx context.Context,
+	in *pb.GenerateRecoveryCodesRequest,
+) (*pb.GenerateRecoveryCodesResponse, error) {
+	user, err := utils.GetUserByID(int(in.UserId), s.UserManagementServiceDB.DB)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, status.Error(codes.NotFound, "user not found")
+		}
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	switch {
+	case in.Code != "":
+		valid, err := s.verifyTOTP(ctx, user.ID, in.Code)
+		if err != nil {
+			return nil, err
+		}
+		if !valid {
+			return nil, status.Error(codes.InvalidArgument, "invalid code")
+		}
+	case in.Password != "":
+		if err := s.checkUserPassword(user.ID, in.Password); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, status.Error(codes.InvalidArgument, "code or password is required")
+	}
+
+	recoveryCodes, err := actions.GenerateRecoveryCodes(user.ID, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.GenerateRecoveryCodesResponse{Codes: recoveryCodes}, nil
+}
+
+// startMFAChallenge answers a login that passed the first factor with a MFA challenge that
+// ConfirmMFA completes. The email code is only sent right away when it is the sole method available.
+func (s *UserManagementService) startMFAChallenge(
+	ctx context.Context,
+	user models.User,
+	provider string,
+	methods []string,
+) (*pb.LoginResponse, error) {
+	challengeID, err := actions.CreateMFAChallenge(user.ID, provider, methods, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &pb.LoginResponse{
+		Message:        "MFA required",
+		MfaRequired:    true,
+		MfaChallengeId: challengeID,
+		MfaMethods:     methods,
+	}
+
+	if len(methods) == 1 && methods[0] == consts.MFA_METHOD_EMAIL {
+		if err := s.sendMFAEmailCode(ctx, user.Email, challengeID); err != nil {
+			return nil, err
+		}
+		response.Message = "MFA token sent successfully"
+	}
+
+	return response, nil
+}
+
+// SendMFAEmailCode emails a code for a MFA challenge, it is the fallback when the authenticator
+// app is not at hand
+func (s *UserManagementService) SendMFAEmailCode(
+	ctx context.Context,
+	in *pb.SendMFAEmailCodeRequest,
+) (*pb.SendMFAEmailCodeResponse, error) {
+	maxAttempts, err := s.getMFAMaxAttempts()
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, err := actions.GetMFAChallenge(in.MfaChallengeId, maxAttempts, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(strings.Split(challenge.Methods, ","), consts.MFA_METHOD_EMAIL) {
+		return nil, status.Error(codes.InvalidArgument, "MFA method is not available")
+	}
+
+	user, err := utils.GetUserByID(challenge.UserID, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	if err := s.sendMFAEmailCode(ctx, user.Email, in.MfaChallengeId); err != nil {
+		return nil, err
+	}
+
+	return &pb.SendMFAEmailCodeResponse{Message: "MFA token sent successfully"}, nil
+}
+
+func (s *UserManagementService) sendMFAEmailCode(ctx context.Context, email string, challengeID string) error {
+	// generate a MFA token
+	MFACode, err := utils.GenerateMFACode()
+	if err != nil {
+		return status.Error(codes.Internal, "failed to generate MFA token")
+	}
+
+	// save the MFA token on the challenge
+	if err := actions.SetMFAChallengeEmailCode(challengeID, MFACode, s.UserManagementServiceDB.DB); err != nil {
+		return err
+	}
+
+	// send the MFA token to the user
+	_, err = (*s.EmailServiceClient).SendMFAEmail(context.Background(), &pbEmail.SendEmailRequest{To: email, Token: MFACode})
+	if err != nil {
+		return status.Error(codes.Internal, "failed to send MFA token")
+	}
+
+	return nil
+}
+
+func (s *UserManagementService) getMFAMaxAttempts() (int, error) {
+	maxAttempts, err := utils.GetIntSetting("MFA_MAX_ATTEMPTS", 5, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return 0, status.Error(codes.Internal, "failed to get the MFA settings")
+	}
+	return maxAttempts, nil
+}
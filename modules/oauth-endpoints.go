@@ -0,0 +1,241 @@
+package modules
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/actions"
+	"github.com/isaacwassouf/authentication-service/models"
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+// handleIntrospect implements the token introspection of RFC 7662 for the access and refresh tokens
+func (s *UserManagementService) handleIntrospect(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticateOAuthClient(w, r) {
+		return
+	}
+
+	token := r.PostFormValue("token")
+	if token == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "token is required")
+		return
+	}
+
+	// the hint only decides which kind of token is looked up first
+	lookups := []func(context.Context, string) (map[string]interface{}, error){s.introspectAccessToken, s.introspectRefreshToken}
+	if r.PostFormValue("token_type_hint") == "refresh_token" {
+		lookups = []func(context.Context, string) (map[string]interface{}, error){s.introspectRefreshToken, s.introspectAccessToken}
+	}
+
+	for _, lookup := range lookups {
+		response, err := lookup(r.Context(), token)
+		if err != nil {
+			writeOAuthError(w, http.StatusInternalServerError, "server_error", "failed to introspect the token")
+			return
+		}
+		if response != nil {
+			w.Header().Set("Cache-Control", "no-store")
+			writeJSON(w, http.StatusOK, response)
+			return
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{"active": false})
+}
+
+// handleRevoke implements the token revocation of RFC 7009. Revoking a refresh token logs out of
+// the session it belongs to, revoking an access token blacklists it.
+func (s *UserManagementService) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticateOAuthClient(w, r) {
+		return
+	}
+
+	token := r.PostFormValue("token")
+	if token == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "token is required")
+		return
+	}
+
+	revokes := []func(context.Context, string) (bool, error){s.revokeAccessToken, s.revokeRefreshToken}
+	if r.PostFormValue("token_type_hint") == "refresh_token" {
+		revokes = []func(context.Context, string) (bool, error){s.revokeRefreshToken, s.revokeAccessToken}
+	}
+
+	for _, revoke := range revokes {
+		revoked, err := revoke(r.Context(), token)
+		if err != nil {
+			writeOAuthError(w, http.StatusServiceUnavailable, "server_error", "failed to revoke the token")
+			return
+		}
+		if revoked {
+			break
+		}
+	}
+
+	// the unknown and the invalid tokens are answered the same way as the revoked ones
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *UserManagementService) introspectAccessToken(ctx context.Context, token string) (map[string]interface{}, error) {
+	claims, err := utils.ParseAccessToken(token, utils.AccessTokenAudience(), s.KeyManager)
+	if err != nil {
+		return nil, nil
+	}
+
+	if claims.ServiceAccount != nil {
+		return map[string]interface{}{
+			"active":          true,
+			"token_type":      "Bearer",
+			"sub":             claims.Subject,
+			"client_id":       claims.ServiceAccount.ClientID,
+			"scope":           claims.Scope,
+			"aud":             claims.Audience,
+			"exp":             claims.ExpiresAt.Unix(),
+			"iat":             claims.IssuedAt.Unix(),
+			"jti":             claims.ID,
+			"service_account": true,
+		}, nil
+	}
+
+	var revoked bool
+	if claims.User.IsAdmin {
+		revoked, err = s.isAdminTokenRevoked(ctx, claims.User.ID, claims.ID, claims.Version)
+	} else {
+		revoked, err = s.RevocationCache.IsRevoked(ctx, claims.User.ID, claims.ID, claims.Version)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return map[string]interface{}{"active": false}, nil
+	}
+
+	response := map[string]interface{}{
+		"active":     true,
+		"token_type": "Bearer",
+		"sub":        strconv.Itoa(claims.User.ID),
+		"username":   claims.User.Email,
+		"aud":        claims.Audience,
+		"exp":        claims.ExpiresAt.Unix(),
+		"iat":        claims.IssuedAt.Unix(),
+		"is_admin":   claims.User.IsAdmin,
+	}
+	if claims.ID != "" {
+		response["jti"] = claims.ID
+	}
+	if claims.Scope != "" {
+		response["scope"] = claims.Scope
+	}
+	if len(claims.User.Roles) > 0 {
+		response["roles"] = claims.User.Roles
+	}
+	if len(claims.User.Permissions) > 0 {
+		response["permissions"] = claims.User.Permissions
+	}
+	return response, nil
+}
+
+func (s *UserManagementService) introspectRefreshToken(ctx context.Context, token string) (map[string]interface{}, error) {
+	refreshToken, err := actions.GetRefreshToken(token, s.UserManagementServiceDB.DB)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if refreshToken.UsedAt.Valid || refreshToken.RevokedAt.Valid || time.Now().After(refreshToken.ExpiresAt) {
+		return map[string]interface{}{"active": false}, nil
+	}
+
+	return map[string]interface{}{
+		"active":     true,
+		"token_type": "refresh_token",
+		"sub":        strconv.Itoa(refreshToken.UserID),
+		"exp":        refreshToken.ExpiresAt.Unix(),
+		"iat":        refreshToken.CreatedAt.Unix(),
+	}, nil
+}
+
+func (s *UserManagementService) revokeAccessToken(ctx context.Context, token string) (bool, error) {
+	// the service account tokens are not blacklisted, they expire on their own
+	claims, err := utils.ParseAccessToken(token, utils.AccessTokenAudience(), s.KeyManager)
+	if err != nil || claims.ID == "" || claims.ServiceAccount != nil {
+		return false, nil
+	}
+
+	var blacklisted models.BlacklistedToken
+	if claims.User.IsAdmin {
+		blacklisted, err = actions.BlacklistAdminToken(claims.User.ID, claims.ID, claims.ExpiresAt.Time, s.UserManagementServiceDB.DB)
+	} else {
+		blacklisted, err = actions.BlacklistToken(claims.User.ID, claims.ID, s.UserManagementServiceDB.DB)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, s.RevocationCache.Revoke(ctx, blacklisted)
+}
+
+func (s *UserManagementService) revokeRefreshToken(ctx context.Context, token string) (bool, error) {
+	refreshToken, err := actions.GetRefreshToken(token, s.UserManagementServiceDB.DB)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return false, nil
+		}
+		return false, err
+	}
+
+	// the access tokens issued from the same login are revoked along with the refresh token
+	tokens, err := actions.RevokeSessionFamily(refreshToken.UserID, refreshToken.FamilyID, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return false, err
+	}
+	return true, s.RevocationCache.Revoke(ctx, tokens...)
+}
+
+// authenticateOAuthClient checks the credentials of the caller of the introspection and revocation
+// endpoints, sent with HTTP basic authentication or in the form
+func (s *UserManagementService) authenticateOAuthClient(w http.ResponseWriter, r *http.Request) bool {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+
+	authenticated := false
+	if clientID != "" && clientSecret != "" {
+		secret, found := getOAuthClients()[clientID]
+		authenticated = found && subtle.ConstantTimeCompare([]byte(secret), []byte(clientSecret)) == 1
+	}
+
+	if !authenticated {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+	}
+	return authenticated
+}
+
+// getOAuthClients returns the secrets of the clients configured in OAUTH_CLIENTS as a comma
+// separated list of client_id:client_secret, the entries without a secret are skipped
+func getOAuthClients() map[string]string {
+	clients := map[string]string{}
+	for _, client := range strings.Split(utils.GetEnvVar("OAUTH_CLIENTS", ""), ",") {
+		id, secret, found := strings.Cut(strings.TrimSpace(client), ":")
+		if found && id != "" && secret != "" {
+			clients[id] = secret
+		}
+	}
+	return clients
+}
+
+func writeOAuthError(w http.ResponseWriter, statusCode int, code string, description string) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, statusCode, map[string]string{"error": code, "error_description": description})
+}
@@ -0,0 +1,127 @@
+package modules
+
+import (
+	"context"
+	"net/url"
+	"slices"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/actions"
+	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
+)
+
+// GetOIDCAuthorization describes an authorization request of a client to the login page. The page
+// logs the user in with LoginUser, and ConfirmMFA when a second factor is asked for, then asks for
+// their consent unless they already gave it for every requested scope.
+func (s *UserManagementService) GetOIDCAuthorization(
+	ctx context.Context,
+	in *pb.GetOIDCAuthorizationRequest,
+) (*pb.GetOIDCAuthorizationResponse, error) {
+	authorization, err := actions.GetOIDCAuthorization(in.RequestId, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := actions.GetOIDCClientByID(authorization.ClientID, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	granted, err := actions.GetOIDCConsent(int(in.UserId), client.ID, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	scopes := strings.Fields(authorization.Scope)
+	consentRequired := false
+	for _, scope := range scopes {
+		if !slices.Contains(granted, scope) {
+			consentRequired = true
+		}
+	}
+
+	return &pb.GetOIDCAuthorizationResponse{
+		ClientName:      client.Name,
+		Scopes:          scopes,
+		ConsentRequired: consentRequired,
+	}, nil
+}
+
+// CompleteOIDCAuthorization approves or denies an authorization request on behalf of the logged
+// in user and returns the URL of the client the login page redirects to. An approval records the
+// consent of the user and issues the authorization code, the login of the access token the user
+// presented is the one the ID token describes.
+func (s *UserManagementService) CompleteOIDCAuthorization(
+	ctx context.Context,
+	in *pb.CompleteOIDCAuthorizationRequest,
+) (*pb.CompleteOIDCAuthorizationResponse, error) {
+	authorization, err := actions.GetOIDCAuthorization(in.RequestId, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+	if authorization.State != "" {
+		params.Set("state", authorization.State)
+	}
+
+	if !in.Approve {
+		if err := actions.DenyOIDCAuthorization(in.RequestId, s.UserManagementServiceDB.DB); err != nil {
+			return nil, err
+		}
+		params.Set("error", "access_denied")
+		params.Set("error_description", "the user denied the request")
+		return &pb.CompleteOIDCAuthorizationResponse{RedirectUrl: oidcRedirectURL(authorization.RedirectURI, params)}, nil
+	}
+
+	if in.Jti == "" {
+		return nil, status.Error(codes.InvalidArgument, "jti is required")
+	}
+	authMethod, authTime, err := actions.GetSessionLogin(int(in.UserId), in.Jti, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	err = actions.GrantOIDCConsent(
+		int(in.UserId),
+		authorization.ClientID,
+		strings.Fields(authorization.Scope),
+		s.UserManagementServiceDB.DB,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	code, err := actions.ApproveOIDCAuthorization(
+		in.RequestId,
+		int(in.UserId),
+		authMethod,
+		authTime,
+		s.UserManagementServiceDB.DB,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	params.Set("code", code)
+	return &pb.CompleteOIDCAuthorizationResponse{RedirectUrl: oidcRedirectURL(authorization.RedirectURI, params)}, nil
+}
+
+// oidcRedirectURL adds the parameters of the response to the redirect URI of the client
+func oidcRedirectURL(redirectURI string, params url.Values) string {
+	parsed, err := url.Parse(redirectURI)
+	if err != nil {
+		// the redirect URIs were validated when the client was registered
+		return redirectURI
+	}
+
+	query := parsed.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
@@ -0,0 +1,102 @@
+package modules
+
+import (
+	"context"
+	"net/url"
+	"slices"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/isaacwassouf/authentication-service/actions"
+	"github.com/isaacwassouf/authentication-service/consts"
+	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
+)
+
+// oidcScopes are the scopes the clients of the OpenID Connect provider can be registered for
+var oidcScopes = []string{
+	consts.OIDC_SCOPE_OPENID,
+	consts.OIDC_SCOPE_PROFILE,
+	consts.OIDC_SCOPE_EMAIL,
+	consts.OIDC_SCOPE_OFFLINE_ACCESS,
+}
+
+// RegisterOIDCClient registers an application that logs its users in against the service, the
+// secret of a confidential client is only returned here
+func (s *UserManagementService) RegisterOIDCClient(
+	ctx context.Context,
+	in *pb.RegisterOIDCClientRequest,
+) (*pb.RegisterOIDCClientResponse, error) {
+	if in.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "Name is required")
+	}
+	if len(in.RedirectUris) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "At least one redirect URI is required")
+	}
+	for _, redirectURI := range in.RedirectUris {
+		parsed, err := url.Parse(redirectURI)
+		if err != nil || !parsed.IsAbs() || parsed.Host == "" || parsed.Fragment != "" {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid redirect URI %q", redirectURI)
+		}
+	}
+
+	scopes := in.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{consts.OIDC_SCOPE_OPENID, consts.OIDC_SCOPE_PROFILE, consts.OIDC_SCOPE_EMAIL}
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(oidcScopes, scope) {
+			return nil, status.Errorf(codes.InvalidArgument, "Unsupported scope %q", scope)
+		}
+	}
+	if !slices.Contains(scopes, consts.OIDC_SCOPE_OPENID) {
+		return nil, status.Error(codes.InvalidArgument, "The openid scope is required")
+	}
+
+	clientID, clientSecret, err := actions.CreateOIDCClient(in.Name, in.RedirectUris, scopes, in.Public, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.RegisterOIDCClientResponse{
+		ClientId:     clientID,
+		ClientSecret: clientSecret,
+		Message:      "Client registered successfully",
+	}, nil
+}
+
+// ListOIDCClients lists the applications registered with the OpenID Connect provider
+func (s *UserManagementService) ListOIDCClients(ctx context.Context, in *emptypb.Empty) (*pb.ListOIDCClientsResponse, error) {
+	clients, err := actions.ListOIDCClients(s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &pb.ListOIDCClientsResponse{}
+	for _, client := range clients {
+		response.Clients = append(response.Clients, &pb.OIDCClient{
+			ClientId:     client.ClientID,
+			Name:         client.Name,
+			RedirectUris: client.RedirectURIs,
+			Scopes:       client.Scopes,
+			Public:       client.IsPublic(),
+			CreatedAt:    client.CreatedAt.Format(time.RFC3339),
+		})
+	}
+
+	return response, nil
+}
+
+// DeleteOIDCClient unregisters an application, its users can no longer log in to it
+func (s *UserManagementService) DeleteOIDCClient(
+	ctx context.Context,
+	in *pb.DeleteOIDCClientRequest,
+) (*pb.DeleteOIDCClientResponse, error) {
+	if err := actions.DeleteOIDCClient(in.ClientId, s.UserManagementServiceDB.DB); err != nil {
+		return nil, err
+	}
+
+	return &pb.DeleteOIDCClientResponse{Message: "Client deleted successfully"}, nil
+}
@@ -0,0 +1,382 @@
+package modules
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/matoous/go-nanoid/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/actions"
+	"github.com/isaacwassouf/authentication-service/consts"
+	"github.com/isaacwassouf/authentication-service/models"
+	"github.com/isaacwassouf/authentication-service/oauth"
+	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+// handleOpenIDConfiguration serves the discovery document of the OpenID Connect provider
+func (s *UserManagementService) handleOpenIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	issuer := utils.OIDCIssuer()
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/oauth/authorize",
+		"token_endpoint":                        issuer + "/oauth/token",
+		"userinfo_endpoint":                     issuer + "/oauth/userinfo",
+		"jwks_uri":                              issuer + "/.well-known/jwks.json",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token", "client_credentials"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": s.KeyManager.Algorithms(),
+		"scopes_supported":                      oidcScopes,
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported": []string{
+			"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "amr", "name", "email", "email_verified",
+		},
+	})
+}
+
+// handleAuthorize starts the authorization code flow of a client. PKCE is required of every client.
+// The request is recorded and the user sent to the login page, which completes it with
+// CompleteOIDCAuthorization once the user logged in.
+func (s *UserManagementService) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	client, err := actions.GetOIDCClient(query.Get("client_id"), s.UserManagementServiceDB.DB)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_request", "unknown client")
+			return
+		}
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "failed to get the client")
+		return
+	}
+
+	// the errors are only reported to a redirect URI registered for the client
+	redirectURI := query.Get("redirect_uri")
+	if !slices.Contains(client.RedirectURIs, redirectURI) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "redirect_uri is not registered for the client")
+		return
+	}
+
+	state := query.Get("state")
+	redirectError := func(code string, description string) {
+		params := url.Values{"error": {code}, "error_description": {description}}
+		if state != "" {
+			params.Set("state", state)
+		}
+		http.Redirect(w, r, oidcRedirectURL(redirectURI, params), http.StatusFound)
+	}
+
+	if query.Get("response_type") != "code" {
+		redirectError("unsupported_response_type", "only the code response type is supported")
+		return
+	}
+
+	scopes := strings.Fields(query.Get("scope"))
+	if !slices.Contains(scopes, consts.OIDC_SCOPE_OPENID) {
+		redirectError("invalid_scope", "the openid scope is required")
+		return
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(client.Scopes, scope) {
+			redirectError("invalid_scope", "the client is not allowed the "+scope+" scope")
+			return
+		}
+	}
+
+	if query.Get("code_challenge") == "" || query.Get("code_challenge_method") != "S256" {
+		redirectError("invalid_request", "a S256 code challenge is required")
+		return
+	}
+
+	requestID, err := actions.CreateOIDCAuthorization(models.OIDCAuthorization{
+		ClientID:      client.ID,
+		RedirectURI:   redirectURI,
+		Scope:         strings.Join(scopes, " "),
+		State:         state,
+		Nonce:         query.Get("nonce"),
+		CodeChallenge: query.Get("code_challenge"),
+	}, s.UserManagementServiceDB.DB)
+	if err != nil {
+		redirectError("server_error", "failed to save the authorization request")
+		return
+	}
+
+	loginURL, err := url.Parse(utils.GetEnvVar("OIDC_LOGIN_URL", "http://localhost:5173/oidc/login"))
+	if err != nil {
+		redirectError("server_error", "the login page is misconfigured")
+		return
+	}
+	loginQuery := loginURL.Query()
+	loginQuery.Set("request_id", requestID)
+	loginURL.RawQuery = loginQuery.Encode()
+
+	http.Redirect(w, r, loginURL.String(), http.StatusFound)
+}
+
+// handleToken exchanges an authorization code or a refresh token for the tokens of the user, or
+// the credentials of a service account for its access token
+func (s *UserManagementService) handleToken(w http.ResponseWriter, r *http.Request) {
+	// the service accounts are not OpenID Connect clients
+	if r.PostFormValue("grant_type") == "client_credentials" {
+		s.exchangeClientCredentials(w, r)
+		return
+	}
+
+	client, ok := s.authenticateOIDCClient(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.PostFormValue("grant_type") {
+	case "authorization_code":
+		s.exchangeAuthorizationCode(w, r, client)
+	case "refresh_token":
+		s.exchangeRefreshToken(w, r, client)
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "unsupported grant type")
+	}
+}
+
+// handleUserInfo returns the claims about the user an access token was issued to, only the claims
+// of the scopes granted to the client are released
+func (s *UserManagementService) handleUserInfo(w http.ResponseWriter, r *http.Request) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="userinfo"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_request", "a bearer token is required")
+		return
+	}
+
+	validated, err := s.ValidateToken(r.Context(), &pb.ValidateTokenRequest{Token: token, Audience: utils.UserInfoAudience()})
+	if err != nil || validated.User == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="userinfo", error="invalid_token"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_token", "the access token is invalid")
+		return
+	}
+
+	// the tokens issued to the OpenID Connect clients always carry a scope
+	scopes := strings.Fields(validated.Scope)
+	if !slices.Contains(scopes, consts.OIDC_SCOPE_OPENID) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="userinfo", error="insufficient_scope"`)
+		writeOAuthError(w, http.StatusForbidden, "insufficient_scope", "the access token was not granted the openid scope")
+		return
+	}
+
+	user := models.User{
+		ID:       int(validated.User.Id),
+		Name:     validated.User.Name,
+		Email:    validated.User.Email,
+		Verified: validated.User.Verified,
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, struct {
+		Subject string `json:"sub"`
+		utils.OIDCUserClaims
+	}{
+		Subject:        strconv.Itoa(user.ID),
+		OIDCUserClaims: utils.NewOIDCUserClaims(user, scopes),
+	})
+}
+
+func (s *UserManagementService) exchangeAuthorizationCode(w http.ResponseWriter, r *http.Request, client models.OIDCClient) {
+	authorization, err := actions.ConsumeOIDCAuthorizationCode(r.PostFormValue("code"), client.ID, s.UserManagementServiceDB.DB)
+	if err != nil {
+		if status.Code(err) == codes.InvalidArgument {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", status.Convert(err).Message())
+			return
+		}
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "failed to exchange the authorization code")
+		return
+	}
+
+	if authorization.RedirectURI != r.PostFormValue("redirect_uri") {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "redirect_uri does not match the authorization request")
+		return
+	}
+	codeVerifier := r.PostFormValue("code_verifier")
+	if codeVerifier == "" || oauth.CodeChallenge(codeVerifier) != authorization.CodeChallenge {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "code_verifier does not match the code challenge")
+		return
+	}
+
+	user, err := utils.GetUserByID(int(authorization.UserID.Int64), s.UserManagementServiceDB.DB)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "user not found")
+			return
+		}
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "failed to get the user")
+		return
+	}
+
+	// the tokens are recorded as a new session with the auth method of the login of the user, a
+	// refresh token bound to the client is only issued for offline access
+	scopes := strings.Fields(authorization.Scope)
+	familyID, err := gonanoid.New()
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "failed to generate the refresh token family")
+		return
+	}
+	token, err := s.generateToken(r.Context(), user, familyID, authorization.AuthMethod, authorization.Scope)
+	if err != nil {
+		writeTokenError(w, err)
+		return
+	}
+	var refreshToken string
+	if slices.Contains(scopes, consts.OIDC_SCOPE_OFFLINE_ACCESS) {
+		refreshToken, err = actions.CreateOIDCRefreshToken(user.ID, familyID, client.ID, s.UserManagementServiceDB.DB)
+		if err != nil {
+			writeTokenError(w, err)
+			return
+		}
+	}
+
+	idToken, err := utils.GenerateIDToken(
+		user,
+		client.ClientID,
+		authorization.Nonce,
+		authorization.AuthTime.Time,
+		strings.Split(authorization.AuthMethod, ","),
+		scopes,
+		s.KeyManager,
+	)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "failed to generate the ID token")
+		return
+	}
+
+	response := map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(utils.AccessTokenTTL.Seconds()),
+		"id_token":     idToken,
+		"scope":        authorization.Scope,
+	}
+	if refreshToken != "" {
+		response["refresh_token"] = refreshToken
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *UserManagementService) exchangeRefreshToken(w http.ResponseWriter, r *http.Request, client models.OIDCClient) {
+	refreshToken := r.PostFormValue("refresh_token")
+	if refreshToken == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "refresh_token is required")
+		return
+	}
+
+	// the refresh token has to be issued to the client that presents it
+	refreshed, err := s.refreshTokens(r.Context(), refreshToken, sql.NullInt64{Int64: int64(client.ID), Valid: true})
+	if err != nil {
+		writeTokenError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token":  refreshed.Token,
+		"token_type":    "Bearer",
+		"expires_in":    int(utils.AccessTokenTTL.Seconds()),
+		"refresh_token": refreshed.RefreshToken,
+	})
+}
+
+func (s *UserManagementService) exchangeClientCredentials(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+
+	issued, err := s.GetServiceAccountToken(r.Context(), &pb.GetServiceAccountTokenRequest{
+		ClientId:     clientID,
+		ClientSecret: clientSecret,
+		Scope:        r.PostFormValue("scope"),
+	})
+	if err != nil {
+		switch status.Code(err) {
+		case codes.Unauthenticated:
+			w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+			writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		case codes.PermissionDenied:
+			writeOAuthError(w, http.StatusBadRequest, "invalid_scope", status.Convert(err).Message())
+		default:
+			writeOAuthError(w, http.StatusInternalServerError, "server_error", "failed to issue the token")
+		}
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": issued.Token,
+		"token_type":   "Bearer",
+		"expires_in":   int(utils.ServiceAccountTokenTTL.Seconds()),
+		"scope":        issued.Scope,
+	})
+}
+
+// authenticateOIDCClient identifies the client calling the token endpoint. The confidential clients
+// authenticate with their secret, sent with HTTP basic authentication or in the form, the public
+// clients only send their client id and are held to PKCE instead.
+func (s *UserManagementService) authenticateOIDCClient(w http.ResponseWriter, r *http.Request) (models.OIDCClient, bool) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+
+	fail := func() (models.OIDCClient, bool) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return models.OIDCClient{}, false
+	}
+
+	if clientID == "" {
+		return fail()
+	}
+	client, err := actions.GetOIDCClient(clientID, s.UserManagementServiceDB.DB)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return fail()
+		}
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "failed to get the client")
+		return client, false
+	}
+
+	if client.IsPublic() {
+		if clientSecret != "" {
+			return fail()
+		}
+		return client, true
+	}
+
+	valid, err := actions.CheckOIDCClientSecret(client, clientSecret)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "failed to check the client secret")
+		return client, false
+	}
+	if !valid {
+		return fail()
+	}
+	return client, true
+}
+
+// writeTokenError maps the errors of issuing the tokens of a user to the errors of the token
+// endpoint, e.g., a suspended user or a reused refresh token is an invalid grant
+func writeTokenError(w http.ResponseWriter, err error) {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.Unauthenticated, codes.NotFound, codes.PermissionDenied:
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", status.Convert(err).Message())
+	default:
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "failed to issue the tokens")
+	}
+}
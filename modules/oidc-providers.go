@@ -0,0 +1,127 @@
+package modules
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"regexp"
+
+	sq "github.com/Masterminds/squirrel"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/consts"
+	"github.com/isaacwassouf/authentication-service/oauth"
+	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
+)
+
+var providerNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{1,62}$`)
+
+// CreateAuthProvider registers an external auth provider of any type known to the provider registry
+func (s *UserManagementService) CreateAuthProvider(
+	ctx context.Context,
+	in *pb.CreateAuthProviderRequest,
+) (*pb.CreateAuthProviderResponse, error) {
+	if !providerNameRegex.MatchString(in.Name) {
+		return nil, status.Error(codes.InvalidArgument, "Name must be lowercase letters, digits, dashes or underscores")
+	}
+	provider, ok := oauth.Lookup(in.Type)
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "Unsupported auth provider type")
+	}
+
+	// only the generic OpenID Connect providers are configured through an issuer
+	issuerURL := sql.NullString{}
+	if provider.Type() == consts.OIDC {
+		if in.IssuerUrl == "" {
+			return nil, status.Error(codes.InvalidArgument, "Issuer URL is required")
+		}
+
+		// make sure the issuer is a reachable OpenID Connect provider
+		_, err := oauth.Discover(ctx, in.IssuerUrl)
+		if err != nil {
+			log.Printf("failed to discover %s: %v", in.IssuerUrl, err)
+			return nil, status.Error(codes.InvalidArgument, "Failed to fetch the discovery document of the issuer")
+		}
+		issuerURL = sql.NullString{String: in.IssuerUrl, Valid: true}
+	}
+
+	var count int
+	err := sq.Select("COUNT(*)").
+		From("auth_providers").
+		Where(sq.Eq{"name": in.Name}).
+		RunWith(s.UserManagementServiceDB.DB).
+		QueryRow().
+		Scan(&count)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed query the database")
+	}
+	if count > 0 {
+		return nil, status.Error(codes.AlreadyExists, "Auth provider already exists")
+	}
+
+	scopes := in.Scopes
+	if scopes == "" {
+		scopes = provider.Scopes()
+	}
+
+	tx, err := s.UserManagementServiceDB.DB.Begin()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	result, err := sq.Insert("auth_providers").
+		Columns("name", "type", "issuer_url", "scopes").
+		Values(in.Name, provider.Type(), issuerURL, scopes).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to insert the auth provider")
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to get the last inserted id")
+	}
+
+	// the credentials are set afterwards with SetAuthProviderCredentials
+	_, err = sq.Insert("auth_providers_details").
+		Columns("auth_provider_id").
+		Values(id).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to insert the auth provider details")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, status.Error(codes.Internal, "Failed to commit transaction")
+	}
+
+	return &pb.CreateAuthProviderResponse{Id: uint64(id), Message: "Auth provider created successfully"}, nil
+}
+
+// DeleteAuthProvider deletes an auth provider registered by an admin
+func (s *UserManagementService) DeleteAuthProvider(
+	ctx context.Context,
+	in *pb.DeleteAuthProviderRequest,
+) (*pb.DeleteAuthProviderResponse, error) {
+	result, err := sq.Delete("auth_providers").
+		Where(sq.Eq{"id": in.AuthProviderId}).
+		RunWith(s.UserManagementServiceDB.DB).
+		Exec()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to delete the auth provider")
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to delete the auth provider")
+	}
+	if affected == 0 {
+		return nil, status.Error(codes.NotFound, "Auth provider not found")
+	}
+
+	return &pb.DeleteAuthProviderResponse{Message: "Auth provider deleted successfully"}, nil
+}
@@ -0,0 +1,194 @@
+package modules
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/isaacwassouf/authentication-service/actions"
+	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
+)
+
+var (
+	roleNameRegex       = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{1,62}$`)
+	permissionNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9:._-]{0,127}$`)
+)
+
+// CreateRole creates a role, permissions are then granted to it with GrantPermission
+func (s *UserManagementService) CreateRole(ctx context.Context, in *pb.CreateRoleRequest) (*pb.CreateRoleResponse, error) {
+	if !roleNameRegex.MatchString(in.Name) {
+		return nil, status.Error(codes.InvalidArgument, "Name must be lowercase letters, digits, dashes or underscores")
+	}
+
+	id, err := actions.CreateRole(in.Name, in.Description, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.CreateRoleResponse{Id: uint64(id), Message: "Role created successfully"}, nil
+}
+
+// ListRoles lists the roles and the permissions granted to them
+func (s *UserManagementService) ListRoles(ctx context.Context, in *emptypb.Empty) (*pb.ListRolesResponse, error) {
+	roles, err := actions.ListRoles(s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &pb.ListRolesResponse{}
+	for _, role := range roles {
+		response.Roles = append(response.Roles, &pb.Role{
+			Id:          uint64(role.ID),
+			Name:        role.Name,
+			Description: role.Description,
+			Permissions: role.Permissions,
+			CreatedAt:   role.CreatedAt.Format(time.RFC3339),
+		})
+	}
+
+	return response, nil
+}
+
+// DeleteRole deletes a role and unassigns it from its users, the access tokens that carry it are
+// revoked
+func (s *UserManagementService) DeleteRole(ctx context.Context, in *pb.DeleteRoleRequest) (*pb.DeleteRoleResponse, error) {
+	userIDs, err := actions.DeleteRole(in.Name, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.invalidateUsersTokens(ctx, userIDs); err != nil {
+		return nil, err
+	}
+
+	return &pb.DeleteRoleResponse{Message: "Role deleted successfully"}, nil
+}
+
+// CreatePermission creates a permission the product services can check, e.g., orders:write
+func (s *UserManagementService) CreatePermission(
+	ctx context.Context,
+	in *pb.CreatePermissionRequest,
+) (*pb.CreatePermissionResponse, error) {
+	if !permissionNameRegex.MatchString(in.Name) {
+		return nil, status.Error(codes.InvalidArgument, "Name must be lowercase letters, digits, colons, dots, dashes or underscores")
+	}
+
+	id, err := actions.CreatePermission(in.Name, in.Description, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.CreatePermissionResponse{Id: uint64(id), Message: "Permission created successfully"}, nil
+}
+
+// ListPermissions lists the permissions
+func (s *UserManagementService) ListPermissions(ctx context.Context, in *emptypb.Empty) (*pb.ListPermissionsResponse, error) {
+	permissions, err := actions.ListPermissions(s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &pb.ListPermissionsResponse{}
+	for _, permission := range permissions {
+		response.Permissions = append(response.Permissions, &pb.Permission{
+			Id:          uint64(permission.ID),
+			Name:        permission.Name,
+			Description: permission.Description,
+			CreatedAt:   permission.CreatedAt.Format(time.RFC3339),
+		})
+	}
+
+	return response, nil
+}
+
+// DeletePermission deletes a permission and revokes it from every role, the access tokens that
+// carry it are revoked
+func (s *UserManagementService) DeletePermission(
+	ctx context.Context,
+	in *pb.DeletePermissionRequest,
+) (*pb.DeletePermissionResponse, error) {
+	userIDs, err := actions.DeletePermission(in.Name, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.invalidateUsersTokens(ctx, userIDs); err != nil {
+		return nil, err
+	}
+
+	return &pb.DeletePermissionResponse{Message: "Permission deleted successfully"}, nil
+}
+
+// GrantPermission grants a permission to a role
+func (s *UserManagementService) GrantPermission(
+	ctx context.Context,
+	in *pb.GrantPermissionRequest,
+) (*pb.GrantPermissionResponse, error) {
+	if err := actions.GrantPermission(in.Role, in.Permission, s.UserManagementServiceDB.DB); err != nil {
+		return nil, err
+	}
+
+	return &pb.GrantPermissionResponse{Message: "Permission granted successfully"}, nil
+}
+
+// RevokePermission revokes a permission from a role, the access tokens of the users the role is
+// assigned to are revoked
+func (s *UserManagementService) RevokePermission(
+	ctx context.Context,
+	in *pb.RevokePermissionRequest,
+) (*pb.RevokePermissionResponse, error) {
+	userIDs, err := actions.RevokePermission(in.Role, in.Permission, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.invalidateUsersTokens(ctx, userIDs); err != nil {
+		return nil, err
+	}
+
+	return &pb.RevokePermissionResponse{Message: "Permission revoked successfully"}, nil
+}
+
+// AssignRole assigns a role to a user, the tokens issued to the user from now on carry it along
+// with its permissions
+func (s *UserManagementService) AssignRole(ctx context.Context, in *pb.AssignRoleRequest) (*pb.AssignRoleResponse, error) {
+	if err := actions.AssignRole(int(in.UserId), in.Role, s.UserManagementServiceDB.DB); err != nil {
+		return nil, err
+	}
+
+	return &pb.AssignRoleResponse{Message: "Role assigned successfully"}, nil
+}
+
+// UnassignRole removes a role from a user and revokes the access tokens that carry it, the user
+// refreshes them to get tokens without the role
+func (s *UserManagementService) UnassignRole(ctx context.Context, in *pb.UnassignRoleRequest) (*pb.UnassignRoleResponse, error) {
+	if err := actions.UnassignRole(int(in.UserId), in.Role, s.UserManagementServiceDB.DB); err != nil {
+		return nil, err
+	}
+	if err := s.invalidateUserTokens(ctx, int(in.UserId)); err != nil {
+		return nil, err
+	}
+
+	return &pb.UnassignRoleResponse{Message: "Role unassigned successfully"}, nil
+}
+
+// ListUserRoles lists the roles assigned to a user and the permissions they grant
+func (s *UserManagementService) ListUserRoles(ctx context.Context, in *pb.ListUserRolesRequest) (*pb.ListUserRolesResponse, error) {
+	roles, permissions, err := actions.GetUserRoles(int(in.UserId), s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.ListUserRolesResponse{Roles: roles, Permissions: permissions}, nil
+}
+
+// invalidateUsersTokens is invalidateUserTokens for the users of a role
+func (s *UserManagementService) invalidateUsersTokens(ctx context.Context, userIDs []int) error {
+	for _, userID := range userIDs {
+		if err := s.invalidateUserTokens(ctx, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package modules
+
+import (
+	"context"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/isaacwassouf/authentication-service/actions"
+	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+var serviceAccountScopeRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9:._-]{0,127}$`)
+
+// CreateServiceAccount creates a service account for a backend job, the secret is only returned here
+func (s *UserManagementService) CreateServiceAccount(
+	ctx context.Context,
+	in *pb.CreateServiceAccountRequest,
+) (*pb.CreateServiceAccountResponse, error) {
+	if in.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "Name is required")
+	}
+	if in.Owner == "" {
+		return nil, status.Error(codes.InvalidArgument, "Owner is required")
+	}
+	for _, scope := range in.Scopes {
+		if !serviceAccountScopeRegex.MatchString(scope) {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid scope %q", scope)
+		}
+	}
+
+	clientID, clientSecret, err := actions.CreateServiceAccount(in.Name, in.Owner, in.Scopes, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.CreateServiceAccountResponse{
+		ClientId:     clientID,
+		ClientSecret: clientSecret,
+		Message:      "Service account created successfully",
+	}, nil
+}
+
+// ListServiceAccounts lists the service accounts
+func (s *UserManagementService) ListServiceAccounts(ctx context.Context, in *emptypb.Empty) (*pb.ListServiceAccountsResponse, error) {
+	accounts, err := actions.ListServiceAccounts(s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &pb.ListServiceAccountsResponse{}
+	for _, account := range accounts {
+		response.ServiceAccounts = append(response.ServiceAccounts, &pb.ServiceAccount{
+			ClientId:  account.ClientID,
+			Name:      account.Name,
+			Owner:     account.Owner,
+			Scopes:    account.Scopes,
+			CreatedAt: account.CreatedAt.Format(time.RFC3339),
+		})
+	}
+
+	return response, nil
+}
+
+// RotateServiceAccountSecret issues a new secret to a service account, the previous secrets keep
+// working for the overlap given in seconds or SERVICE_ACCOUNT_SECRET_OVERLAP by default
+func (s *UserManagementService) RotateServiceAccountSecret(
+	ctx context.Context,
+	in *pb.RotateServiceAccountSecretRequest,
+) (*pb.RotateServiceAccountSecretResponse, error) {
+	overlap := time.Duration(in.OverlapSeconds) * time.Second
+	if in.OverlapSeconds == 0 {
+		var err error
+		overlap, err = utils.GetDurationSetting("SERVICE_ACCOUNT_SECRET_OVERLAP", time.Hour*24, s.UserManagementServiceDB.DB)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "failed to get the secret overlap")
+		}
+	}
+
+	clientSecret, previousExpiresAt, err := actions.RotateServiceAccountSecret(in.ClientId, overlap, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.RotateServiceAccountSecretResponse{
+		ClientSecret:            clientSecret,
+		PreviousSecretExpiresAt: previousExpiresAt.Format(time.RFC3339),
+		Message:                 "Secret rotated successfully",
+	}, nil
+}
+
+// DeleteServiceAccount deletes a service account, it can no longer obtain tokens
+func (s *UserManagementService) DeleteServiceAccount(
+	ctx context.Context,
+	in *pb.DeleteServiceAccountRequest,
+) (*pb.DeleteServiceAccountResponse, error) {
+	if err := actions.DeleteServiceAccount(in.ClientId, s.UserManagementServiceDB.DB); err != nil {
+		return nil, err
+	}
+
+	return &pb.DeleteServiceAccountResponse{Message: "Service account deleted successfully"}, nil
+}
+
+// GetServiceAccountToken issues an access token to a service account with the client credentials
+// grant. The token is limited to the requested scopes, or carries every scope of the account when
+// none are requested.
+func (s *UserManagementService) GetServiceAccountToken(
+	ctx context.Context,
+	in *pb.GetServiceAccountTokenRequest,
+) (*pb.GetServiceAccountTokenResponse, error) {
+	account, err := actions.AuthenticateServiceAccount(in.ClientId, in.ClientSecret, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	scopes := strings.Fields(in.Scope)
+	if len(scopes) == 0 {
+		scopes = account.Scopes
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(account.Scopes, scope) {
+			return nil, status.Errorf(codes.PermissionDenied, "the service account is not allowed the %s scope", scope)
+		}
+	}
+
+	token, claims, err := utils.GenerateServiceAccountToken(account, scopes, s.KeyManager)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to generate token")
+	}
+
+	return &pb.GetServiceAccountTokenResponse{
+		Token:     token,
+		Scope:     claims.Scope,
+		ExpiresAt: claims.ExpiresAt.Time.Format(time.RFC3339),
+	}, nil
+}
@@ -0,0 +1,96 @@
+package modules
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/actions"
+	"github.com/isaacwassouf/authentication-service/models"
+	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
+)
+
+// ListSessions lists the logins of the user that can still be used
+func (s *UserManagementService) ListSessions(
+	ctx context.Context,
+	in *pb.ListSessionsRequest,
+) (*pb.ListSessionsResponse, error) {
+	sessions, err := actions.ListSessions(int(in.UserId), s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &pb.ListSessionsResponse{}
+	for _, session := range sessions {
+		response.Sessions = append(response.Sessions, &pb.Session{
+			Id:         uint64(session.ID),
+			AuthMethod: session.AuthMethod,
+			Ip:         session.IP,
+			UserAgent:  session.UserAgent,
+			IssuedAt:   session.IssuedAt.Format(time.RFC3339),
+			ExpiresAt:  session.ExpiresAt.Format(time.RFC3339),
+		})
+	}
+
+	return response, nil
+}
+
+// RevokeSession logs the user out of one of their sessions
+func (s *UserManagementService) RevokeSession(
+	ctx context.Context,
+	in *pb.RevokeSessionRequest,
+) (*pb.RevokeSessionResponse, error) {
+	tokens, err := actions.RevokeSession(int(in.UserId), int(in.SessionId), s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.revokeTokens(ctx, tokens...); err != nil {
+		return nil, err
+	}
+
+	return &pb.RevokeSessionResponse{Message: "Session revoked successfully"}, nil
+}
+
+// RevokeAllSessions logs the user out everywhere
+func (s *UserManagementService) RevokeAllSessions(
+	ctx context.Context,
+	in *pb.RevokeAllSessionsRequest,
+) (*pb.RevokeAllSessionsResponse, error) {
+	err := actions.RevokeAllSessions(int(in.UserId), s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.invalidateUserTokens(ctx, int(in.UserId)); err != nil {
+		return nil, err
+	}
+
+	return &pb.RevokeAllSessionsResponse{Message: "Sessions revoked successfully"}, nil
+}
+
+// revokeTokens adds the blacklisted tokens to the revocation cache of every instance
+func (s *UserManagementService) revokeTokens(ctx context.Context, tokens ...models.BlacklistedToken) error {
+	if err := s.RevocationCache.Revoke(ctx, tokens...); err != nil {
+		return status.Error(codes.Internal, "failed to broadcast the revocation")
+	}
+	return nil
+}
+
+// invalidateAdminTokens makes every instance read the state of the admin again once the tokens of
+// the admin were revoked or the admin deactivated or deleted
+func (s *UserManagementService) invalidateAdminTokens(ctx context.Context, adminID int) error {
+	if err := s.RevocationCache.InvalidateAdmin(ctx, adminID); err != nil {
+		return status.Error(codes.Internal, "failed to broadcast the revocation")
+	}
+	return nil
+}
+
+// invalidateUserTokens makes every instance read the token version of the user again once the
+// tokens of the user were revoked
+func (s *UserManagementService) invalidateUserTokens(ctx context.Context, userID int) error {
+	if err := s.RevocationCache.InvalidateUser(ctx, userID); err != nil {
+		return status.Error(codes.Internal, "failed to broadcast the revocation")
+	}
+	return nil
+}
@@ -3,70 +3,46 @@ package modules
 import (
 	"context"
 
-	sq "github.com/Masterminds/squirrel"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
 
+	"github.com/isaacwassouf/authentication-service/actions"
 	"github.com/isaacwassouf/authentication-service/consts"
 	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
 )
 
+// GetMFA reports whether the global MFA policy requires a second factor
 func (s *UserManagementService) GetMFA(ctx context.Context, in *emptypb.Empty) (*pb.GetMFAResponse, error) {
-	var mfaStatus string
-	err := sq.Select("value").
-		From("settings").
-		Where(sq.Eq{"name": "mfa"}).
-		RunWith(s.UserManagementServiceDB.DB).
-		QueryRow().
-		Scan(&mfaStatus)
-	if err != nil {
+	policy, err := actions.GetMFAPolicy(consts.MFA_SCOPE_GLOBAL, "", s.UserManagementServiceDB.DB)
+	if err != nil && status.Code(err) != codes.NotFound {
 		return nil, status.Error(codes.Internal, "failed to get MFA status")
 	}
 
-	if mfaStatus == "" {
-		mfaStatus = consts.DISABLED
-	}
-
-	if mfaStatus == consts.ENABLED {
-		return &pb.GetMFAResponse{Enabled: true}, nil
-	} else {
-		return &pb.GetMFAResponse{Enabled: false}, nil
-	}
+	return &pb.GetMFAResponse{Enabled: policy.Mode == consts.MFA_REQUIRED}, nil
 }
 
-func (s *UserManagementService) ToggleMFA(ctx context.Context, in *emptypb.Empty) (*emptypb.Empty, error) {
-	// get MFA status
-	var mfaStatus string
-	err := sq.Select("value").
-		From("settings").
-		Where(sq.Eq{"name": "mfa"}).
-		RunWith(s.UserManagementServiceDB.DB).
-		QueryRow().
-		Scan(&mfaStatus)
-	if err != nil {
+// ToggleMFA switches the global MFA policy between required and optional, the more specific
+// policies still apply on top of it
+func (s *UserManagementService) ToggleMFA(ctx context.Context, in *emptypb.Empty) (response *emptypb.Empty, err error) {
+	event := newAdminAuditEvent(ctx, consts.AUDIT_MFA_TOGGLED)
+	event.Target = auditMFAPolicyTarget(consts.MFA_SCOPE_GLOBAL, "")
+	defer func() { s.recordAuditEvent(ctx, event, err) }()
+
+	policy, err := actions.GetMFAPolicy(consts.MFA_SCOPE_GLOBAL, "", s.UserManagementServiceDB.DB)
+	if err != nil && status.Code(err) != codes.NotFound {
 		return nil, status.Error(codes.Internal, "failed to get MFA status")
 	}
 
-	// toggle MFA status
-	if mfaStatus == consts.ENABLED {
-		_, err = sq.Update("settings").
-			Set("value", consts.DISABLED).
-			Where(sq.Eq{"name": "mfa"}).
-			RunWith(s.UserManagementServiceDB.DB).
-			Exec()
-		if err != nil {
-			return nil, status.Error(codes.Internal, "failed to disable MFA")
-		}
-	} else {
-		_, err = sq.Update("settings").
-			Set("value", consts.ENABLED).
-			Where(sq.Eq{"name": "mfa"}).
-			RunWith(s.UserManagementServiceDB.DB).
-			Exec()
-		if err != nil {
-			return nil, status.Error(codes.Internal, "failed to enable MFA")
-		}
+	mode := consts.MFA_REQUIRED
+	if policy.Mode == consts.MFA_REQUIRED {
+		mode = consts.MFA_OPTIONAL
+	}
+	event.Metadata["mode"] = mode
+
+	_, err = actions.SetMFAPolicy(consts.MFA_SCOPE_GLOBAL, "", mode, policy.GracePeriodHours, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
 	}
 
 	return &emptypb.Empty{}, nil
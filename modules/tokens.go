@@ -0,0 +1,212 @@
+package modules
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/matoous/go-nanoid/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/actions"
+	"github.com/isaacwassouf/authentication-service/models"
+	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+// issueTokens generates an access token and starts a new refresh token family for the user, the
+// login is recorded as a new session
+func (s *UserManagementService) issueTokens(ctx context.Context, user models.User, authMethod string) (string, string, error) {
+	familyID, err := gonanoid.New()
+	if err != nil {
+		return "", "", status.Error(codes.Internal, "failed to generate the refresh token family")
+	}
+
+	token, err := s.generateToken(ctx, user, familyID, authMethod, "")
+	if err != nil {
+		return "", "", err
+	}
+
+	refreshToken, err := actions.CreateRefreshToken(user.ID, familyID, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return "", "", err
+	}
+
+	return token, refreshToken, nil
+}
+
+// generateToken generates an access token and records it in the session of the refresh token family,
+// the token carries the current token version, roles and permissions of the user along with the
+// scopes granted to an OpenID Connect client
+func (s *UserManagementService) generateToken(ctx context.Context, user models.User, familyID string, authMethod string, scope string) (string, error) {
+	tokenVersion, err := actions.GetTokenVersion(user.ID, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return "", err
+	}
+	user.TokenVersion = tokenVersion
+
+	user.Roles, user.Permissions, err = actions.GetUserRoles(user.ID, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return "", err
+	}
+
+	token, claims, err := utils.GenerateToken(user, scope, s.KeyManager)
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to generate token")
+	}
+
+	err = actions.CreateSession(models.Session{
+		JTI:        claims.ID,
+		UserID:     user.ID,
+		FamilyID:   familyID,
+		AuthMethod: authMethod,
+		Scope:      scope,
+		IP:         utils.GetClientIP(ctx),
+		UserAgent:  utils.GetUserAgent(ctx),
+		IssuedAt:   claims.IssuedAt.Time,
+		ExpiresAt:  claims.ExpiresAt.Time,
+	}, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// RefreshToken exchanges a refresh token for a new access token and a rotated refresh token
+func (s *UserManagementService) RefreshToken(
+	ctx context.Context,
+	in *pb.RefreshTokenRequest,
+) (*pb.RefreshTokenResponse, error) {
+	if in.RefreshToken == "" {
+		return nil, status.Error(codes.InvalidArgument, "refresh token is required")
+	}
+
+	// the refresh tokens issued to the OpenID Connect clients are refreshed at the token endpoint
+	return s.refreshTokens(ctx, in.RefreshToken, sql.NullInt64{})
+}
+
+// refreshTokens rotates a refresh token issued to the given OpenID Connect client, or to none,
+// and issues a new access token in the same session
+func (s *UserManagementService) refreshTokens(ctx context.Context, token string, clientID sql.NullInt64) (*pb.RefreshTokenResponse, error) {
+	userID, familyID, refreshToken, err := actions.RotateRefreshToken(token, clientID, s.UserManagementServiceDB.DB)
+	if errors.Is(err, actions.ErrRefreshTokenReuse) {
+		// the refresh token was stolen, log out of the session it belongs to
+		tokens, revokeErr := actions.RevokeSessionFamily(userID, familyID, s.UserManagementServiceDB.DB)
+		if revokeErr != nil {
+			return nil, revokeErr
+		}
+		if revokeErr := s.revokeTokens(ctx, tokens...); revokeErr != nil {
+			return nil, revokeErr
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := utils.GetUserByID(userID, s.UserManagementServiceDB.DB)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, status.Error(codes.NotFound, "user not found")
+		}
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	authMethod, scope, err := actions.GetSessionGrant(familyID, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, err := s.generateToken(ctx, user, familyID, authMethod, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.RefreshTokenResponse{Token: accessToken, RefreshToken: refreshToken}, nil
+}
+
+// ValidateToken verifies the signature, expiry, audience and revocation of an access token in one
+// call and returns the payload of the user, admin or service account it was issued to
+func (s *UserManagementService) ValidateToken(
+	ctx context.Context,
+	in *pb.ValidateTokenRequest,
+) (*pb.ValidateTokenResponse, error) {
+	if in.Token == "" {
+		return nil, status.Error(codes.InvalidArgument, "token is required")
+	}
+
+	audience := in.Audience
+	if audience == "" {
+		audience = utils.AccessTokenAudience()
+	}
+
+	claims, err := utils.ParseAccessToken(in.Token, audience, s.KeyManager)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+
+	response := &pb.ValidateTokenResponse{
+		Jti:       claims.ID,
+		ExpiresAt: claims.ExpiresAt.Time.Format(time.RFC3339),
+		Scope:     claims.Scope,
+	}
+
+	if claims.ServiceAccount != nil {
+		response.ServiceAccount = &pb.ServiceAccountPayload{
+			ClientId: claims.ServiceAccount.ClientID,
+			Name:     claims.ServiceAccount.Name,
+			Scopes:   strings.Fields(claims.Scope),
+		}
+		return response, nil
+	}
+
+	if claims.User.IsAdmin {
+		revoked, err := s.isAdminTokenRevoked(ctx, claims.User.ID, claims.ID, claims.Version)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, status.Error(codes.Unauthenticated, "token is revoked")
+		}
+		response.Admin = &pb.AdminPayload{Id: uint64(claims.User.ID), Email: claims.User.Email}
+		return response, nil
+	}
+
+	revoked, err := s.RevocationCache.IsRevoked(ctx, claims.User.ID, claims.ID, claims.Version)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to check the token revocation")
+	}
+	if revoked {
+		return nil, status.Error(codes.Unauthenticated, "token is revoked")
+	}
+
+	response.User = &pb.UserPayload{
+		Id:          uint64(claims.User.ID),
+		Name:        claims.User.Name,
+		Email:       claims.User.Email,
+		Verified:    claims.User.Verified,
+		Provider:    claims.User.Provider,
+		Roles:       claims.User.Roles,
+		Permissions: claims.User.Permissions,
+	}
+	return response, nil
+}
+
+// isAdminTokenRevoked reports whether the admin token was blacklisted or its admin deactivated or
+// deleted. The admin tokens issued before they carried an id can not be blacklisted, they are
+// refused.
+func (s *UserManagementService) isAdminTokenRevoked(ctx context.Context, adminID int, jti string, version int) (bool, error) {
+	if jti == "" {
+		return true, nil
+	}
+
+	revoked, err := s.RevocationCache.IsAdminRevoked(ctx, adminID, jti, version)
+	if err != nil {
+		return false, status.Error(codes.Internal, "failed to check the token revocation")
+	}
+	return revoked, nil
+}
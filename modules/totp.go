@@ -0,0 +1,218 @@
+package modules
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/models"
+	pbcryptography "github.com/isaacwassouf/authentication-service/protobufs/cryptography_service"
+	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+// BeginTOTPEnrollment generates a new TOTP secret for the user, the enrollment is only effective
+// once a code generated from it is confirmed
+func (s *UserManagementService) BeginTOTPEnrollment(
+	ctx context.Context,
+	in *pb.BeginTOTPEnrollmentRequest,
+) (*pb.BeginTOTPEnrollmentResponse, error) {
+	user, err := utils.GetUserByID(int(in.UserId), s.UserManagementServiceDB.DB)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, status.Error(codes.NotFound, "user not found")
+		}
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	totp, err := s.getUserTOTP(user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+	if err == nil && totp.Confirmed {
+		return nil, status.Error(codes.FailedPrecondition, "TOTP is already enabled")
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to generate the TOTP secret")
+	}
+
+	// the secret is stored encrypted like the other credentials
+	encryptedSecret, err := (*s.CryptographyServiceClient).Encrypt(ctx, &pbcryptography.EncryptRequest{Plaintext: secret})
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to encrypt the TOTP secret")
+	}
+
+	// restarting an enrollment replaces the unconfirmed secret
+	_, err = sq.Insert("users_totp").
+		Columns("user_id", "secret").
+		Values(user.ID, encryptedSecret.Ciphertext).
+		Suffix("ON DUPLICATE KEY UPDATE secret = VALUES(secret), confirmed = FALSE, last_used_step = 0, created_at = CURRENT_TIMESTAMP").
+		RunWith(s.UserManagementServiceDB.DB).
+		Exec()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to save the TOTP secret")
+	}
+
+	return &pb.BeginTOTPEnrollmentResponse{
+		Secret: secret,
+		Uri:    utils.TOTPURI(utils.GetEnvVar("TOTP_ISSUER", "authentication-service"), user.Email, secret),
+	}, nil
+}
+
+// ConfirmTOTPEnrollment enables TOTP for the user once they prove their authenticator app
+// generates valid codes
+func (s *UserManagementService) ConfirmTOTPEnrollment(
+	ctx context.Context,
+	in *pb.ConfirmTOTPEnrollmentRequest,
+) (*pb.ConfirmTOTPEnrollmentResponse, error) {
+	if in.Code == "" {
+		return nil, status.Error(codes.InvalidArgument, "code is required")
+	}
+
+	totp, err := s.getUserTOTP(int(in.UserId))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, status.Error(codes.NotFound, "TOTP enrollment not found")
+		}
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+	if totp.Confirmed {
+		return nil, status.Error(codes.FailedPrecondition, "TOTP is already enabled")
+	}
+
+	step, valid, err := s.validateTOTPCode(ctx, totp.Secret, totp.LastUsedStep, in.Code)
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		return nil, status.Error(codes.InvalidArgument, "invalid code")
+	}
+
+	_, err = sq.Update("users_totp").
+		Set("confirmed", true).
+		Set("confirmed_at", time.Now()).
+		Set("last_used_step", step).
+		Where(sq.Eq{"id": totp.ID}).
+		RunWith(s.UserManagementServiceDB.DB).
+		Exec()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to enable TOTP")
+	}
+
+	return &pb.ConfirmTOTPEnrollmentResponse{Message: "TOTP enabled successfully"}, nil
+}
+
+// DisableTOTP removes the TOTP secret of the user, a current code is required so that a stolen
+// access token is not enough to remove the second factor
+func (s *UserManagementService) DisableTOTP(
+	ctx context.Context,
+	in *pb.DisableTOTPRequest,
+) (*pb.DisableTOTPResponse, error) {
+	if in.Code == "" {
+		return nil, status.Error(codes.InvalidArgument, "code is required")
+	}
+
+	totp, err := s.getUserTOTP(int(in.UserId))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, status.Error(codes.NotFound, "TOTP is not enabled")
+		}
+		return nil, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	_, valid, err := s.validateTOTPCode(ctx, totp.Secret, totp.LastUsedStep, in.Code)
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		return nil, status.Error(codes.InvalidArgument, "invalid code")
+	}
+
+	_, err = sq.Delete("users_totp").
+		Where(sq.Eq{"id": totp.ID}).
+		RunWith(s.UserManagementServiceDB.DB).
+		Exec()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to disable TOTP")
+	}
+
+	return &pb.DisableTOTPResponse{Message: "TOTP disabled successfully"}, nil
+}
+
+// verifyTOTP checks a code against the confirmed TOTP secret of the user and marks its time step
+// as used so that the code can not be replayed
+func (s *UserManagementService) verifyTOTP(ctx context.Context, userID int, code string) (bool, error) {
+	totp, err := s.getUserTOTP(userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, status.Error(codes.Internal, "failed to query the database")
+	}
+	if !totp.Confirmed {
+		return false, nil
+	}
+
+	step, valid, err := s.validateTOTPCode(ctx, totp.Secret, totp.LastUsedStep, code)
+	if err != nil || !valid {
+		return false, err
+	}
+
+	// only one of the concurrent logins with the same code moves the step forward
+	result, err := sq.Update("users_totp").
+		Set("last_used_step", step).
+		Where(sq.Eq{"id": totp.ID}).
+		Where(sq.Lt{"last_used_step": step}).
+		RunWith(s.UserManagementServiceDB.DB).
+		Exec()
+	if err != nil {
+		return false, status.Error(codes.Internal, "failed to update the TOTP")
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, status.Error(codes.Internal, "failed to update the TOTP")
+	}
+
+	return updated == 1, nil
+}
+
+// hasTOTP reports whether the user completed the TOTP enrollment
+func (s *UserManagementService) hasTOTP(userID int) (bool, error) {
+	totp, err := s.getUserTOTP(userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	return totp.Confirmed, nil
+}
+
+// validateTOTPCode checks a code against an encrypted TOTP secret of a user or an admin
+func (s *UserManagementService) validateTOTPCode(ctx context.Context, encryptedSecret string, lastUsedStep int64, code string) (int64, bool, error) {
+	secret, err := (*s.CryptographyServiceClient).Decrypt(ctx, &pbcryptography.DecryptRequest{Ciphertext: encryptedSecret})
+	if err != nil {
+		return 0, false, status.Error(codes.Internal, "failed to decrypt the TOTP secret")
+	}
+
+	step, valid := utils.ValidateTOTPCode(secret.Plaintext, code, lastUsedStep)
+	return step, valid, nil
+}
+
+func (s *UserManagementService) getUserTOTP(userID int) (models.UserTOTP, error) {
+	var totp models.UserTOTP
+	err := sq.Select("id", "user_id", "secret", "confirmed", "last_used_step", "confirmed_at", "created_at").
+		From("users_totp").
+		Where(sq.Eq{"user_id": userID}).
+		RunWith(s.UserManagementServiceDB.DB).
+		QueryRow().
+		Scan(&totp.ID, &totp.UserID, &totp.Secret, &totp.Confirmed, &totp.LastUsedStep, &totp.ConfirmedAt, &totp.CreatedAt)
+	return totp, err
+}
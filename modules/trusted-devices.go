@@ -0,0 +1,84 @@
+package modules
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/actions"
+	"github.com/isaacwassouf/authentication-service/models"
+	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+// ListTrustedDevices lists the devices on which the user skips the MFA
+func (s *UserManagementService) ListTrustedDevices(
+	ctx context.Context,
+	in *pb.ListTrustedDevicesRequest,
+) (*pb.ListTrustedDevicesResponse, error) {
+	devices, err := actions.ListTrustedDevices(int(in.UserId), s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &pb.ListTrustedDevicesResponse{}
+	for _, device := range devices {
+		response.Devices = append(response.Devices, &pb.TrustedDevice{
+			Id:         uint64(device.ID),
+			UserAgent:  device.UserAgent,
+			Ip:         device.IP,
+			LastSeenAt: device.LastSeenAt.Format(time.RFC3339),
+			ExpiresAt:  device.ExpiresAt.Format(time.RFC3339),
+			CreatedAt:  device.CreatedAt.Format(time.RFC3339),
+		})
+	}
+
+	return response, nil
+}
+
+// RevokeTrustedDevice makes the MFA required again on a device of the user
+func (s *UserManagementService) RevokeTrustedDevice(
+	ctx context.Context,
+	in *pb.RevokeTrustedDeviceRequest,
+) (*pb.RevokeTrustedDeviceResponse, error) {
+	err := actions.RevokeTrustedDevice(int(in.UserId), int(in.DeviceId), s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.RevokeTrustedDeviceResponse{Message: "Trusted device revoked successfully"}, nil
+}
+
+// trustDevice remembers the device the user completed the MFA on and returns its device token
+func (s *UserManagementService) trustDevice(ctx context.Context, user models.User) (string, error) {
+	days, err := utils.GetIntSetting("TRUSTED_DEVICE_DAYS", 30, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to get the MFA settings")
+	}
+
+	return actions.CreateTrustedDevice(
+		user.ID,
+		utils.GetUserAgent(ctx),
+		utils.GetClientIP(ctx),
+		time.Hour*24*time.Duration(days),
+		s.UserManagementServiceDB.DB,
+	)
+}
+
+// isTrustedDevice checks the device token sent along with a login. A token that is unknown,
+// expired, revoked or issued to another user only means the MFA is asked for.
+func (s *UserManagementService) isTrustedDevice(ctx context.Context, user models.User, deviceToken string) (bool, error) {
+	if deviceToken == "" {
+		return false, nil
+	}
+
+	return actions.CheckTrustedDevice(
+		user.ID,
+		deviceToken,
+		utils.GetUserAgent(ctx),
+		utils.GetClientIP(ctx),
+		s.UserManagementServiceDB.DB,
+	)
+}
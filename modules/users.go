@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"strconv"
 
 	sq "github.com/Masterminds/squirrel"
 	"google.golang.org/grpc/codes"
@@ -11,6 +12,7 @@ import (
 	"google.golang.org/protobuf/types/known/emptypb"
 
 	"github.com/isaacwassouf/authentication-service/actions"
+	"github.com/isaacwassouf/authentication-service/consts"
 	"github.com/isaacwassouf/authentication-service/models"
 	pbEmail "github.com/isaacwassouf/authentication-service/protobufs/email_management_service"
 	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
@@ -47,10 +49,33 @@ func (s *UserManagementService) RegisterUser(
 func (s *UserManagementService) LoginUser(
 	ctx context.Context,
 	in *pb.LoginRequest,
-) (*pb.LoginResponse, error) {
+) (response *pb.LoginResponse, err error) {
+	event := models.AuditEvent{
+		EventType: consts.AUDIT_USER_LOGIN,
+		ActorType: consts.AUDIT_ACTOR_USER,
+		Actor:     in.Email,
+		Metadata:  map[string]string{"provider": consts.PASSWORD},
+	}
+	defer func() {
+		if response != nil && response.MfaRequired {
+			event.Outcome = consts.AUDIT_OUTCOME_MFA_REQUIRED
+		}
+		s.recordAuditEvent(ctx, event, err)
+	}()
+
+	// reject the attempt while the account or the IP is locked
+	throttle, err := actions.GetLoginThrottle(s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to get the login settings")
+	}
+	subjects := actions.NewLoginSubjects("user", in.Email, utils.GetClientIP(ctx))
+	if err := actions.CheckLoginAllowed(subjects, throttle, s.UserManagementServiceDB.DB); err != nil {
+		return nil, err
+	}
+
 	// get the user from the database
 	var user models.User
-	err := sq.Select("users.id", "users.name", "users_email.email", "users_password.password", "users_email.is_verified").
+	err = sq.Select("users.id", "users.name", "users_email.email", "users_password.password", "users_email.is_verified").
 		From("users").
 		InnerJoin("users_email ON users.id = users_email.user_id").
 		InnerJoin("users_password ON users.id = users_password.user_id").
@@ -58,97 +83,77 @@ func (s *UserManagementService) LoginUser(
 		RunWith(s.UserManagementServiceDB.DB).
 		QueryRow().
 		Scan(&user.ID, &user.Name, &user.Email, &user.Password, &user.Verified)
-		// if the user does not exist return an error
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, status.Error(codes.NotFound, "user not found")
-		}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return nil, status.Error(codes.Internal, "failed to query the database")
 	}
-
-	// check if the password is correct
-	if !utils.CheckPasswordHash(in.Password, user.Password) {
-		return nil, status.Error(codes.InvalidArgument, "incorrect password")
+	if err == nil {
+		event.ActorID = sql.NullInt64{Int64: int64(user.ID), Valid: true}
+		event.Target = auditUserTarget(user.ID)
 	}
 
-	MFAStatus, err := utils.GetMFAStatus(s.UserManagementServiceDB.DB)
-	if err != nil {
-		return nil, status.Error(codes.Internal, "failed to get MFA status")
+	// check if the password is correct, an unknown email fails the same way as a wrong password
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.CheckDummyPasswordHash(in.Password)
 	}
-
-	// if the MFA is not enabled then send the MFA token to the user
-	if !MFAStatus {
-		// generate a JWT token
-		token, err := utils.GenerateToken(user)
-		if err != nil {
-			return nil, status.Error(codes.Internal, "failed to generate token")
+	if errors.Is(err, sql.ErrNoRows) || !utils.CheckPasswordHash(in.Password, user.Password) {
+		if err := actions.RecordLoginFailure(subjects, throttle, s.UserManagementServiceDB.DB); err != nil {
+			return nil, err
 		}
-
-		return &pb.LoginResponse{Message: "Logged in successfully", Token: token}, nil
+		return nil, errInvalidCredentials
 	}
 
-	// if the MFA is enabled then send the MFA token to the user
-	// generate a MFA token
-	MFACode, err := utils.GenerateMFACode()
-	if err != nil {
-		return nil, status.Error(codes.Internal, "failed to generate MFA token")
+	if err := actions.ClearLoginFailures(subjects, s.UserManagementServiceDB.DB); err != nil {
+		return nil, err
 	}
 
-	// hash the code
-	hashedMFACode, err := utils.HashMFACode(MFACode)
-	if err != nil {
-		return nil, status.Error(codes.Internal, "failed to hash MFA token")
-	}
+	// the MFA policy decides whether a second factor is needed
+	return s.completeLogin(ctx, user, consts.PASSWORD, in.DeviceToken)
+}
 
-	// save the MFA token in the database
-	_, err = sq.Insert("mfa_verification").
-		Columns("user_id", "code").
-		Values(user.ID, hashedMFACode).
-		RunWith(s.UserManagementServiceDB.DB).
-		Exec()
-	if err != nil {
-		return nil, status.Error(codes.Internal, "failed to save the MFA token")
+func (s *UserManagementService) LogoutUser(ctx context.Context, in *pb.LogoutRequest) (*emptypb.Empty, error) {
+	// the refresh token has to be one of the caller, it is checked before anything is revoked
+	if in.RefreshToken != "" {
+		if err := actions.RevokeRefreshToken(int(in.UserId), in.RefreshToken, s.UserManagementServiceDB.DB); err != nil {
+			return nil, err
+		}
 	}
 
-	// send the MFA token to the user
-	_, err = (*s.EmailServiceClient).SendMFAEmail(context.Background(), &pbEmail.SendEmailRequest{To: user.Email, Token: MFACode})
+	token, err := actions.BlacklistToken(int(in.UserId), in.Jti, s.UserManagementServiceDB.DB)
 	if err != nil {
-		return nil, status.Error(codes.Internal, "failed to send MFA token")
+		return nil, err
 	}
 
-	return &pb.LoginResponse{Message: "MFA token sent successfully"}, nil
-}
-
-func (s *UserManagementService) LogoutUser(ctx context.Context, in *pb.LogoutRequest) (*emptypb.Empty, error) {
-	_, err := sq.Insert("tokens_blacklist").
-		Columns("user_id", "jti").
-		Values(in.UserId, in.Jti).
-		RunWith(s.UserManagementServiceDB.DB).
-		Exec()
+	// revoke the other access tokens and the refresh tokens of the session as well
+	tokens, err := actions.RevokeSessionByJTI(int(in.UserId), in.Jti, s.UserManagementServiceDB.DB)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, err
+	}
+	if err := s.revokeTokens(ctx, append(tokens, token)...); err != nil {
+		return nil, err
 	}
 
 	return &emptypb.Empty{}, nil
 }
 
+// VerifyTokenRevoation is called by the gateway for every request, it is answered from the
+// revocation cache
 func (s *UserManagementService) VerifyTokenRevoation(ctx context.Context, in *pb.VerifyTokenRevoationRequest) (*pb.VerifyTokenRevoationResponse, error) {
-	var count int
-	err := sq.Select("count(*)").
-		From("tokens_blacklist").
-		Where(sq.Eq{"user_id": in.UserId, "jti": in.Jti}).
-		RunWith(s.UserManagementServiceDB.DB).
-		QueryRow().
-		Scan(&count)
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	if in.IsAdmin {
+		revoked, err := s.isAdminTokenRevoked(ctx, int(in.UserId), in.Jti, int(in.Ver))
+		if err != nil {
+			return nil, status.Error(codes.Internal, "failed to check the token revocation")
+		}
+		return &pb.VerifyTokenRevoationResponse{IsRevoked: revoked}, nil
 	}
 
-	if count == 0 {
-		return &pb.VerifyTokenRevoationResponse{IsRevoked: false}, nil
+	// the blacklisted tokens and the tokens issued before a password reset, a password or email
+	// change or a suspension
+	revoked, err := s.RevocationCache.IsRevoked(ctx, int(in.UserId), in.Jti, int(in.Ver))
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to check the token revocation")
 	}
 
-	return &pb.VerifyTokenRevoationResponse{IsRevoked: true}, nil
+	return &pb.VerifyTokenRevoationResponse{IsRevoked: revoked}, nil
 }
 
 func (s *UserManagementService) ListUsers(empty *emptypb.Empty, stream pb.UserManager_ListUsersServer) error {
@@ -160,6 +165,7 @@ func (s *UserManagementService) ListUsers(empty *emptypb.Empty, stream pb.UserMa
 		"auth_providers.name as auth_provider_name",
 		"users.created_at",
 		"users.updated_at",
+		"(SELECT COUNT(*) FROM mfa_recovery_codes WHERE mfa_recovery_codes.user_id = users.id AND mfa_recovery_codes.used_at IS NULL) AS recovery_codes_remaining",
 	).
 		From("users").
 		InnerJoin("users_email ON users.id = users_email.user_id").
@@ -176,6 +182,7 @@ func (s *UserManagementService) ListUsers(empty *emptypb.Empty, stream pb.UserMa
 		var name, email, createdAt, updatedAt string
 		var verified bool
 		var authProvider sql.NullString
+		var recoveryCodesRemaining uint32
 		err := rows.Scan(
 			&id,
 			&name,
@@ -184,19 +191,21 @@ func (s *UserManagementService) ListUsers(empty *emptypb.Empty, stream pb.UserMa
 			&authProvider,
 			&createdAt,
 			&updatedAt,
+			&recoveryCodesRemaining,
 		)
 		if err != nil {
 			return status.Error(codes.Internal, "failed to scan the database")
 		}
 
 		err = stream.Send(&pb.User{
-			Id:           id,
-			Name:         name,
-			Email:        email,
-			IsVerified:   verified,
-			AuthProvider: authProvider.String,
-			CreatedAt:    createdAt,
-			UpdatedAt:    updatedAt,
+			Id:                     id,
+			Name:                   name,
+			Email:                  email,
+			IsVerified:             verified,
+			AuthProvider:           authProvider.String,
+			CreatedAt:              createdAt,
+			UpdatedAt:              updatedAt,
+			RecoveryCodesRemaining: recoveryCodesRemaining,
 		})
 		if err != nil {
 			return status.Error(codes.Internal, "failed to send the response")
@@ -256,7 +265,14 @@ func (s *UserManagementService) RequestPasswordReset(ctx context.Context, in *pb
 	return &pb.RequestPasswordResetResponse{Message: "Password reset code sent successfully"}, nil
 }
 
-func (s *UserManagementService) ConfirmPasswordReset(ctx context.Context, in *pb.ConfirmPasswordResetRequest) (*pb.ConfirmPasswordResetResponse, error) {
+func (s *UserManagementService) ConfirmPasswordReset(
+	ctx context.Context,
+	in *pb.ConfirmPasswordResetRequest,
+) (response *pb.ConfirmPasswordResetResponse, err error) {
+	// the reset is performed by whoever holds the emailed code
+	event := models.AuditEvent{EventType: consts.AUDIT_PASSWORD_RESET, ActorType: consts.AUDIT_ACTOR_ANONYMOUS}
+	defer func() { s.recordAuditEvent(ctx, event, err) }()
+
 	// check if the code is sent
 	if in.Code == "" {
 		return nil, status.Error(codes.InvalidArgument, "code is required")
@@ -282,6 +298,7 @@ func (s *UserManagementService) ConfirmPasswordReset(ctx context.Context, in *pb
 		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	event.Target = auditUserTarget(passwordReset.UserID)
 
 	// check if the code is expired
 	if utils.IsExpired(passwordReset.CreatedAt) {
@@ -299,23 +316,14 @@ func (s *UserManagementService) ConfirmPasswordReset(ctx context.Context, in *pb
 		return nil, status.Error(codes.Internal, "failed to hash the password")
 	}
 
-	// update the password in the database
-	_, err = sq.Update("users_password").
-		Where(sq.Eq{"user_id": passwordReset.UserID}).
-		Set("password", hashedPassword).
-		RunWith(s.UserManagementServiceDB.DB).
-		Exec()
+	// update the password, consume the code and log out everywhere at once, whoever knew the old
+	// password loses access
+	err = actions.ResetPassword(passwordReset.UserID, hashedPassword, hashedCode, s.UserManagementServiceDB.DB)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, err
 	}
-
-	// delete the password reset code
-	_, err = sq.Delete("passwords_reset").
-		Where(sq.Eq{"code": hashedCode}).
-		RunWith(s.UserManagementServiceDB.DB).
-		Exec()
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	if err := s.invalidateUserTokens(ctx, passwordReset.UserID); err != nil {
+		return nil, err
 	}
 
 	return &pb.ConfirmPasswordResetResponse{Message: "Password reset successfully"}, nil
@@ -376,7 +384,11 @@ func (s *UserManagementService) RequestEmailVerification(ctx context.Context, in
 }
 
 // VerifyEmail verifies a user by Email
-func (s *UserManagementService) VerifyEmail(ctx context.Context, in *pb.VerifyEmailRequest) (*pb.VerifyEmailResponse, error) {
+func (s *UserManagementService) VerifyEmail(ctx context.Context, in *pb.VerifyEmailRequest) (response *pb.VerifyEmailResponse, err error) {
+	// the email is verified by whoever holds the emailed code
+	event := models.AuditEvent{EventType: consts.AUDIT_EMAIL_VERIFIED, ActorType: consts.AUDIT_ACTOR_ANONYMOUS}
+	defer func() { s.recordAuditEvent(ctx, event, err) }()
+
 	// check if the code is sent
 	if in.Token == "" {
 		return nil, status.Error(codes.InvalidArgument, "code is required")
@@ -384,7 +396,7 @@ func (s *UserManagementService) VerifyEmail(ctx context.Context, in *pb.VerifyEm
 
 	// get the email verification code from the database
 	var emailVerification models.EmailVerification
-	err := sq.Select("user_id", "code", "created_at").
+	err = sq.Select("user_id", "code", "created_at").
 		From("email_verification").
 		Where(sq.Eq{"code": in.Token}).
 		RunWith(s.UserManagementServiceDB.DB).
@@ -396,6 +408,11 @@ func (s *UserManagementService) VerifyEmail(ctx context.Context, in *pb.VerifyEm
 		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	userID, err := strconv.Atoi(emailVerification.UserID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to parse the user id")
+	}
+	event.Target = auditUserTarget(userID)
 
 	// check if the code is expired
 	if utils.IsExpired(emailVerification.CreatedAt) {
@@ -424,45 +441,58 @@ func (s *UserManagementService) VerifyEmail(ctx context.Context, in *pb.VerifyEm
 	return &pb.VerifyEmailResponse{Message: "Email verified successfully"}, nil
 }
 
-func (s *UserManagementService) ConfirmMFA(ctx context.Context, in *pb.ConfirmMFARequest) (*pb.ConfirmMFAResponse, error) {
+func (s *UserManagementService) ConfirmMFA(
+	ctx context.Context,
+	in *pb.ConfirmMFARequest,
+) (response *pb.ConfirmMFAResponse, err error) {
+	method := in.Method
+	if method == "" {
+		method = consts.MFA_METHOD_EMAIL
+	}
+
+	// the login is audited again with the outcome of the second factor
+	event := newUserLoginAuditEvent("")
+	event.Metadata["mfa_method"] = method
+	defer func() { s.recordAuditEvent(ctx, event, err) }()
+
 	// check if the code is sent
 	if in.Code == "" {
 		return nil, status.Error(codes.InvalidArgument, "code is required")
 	}
 
-	// hash the code
-	hashedCode, err := utils.HashMFACode(in.Code)
-	if err != nil {
-		return nil, status.Error(codes.Internal, "failed to hash MFA code")
-	}
-
-	// get the MFA code from the database
-	var mfaVerification models.MFAVerifiction
-	err = sq.Select("user_id", "code", "created_at").
-		From("mfa_verification").
-		Where(sq.Eq{"code": hashedCode}).
-		RunWith(s.UserManagementServiceDB.DB).
-		QueryRow().
-		Scan(&mfaVerification.UserID, &mfaVerification.Code, &mfaVerification.CreatedAt)
+	maxAttempts, err := s.getMFAMaxAttempts()
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, status.Error(codes.NotFound, "code not found")
-		}
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, err
 	}
 
-	// check if the code is expired
-	if utils.MFAExpired(mfaVerification.CreatedAt) {
-		return nil, status.Error(codes.InvalidArgument, "code is expired")
+	// the code is only checked against the challenge of the login that produced it
+	challenge, err := actions.CompleteMFAChallenge(
+		in.MfaChallengeId,
+		method,
+		maxAttempts,
+		func(challenge models.MFAChallenge) (bool, error) {
+			switch method {
+			case consts.MFA_METHOD_TOTP:
+				return s.verifyTOTP(ctx, challenge.UserID, in.Code)
+			case consts.MFA_METHOD_WEBAUTHN:
+				return s.verifyWebAuthnAssertion(challenge, in.Code)
+			case consts.MFA_METHOD_RECOVERY_CODE:
+				return actions.UseRecoveryCode(challenge.UserID, in.Code, s.UserManagementServiceDB.DB)
+			case consts.MFA_METHOD_EMAIL:
+				return actions.CheckMFAEmailCode(challenge, in.Code)
+			default:
+				return false, status.Error(codes.InvalidArgument, "unknown MFA method")
+			}
+		},
+		s.UserManagementServiceDB.DB,
+	)
+	if challenge.UserID != 0 {
+		event.ActorID = sql.NullInt64{Int64: int64(challenge.UserID), Valid: true}
+		event.Target = auditUserTarget(challenge.UserID)
+		event.Metadata["provider"] = challenge.Provider
 	}
-
-	// delete the MFA code
-	_, err = sq.Delete("mfa_verification").
-		Where(sq.Eq{"code": mfaVerification.Code}).
-		RunWith(s.UserManagementServiceDB.DB).
-		Exec()
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, err
 	}
 
 	// get the user from the database
@@ -470,7 +500,7 @@ func (s *UserManagementService) ConfirmMFA(ctx context.Context, in *pb.ConfirmMF
 	err = sq.Select("users.id", "users.name", "users_email.email", "users_email.is_verified").
 		From("users").
 		InnerJoin("users_email ON users.id = users_email.user_id").
-		Where(sq.Eq{"users.id": mfaVerification.UserID}).
+		Where(sq.Eq{"users.id": challenge.UserID}).
 		RunWith(s.UserManagementServiceDB.DB).
 		QueryRow().
 		Scan(&user.ID, &user.Name, &user.Email, &user.Verified)
@@ -481,12 +511,93 @@ func (s *UserManagementService) ConfirmMFA(ctx context.Context, in *pb.ConfirmMF
 		}
 		return nil, status.Error(codes.Internal, "failed to query the database")
 	}
+	setAuditUser(&event, user)
+
+	// generate a JWT token and a refresh token
+	token, refreshToken, err := s.issueTokens(ctx, user, challenge.Provider+","+method)
+	if err != nil {
+		return nil, err
+	}
+
+	response = &pb.ConfirmMFAResponse{Token: token, RefreshToken: refreshToken}
+	if in.RememberDevice {
+		response.DeviceToken, err = s.trustDevice(ctx, user)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return response, nil
+}
+
+// ChangePassword replaces the password of a user who knows the current one, the tokens issued
+// with the old password are revoked
+func (s *UserManagementService) ChangePassword(ctx context.Context, in *pb.ChangePasswordRequest) (*pb.ChangePasswordResponse, error) {
+	if in.NewPassword == "" {
+		return nil, status.Error(codes.InvalidArgument, "new password is required")
+	}
+	if in.NewPassword != in.NewPasswordConfirmation {
+		return nil, status.Error(codes.InvalidArgument, "passwords do not match")
+	}
+
+	if err := s.checkUserPassword(int(in.UserId), in.CurrentPassword); err != nil {
+		return nil, err
+	}
+
+	hashedPassword, err := utils.HashPassword(in.NewPassword)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to hash the password")
+	}
+
+	if err := actions.ChangePassword(int(in.UserId), hashedPassword, s.UserManagementServiceDB.DB); err != nil {
+		return nil, err
+	}
+	if err := s.invalidateUserTokens(ctx, int(in.UserId)); err != nil {
+		return nil, err
+	}
+
+	return &pb.ChangePasswordResponse{Message: "Password changed successfully"}, nil
+}
+
+// ChangeEmail replaces the email of a user who knows their password, the email has to be verified
+// again and the tokens carrying the old email are revoked
+func (s *UserManagementService) ChangeEmail(ctx context.Context, in *pb.ChangeEmailRequest) (*pb.ChangeEmailResponse, error) {
+	if in.Email == "" {
+		return nil, status.Error(codes.InvalidArgument, "email is required")
+	}
 
-	// generate a JWT token
-	token, err := utils.GenerateToken(user)
+	// the email of the external users is the one of their provider
+	if err := s.checkUserPassword(int(in.UserId), in.Password); err != nil {
+		return nil, err
+	}
+
+	if err := actions.ChangeEmail(int(in.UserId), in.Email, s.UserManagementServiceDB.DB); err != nil {
+		return nil, err
+	}
+	if err := s.invalidateUserTokens(ctx, int(in.UserId)); err != nil {
+		return nil, err
+	}
+
+	return &pb.ChangeEmailResponse{Message: "Email changed successfully"}, nil
+}
+
+func (s *UserManagementService) checkUserPassword(userID int, password string) error {
+	var hashedPassword string
+	err := sq.Select("password").
+		From("users_password").
+		Where(sq.Eq{"user_id": userID}).
+		RunWith(s.UserManagementServiceDB.DB).
+		QueryRow().
+		Scan(&hashedPassword)
 	if err != nil {
-		return nil, status.Error(codes.Internal, "failed to generate token")
+		if errors.Is(err, sql.ErrNoRows) {
+			return status.Error(codes.FailedPrecondition, "user does not have a password")
+		}
+		return status.Error(codes.Internal, "failed to query the database")
 	}
 
-	return &pb.ConfirmMFAResponse{Token: token}, nil
+	if !utils.CheckPasswordHash(password, hashedPassword) {
+		return status.Error(codes.Unauthenticated, "invalid password")
+	}
+	return nil
 }
@@ -0,0 +1,367 @@
+package modules
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/actions"
+	"github.com/isaacwassouf/authentication-service/consts"
+	"github.com/isaacwassouf/authentication-service/models"
+	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+// BeginWebAuthnRegistration returns the options the browser passes to navigator.credentials.create
+func (s *UserManagementService) BeginWebAuthnRegistration(
+	ctx context.Context,
+	in *pb.BeginWebAuthnRegistrationRequest,
+) (*pb.BeginWebAuthnRegistrationResponse, error) {
+	webAuthnUser, err := s.getWebAuthnUser(int(in.UserId))
+	if err != nil {
+		return nil, err
+	}
+
+	// the authenticators already registered are excluded so that they are not registered twice
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(webAuthnUser.Credentials))
+	for _, credential := range webAuthnUser.Credentials {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+
+	options, session, err := s.WebAuthn.BeginRegistration(
+		webAuthnUser,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+	)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to start the WebAuthn registration")
+	}
+
+	sessionID, err := actions.CreateWebAuthnSession(consts.WEBAUTHN_REGISTRATION, webAuthnUser.User.ID, session, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	encodedOptions, err := json.Marshal(options)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to encode the WebAuthn options")
+	}
+
+	return &pb.BeginWebAuthnRegistrationResponse{SessionId: sessionID, Options: string(encodedOptions)}, nil
+}
+
+// FinishWebAuthnRegistration verifies the attestation returned by the authenticator and stores
+// the new credential
+func (s *UserManagementService) FinishWebAuthnRegistration(
+	ctx context.Context,
+	in *pb.FinishWebAuthnRegistrationRequest,
+) (*pb.FinishWebAuthnRegistrationResponse, error) {
+	if in.Credential == "" {
+		return nil, status.Error(codes.InvalidArgument, "credential is required")
+	}
+
+	session, data, err := actions.ConsumeWebAuthnSession(in.SessionId, consts.WEBAUTHN_REGISTRATION, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+	if session.UserID.Int64 != int64(in.UserId) {
+		return nil, status.Error(codes.InvalidArgument, "unknown WebAuthn session")
+	}
+
+	webAuthnUser, err := s.getWebAuthnUser(int(in.UserId))
+	if err != nil {
+		return nil, err
+	}
+
+	parsedResponse, err := protocol.ParseCredentialCreationResponseBody(strings.NewReader(in.Credential))
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid credential")
+	}
+
+	credential, err := s.WebAuthn.CreateCredential(webAuthnUser, data, parsedResponse)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "failed to verify the credential")
+	}
+
+	name := in.Name
+	if name == "" {
+		name = "Passkey"
+	}
+	if err := actions.CreateWebAuthnCredential(webAuthnUser.User.ID, name, credential, s.UserManagementServiceDB.DB); err != nil {
+		return nil, err
+	}
+
+	return &pb.FinishWebAuthnRegistrationResponse{Message: "Credential registered successfully"}, nil
+}
+
+// BeginWebAuthnLogin starts a passwordless login, the authenticator lets the user pick one of
+// their passkeys so no email is asked for
+func (s *UserManagementService) BeginWebAuthnLogin(
+	ctx context.Context,
+	in *pb.BeginWebAuthnLoginRequest,
+) (*pb.BeginWebAuthnLoginResponse, error) {
+	// the passkey replaces both factors, so the user has to be verified by the authenticator
+	options, session, err := s.WebAuthn.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to start the WebAuthn login")
+	}
+
+	sessionID, err := actions.CreateWebAuthnSession(consts.WEBAUTHN_LOGIN, 0, session, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	encodedOptions, err := json.Marshal(options)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to encode the WebAuthn options")
+	}
+
+	return &pb.BeginWebAuthnLoginResponse{SessionId: sessionID, Options: string(encodedOptions)}, nil
+}
+
+// FinishWebAuthnLogin verifies the assertion of a passwordless login and logs the user in
+func (s *UserManagementService) FinishWebAuthnLogin(
+	ctx context.Context,
+	in *pb.FinishWebAuthnLoginRequest,
+) (response *pb.LoginResponse, err error) {
+	event := newUserLoginAuditEvent(consts.MFA_METHOD_WEBAUTHN)
+	defer func() { s.recordAuditEvent(ctx, event, err) }()
+
+	if in.Credential == "" {
+		return nil, status.Error(codes.InvalidArgument, "credential is required")
+	}
+
+	// the account is only known from the assertion, so the IP is checked first and the account
+	// once its user handle is read
+	throttle, err := actions.GetLoginThrottle(s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to get the login settings")
+	}
+	clientIP := utils.GetClientIP(ctx)
+	subjects := actions.NewIPLoginSubjects(clientIP)
+	if err := actions.CheckLoginAllowed(subjects, throttle, s.UserManagementServiceDB.DB); err != nil {
+		return nil, err
+	}
+
+	_, data, err := actions.ConsumeWebAuthnSession(in.SessionId, consts.WEBAUTHN_LOGIN, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	parsedResponse, err := protocol.ParseCredentialRequestResponseBody(strings.NewReader(in.Credential))
+	if err != nil {
+		if err := actions.RecordLoginFailure(subjects, throttle, s.UserManagementServiceDB.DB); err != nil {
+			return nil, err
+		}
+		return nil, status.Error(codes.InvalidArgument, "invalid credential")
+	}
+
+	// the user is found from the user handle stored by the authenticator
+	var webAuthnUser utils.WebAuthnUser
+	var throttleErr error
+	credential, err := s.WebAuthn.ValidateDiscoverableLogin(
+		func(rawID, userHandle []byte) (webauthn.User, error) {
+			userID, err := utils.ParseWebAuthnUserHandle(userHandle)
+			if err != nil {
+				return nil, err
+			}
+			webAuthnUser, err = s.getWebAuthnUser(userID)
+			if err != nil {
+				return nil, err
+			}
+			setAuditUser(&event, webAuthnUser.User)
+
+			subjects = actions.NewLoginSubjects("user", webAuthnUser.User.Email, clientIP)
+			throttleErr = actions.CheckLoginAllowed(subjects, throttle, s.UserManagementServiceDB.DB)
+			if throttleErr != nil {
+				return nil, throttleErr
+			}
+			return webAuthnUser, nil
+		},
+		data,
+		parsedResponse,
+	)
+	if throttleErr != nil {
+		return nil, throttleErr
+	}
+	if err != nil {
+		if err := actions.RecordLoginFailure(subjects, throttle, s.UserManagementServiceDB.DB); err != nil {
+			return nil, err
+		}
+		return nil, status.Error(codes.Unauthenticated, "failed to verify the credential")
+	}
+
+	if err := s.recordWebAuthnAssertion(credential); err != nil {
+		return nil, err
+	}
+
+	if err := actions.ClearLoginFailures(subjects, s.UserManagementServiceDB.DB); err != nil {
+		return nil, err
+	}
+
+	token, refreshToken, err := s.issueTokens(ctx, webAuthnUser.User, consts.MFA_METHOD_WEBAUTHN)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.LoginResponse{Message: "Logged in successfully", Token: token, RefreshToken: refreshToken}, nil
+}
+
+// BeginWebAuthnMFA returns the assertion options of a MFA challenge completed with a passkey,
+// the assertion is then sent as the code of ConfirmMFA
+func (s *UserManagementService) BeginWebAuthnMFA(
+	ctx context.Context,
+	in *pb.BeginWebAuthnMFARequest,
+) (*pb.BeginWebAuthnMFAResponse, error) {
+	maxAttempts, err := s.getMFAMaxAttempts()
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, err := actions.GetMFAChallenge(in.MfaChallengeId, maxAttempts, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(strings.Split(challenge.Methods, ","), consts.MFA_METHOD_WEBAUTHN) {
+		return nil, status.Error(codes.InvalidArgument, "MFA method is not available")
+	}
+
+	webAuthnUser, err := s.getWebAuthnUser(challenge.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	options, session, err := s.WebAuthn.BeginLogin(webAuthnUser)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to start the WebAuthn assertion")
+	}
+
+	if err := actions.SetMFAChallengeWebAuthnSession(in.MfaChallengeId, session, s.UserManagementServiceDB.DB); err != nil {
+		return nil, err
+	}
+
+	encodedOptions, err := json.Marshal(options)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to encode the WebAuthn options")
+	}
+
+	return &pb.BeginWebAuthnMFAResponse{Options: string(encodedOptions)}, nil
+}
+
+// ListWebAuthnCredentials lists the passkeys registered by the user
+func (s *UserManagementService) ListWebAuthnCredentials(
+	ctx context.Context,
+	in *pb.ListWebAuthnCredentialsRequest,
+) (*pb.ListWebAuthnCredentialsResponse, error) {
+	credentials, err := actions.ListWebAuthnCredentials(int(in.UserId), s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &pb.ListWebAuthnCredentialsResponse{}
+	for _, credential := range credentials {
+		var lastUsedAt string
+		if credential.LastUsedAt.Valid {
+			lastUsedAt = credential.LastUsedAt.Time.Format(time.RFC3339)
+		}
+		response.Credentials = append(response.Credentials, &pb.WebAuthnCredential{
+			Id:         uint64(credential.ID),
+			Name:       credential.Name,
+			CreatedAt:  credential.CreatedAt.Format(time.RFC3339),
+			LastUsedAt: lastUsedAt,
+		})
+	}
+
+	return response, nil
+}
+
+// DeleteWebAuthnCredential removes a passkey of the user
+func (s *UserManagementService) DeleteWebAuthnCredential(
+	ctx context.Context,
+	in *pb.DeleteWebAuthnCredentialRequest,
+) (*pb.DeleteWebAuthnCredentialResponse, error) {
+	err := actions.DeleteWebAuthnCredential(int(in.UserId), int(in.CredentialId), s.UserManagementServiceDB.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.DeleteWebAuthnCredentialResponse{Message: "Credential deleted successfully"}, nil
+}
+
+// verifyWebAuthnAssertion checks an assertion sent as the code of a MFA challenge against the
+// options returned by BeginWebAuthnMFA
+func (s *UserManagementService) verifyWebAuthnAssertion(challenge models.MFAChallenge, assertion string) (bool, error) {
+	if !challenge.WebAuthnSession.Valid {
+		return false, nil
+	}
+
+	var data webauthn.SessionData
+	if err := json.Unmarshal([]byte(challenge.WebAuthnSession.String), &data); err != nil {
+		return false, status.Error(codes.Internal, "failed to decode the WebAuthn session")
+	}
+
+	parsedResponse, err := protocol.ParseCredentialRequestResponseBody(strings.NewReader(assertion))
+	if err != nil {
+		return false, nil
+	}
+
+	webAuthnUser, err := s.getWebAuthnUser(challenge.UserID)
+	if err != nil {
+		return false, err
+	}
+
+	credential, err := s.WebAuthn.ValidateLogin(webAuthnUser, data, parsedResponse)
+	if err != nil {
+		return false, nil
+	}
+
+	if err := s.recordWebAuthnAssertion(credential); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// hasWebAuthn reports whether the user registered at least one passkey
+func (s *UserManagementService) hasWebAuthn(userID int) (bool, error) {
+	credentials, err := actions.ListWebAuthnCredentials(userID, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return false, err
+	}
+	return len(credentials) > 0, nil
+}
+
+// recordWebAuthnAssertion rejects the assertions of cloned authenticators and stores the new sign
+// count of the credential
+func (s *UserManagementService) recordWebAuthnAssertion(credential *webauthn.Credential) error {
+	if credential.Authenticator.CloneWarning {
+		return status.Error(codes.Unauthenticated, "the authenticator may have been cloned")
+	}
+	return actions.UpdateWebAuthnCredentialUsage(credential, s.UserManagementServiceDB.DB)
+}
+
+func (s *UserManagementService) getWebAuthnUser(userID int) (utils.WebAuthnUser, error) {
+	user, err := utils.GetUserByID(userID, s.UserManagementServiceDB.DB)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return utils.WebAuthnUser{}, status.Error(codes.NotFound, "user not found")
+		}
+		return utils.WebAuthnUser{}, status.Error(codes.Internal, "failed to query the database")
+	}
+
+	credentials, err := actions.GetWebAuthnCredentials(user.ID, s.UserManagementServiceDB.DB)
+	if err != nil {
+		return utils.WebAuthnUser{}, err
+	}
+
+	return utils.WebAuthnUser{User: user, Credentials: credentials}, nil
+}
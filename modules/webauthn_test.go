@@ -0,0 +1,247 @@
+package modules
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/descope/virtualwebauthn"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassouf/authentication-service/consts"
+	"github.com/isaacwassouf/authentication-service/database"
+	pb "github.com/isaacwassouf/authentication-service/protobufs/users_management_service"
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+const webAuthnTestUserID = 7
+
+var webAuthnTestRelyingParty = virtualwebauthn.RelyingParty{
+	ID:     "localhost",
+	Name:   "Authentication Service",
+	Origin: "http://localhost:5173",
+}
+
+// webAuthnLoginTest holds a service backed by a mocked database and a passkey login started on it
+type webAuthnLoginTest struct {
+	service    *UserManagementService
+	mock       sqlmock.Sqlmock
+	session    []byte
+	credential virtualwebauthn.Credential
+	assertion  string
+}
+
+func newWebAuthnLoginTest(t *testing.T) *webAuthnLoginTest {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create the database mock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	webAuthn, err := utils.NewWebAuthn()
+	if err != nil {
+		t.Fatalf("failed to create the relying party: %v", err)
+	}
+
+	options, session, err := webAuthn.BeginDiscoverableLogin()
+	if err != nil {
+		t.Fatalf("failed to begin the login: %v", err)
+	}
+	encodedOptions, err := json.Marshal(options)
+	if err != nil {
+		t.Fatalf("failed to encode the options: %v", err)
+	}
+	encodedSession, err := json.Marshal(session)
+	if err != nil {
+		t.Fatalf("failed to encode the session: %v", err)
+	}
+
+	assertionOptions, err := virtualwebauthn.ParseAssertionOptions(string(encodedOptions))
+	if err != nil {
+		t.Fatalf("failed to parse the options: %v", err)
+	}
+	authenticator := virtualwebauthn.NewAuthenticatorWithOptions(virtualwebauthn.AuthenticatorOptions{
+		UserHandle: utils.WebAuthnUserHandle(webAuthnTestUserID),
+	})
+	credential := virtualwebauthn.NewCredential(virtualwebauthn.KeyTypeEC2)
+	authenticator.AddCredential(credential)
+
+	return &webAuthnLoginTest{
+		service: &UserManagementService{
+			UserManagementServiceDB: &database.UserManagementServiceDB{DB: db},
+			WebAuthn:                webAuthn,
+		},
+		mock:       mock,
+		session:    encodedSession,
+		credential: credential,
+		assertion:  virtualwebauthn.CreateAssertionResponse(webAuthnTestRelyingParty, authenticator, credential, *assertionOptions),
+	}
+}
+
+func (test *webAuthnLoginTest) finish() error {
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("203.0.113.5"), Port: 443}})
+	_, err := test.service.FinishWebAuthnLogin(ctx, &pb.FinishWebAuthnLoginRequest{
+		SessionId:  "session",
+		Credential: test.assertion,
+	})
+	return err
+}
+
+func (test *webAuthnLoginTest) expectThrottleSettings() {
+	for i := 0; i < 5; i++ {
+		test.mock.ExpectQuery("FROM settings").WillReturnRows(sqlmock.NewRows([]string{"value"}))
+	}
+}
+
+func (test *webAuthnLoginTest) expectLoginFailure(lockedUntil *time.Time) {
+	rows := sqlmock.NewRows([]string{"id", "subject", "failed_count", "last_failed_at", "locked_until"})
+	if lockedUntil != nil {
+		rows.AddRow(1, "subject", 0, time.Now(), *lockedUntil)
+	}
+	test.mock.ExpectQuery("FROM login_failures").WillReturnRows(rows)
+}
+
+func (test *webAuthnLoginTest) expectSession() {
+	test.mock.ExpectBegin()
+	test.mock.ExpectQuery("FROM webauthn_sessions").WillReturnRows(
+		sqlmock.NewRows([]string{"id", "session", "ceremony", "user_id", "data", "expires_at", "created_at"}).
+			AddRow(1, "session", "login", nil, string(test.session), time.Now().Add(time.Minute), time.Now()),
+	)
+	test.mock.ExpectExec("DELETE FROM webauthn_sessions").WillReturnResult(sqlmock.NewResult(0, 1))
+	test.mock.ExpectCommit()
+}
+
+// expectUser returns the user with a credential of the given public key
+func (test *webAuthnLoginTest) expectUser(publicKey []byte) {
+	test.mock.ExpectQuery("FROM users").WillReturnRows(
+		sqlmock.NewRows([]string{"id", "name", "email", "is_verified", "provider"}).
+			AddRow(webAuthnTestUserID, "Jane", "jane@example.com", true, nil),
+	)
+	test.mock.ExpectQuery("FROM users_webauthn_credentials").WillReturnRows(
+		sqlmock.NewRows([]string{
+			"id", "user_id", "credential_id", "name", "public_key", "attestation_type", "aaguid",
+			"sign_count", "transports", "backup_eligible", "backup_state", "last_used_at", "created_at",
+		}).AddRow(
+			1, webAuthnTestUserID, base64.RawURLEncoding.EncodeToString(test.credential.ID), "passkey", publicKey,
+			"none", make([]byte, 16), 0, "internal", false, false, nil, time.Now(),
+		),
+	)
+}
+
+// expectLoginAudit expects the login to be audited with the outcome, actorID is nil while the user
+// is unknown
+func (test *webAuthnLoginTest) expectLoginAudit(actorID interface{}, outcome string) {
+	test.mock.ExpectBegin()
+	test.mock.ExpectQuery("FROM audit_chain").WillReturnRows(sqlmock.NewRows([]string{"hash"}).AddRow("hash"))
+	test.mock.ExpectExec("INSERT INTO audit_events").
+		WithArgs(
+			consts.AUDIT_USER_LOGIN, consts.AUDIT_ACTOR_USER, actorID, sqlmock.AnyArg(), sqlmock.AnyArg(),
+			"203.0.113.5", outcome, sqlmock.AnyArg(), "hash", sqlmock.AnyArg(), sqlmock.AnyArg(),
+		).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	test.mock.ExpectExec("UPDATE audit_chain").WillReturnResult(sqlmock.NewResult(0, 1))
+	test.mock.ExpectCommit()
+}
+
+func TestFinishWebAuthnLoginRecordsFailedAssertion(t *testing.T) {
+	test := newWebAuthnLoginTest(t)
+
+	// the stored public key is not the one the assertion is signed with
+	otherCredential := virtualwebauthn.NewCredential(virtualwebauthn.KeyTypeEC2)
+
+	test.expectThrottleSettings()
+	test.expectLoginFailure(nil)
+	test.expectSession()
+	test.expectUser(otherCredential.Key.SigningKey.KeyData())
+	test.expectLoginFailure(nil)
+	test.expectLoginFailure(nil)
+	// the failure is counted against the account and the IP
+	test.mock.ExpectExec("INSERT INTO login_failures").WillReturnResult(sqlmock.NewResult(1, 1))
+	test.mock.ExpectExec("INSERT INTO login_failures").WillReturnResult(sqlmock.NewResult(1, 1))
+
+	test.expectLoginAudit(int64(webAuthnTestUserID), consts.AUDIT_OUTCOME_FAILURE)
+
+	err := test.finish()
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected Unauthenticated, got %v", err)
+	}
+	if err := test.mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFinishWebAuthnLoginRejectsLockedIP(t *testing.T) {
+	test := newWebAuthnLoginTest(t)
+	lockedUntil := time.Now().Add(time.Minute)
+
+	test.expectThrottleSettings()
+	test.expectLoginFailure(&lockedUntil)
+
+	test.expectLoginAudit(nil, consts.AUDIT_OUTCOME_FAILURE)
+
+	// the session is not consumed and the assertion is not verified
+	err := test.finish()
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted, got %v", err)
+	}
+	if err := test.mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFinishWebAuthnLoginRejectsLockedAccount(t *testing.T) {
+	test := newWebAuthnLoginTest(t)
+	lockedUntil := time.Now().Add(time.Minute)
+
+	test.expectThrottleSettings()
+	test.expectLoginFailure(nil)
+	test.expectSession()
+	test.expectUser(test.credential.Key.SigningKey.KeyData())
+	test.expectLoginFailure(&lockedUntil)
+
+	test.expectLoginAudit(int64(webAuthnTestUserID), consts.AUDIT_OUTCOME_FAILURE)
+
+	// a valid assertion does not log in to a locked account, and is not counted as a failure
+	err := test.finish()
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted, got %v", err)
+	}
+	if err := test.mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFinishWebAuthnLoginClearsFailures(t *testing.T) {
+	test := newWebAuthnLoginTest(t)
+
+	test.expectThrottleSettings()
+	test.expectLoginFailure(nil)
+	test.expectSession()
+	test.expectUser(test.credential.Key.SigningKey.KeyData())
+	test.expectLoginFailure(nil)
+	test.expectLoginFailure(nil)
+	test.mock.ExpectExec("UPDATE users_webauthn_credentials").WillReturnResult(sqlmock.NewResult(0, 1))
+	test.mock.ExpectExec("DELETE FROM login_failures").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// the tokens are issued once the assertion is verified, the failure stops the test there
+	test.mock.ExpectQuery("SELECT token_version").WillReturnError(errors.New("stop"))
+
+	test.expectLoginAudit(int64(webAuthnTestUserID), consts.AUDIT_OUTCOME_FAILURE)
+
+	err := test.finish()
+	if status.Code(err) == codes.Unauthenticated || status.Code(err) == codes.ResourceExhausted {
+		t.Fatalf("expected the assertion to be accepted, got %v", err)
+	}
+	if err := test.mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,106 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/isaacwassouf/authentication-service/models"
+)
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// TokenResponse is the response of the token endpoint of a provider
+type TokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	IDToken          string `json:"id_token"`
+	Scope            string `json:"scope"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// ExchangeCode exchanges an authorization code for the provider tokens, proving with the PKCE
+// code verifier that the code was requested by this service
+func ExchangeCode(
+	ctx context.Context,
+	tokenURL string,
+	credentials models.AuthProviderCredentials,
+	code string,
+	codeVerifier string,
+) (TokenResponse, error) {
+	var tokenResponse TokenResponse
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", credentials.RedirectURL)
+	form.Set("client_id", credentials.ClientID)
+	form.Set("client_secret", credentials.ClientSecret)
+	form.Set("code_verifier", codeVerifier)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return tokenResponse, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+
+	err = doJSON(request, &tokenResponse)
+	if err != nil {
+		return tokenResponse, err
+	}
+
+	// some providers, e.g., GitHub, report the errors with a 200 status
+	if tokenResponse.Error != "" {
+		return tokenResponse, fmt.Errorf("token exchange failed: %s %s", tokenResponse.Error, tokenResponse.ErrorDescription)
+	}
+	if tokenResponse.AccessToken == "" {
+		return tokenResponse, fmt.Errorf("token exchange failed: no access token")
+	}
+
+	return tokenResponse, nil
+}
+
+// getJSON fetches a JSON document, authenticated with the access token if one is given
+func getJSON(ctx context.Context, endpoint string, accessToken string, out interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/json")
+	if accessToken != "" {
+		request.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	return doJSON(request, out)
+}
+
+func doJSON(request *http.Request, out interface{}) error {
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode >= http.StatusBadRequest {
+		// token endpoints describe the failure in the body
+		var errorResponse TokenResponse
+		if json.Unmarshal(body, &errorResponse) == nil && errorResponse.Error != "" {
+			return fmt.Errorf("%s returned %d: %s %s", request.URL.Host, response.StatusCode, errorResponse.Error, errorResponse.ErrorDescription)
+		}
+		return fmt.Errorf("%s returned %d", request.URL.Host, response.StatusCode)
+	}
+
+	return json.Unmarshal(body, out)
+}
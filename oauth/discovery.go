@@ -0,0 +1,63 @@
+package oauth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Discovery is the OpenID Connect discovery document of an issuer
+type Discovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	UserinfoEndpoint      string   `json:"userinfo_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	ScopesSupported       []string `json:"scopes_supported"`
+}
+
+type cachedDiscovery struct {
+	discovery Discovery
+	fetchedAt time.Time
+}
+
+var (
+	discoveriesMu sync.Mutex
+	discoveries   = map[string]cachedDiscovery{}
+)
+
+const discoveryTTL = time.Hour
+
+// Discover fetches the discovery document of an issuer, the documents are cached for an hour
+func Discover(ctx context.Context, issuer string) (Discovery, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+
+	discoveriesMu.Lock()
+	cached, ok := discoveries[issuer]
+	discoveriesMu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < discoveryTTL {
+		return cached.discovery, nil
+	}
+
+	var discovery Discovery
+	err := getJSON(ctx, issuer+"/.well-known/openid-configuration", "", &discovery)
+	if err != nil {
+		return discovery, fmt.Errorf("failed to fetch the discovery document: %w", err)
+	}
+
+	// the issuer of the document must be the one that was asked for
+	if strings.TrimSuffix(discovery.Issuer, "/") != issuer {
+		return discovery, fmt.Errorf("discovery document issuer %q does not match %q", discovery.Issuer, issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return discovery, fmt.Errorf("discovery document of %q is incomplete", issuer)
+	}
+
+	discoveriesMu.Lock()
+	discoveries[issuer] = cachedDiscovery{discovery: discovery, fetchedAt: time.Now()}
+	discoveriesMu.Unlock()
+
+	return discovery, nil
+}
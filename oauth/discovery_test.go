@@ -0,0 +1,69 @@
+package oauth
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDiscover(t *testing.T) {
+	tests := []struct {
+		name string
+		// document changes the discovery document of a valid issuer
+		document    func(issuer *fakeIssuer)
+		expectError bool
+	}{
+		{name: "valid document", document: func(issuer *fakeIssuer) {}},
+		{
+			name:     "trailing slash",
+			document: func(issuer *fakeIssuer) { issuer.discovery.Issuer += "/" },
+		},
+		{
+			name:        "other issuer",
+			document:    func(issuer *fakeIssuer) { issuer.discovery.Issuer = "https://attacker.example.com" },
+			expectError: true,
+		},
+		{
+			name:        "no token endpoint",
+			document:    func(issuer *fakeIssuer) { issuer.discovery.TokenEndpoint = "" },
+			expectError: true,
+		},
+		{
+			name:        "no keys",
+			document:    func(issuer *fakeIssuer) { issuer.discovery.JWKSURI = "" },
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		// the documents are cached by issuer, every case gets its own
+		issuer := newFakeIssuer(t)
+		test.document(issuer)
+
+		discovery, err := Discover(context.Background(), issuer.server.URL)
+		if test.expectError {
+			if err == nil {
+				t.Errorf("%s: expected the discovery document to be rejected", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if discovery.JWKSURI != issuer.server.URL+"/jwks" {
+			t.Errorf("%s: unexpected discovery document %+v", test.name, discovery)
+		}
+	}
+}
+
+func TestDiscoverCachesDocument(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	if _, err := Discover(context.Background(), issuer.server.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	// the cached document is used while the provider is unreachable
+	issuer.server.Close()
+	if _, err := Discover(context.Background(), issuer.server.URL+"/"); err != nil {
+		t.Fatalf("expected the cached discovery document, got %v", err)
+	}
+}
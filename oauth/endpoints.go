@@ -0,0 +1,35 @@
+package oauth
+
+import (
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+// Endpoints are the URLs of an OAuth provider, they can be overridden from the environment
+// so that a local fake provider can be used instead
+type Endpoints struct {
+	AuthorizationURL string
+	TokenURL         string
+	JWKSURL          string
+	APIURL           string
+	Issuers          []string
+}
+
+func GoogleEndpoints() Endpoints {
+	return Endpoints{
+		AuthorizationURL: utils.GetEnvVar("GOOGLE_AUTHORIZATION_URL", "https://accounts.google.com/o/oauth2/v2/auth"),
+		TokenURL:         utils.GetEnvVar("GOOGLE_TOKEN_URL", "https://oauth2.googleapis.com/token"),
+		JWKSURL:          utils.GetEnvVar("GOOGLE_JWKS_URL", "https://www.googleapis.com/oauth2/v3/certs"),
+		Issuers: []string{
+			utils.GetEnvVar("GOOGLE_ISSUER", "https://accounts.google.com"),
+			"accounts.google.com",
+		},
+	}
+}
+
+func GitHubEndpoints() Endpoints {
+	return Endpoints{
+		AuthorizationURL: utils.GetEnvVar("GITHUB_AUTHORIZATION_URL", "https://github.com/login/oauth/authorize"),
+		TokenURL:         utils.GetEnvVar("GITHUB_TOKEN_URL", "https://github.com/login/oauth/access_token"),
+		APIURL:           utils.GetEnvVar("GITHUB_API_URL", "https://api.github.com"),
+	}
+}
@@ -0,0 +1,88 @@
+package oauth
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/isaacwassouf/authentication-service/consts"
+	"github.com/isaacwassouf/authentication-service/models"
+)
+
+type gitHubUser struct {
+	ID    int64  `json:"id"`
+	Login string `json:"login"`
+	Name  string `json:"name"`
+}
+
+type gitHubEmail struct {
+	Email    string `json:"email"`
+	Primary  bool   `json:"primary"`
+	Verified bool   `json:"verified"`
+}
+
+type gitHubProvider struct{}
+
+func init() {
+	Register(gitHubProvider{})
+}
+
+func (gitHubProvider) Type() string {
+	return consts.GITHUB
+}
+
+func (gitHubProvider) Scopes() string {
+	return "read:user user:email"
+}
+
+func (p gitHubProvider) AuthorizationURL(ctx context.Context, config models.AuthProvider, request AuthorizationRequest) (string, error) {
+	return buildAuthorizationURL(GitHubEndpoints().AuthorizationURL, scopesOf(p, config), request, nil)
+}
+
+func (gitHubProvider) Exchange(
+	ctx context.Context,
+	config models.AuthProvider,
+	credentials models.AuthProviderCredentials,
+	code string,
+	codeVerifier string,
+) (TokenResponse, error) {
+	return ExchangeCode(ctx, GitHubEndpoints().TokenURL, credentials, code, codeVerifier)
+}
+
+// Identity fetches the profile of the user from the GitHub API
+func (gitHubProvider) Identity(
+	ctx context.Context,
+	config models.AuthProvider,
+	credentials models.AuthProviderCredentials,
+	token TokenResponse,
+	nonce string,
+) (models.ExternalIdentity, error) {
+	var identity models.ExternalIdentity
+	endpoints := GitHubEndpoints()
+
+	var user gitHubUser
+	err := getJSON(ctx, endpoints.APIURL+"/user", token.AccessToken, &user)
+	if err != nil {
+		return identity, err
+	}
+
+	// the public email of the profile may be unverified, use the primary verified one instead
+	var emails []gitHubEmail
+	err = getJSON(ctx, endpoints.APIURL+"/user/emails", token.AccessToken, &emails)
+	if err != nil {
+		return identity, err
+	}
+
+	identity.Identifier = strconv.FormatInt(user.ID, 10)
+	identity.Name = user.Name
+	if identity.Name == "" {
+		identity.Name = user.Login
+	}
+	for _, email := range emails {
+		if email.Primary && email.Verified {
+			identity.Email = email.Email
+			identity.EmailVerified = true
+		}
+	}
+
+	return identity, nil
+}
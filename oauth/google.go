@@ -0,0 +1,74 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+
+	"github.com/isaacwassouf/authentication-service/consts"
+	"github.com/isaacwassouf/authentication-service/models"
+)
+
+type googleProvider struct{}
+
+func init() {
+	Register(googleProvider{})
+}
+
+func (googleProvider) Type() string {
+	return consts.GOOGLE
+}
+
+func (googleProvider) Scopes() string {
+	return "openid email profile"
+}
+
+func (p googleProvider) AuthorizationURL(ctx context.Context, config models.AuthProvider, request AuthorizationRequest) (string, error) {
+	return buildAuthorizationURL(GoogleEndpoints().AuthorizationURL, scopesOf(p, config), request, map[string]string{"nonce": request.Nonce})
+}
+
+func (googleProvider) Exchange(
+	ctx context.Context,
+	config models.AuthProvider,
+	credentials models.AuthProviderCredentials,
+	code string,
+	codeVerifier string,
+) (TokenResponse, error) {
+	return ExchangeCode(ctx, GoogleEndpoints().TokenURL, credentials, code, codeVerifier)
+}
+
+// Identity verifies the ID token returned by Google
+func (googleProvider) Identity(
+	ctx context.Context,
+	config models.AuthProvider,
+	credentials models.AuthProviderCredentials,
+	token TokenResponse,
+	nonce string,
+) (models.ExternalIdentity, error) {
+	var identity models.ExternalIdentity
+	endpoints := GoogleEndpoints()
+
+	if token.IDToken == "" {
+		return identity, errors.New("google did not return an ID token")
+	}
+
+	claims, err := VerifyIDToken(token.IDToken, KeySetFor(endpoints.JWKSURL), credentials.ClientID, endpoints.Issuers)
+	if err != nil {
+		return identity, err
+	}
+
+	// the nonce binds the ID token to the authorization request
+	if claims.Nonce != nonce {
+		return identity, errors.New("ID token nonce does not match")
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return identity, errors.New("google account email is not verified")
+	}
+
+	return models.ExternalIdentity{
+		Identifier:    claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: true,
+		Name:          claims.Name,
+	}, nil
+}
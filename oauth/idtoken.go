@@ -0,0 +1,81 @@
+package oauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// IDTokenClaims are the claims of an OpenID Connect ID token that are used to identify the user
+type IDTokenClaims struct {
+	Email         string       `json:"email"`
+	EmailVerified flexibleBool `json:"email_verified"`
+	Name          string       `json:"name"`
+	Nonce         string       `json:"nonce"`
+	jwt.RegisteredClaims
+}
+
+// flexibleBool accepts both booleans and strings since some providers send "true"
+type flexibleBool bool
+
+func (b *flexibleBool) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case bool:
+		*b = flexibleBool(v)
+	case string:
+		*b = v == "true"
+	}
+	return nil
+}
+
+var (
+	keySetsMu sync.Mutex
+	keySets   = map[string]*RemoteKeySet{}
+)
+
+// KeySetFor returns the cached key set of a JWKS URL
+func KeySetFor(url string) *RemoteKeySet {
+	keySetsMu.Lock()
+	defer keySetsMu.Unlock()
+
+	keySet, ok := keySets[url]
+	if !ok {
+		keySet = NewRemoteKeySet(url)
+		keySets[url] = keySet
+	}
+	return keySet
+}
+
+// VerifyIDToken checks the signature, audience, issuer and expiry of an ID token
+func VerifyIDToken(idToken string, keys *RemoteKeySet, clientID string, issuers []string) (*IDTokenClaims, error) {
+	claims := &IDTokenClaims{}
+	_, err := jwt.ParseWithClaims(
+		idToken,
+		claims,
+		keys.Keyfunc,
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithAudience(clientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+
+	if !slices.Contains(issuers, claims.Issuer) {
+		return nil, fmt.Errorf("unexpected ID token issuer %q", claims.Issuer)
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,129 @@
+package oauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestVerifyIDToken(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	keys := NewRemoteKeySet(issuer.discovery.JWKSURI)
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate the key: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		// token builds the ID token from the claims of a valid one
+		token       func(claims *IDTokenClaims) string
+		expectError bool
+	}{
+		{
+			name:  "valid token",
+			token: func(claims *IDTokenClaims) string { return issuer.sign(t, claims) },
+		},
+		{
+			name:        "signed by another key",
+			token:       func(claims *IDTokenClaims) string { return signWith(t, otherKey, "kid", claims) },
+			expectError: true,
+		},
+		{
+			name:        "unknown key id",
+			token:       func(claims *IDTokenClaims) string { return signWith(t, issuer.key, "other", claims) },
+			expectError: true,
+		},
+		{
+			name: "symmetric algorithm",
+			token: func(claims *IDTokenClaims) string {
+				signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("client-secret"))
+				if err != nil {
+					t.Fatalf("failed to sign the token: %v", err)
+				}
+				return signed
+			},
+			expectError: true,
+		},
+		{
+			name: "unsigned token",
+			token: func(claims *IDTokenClaims) string {
+				signed, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+				if err != nil {
+					t.Fatalf("failed to encode the token: %v", err)
+				}
+				return signed
+			},
+			expectError: true,
+		},
+		{
+			name: "other issuer",
+			token: func(claims *IDTokenClaims) string {
+				claims.Issuer = "https://attacker.example.com"
+				return issuer.sign(t, claims)
+			},
+			expectError: true,
+		},
+		{
+			name: "other audience",
+			token: func(claims *IDTokenClaims) string {
+				claims.Audience = jwt.ClaimStrings{"other-client"}
+				return issuer.sign(t, claims)
+			},
+			expectError: true,
+		},
+		{
+			name: "expired",
+			token: func(claims *IDTokenClaims) string {
+				claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+				return issuer.sign(t, claims)
+			},
+			expectError: true,
+		},
+		{
+			name: "no expiry",
+			token: func(claims *IDTokenClaims) string {
+				claims.ExpiresAt = nil
+				return issuer.sign(t, claims)
+			},
+			expectError: true,
+		},
+		{
+			name: "issued in the future",
+			token: func(claims *IDTokenClaims) string {
+				claims.IssuedAt = jwt.NewNumericDate(time.Now().Add(time.Hour))
+				return issuer.sign(t, claims)
+			},
+			expectError: true,
+		},
+		{
+			name: "no subject",
+			token: func(claims *IDTokenClaims) string {
+				claims.Subject = ""
+				return issuer.sign(t, claims)
+			},
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		claims, err := VerifyIDToken(test.token(issuer.claims()), keys, "client", []string{issuer.server.URL})
+		if test.expectError {
+			if err == nil {
+				t.Errorf("%s: expected the ID token to be rejected", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if claims.Subject != "subject" || claims.Nonce != "nonce" || !bool(claims.EmailVerified) {
+			t.Errorf("%s: unexpected claims %+v", test.name, claims)
+		}
+	}
+}
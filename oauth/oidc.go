@@ -0,0 +1,111 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+
+	"github.com/isaacwassouf/authentication-service/consts"
+	"github.com/isaacwassouf/authentication-service/models"
+)
+
+// DefaultOIDCScopes are requested when no scopes are configured for a provider
+const DefaultOIDCScopes = "openid email profile"
+
+type userinfo struct {
+	Subject       string       `json:"sub"`
+	Email         string       `json:"email"`
+	EmailVerified flexibleBool `json:"email_verified"`
+	Name          string       `json:"name"`
+}
+
+// oidcProvider handles any OpenID Connect provider from its discovery document,
+// e.g., Okta, Keycloak, Azure AD or Auth0
+type oidcProvider struct{}
+
+func init() {
+	Register(oidcProvider{})
+}
+
+func (oidcProvider) Type() string {
+	return consts.OIDC
+}
+
+func (oidcProvider) Scopes() string {
+	return DefaultOIDCScopes
+}
+
+func (p oidcProvider) AuthorizationURL(ctx context.Context, config models.AuthProvider, request AuthorizationRequest) (string, error) {
+	discovery, err := Discover(ctx, config.IssuerURL)
+	if err != nil {
+		return "", err
+	}
+	return buildAuthorizationURL(discovery.AuthorizationEndpoint, scopesOf(p, config), request, map[string]string{"nonce": request.Nonce})
+}
+
+func (oidcProvider) Exchange(
+	ctx context.Context,
+	config models.AuthProvider,
+	credentials models.AuthProviderCredentials,
+	code string,
+	codeVerifier string,
+) (TokenResponse, error) {
+	discovery, err := Discover(ctx, config.IssuerURL)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	return ExchangeCode(ctx, discovery.TokenEndpoint, credentials, code, codeVerifier)
+}
+
+// Identity verifies the ID token against the keys published by the issuer
+func (oidcProvider) Identity(
+	ctx context.Context,
+	config models.AuthProvider,
+	credentials models.AuthProviderCredentials,
+	token TokenResponse,
+	nonce string,
+) (models.ExternalIdentity, error) {
+	var identity models.ExternalIdentity
+
+	discovery, err := Discover(ctx, config.IssuerURL)
+	if err != nil {
+		return identity, err
+	}
+
+	if token.IDToken == "" {
+		return identity, errors.New("the provider did not return an ID token")
+	}
+
+	claims, err := VerifyIDToken(token.IDToken, KeySetFor(discovery.JWKSURI), credentials.ClientID, []string{discovery.Issuer})
+	if err != nil {
+		return identity, err
+	}
+	if claims.Nonce != nonce {
+		return identity, errors.New("ID token nonce does not match")
+	}
+
+	identity.Identifier = claims.Subject
+	identity.Email = claims.Email
+	identity.EmailVerified = bool(claims.EmailVerified)
+	identity.Name = claims.Name
+
+	// some providers only put the profile in the userinfo response
+	if (identity.Email == "" || identity.Name == "") && discovery.UserinfoEndpoint != "" {
+		var info userinfo
+		err = getJSON(ctx, discovery.UserinfoEndpoint, token.AccessToken, &info)
+		if err != nil {
+			return identity, err
+		}
+		if info.Subject != claims.Subject {
+			return identity, errors.New("userinfo subject does not match the ID token")
+		}
+		if identity.Email == "" {
+			identity.Email = info.Email
+			identity.EmailVerified = bool(info.EmailVerified)
+		}
+		if identity.Name == "" {
+			identity.Name = info.Name
+		}
+	}
+
+	return identity, nil
+}
@@ -0,0 +1,178 @@
+package oauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/isaacwassouf/authentication-service/models"
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+// fakeIssuer is an OpenID Connect provider serving its discovery document, its keys, a token
+// endpoint that checks the PKCE code verifier and a userinfo endpoint
+type fakeIssuer struct {
+	server    *httptest.Server
+	key       *ecdsa.PrivateKey
+	discovery Discovery
+	// codeChallenge is the challenge of the authorization the token endpoint exchanges
+	codeChallenge string
+	idToken       string
+	userinfo      userinfo
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate the key: %v", err)
+	}
+	issuer := &fakeIssuer{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(issuer.discovery)
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]utils.JSONWebKey{"keys": {{
+			Kty: "EC",
+			Use: "sig",
+			Kid: "kid",
+			Alg: "ES256",
+			Crv: "P-256",
+			X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if CodeChallenge(r.PostFormValue("code_verifier")) != issuer.codeChallenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(TokenResponse{Error: "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(TokenResponse{AccessToken: "access", TokenType: "Bearer", IDToken: issuer.idToken})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(issuer.userinfo)
+	})
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+
+	issuer.discovery = Discovery{
+		Issuer:                issuer.server.URL,
+		AuthorizationEndpoint: issuer.server.URL + "/authorize",
+		TokenEndpoint:         issuer.server.URL + "/token",
+		UserinfoEndpoint:      issuer.server.URL + "/userinfo",
+		JWKSURI:               issuer.server.URL + "/jwks",
+	}
+	return issuer
+}
+
+// claims returns the claims of a valid ID token issued to the client
+func (issuer *fakeIssuer) claims() *IDTokenClaims {
+	return &IDTokenClaims{
+		Email:         "jane@example.com",
+		EmailVerified: true,
+		Name:          "Jane",
+		Nonce:         "nonce",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer.server.URL,
+			Subject:   "subject",
+			Audience:  jwt.ClaimStrings{"client"},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+}
+
+// sign signs the claims with the key published by the issuer
+func (issuer *fakeIssuer) sign(t *testing.T, claims jwt.Claims) string {
+	t.Helper()
+	return signWith(t, issuer.key, "kid", claims)
+}
+
+func signWith(t *testing.T, key *ecdsa.PrivateKey, kid string, claims jwt.Claims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("failed to sign the token: %v", err)
+	}
+	return signed
+}
+
+func (issuer *fakeIssuer) config() models.AuthProvider {
+	return models.AuthProvider{IssuerURL: issuer.server.URL}
+}
+
+func TestOIDCIdentityChecksNonce(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	credentials := models.AuthProviderCredentials{ClientID: "client"}
+
+	tests := []struct {
+		name        string
+		tokenNonce  string
+		loginNonce  string
+		expectError bool
+	}{
+		{name: "matching nonce", tokenNonce: "nonce", loginNonce: "nonce"},
+		{name: "nonce of another login", tokenNonce: "other", loginNonce: "nonce", expectError: true},
+		{name: "missing nonce", tokenNonce: "", loginNonce: "nonce", expectError: true},
+	}
+	for _, test := range tests {
+		claims := issuer.claims()
+		claims.Nonce = test.tokenNonce
+		token := TokenResponse{AccessToken: "access", IDToken: issuer.sign(t, claims)}
+
+		identity, err := oidcProvider{}.Identity(context.Background(), issuer.config(), credentials, token, test.loginNonce)
+		if test.expectError {
+			if err == nil {
+				t.Errorf("%s: expected the ID token to be rejected", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if identity.Identifier != "subject" || identity.Email != "jane@example.com" || !identity.EmailVerified {
+			t.Errorf("%s: unexpected identity %+v", test.name, identity)
+		}
+	}
+}
+
+func TestOIDCIdentityChecksUserinfoSubject(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	credentials := models.AuthProviderCredentials{ClientID: "client"}
+
+	// the profile is only in the userinfo response
+	claims := issuer.claims()
+	claims.Email, claims.Name = "", ""
+	token := TokenResponse{AccessToken: "access", IDToken: issuer.sign(t, claims)}
+
+	issuer.userinfo = userinfo{Subject: "subject", Email: "jane@example.com", EmailVerified: true, Name: "Jane"}
+	identity, err := oidcProvider{}.Identity(context.Background(), issuer.config(), credentials, token, "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Email != "jane@example.com" || identity.Name != "Jane" {
+		t.Fatalf("expected the profile of the userinfo response, got %+v", identity)
+	}
+
+	issuer.userinfo.Subject = "other"
+	if _, err := (oidcProvider{}).Identity(context.Background(), issuer.config(), credentials, token, "nonce"); err == nil {
+		t.Fatal("expected the userinfo of another subject to be rejected")
+	}
+}
@@ -0,0 +1,21 @@
+package oauth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+
+	"github.com/matoous/go-nanoid/v2"
+)
+
+// the unreserved characters allowed in a code verifier by RFC 7636
+const codeVerifierAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-._~"
+
+func GenerateCodeVerifier() (string, error) {
+	return gonanoid.Generate(codeVerifierAlphabet, 64)
+}
+
+// CodeChallenge derives the S256 code challenge of a code verifier
+func CodeChallenge(codeVerifier string) string {
+	hash := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
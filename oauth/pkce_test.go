@@ -0,0 +1,104 @@
+package oauth
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/isaacwassouf/authentication-service/models"
+)
+
+func TestCodeChallenge(t *testing.T) {
+	// the example of RFC 7636 appendix B
+	challenge := CodeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	if challenge != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Fatalf("unexpected code challenge %s", challenge)
+	}
+}
+
+func TestGenerateCodeVerifier(t *testing.T) {
+	verifier, err := GenerateCodeVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verifier) < 43 || len(verifier) > 128 {
+		t.Fatalf("expected a verifier of 43 to 128 characters, got %d", len(verifier))
+	}
+	for _, c := range verifier {
+		if !strings.ContainsRune(codeVerifierAlphabet, c) {
+			t.Fatalf("unexpected character %q in the verifier", c)
+		}
+	}
+}
+
+func TestAuthorizationURLCarriesCodeChallenge(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	request := AuthorizationRequest{
+		ClientID:     "client",
+		RedirectURL:  "http://localhost:5173/callback",
+		State:        "state",
+		Nonce:        "nonce",
+		CodeVerifier: "verifier",
+	}
+
+	authorizationURL, err := oidcProvider{}.AuthorizationURL(context.Background(), issuer.config(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedURL, err := url.Parse(authorizationURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := parsedURL.Query()
+	expected := map[string]string{
+		"client_id":             "client",
+		"state":                 "state",
+		"nonce":                 "nonce",
+		"code_challenge":        CodeChallenge("verifier"),
+		"code_challenge_method": "S256",
+		"scope":                 DefaultOIDCScopes,
+	}
+	for key, value := range expected {
+		if query.Get(key) != value {
+			t.Errorf("expected %s to be %q, got %q", key, value, query.Get(key))
+		}
+	}
+	// the verifier itself never leaves the service through the browser
+	if strings.Contains(authorizationURL, "verifier") {
+		t.Error("expected the code verifier to stay out of the authorization URL")
+	}
+}
+
+func TestExchangeCodeSendsCodeVerifier(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	issuer.codeChallenge = CodeChallenge("verifier")
+	credentials := models.AuthProviderCredentials{ClientID: "client", ClientSecret: "secret"}
+
+	tests := []struct {
+		name         string
+		codeVerifier string
+		expectError  bool
+	}{
+		{name: "verifier of the authorization", codeVerifier: "verifier"},
+		{name: "verifier of another authorization", codeVerifier: "other", expectError: true},
+		{name: "no verifier", codeVerifier: "", expectError: true},
+	}
+	for _, test := range tests {
+		token, err := ExchangeCode(context.Background(), issuer.discovery.TokenEndpoint, credentials, "code", test.codeVerifier)
+		if test.expectError {
+			if err == nil {
+				t.Errorf("%s: expected the exchange to fail", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if token.AccessToken != "access" {
+			t.Errorf("%s: unexpected token response %+v", test.name, token)
+		}
+	}
+}
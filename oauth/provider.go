@@ -0,0 +1,102 @@
+package oauth
+
+import (
+	"context"
+	"net/url"
+	"sync"
+
+	"github.com/isaacwassouf/authentication-service/models"
+)
+
+// AuthorizationRequest holds the parameters of the authorization URL of a login attempt
+type AuthorizationRequest struct {
+	ClientID     string
+	RedirectURL  string
+	State        string
+	Nonce        string
+	CodeVerifier string
+}
+
+// Provider is implemented by every kind of external auth provider. Adding a provider takes an
+// implementation registered in its init function and a row in the auth_providers table whose
+// type matches Type.
+type Provider interface {
+	// Type is the value of auth_providers.type handled by the provider
+	Type() string
+	// Scopes are the scopes requested when none are configured for the provider
+	Scopes() string
+	// AuthorizationURL builds the URL the user is sent to in order to log in at the provider
+	AuthorizationURL(ctx context.Context, config models.AuthProvider, request AuthorizationRequest) (string, error)
+	// Exchange exchanges the authorization code for the provider tokens
+	Exchange(ctx context.Context, config models.AuthProvider, credentials models.AuthProviderCredentials, code string, codeVerifier string) (TokenResponse, error)
+	// Identity verifies the tokens and normalizes the profile of the user
+	Identity(ctx context.Context, config models.AuthProvider, credentials models.AuthProviderCredentials, token TokenResponse, nonce string) (models.ExternalIdentity, error)
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Provider{}
+)
+
+// Register makes a provider available for its type
+func Register(provider Provider) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[provider.Type()] = provider
+}
+
+// Lookup gets the provider registered for a type
+func Lookup(providerType string) (Provider, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	provider, ok := registry[providerType]
+	return provider, ok
+}
+
+// Authenticate exchanges the authorization code and returns the verified identity of the user
+func Authenticate(
+	ctx context.Context,
+	provider Provider,
+	config models.AuthProvider,
+	credentials models.AuthProviderCredentials,
+	code string,
+	codeVerifier string,
+	nonce string,
+) (models.ExternalIdentity, error) {
+	token, err := provider.Exchange(ctx, config, credentials, code, codeVerifier)
+	if err != nil {
+		return models.ExternalIdentity{}, err
+	}
+	return provider.Identity(ctx, config, credentials, token, nonce)
+}
+
+// scopesOf returns the scopes configured for a provider or its defaults
+func scopesOf(provider Provider, config models.AuthProvider) string {
+	if config.Scopes != "" {
+		return config.Scopes
+	}
+	return provider.Scopes()
+}
+
+// buildAuthorizationURL adds the standard authorization code parameters to an authorization endpoint
+func buildAuthorizationURL(endpoint string, scopes string, request AuthorizationRequest, params map[string]string) (string, error) {
+	baseURL, err := url.ParseRequestURI(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	query := baseURL.Query()
+	query.Set("client_id", request.ClientID)
+	query.Set("response_type", "code")
+	query.Set("scope", scopes)
+	query.Set("state", request.State)
+	query.Set("code_challenge", CodeChallenge(request.CodeVerifier))
+	query.Set("code_challenge_method", "S256")
+	query.Set("redirect_uri", request.RedirectURL)
+	for key, value := range params {
+		query.Set(key, value)
+	}
+	baseURL.RawQuery = query.Encode()
+
+	return baseURL.String(), nil
+}
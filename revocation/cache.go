@@ -0,0 +1,308 @@
+package revocation
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+
+	"github.com/isaacwassouf/authentication-service/models"
+)
+
+// userTokenState is the token version and the suspension of a user as last read from the database
+type userTokenState struct {
+	version   int
+	revoked   bool
+	fetchedAt time.Time
+}
+
+// adminTokenState is the token version of an admin and whether they were active when last read
+// from the database
+type adminTokenState struct {
+	version   int
+	active    bool
+	fetchedAt time.Time
+}
+
+// Cache answers whether a token is revoked without querying the database. It holds every
+// blacklisted token that did not expire yet, warmed from the tokens_blacklist table and kept up to
+// date through the pub/sub, along with the token versions of the users and the state of the admins
+// seen recently.
+type Cache struct {
+	db     *sql.DB
+	pubsub PubSub
+	// userTTL bounds how long a token version or an admin state is trusted when an event is missed
+	userTTL time.Duration
+
+	mu     sync.RWMutex
+	tokens map[string]time.Time
+	users  map[int]userTokenState
+	admins map[int]adminTokenState
+	// the generations count the invalidations of a user or an admin, a read from the database that
+	// started before an invalidation is not cached
+	userGenerations  map[int]uint64
+	adminGenerations map[int]uint64
+}
+
+func NewCache(db *sql.DB, pubsub PubSub) *Cache {
+	return &Cache{
+		db:      db,
+		pubsub:  pubsub,
+		userTTL: time.Minute * 5,
+		tokens:  map[string]time.Time{},
+		users:   map[int]userTokenState{},
+		admins:  map[int]adminTokenState{},
+
+		userGenerations:  map[int]uint64{},
+		adminGenerations: map[int]uint64{},
+	}
+}
+
+// Load subscribes to the revocations of the other instances and warms the cache, it must succeed
+// before the cache answers
+func (c *Cache) Load(ctx context.Context) error {
+	// subscribe first so that no revocation falls between the warm up and the subscription
+	if err := c.pubsub.Subscribe(ctx, c.apply); err != nil {
+		return err
+	}
+	return c.reload(ctx)
+}
+
+// IsRevoked reports whether the token was blacklisted or issued before the tokens of the user
+// were revoked
+func (c *Cache) IsRevoked(ctx context.Context, userID int, jti string, version int) (bool, error) {
+	c.mu.RLock()
+	_, blacklisted := c.tokens[jti]
+	state, ok := c.users[userID]
+	generation := c.userGenerations[userID]
+	c.mu.RUnlock()
+
+	if blacklisted {
+		return true, nil
+	}
+
+	if !ok || time.Since(state.fetchedAt) > c.userTTL {
+		var err error
+		state, err = c.fetchUser(ctx, userID, generation)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return state.revoked || version < state.version, nil
+}
+
+// IsAdminRevoked reports whether the admin token was blacklisted, issued before the password of the
+// admin changed or its admin deactivated or deleted
+func (c *Cache) IsAdminRevoked(ctx context.Context, adminID int, jti string, version int) (bool, error) {
+	c.mu.RLock()
+	_, blacklisted := c.tokens[jti]
+	state, ok := c.admins[adminID]
+	generation := c.adminGenerations[adminID]
+	c.mu.RUnlock()
+
+	if blacklisted {
+		return true, nil
+	}
+
+	if !ok || time.Since(state.fetchedAt) > c.userTTL {
+		var err error
+		state, err = c.fetchAdmin(ctx, adminID, generation)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return !state.active || version < state.version, nil
+}
+
+// IsBlacklisted reports whether the token was blacklisted, it is used for the tokens that are not
+// bound to a token version
+func (c *Cache) IsBlacklisted(jti string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, blacklisted := c.tokens[jti]
+	return blacklisted
+}
+
+// Revoke adds the blacklisted tokens to the cache and broadcasts them to the other instances
+func (c *Cache) Revoke(ctx context.Context, tokens ...models.BlacklistedToken) error {
+	for _, token := range tokens {
+		event := Event{Kind: EventToken, JTI: token.JTI, UserID: token.UserID, ExpiresAt: token.ExpiresAt}
+		c.apply(event)
+		if err := c.pubsub.Publish(ctx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InvalidateUser drops the cached token version of the user on every instance, it is called once
+// the version was bumped or the user suspended or reinstated
+func (c *Cache) InvalidateUser(ctx context.Context, userID int) error {
+	event := Event{Kind: EventUser, UserID: userID}
+	c.apply(event)
+	return c.pubsub.Publish(ctx, event)
+}
+
+// InvalidateAdmin drops the cached state of the admin on every instance, it is called once the
+// version was bumped or the admin deactivated or deleted
+func (c *Cache) InvalidateAdmin(ctx context.Context, adminID int) error {
+	event := Event{Kind: EventAdmin, UserID: adminID}
+	c.apply(event)
+	return c.pubsub.Publish(ctx, event)
+}
+
+// Run prunes the expired tokens from the blacklist and the cache until the context is done. The
+// cache is reloaded from the blacklist on every run to recover the events that were missed.
+func (c *Cache) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Prune(ctx); err != nil {
+				log.Printf("failed to prune the token blacklist: %v", err)
+			}
+		}
+	}
+}
+
+// Prune deletes the blacklisted tokens that expired and reloads the cache
+func (c *Cache) Prune(ctx context.Context) error {
+	result, err := sq.Delete("tokens_blacklist").
+		Where(sq.Lt{"expires_at": time.Now()}).
+		RunWith(c.db).
+		ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	if pruned, err := result.RowsAffected(); err == nil && pruned > 0 {
+		log.Printf("pruned %d expired tokens from the blacklist", pruned)
+	}
+
+	return c.reload(ctx)
+}
+
+func (c *Cache) apply(event Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch event.Kind {
+	case EventToken:
+		c.tokens[event.JTI] = event.ExpiresAt
+	case EventUser:
+		delete(c.users, event.UserID)
+		c.userGenerations[event.UserID]++
+	case EventAdmin:
+		delete(c.admins, event.UserID)
+		c.adminGenerations[event.UserID]++
+	}
+}
+
+func (c *Cache) reload(ctx context.Context) error {
+	now := time.Now()
+	rows, err := sq.Select("jti", "expires_at").
+		From("tokens_blacklist").
+		Where(sq.Gt{"expires_at": now}).
+		RunWith(c.db).
+		QueryContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	tokens := map[string]time.Time{}
+	for rows.Next() {
+		var jti string
+		var expiresAt time.Time
+		if err := rows.Scan(&jti, &expiresAt); err != nil {
+			return err
+		}
+		tokens[jti] = expiresAt
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// keep the revocations received while reloading
+	for jti, expiresAt := range c.tokens {
+		if _, ok := tokens[jti]; !ok && expiresAt.After(now) {
+			tokens[jti] = expiresAt
+		}
+	}
+	c.tokens = tokens
+
+	for userID, state := range c.users {
+		if time.Since(state.fetchedAt) > c.userTTL {
+			delete(c.users, userID)
+		}
+	}
+	for adminID, state := range c.admins {
+		if time.Since(state.fetchedAt) > c.userTTL {
+			delete(c.admins, adminID)
+		}
+	}
+	return nil
+}
+
+// fetchUser reads the token state of the user, it is cached unless the user was invalidated since
+// the generation was read
+func (c *Cache) fetchUser(ctx context.Context, userID int, generation uint64) (userTokenState, error) {
+	state := userTokenState{fetchedAt: time.Now()}
+
+	var suspendedAt sql.NullTime
+	err := sq.Select("token_version", "suspended_at").
+		From("users").
+		Where(sq.Eq{"id": userID}).
+		RunWith(c.db).
+		QueryRowContext(ctx).
+		Scan(&state.version, &suspendedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return state, err
+	}
+	// the tokens of deleted and suspended users are all revoked
+	state.revoked = errors.Is(err, sql.ErrNoRows) || suspendedAt.Valid
+
+	c.mu.Lock()
+	if c.userGenerations[userID] == generation {
+		c.users[userID] = state
+	}
+	c.mu.Unlock()
+	return state, nil
+}
+
+// fetchAdmin is fetchUser for the admins
+func (c *Cache) fetchAdmin(ctx context.Context, adminID int, generation uint64) (adminTokenState, error) {
+	state := adminTokenState{fetchedAt: time.Now()}
+
+	var deactivatedAt sql.NullTime
+	err := sq.Select("token_version", "deactivated_at").
+		From("admins").
+		Where(sq.Eq{"id": adminID}).
+		RunWith(c.db).
+		QueryRowContext(ctx).
+		Scan(&state.version, &deactivatedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return state, err
+	}
+	// the tokens of deleted and deactivated admins are all revoked
+	state.active = err == nil && !deactivatedAt.Valid
+
+	c.mu.Lock()
+	if c.adminGenerations[adminID] == generation {
+		c.admins[adminID] = state
+	}
+	c.mu.Unlock()
+	return state, nil
+}
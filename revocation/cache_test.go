@@ -0,0 +1,195 @@
+package revocation
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/isaacwassouf/authentication-service/models"
+)
+
+func newTestCache(t *testing.T, pubsub PubSub) (*Cache, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create the database mock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cache := NewCache(db, pubsub)
+	mock.ExpectQuery("FROM tokens_blacklist").WillReturnRows(sqlmock.NewRows([]string{"jti", "expires_at"}))
+	if err := cache.Load(context.Background()); err != nil {
+		t.Fatalf("failed to load the cache: %v", err)
+	}
+	return cache, mock
+}
+
+func expectUser(mock sqlmock.Sqlmock, version int) {
+	mock.ExpectQuery("FROM users").
+		WillReturnRows(sqlmock.NewRows([]string{"token_version", "suspended_at"}).AddRow(version, nil))
+}
+
+func TestCacheRevokePropagates(t *testing.T) {
+	pubsub := NewLocalPubSub()
+	revoking, _ := newTestCache(t, pubsub)
+	other, _ := newTestCache(t, pubsub)
+
+	token := models.BlacklistedToken{JTI: "jti", UserID: 1, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := revoking.Revoke(context.Background(), token); err != nil {
+		t.Fatal(err)
+	}
+
+	if !revoking.IsBlacklisted("jti") || !other.IsBlacklisted("jti") {
+		t.Fatal("expected the token to be blacklisted on every instance")
+	}
+	if other.IsBlacklisted("other") {
+		t.Fatal("expected another token not to be blacklisted")
+	}
+}
+
+func TestCacheInvalidateUserPropagates(t *testing.T) {
+	pubsub := NewLocalPubSub()
+	invalidating, _ := newTestCache(t, pubsub)
+	other, mock := newTestCache(t, pubsub)
+	ctx := context.Background()
+
+	expectUser(mock, 1)
+	if revoked, err := other.IsRevoked(ctx, 1, "jti", 1); err != nil || revoked {
+		t.Fatalf("expected the token to be valid, got %v %v", revoked, err)
+	}
+
+	// the cached version is used until the user is invalidated
+	if revoked, err := other.IsRevoked(ctx, 1, "jti", 1); err != nil || revoked {
+		t.Fatalf("expected the token to be valid, got %v %v", revoked, err)
+	}
+
+	if err := invalidating.InvalidateUser(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	expectUser(mock, 2)
+	if revoked, err := other.IsRevoked(ctx, 1, "jti", 1); err != nil || !revoked {
+		t.Fatalf("expected the token to be revoked, got %v %v", revoked, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheInvalidateAdminPropagates(t *testing.T) {
+	pubsub := NewLocalPubSub()
+	invalidating, _ := newTestCache(t, pubsub)
+	other, mock := newTestCache(t, pubsub)
+	ctx := context.Background()
+
+	mock.ExpectQuery("FROM admins").WillReturnRows(sqlmock.NewRows([]string{"token_version", "deactivated_at"}).AddRow(1, nil))
+	if revoked, err := other.IsAdminRevoked(ctx, 1, "jti", 1); err != nil || revoked {
+		t.Fatalf("expected the token to be valid, got %v %v", revoked, err)
+	}
+
+	// the cached state is used until the admin is invalidated
+	if revoked, err := other.IsAdminRevoked(ctx, 1, "jti", 1); err != nil || revoked {
+		t.Fatalf("expected the token to be valid, got %v %v", revoked, err)
+	}
+
+	if err := invalidating.InvalidateAdmin(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectQuery("FROM admins").WillReturnRows(sqlmock.NewRows([]string{"token_version", "deactivated_at"}).AddRow(1, time.Now()))
+	if revoked, err := other.IsAdminRevoked(ctx, 1, "jti", 1); err != nil || !revoked {
+		t.Fatalf("expected the token to be revoked, got %v %v", revoked, err)
+	}
+
+	// the tokens issued before a password change are revoked as well
+	if err := invalidating.InvalidateAdmin(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("FROM admins").WillReturnRows(sqlmock.NewRows([]string{"token_version", "deactivated_at"}).AddRow(2, nil))
+	if revoked, err := other.IsAdminRevoked(ctx, 2, "jti", 1); err != nil || !revoked {
+		t.Fatalf("expected the token of the old version to be revoked, got %v %v", revoked, err)
+	}
+
+	// the user with the same id is not affected
+	expectUser(mock, 1)
+	if revoked, err := other.IsRevoked(ctx, 1, "jti", 1); err != nil || revoked {
+		t.Fatalf("expected the user token to be valid, got %v %v", revoked, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheDropsReadsOlderThanInvalidation(t *testing.T) {
+	cache, mock := newTestCache(t, NewLocalPubSub())
+	ctx := context.Background()
+
+	// the version is read, then the user is invalidated before the read is cached
+	expectUser(mock, 1)
+	generation := cache.userGenerations[1]
+	if err := cache.InvalidateUser(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.fetchUser(ctx, 1, generation); err != nil {
+		t.Fatal(err)
+	}
+
+	expectUser(mock, 2)
+	if revoked, err := cache.IsRevoked(ctx, 1, "jti", 1); err != nil || !revoked {
+		t.Fatalf("expected the token to be revoked, got %v %v", revoked, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheUserExpires(t *testing.T) {
+	cache, mock := newTestCache(t, NewLocalPubSub())
+	cache.userTTL = time.Millisecond
+	ctx := context.Background()
+
+	expectUser(mock, 1)
+	if revoked, err := cache.IsRevoked(ctx, 1, "jti", 1); err != nil || revoked {
+		t.Fatalf("expected the token to be valid, got %v %v", revoked, err)
+	}
+
+	// a missed event is recovered once the cached version expires
+	time.Sleep(time.Millisecond * 5)
+	expectUser(mock, 2)
+	if revoked, err := cache.IsRevoked(ctx, 1, "jti", 1); err != nil || !revoked {
+		t.Fatalf("expected the token to be revoked, got %v %v", revoked, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCachePruneReloads(t *testing.T) {
+	cache, mock := newTestCache(t, NewLocalPubSub())
+	ctx := context.Background()
+
+	cache.apply(Event{Kind: EventToken, JTI: "expired", ExpiresAt: time.Now().Add(-time.Minute)})
+	cache.apply(Event{Kind: EventToken, JTI: "received", ExpiresAt: time.Now().Add(time.Hour)})
+
+	// the reload recovers the revocation whose event was missed
+	mock.ExpectExec("DELETE FROM tokens_blacklist").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("FROM tokens_blacklist").WillReturnRows(
+		sqlmock.NewRows([]string{"jti", "expires_at"}).AddRow("missed", time.Now().Add(time.Hour)),
+	)
+	if err := cache.Prune(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if cache.IsBlacklisted("expired") {
+		t.Fatal("expected the expired token to be pruned")
+	}
+	if !cache.IsBlacklisted("received") || !cache.IsBlacklisted("missed") {
+		t.Fatal("expected the received and the reloaded tokens to be blacklisted")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
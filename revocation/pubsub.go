@@ -0,0 +1,198 @@
+package revocation
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+
+	"github.com/isaacwassouf/authentication-service/utils"
+)
+
+const (
+	// EventToken revokes a single access token
+	EventToken = "token"
+	// EventUser invalidates the cached token version of a user, e.g., after a password change
+	EventUser = "user"
+	// EventAdmin invalidates the cached state of an admin, e.g., after a deactivation
+	EventAdmin = "admin"
+)
+
+// Event is broadcast to the revocation caches of every instance when a token is revoked
+type Event struct {
+	Kind string
+	JTI  string
+	// UserID is the id of the admin for the admin events
+	UserID    int
+	ExpiresAt time.Time
+}
+
+// PubSub broadcasts the revocations between the instances of the service. The publishing instance
+// may receive its own events back.
+type PubSub interface {
+	Publish(ctx context.Context, event Event) error
+	// Subscribe delivers the events published from now on to the handler until the context is done
+	Subscribe(ctx context.Context, handler func(Event)) error
+}
+
+// NewPubSub returns the pub/sub configured by REVOCATION_PUBSUB, the database is the default since
+// every instance already shares it
+func NewPubSub(db *sql.DB) (PubSub, error) {
+	switch kind := utils.GetEnvVar("REVOCATION_PUBSUB", "database"); kind {
+	case "database":
+		interval, err := time.ParseDuration(utils.GetEnvVar("REVOCATION_PUBSUB_POLL_INTERVAL", "1s"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid REVOCATION_PUBSUB_POLL_INTERVAL: %w", err)
+		}
+		return NewDatabasePubSub(db, interval), nil
+	case "local":
+		return NewLocalPubSub(), nil
+	default:
+		return nil, fmt.Errorf("unknown revocation pub/sub %q", kind)
+	}
+}
+
+// LocalPubSub delivers the events within the process, it is enough when a single instance runs
+type LocalPubSub struct {
+	mu       sync.RWMutex
+	handlers []func(Event)
+}
+
+func NewLocalPubSub() *LocalPubSub {
+	return &LocalPubSub{}
+}
+
+func (p *LocalPubSub) Publish(ctx context.Context, event Event) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, handler := range p.handlers {
+		handler(event)
+	}
+	return nil
+}
+
+func (p *LocalPubSub) Subscribe(ctx context.Context, handler func(Event)) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.handlers = append(p.handlers, handler)
+	return nil
+}
+
+// DatabasePubSub broadcasts the events through the revocation_events table which every instance
+// polls for the events published since its last poll
+type DatabasePubSub struct {
+	db       *sql.DB
+	interval time.Duration
+	// retention is how long the events are kept for the instances that poll late
+	retention time.Duration
+	// lookback is how far back every poll looks again for the events committed after the events
+	// with a greater id, the ids are assigned on insert and not on commit
+	lookback time.Duration
+}
+
+func NewDatabasePubSub(db *sql.DB, interval time.Duration) *DatabasePubSub {
+	return &DatabasePubSub{db: db, interval: interval, retention: time.Hour, lookback: time.Minute}
+}
+
+func (p *DatabasePubSub) Publish(ctx context.Context, event Event) error {
+	_, err := sq.Insert("revocation_events").
+		Columns("kind", "jti", "user_id", "expires_at").
+		Values(event.Kind, event.JTI, event.UserID, sql.NullTime{Time: event.ExpiresAt, Valid: !event.ExpiresAt.IsZero()}).
+		RunWith(p.db).
+		ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	// clean up the events every instance had the time to receive
+	_, err = sq.Delete("revocation_events").
+		Where(sq.Lt{"created_at": time.Now().Add(-p.retention)}).
+		RunWith(p.db).
+		ExecContext(ctx)
+	return err
+}
+
+// databaseSubscription is the position of a subscriber in the revocation_events table
+type databaseSubscription struct {
+	lastID int64
+	// seen holds the ids of the events within the lookback that were delivered already
+	seen map[int64]bool
+}
+
+func (p *DatabasePubSub) Subscribe(ctx context.Context, handler func(Event)) error {
+	// only the events published from now on are delivered, the ones already in the table are
+	// marked as seen
+	subscription := &databaseSubscription{seen: map[int64]bool{}}
+	if err := p.poll(ctx, subscription, nil); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := p.poll(ctx, subscription, handler); err != nil {
+					log.Printf("failed to poll the revocation events: %v", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// poll delivers the events after the last id along with the events of the lookback that were not
+// delivered yet, a nil handler only moves the subscription forward
+func (p *DatabasePubSub) poll(ctx context.Context, subscription *databaseSubscription, handler func(Event)) error {
+	rows, err := sq.Select("id", "kind", "jti", "user_id", "expires_at").
+		From("revocation_events").
+		Where(sq.Or{
+			sq.Gt{"id": subscription.lastID},
+			sq.Expr("created_at >= CURRENT_TIMESTAMP - INTERVAL ? SECOND", int(p.lookback.Seconds())),
+		}).
+		OrderBy("id").
+		RunWith(p.db).
+		QueryContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// the events that left the lookback are not returned anymore, so they are forgotten
+	seen := map[int64]bool{}
+	for rows.Next() {
+		var id int64
+		var event Event
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&id, &event.Kind, &event.JTI, &event.UserID, &expiresAt); err != nil {
+			return err
+		}
+		event.ExpiresAt = expiresAt.Time
+
+		seen[id] = true
+		if id > subscription.lastID {
+			subscription.lastID = id
+		}
+		if subscription.seen[id] {
+			continue
+		}
+		subscription.seen[id] = true
+		if handler != nil {
+			handler(event)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	subscription.seen = seen
+	return nil
+}
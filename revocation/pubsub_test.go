@@ -0,0 +1,58 @@
+package revocation
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func eventRows(ids ...int64) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"id", "kind", "jti", "user_id", "expires_at"})
+	for _, id := range ids {
+		rows.AddRow(id, EventUser, "", id, nil)
+	}
+	return rows
+}
+
+func TestDatabasePubSubDeliversLateCommits(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create the database mock: %v", err)
+	}
+	defer db.Close()
+
+	pubsub := NewDatabasePubSub(db, time.Second)
+	subscription := &databaseSubscription{seen: map[int64]bool{}}
+	var delivered []int
+	handler := func(event Event) { delivered = append(delivered, event.UserID) }
+
+	// the event 2 is committed after the event 3
+	mock.ExpectQuery("FROM revocation_events").WillReturnRows(eventRows(1, 3))
+	mock.ExpectQuery("FROM revocation_events").WillReturnRows(eventRows(1, 2, 3, 4))
+	// the event 1 left the lookback
+	mock.ExpectQuery("FROM revocation_events").WillReturnRows(eventRows(2, 3, 4))
+
+	for i := 0; i < 3; i++ {
+		if err := pubsub.poll(context.Background(), subscription, handler); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []int{1, 3, 2, 4}
+	if len(delivered) != len(expected) {
+		t.Fatalf("expected the events %v, got %v", expected, delivered)
+	}
+	for i := range expected {
+		if delivered[i] != expected[i] {
+			t.Fatalf("expected the events %v, got %v", expected, delivered)
+		}
+	}
+	if subscription.lastID != 4 || len(subscription.seen) != 3 {
+		t.Fatalf("unexpected subscription %+v", subscription)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
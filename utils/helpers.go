@@ -4,8 +4,9 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
+	"net/url"
 	"os"
-	"time"
+	"strings"
 
 	sq "github.com/Masterminds/squirrel"
 	"github.com/joho/godotenv"
@@ -106,42 +107,98 @@ func CheckAuthProviderIsActive(provider string, db *sql.DB) (bool, error) {
 	return active, nil
 }
 
-// GetExternalAuthUserByEmail ets a user by their external auth provider ID
-func GetExternalAuthUserByEmail(provider string, email string, db *sql.DB) (models.User, error) {
+// GetExternalAuthUserByIdentifier gets a user by its identifier at the external auth provider
+func GetExternalAuthUserByIdentifier(provider string, identifier string, db *sql.DB) (models.User, error) {
+	return getExternalAuthUser(provider, sq.Eq{"users_authentication.auth_provider_identifier": identifier}, db)
+}
+
+// GetExternalAuthUserByID gets an external auth user by its ID
+func GetExternalAuthUserByID(provider string, id int, db *sql.DB) (models.User, error) {
+	return getExternalAuthUser(provider, sq.Eq{"users.id": id}, db)
+}
+
+func getExternalAuthUser(provider string, condition sq.Eq, db *sql.DB) (models.User, error) {
 	var user models.User
+	var email sql.NullString
+	var verified sql.NullBool
+	// users of some providers, e.g., GitHub, may not have an email
 	query := sq.Select("users.id", "users.name", "users_email.email", "users_email.is_verified", "auth_providers.name").
 		From("users").
-		Join("users_email ON users.id = users_email.user_id").
+		LeftJoin("users_email ON users.id = users_email.user_id").
 		Join("users_authentication ON users.id = users_authentication.user_id").
 		Join("auth_providers ON users_authentication.auth_provider_id = auth_providers.id").
 		Where(sq.Eq{"auth_providers.name": provider}).
-		Where(sq.Eq{"users_email.email": email})
+		Where(condition)
 
-	err := query.RunWith(db).QueryRow().Scan(&user.ID, &user.Name, &user.Email, &user.Verified, &user.Provider)
+	err := query.RunWith(db).QueryRow().Scan(&user.ID, &user.Name, &email, &verified, &user.Provider)
 	if err != nil {
 		return user, err
 	}
+	user.Email = email.String
+	user.Verified = verified.Bool
 	return user, nil
 }
 
-// GetExternalAuthUserByID ets a user by their external auth provider ID
-func GetExternalAuthUserByID(provider string, id int, db *sql.DB) (models.User, error) {
+// GetUserByID gets a user by its ID regardless of how it authenticates
+func GetUserByID(id int, db *sql.DB) (models.User, error) {
 	var user models.User
+	var email, provider sql.NullString
+	var verified sql.NullBool
 	query := sq.Select("users.id", "users.name", "users_email.email", "users_email.is_verified", "auth_providers.name").
 		From("users").
-		Join("users_email ON users.id = users_email.user_id").
-		Join("users_authentication ON users.id = users_authentication.user_id").
-		Join("auth_providers ON users_authentication.auth_provider_id = auth_providers.id").
-		Where(sq.Eq{"auth_providers.name": provider}).
+		LeftJoin("users_email ON users.id = users_email.user_id").
+		LeftJoin("users_authentication ON users.id = users_authentication.user_id").
+		LeftJoin("auth_providers ON users_authentication.auth_provider_id = auth_providers.id").
 		Where(sq.Eq{"users.id": id})
 
-	err := query.RunWith(db).QueryRow().Scan(&user.ID, &user.Name, &user.Email, &user.Verified, &user.Provider)
+	err := query.RunWith(db).QueryRow().Scan(&user.ID, &user.Name, &email, &verified, &provider)
 	if err != nil {
 		return user, err
 	}
+	user.Email = email.String
+	user.Verified = verified.Bool
+	user.Provider = provider.String
 	return user, nil
 }
 
+// GetAuthProvider gets an auth provider and its public details by name
+func GetAuthProvider(name string, db *sql.DB) (models.AuthProvider, error) {
+	var provider models.AuthProvider
+	var issuerURL, scopes, clientID, redirectURL sql.NullString
+	query := sq.Select(
+		"auth_providers.id",
+		"auth_providers.name",
+		"auth_providers.type",
+		"auth_providers.issuer_url",
+		"auth_providers.scopes",
+		"auth_providers_details.client_id",
+		"auth_providers_details.redirect_url",
+		"auth_providers_details.active",
+	).
+		From("auth_providers").
+		Join("auth_providers_details ON auth_providers.id = auth_providers_details.auth_provider_id").
+		Where(sq.Eq{"auth_providers.name": name})
+
+	err := query.RunWith(db).QueryRow().Scan(
+		&provider.ID,
+		&provider.Name,
+		&provider.Type,
+		&issuerURL,
+		&scopes,
+		&clientID,
+		&redirectURL,
+		&provider.Active,
+	)
+	if err != nil {
+		return provider, err
+	}
+	provider.IssuerURL = issuerURL.String
+	provider.Scopes = scopes.String
+	provider.ClientID = clientID.String
+	provider.RedirectURL = redirectURL.String
+	return provider, nil
+}
+
 func GetAuthProviderClientID(provider string, db *sql.DB) (sql.NullString, error) {
 	var clientID sql.NullString
 	query := sq.Select("auth_providers_details.client_id").
@@ -164,6 +221,22 @@ func GenerateMFACode() (string, error) {
 	return gonanoid.New()
 }
 
+// GenerateRecoveryCode generates a code the user can type in place of a second factor, e.g.
+// "k3h9x-2m8qa"
+func GenerateRecoveryCode() (string, error) {
+	code, err := gonanoid.Generate("abcdefghijkmnpqrstuvwxyz23456789", 10)
+	if err != nil {
+		return "", err
+	}
+	return code[:5] + "-" + code[5:], nil
+}
+
+// NormalizeRecoveryCode strips the separators and the case the user may have typed the code with
+func NormalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
 func HashMFACode(code string) (string, error) {
 	hash := sha256.New()
 	_, err := hash.Write([]byte(code))
@@ -173,20 +246,31 @@ func HashMFACode(code string) (string, error) {
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-func MFAExpired(createdAt time.Time) bool {
-	return time.Since(createdAt) > time.Minute*5
-}
-
-func GetMFAStatus(db *sql.DB) (bool, error) {
-	var mfaStatus string
-	err := sq.Select("value").
-		From("settings").
-		Where(sq.Eq{"name": "mfa"}).
-		RunWith(db).
-		QueryRow().
-		Scan(&mfaStatus)
+// IsAllowedRedirectURL checks that a redirect requested by a client is a relative path or
+// points to one of the origins listed in ALLOWED_REDIRECT_ORIGINS
+func IsAllowedRedirectURL(redirectURL string) bool {
+	parsed, err := url.Parse(redirectURL)
 	if err != nil {
-		return false, err
+		return false
+	}
+
+	// relative paths, but not protocol relative URLs such as //evil.com. The browsers read a
+	// backslash as a slash, so /\evil.com is protocol relative as well.
+	if parsed.Scheme == "" && parsed.Host == "" {
+		if !strings.HasPrefix(redirectURL, "/") {
+			return false
+		}
+		return len(redirectURL) == 1 || (redirectURL[1] != '/' && redirectURL[1] != '\\')
+	}
+	if parsed.Scheme == "" || parsed.Host == "" {
+		return false
+	}
+
+	origin := parsed.Scheme + "://" + parsed.Host
+	for _, allowed := range strings.Split(GetEnvVar("ALLOWED_REDIRECT_ORIGINS", ""), ",") {
+		if strings.TrimSpace(allowed) == origin {
+			return true
+		}
 	}
-	return mfaStatus == "enabled", nil
+	return false
 }
@@ -0,0 +1,424 @@
+package utils
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/matoous/go-nanoid/v2"
+
+	"github.com/isaacwassouf/authentication-service/consts"
+	"github.com/isaacwassouf/authentication-service/models"
+	pbcryptography "github.com/isaacwassouf/authentication-service/protobufs/cryptography_service"
+)
+
+// JSONWebKey is the public part of a signing key as described in RFC 7517
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type signingKey struct {
+	kid        string
+	algorithm  string
+	privateKey crypto.Signer
+	publicKey  crypto.PublicKey
+	createdAt  time.Time
+}
+
+// KeyManager keeps the keys used to sign the JWT tokens. Only the active key signs new tokens,
+// retired keys stay published until their overlap window ends so that tokens they signed can
+// still be verified.
+type KeyManager struct {
+	db                        *sql.DB
+	cryptographyServiceClient pbcryptography.CryptographyManagerClient
+	algorithm                 string
+	rotationPeriod            time.Duration
+	overlap                   time.Duration
+
+	mu       sync.RWMutex
+	keys     map[string]*signingKey
+	active   *signingKey
+	loadedAt time.Time
+}
+
+func NewKeyManager(db *sql.DB, cryptographyServiceClient pbcryptography.CryptographyManagerClient) (*KeyManager, error) {
+	algorithm := GetEnvVar("JWT_SIGNING_ALGORITHM", consts.RS256)
+	switch algorithm {
+	case consts.RS256, consts.ES256, consts.EDDSA:
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+
+	rotationPeriod, err := time.ParseDuration(GetEnvVar("JWT_KEY_ROTATION_PERIOD", "720h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT_KEY_ROTATION_PERIOD: %w", err)
+	}
+
+	overlap, err := time.ParseDuration(GetEnvVar("JWT_KEY_OVERLAP", "96h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT_KEY_OVERLAP: %w", err)
+	}
+
+	return &KeyManager{
+		db:                        db,
+		cryptographyServiceClient: cryptographyServiceClient,
+		algorithm:                 algorithm,
+		rotationPeriod:            rotationPeriod,
+		overlap:                   overlap,
+		keys:                      map[string]*signingKey{},
+	}, nil
+}
+
+// Load reads the published keys from the database, generating the first key if there is none
+func (m *KeyManager) Load(ctx context.Context) error {
+	rows, err := sq.Select("kid", "algorithm", "private_key", "public_key", "active", "created_at").
+		From("signing_keys").
+		Where(sq.Or{sq.Eq{"retires_at": nil}, sq.Gt{"retires_at": time.Now()}}).
+		RunWith(m.db).
+		QueryContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	keys := map[string]*signingKey{}
+	var active *signingKey
+	for rows.Next() {
+		var row models.SigningKey
+		err := rows.Scan(&row.KID, &row.Algorithm, &row.PrivateKey, &row.PublicKey, &row.Active, &row.CreatedAt)
+		if err != nil {
+			return err
+		}
+
+		publicKey, err := parsePublicKey(row.PublicKey)
+		if err != nil {
+			return fmt.Errorf("failed to parse the public key %s: %w", row.KID, err)
+		}
+		key := &signingKey{kid: row.KID, algorithm: row.Algorithm, publicKey: publicKey, createdAt: row.CreatedAt}
+
+		// only the active key needs its private part
+		if row.Active {
+			key.privateKey, err = m.decryptPrivateKey(ctx, row.PrivateKey)
+			if err != nil {
+				return fmt.Errorf("failed to load the private key %s: %w", row.KID, err)
+			}
+			if active == nil || key.createdAt.After(active.createdAt) {
+				active = key
+			}
+		}
+		keys[row.KID] = key
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if active == nil {
+		return m.Rotate(ctx)
+	}
+
+	m.mu.Lock()
+	m.keys = keys
+	m.active = active
+	m.loadedAt = time.Now()
+	m.mu.Unlock()
+	return nil
+}
+
+// Rotate generates a new active key, the previous active key keeps verifying tokens for the overlap window
+func (m *KeyManager) Rotate(ctx context.Context) error {
+	privateKey, err := generatePrivateKey(m.algorithm)
+	if err != nil {
+		return err
+	}
+
+	privateKeyDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(privateKey.Public())
+	if err != nil {
+		return err
+	}
+
+	// the private key is only stored encrypted
+	encryptedPrivateKey, err := m.cryptographyServiceClient.Encrypt(
+		ctx,
+		&pbcryptography.EncryptRequest{Plaintext: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKeyDER}))},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt the private key: %w", err)
+	}
+
+	kid, err := gonanoid.New()
+	if err != nil {
+		return err
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = sq.Update("signing_keys").
+		Set("active", false).
+		Set("retires_at", time.Now().Add(m.overlap)).
+		Where(sq.Eq{"active": true}).
+		RunWith(tx).
+		ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = sq.Insert("signing_keys").
+		Columns("kid", "algorithm", "private_key", "public_key", "active").
+		Values(
+			kid,
+			m.algorithm,
+			encryptedPrivateKey.Ciphertext,
+			string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyDER})),
+			true,
+		).
+		RunWith(tx).
+		ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("rotated the signing key, new key id %s", kid)
+	return m.Load(ctx)
+}
+
+// RotateIfDue rotates the active key once it is older than the rotation period
+func (m *KeyManager) RotateIfDue(ctx context.Context) error {
+	// pick up the keys rotated by the other instances first
+	if err := m.Load(ctx); err != nil {
+		return err
+	}
+
+	m.mu.RLock()
+	due := time.Since(m.active.createdAt) > m.rotationPeriod
+	m.mu.RUnlock()
+
+	if !due {
+		return nil
+	}
+	return m.Rotate(ctx)
+}
+
+// Run checks periodically whether the active key must be rotated until the context is done
+func (m *KeyManager) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.RotateIfDue(ctx); err != nil {
+				log.Printf("failed to rotate the signing keys: %v", err)
+			}
+		}
+	}
+}
+
+// Sign signs the claims with the active key
+func (m *KeyManager) Sign(claims jwt.Claims) (string, error) {
+	m.mu.RLock()
+	key := m.active
+	m.mu.RUnlock()
+
+	if key == nil {
+		return "", errors.New("no active signing key")
+	}
+
+	token := jwt.NewWithClaims(signingMethod(key.algorithm), claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.privateKey)
+}
+
+// Keyfunc resolves the public key that signed a token, to be used with the jwt parser
+func (m *KeyManager) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, errors.New("token has no key id")
+	}
+
+	key := m.lookup(kid)
+	if key == nil && m.canReload() {
+		// the key may have been generated by another instance
+		if err := m.Load(context.Background()); err != nil {
+			return nil, err
+		}
+		key = m.lookup(kid)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+
+	if token.Method.Alg() != key.algorithm {
+		return nil, fmt.Errorf("unexpected signing method %q", token.Method.Alg())
+	}
+	return key.publicKey, nil
+}
+
+// Algorithms lists the algorithms of the published keys
+func (m *KeyManager) Algorithms() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	seen := map[string]bool{}
+	var algorithms []string
+	for _, key := range m.keys {
+		if !seen[key.algorithm] {
+			seen[key.algorithm] = true
+			algorithms = append(algorithms, key.algorithm)
+		}
+	}
+	return algorithms
+}
+
+// JWKS returns the published public keys
+func (m *KeyManager) JWKS() []JSONWebKey {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	jwks := make([]JSONWebKey, 0, len(m.keys))
+	for _, key := range m.keys {
+		jwk, err := toJSONWebKey(key)
+		if err != nil {
+			log.Printf("failed to export the key %s: %v", key.kid, err)
+			continue
+		}
+		jwks = append(jwks, jwk)
+	}
+	return jwks
+}
+
+func (m *KeyManager) lookup(kid string) *signingKey {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.keys[kid]
+}
+
+// canReload throttles the reloads triggered by unknown key ids
+func (m *KeyManager) canReload() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return time.Since(m.loadedAt) > time.Minute
+}
+
+func (m *KeyManager) decryptPrivateKey(ctx context.Context, ciphertext string) (crypto.Signer, error) {
+	decrypted, err := m.cryptographyServiceClient.Decrypt(ctx, &pbcryptography.DecryptRequest{Ciphertext: ciphertext})
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode([]byte(decrypted.Plaintext))
+	if block == nil {
+		return nil, errors.New("invalid private key PEM")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key cannot sign")
+	}
+	return signer, nil
+}
+
+func parsePublicKey(encoded string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil {
+		return nil, errors.New("invalid public key PEM")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+func generatePrivateKey(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case consts.RS256:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case consts.ES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case consts.EDDSA:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		return privateKey, err
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+}
+
+func signingMethod(algorithm string) jwt.SigningMethod {
+	switch algorithm {
+	case consts.ES256:
+		return jwt.SigningMethodES256
+	case consts.EDDSA:
+		return jwt.SigningMethodEdDSA
+	default:
+		return jwt.SigningMethodRS256
+	}
+}
+
+func toJSONWebKey(key *signingKey) (JSONWebKey, error) {
+	jwk := JSONWebKey{Use: "sig", Kid: key.kid, Alg: key.algorithm}
+
+	switch publicKey := key.publicKey.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+	case *ecdsa.PublicKey:
+		ecdhKey, err := publicKey.ECDH()
+		if err != nil {
+			return jwk, err
+		}
+		// the uncompressed point is 0x04 || X || Y
+		point := ecdhKey.Bytes()
+		size := (len(point) - 1) / 2
+		jwk.Kty = "EC"
+		jwk.Crv = publicKey.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(point[1 : 1+size])
+		jwk.Y = base64.RawURLEncoding.EncodeToString(point[1+size:])
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(publicKey)
+	default:
+		return jwk, fmt.Errorf("unsupported key type %T", publicKey)
+	}
+	return jwk, nil
+}
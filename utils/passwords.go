@@ -35,3 +35,11 @@ func HashPasswordResetCode(code string) (string, error) {
 func IsExpired(createdAt time.Time) bool {
 	return time.Since(createdAt) > time.Hour*24
 }
+
+// dummyPasswordHash is compared against when the account does not exist so that the response
+// time does not reveal whether an email is registered
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+func CheckDummyPasswordHash(password string) {
+	_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+}
@@ -0,0 +1,135 @@
+package utils
+
+import (
+	"context"
+	"log"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// GetClientIP gets the IP of the caller. When TRUST_PROXY_HEADERS is true and the call comes from
+// one of the proxies in TRUSTED_PROXY_CIDRS, e.g., the API gateway, the IP of the end user is read
+// from the x-forwarded-for or x-real-ip metadata instead.
+func GetClientIP(ctx context.Context) string {
+	peerIP := getPeerIP(ctx)
+	if GetEnvVar("TRUST_PROXY_HEADERS", "false") != "true" {
+		return peerIP
+	}
+
+	trustedProxies := getTrustedProxies()
+	if !isTrustedProxy(peerIP, trustedProxies) {
+		return peerIP
+	}
+
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return peerIP
+	}
+	if values := md.Get("x-forwarded-for"); len(values) > 0 {
+		// every proxy appends the address it got the request from, so the right-most hop that is
+		// not a trusted proxy is the client, the hops before it can be spoofed by the client
+		var hops []string
+		for _, value := range values {
+			for _, hop := range strings.Split(value, ",") {
+				if hop = strings.TrimSpace(hop); hop != "" {
+					hops = append(hops, hop)
+				}
+			}
+		}
+		for i := len(hops) - 1; i >= 0; i-- {
+			if !isTrustedProxy(hops[i], trustedProxies) {
+				return hops[i]
+			}
+		}
+		if len(hops) > 0 {
+			return hops[0]
+		}
+	}
+	if values := md.Get("x-real-ip"); len(values) > 0 && values[0] != "" {
+		return values[0]
+	}
+	return peerIP
+}
+
+// getPeerIP gets the IP of the direct peer of the connection
+func getPeerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// getTrustedProxies parses the comma separated CIDRs of TRUSTED_PROXY_CIDRS, the invalid ones
+// are skipped
+func getTrustedProxies() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range strings.Split(GetEnvVar("TRUSTED_PROXY_CIDRS", ""), ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Printf("invalid trusted proxy CIDR %q: %v", cidr, err)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// isTrustedProxy checks whether the IP is in one of the trusted proxy networks
+func isTrustedProxy(address string, trustedProxies []*net.IPNet) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetUserAgent gets the user agent of the caller, the API gateway forwards the one of the end user
+// in the grpcgateway-user-agent metadata
+func GetUserAgent(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	for _, key := range []string{"grpcgateway-user-agent", "user-agent"} {
+		if values := md.Get(key); len(values) > 0 && values[0] != "" {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// GetBearerToken gets the token sent in the authorization metadata of the call, the API gateway
+// forwards the authorization header of the end user there
+func GetBearerToken(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return ""
+	}
+
+	scheme, token, found := strings.Cut(values[0], " ")
+	if !found || !strings.EqualFold(scheme, "bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
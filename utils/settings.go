@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// GetSetting gets the value of a row of the settings table, unset settings are empty
+func GetSetting(name string, db *sql.DB) (string, error) {
+	var value sql.NullString
+	err := sq.Select("value").
+		From("settings").
+		Where(sq.Eq{"name": name}).
+		RunWith(db).
+		QueryRow().
+		Scan(&value)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	return value.String, nil
+}
+
+// GetIntSetting gets an integer setting, falling back to the default when it is unset or invalid
+func GetIntSetting(name string, defaultValue int, db *sql.DB) (int, error) {
+	value, err := GetSetting(name, db)
+	if err != nil {
+		return defaultValue, err
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return defaultValue, nil
+	}
+	return parsed, nil
+}
+
+// GetDurationSetting gets a duration setting, e.g., 15m, falling back to the default when it is unset or invalid
+func GetDurationSetting(name string, defaultValue time.Duration, db *sql.DB) (time.Duration, error) {
+	value, err := GetSetting(name, db)
+	if err != nil {
+		return defaultValue, err
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return defaultValue, nil
+	}
+	return parsed, nil
+}
@@ -1,22 +1,57 @@
 package utils
 
 import (
-	"os"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/matoous/go-nanoid/v2"
 
+	"github.com/isaacwassouf/authentication-service/consts"
 	"github.com/isaacwassouf/authentication-service/models"
 )
 
+const (
+	// AccessTokenTTL is the lifetime of the user access tokens
+	AccessTokenTTL = time.Minute * 15
+	// RefreshTokenTTL is the lifetime of the opaque refresh tokens
+	RefreshTokenTTL = time.Hour * 24 * 30
+	// ServiceAccountTokenTTL is the lifetime of the tokens of the service accounts, they can not be
+	// revoked one by one and expire soon after the account is deleted
+	ServiceAccountTokenTTL = time.Minute * 15
+	// IDTokenTTL is the lifetime of the ID tokens issued to the OpenID Connect clients
+	IDTokenTTL = time.Hour
+)
+
+// OIDCIssuer returns the issuer of the ID tokens, the discovery document is served under it
+func OIDCIssuer() string {
+	return strings.TrimSuffix(GetEnvVar("OIDC_ISSUER", "http://localhost:8081"), "/")
+}
+
+// AccessTokenAudience returns the audience of the user and admin access tokens, the services that
+// accept them check it
+func AccessTokenAudience() string {
+	return GetEnvVar("JWT_AUDIENCE", "api")
+}
+
+// UserInfoAudience returns the audience of the access tokens issued to the OpenID Connect clients,
+// only the userinfo endpoint accepts them
+func UserInfoAudience() string {
+	return OIDCIssuer() + "/userinfo"
+}
+
 type UserPayload struct {
-	ID       int    `json:"id"`
-	Name     string `json:"name"`
-	Email    string `json:"email"`
-	Verified bool   `json:"verified"`
-	Provider string `json:"provider"`
-	IsAdmin  bool   `json:"is_admin"`
+	ID          int      `json:"id"`
+	Name        string   `json:"name"`
+	Email       string   `json:"email"`
+	Verified    bool     `json:"verified"`
+	Provider    string   `json:"provider"`
+	IsAdmin     bool     `json:"is_admin"`
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
 }
 
 type AdminPayload struct {
@@ -25,54 +60,178 @@ type AdminPayload struct {
 	IsAdmin bool   `json:"is_admin"`
 }
 
-// AuthCustomClaims Claims struct
+// ServiceAccountPayload is the claim that sets the tokens of the service accounts apart from the
+// user and admin tokens, which never carry it
+type ServiceAccountPayload struct {
+	ClientID string `json:"client_id"`
+	Name     string `json:"name"`
+}
+
+// AuthCustomClaims Claims struct, the version is compared with the token version of the user to
+// revoke every token issued before a password or email change. The access tokens of the service
+// accounts are parsed into it as well, they have the service account set instead of the user.
 type AuthCustomClaims struct {
-	User UserPayload `json:"user"`
+	User           UserPayload            `json:"user"`
+	Version        int                    `json:"ver"`
+	ServiceAccount *ServiceAccountPayload `json:"service_account,omitempty"`
+	Scope          string                 `json:"scope,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// ServiceAccountClaims are the claims of the tokens issued with the client credentials grant
+type ServiceAccountClaims struct {
+	ServiceAccount ServiceAccountPayload `json:"service_account"`
+	Scope          string                `json:"scope,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// OIDCUserClaims are the standard claims about the user of the ID tokens and the userinfo endpoint
+type OIDCUserClaims struct {
+	Name          string `json:"name,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+}
+
+// IDTokenClaims are the claims of the ID tokens issued by the OpenID Connect provider
+type IDTokenClaims struct {
+	Nonce    string   `json:"nonce,omitempty"`
+	AuthTime int64    `json:"auth_time,omitempty"`
+	AMR      []string `json:"amr,omitempty"`
+	OIDCUserClaims
 	jwt.RegisteredClaims
 }
 
 type AdminCustomClaims struct {
-	User AdminPayload `json:"user"`
+	User    AdminPayload `json:"user"`
+	Version int          `json:"ver"`
 	jwt.RegisteredClaims
 }
 
-// GenerateToken Function to generate a JWT token
-func GenerateToken(user models.User) (string, error) {
+// GenerateToken Function to generate a JWT token, the claims are returned to record the session.
+// The scope is only set for the tokens issued to the OpenID Connect clients, they are issued for
+// the userinfo endpoint rather than for the services.
+func GenerateToken(user models.User, scope string, keys *KeyManager) (string, *AuthCustomClaims, error) {
 	// generate a random id
 	id, err := gonanoid.New()
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
-	// Get the JWT secret key from the environment
-	jwtSecret := os.Getenv("JWT_SECRET")
-	userPayload := UserPayload{
-		ID:       user.ID,
-		Name:     user.Name,
-		Email:    user.Email,
-		Verified: user.Verified,
-		IsAdmin:  false,
-	}
-	if user.Provider != "" {
-		userPayload.Provider = user.Provider
+	audience := AccessTokenAudience()
+	if scope != "" {
+		audience = UserInfoAudience()
 	}
+
 	// Create the claims for the JWT token
 	claims := AuthCustomClaims{
-		User: userPayload,
+		User:    newUserPayload(user),
+		Version: user.TokenVersion,
+		Scope:   scope,
 		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{audience},
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour * 72)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(AccessTokenTTL)),
+			ID:        id,
+		},
+	}
+	// Sign the token with the active key
+	token, err := keys.Sign(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, &claims, nil
+}
+
+// GenerateServiceAccountToken generates the access token of a service account for the scopes
+func GenerateServiceAccountToken(account models.ServiceAccount, scopes []string, keys *KeyManager) (string, *ServiceAccountClaims, error) {
+	id, err := gonanoid.New()
+	if err != nil {
+		return "", nil, err
+	}
+
+	claims := ServiceAccountClaims{
+		ServiceAccount: ServiceAccountPayload{ClientID: account.ClientID, Name: account.Name},
+		Scope:          strings.Join(scopes, " "),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   account.ClientID,
+			Audience:  jwt.ClaimStrings{AccessTokenAudience()},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ServiceAccountTokenTTL)),
 			ID:        id,
 		},
 	}
-	// Create the token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(jwtSecret))
+	token, err := keys.Sign(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, &claims, nil
+}
+
+// GenerateIDToken generates the ID token of an OpenID Connect login for the client, the claims
+// about the user are the ones of the access token limited to the granted scopes
+func GenerateIDToken(
+	user models.User,
+	clientID string,
+	nonce string,
+	authTime time.Time,
+	authMethods []string,
+	scopes []string,
+	keys *KeyManager,
+) (string, error) {
+	claims := IDTokenClaims{
+		Nonce:          nonce,
+		AuthTime:       authTime.Unix(),
+		AMR:            authMethods,
+		OIDCUserClaims: NewOIDCUserClaims(user, scopes),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    OIDCIssuer(),
+			Subject:   strconv.Itoa(user.ID),
+			Audience:  jwt.ClaimStrings{clientID},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(IDTokenTTL)),
+		},
+	}
+	return keys.Sign(claims)
+}
+
+// NewOIDCUserClaims returns the standard claims about the user released for the scopes
+func NewOIDCUserClaims(user models.User, scopes []string) OIDCUserClaims {
+	payload := newUserPayload(user)
+
+	var claims OIDCUserClaims
+	for _, scope := range scopes {
+		switch scope {
+		case consts.OIDC_SCOPE_PROFILE:
+			claims.Name = payload.Name
+		case consts.OIDC_SCOPE_EMAIL:
+			claims.Email = payload.Email
+			claims.EmailVerified = &payload.Verified
+		}
+	}
+	return claims
 }
 
-func GenerateAdminToken(admin models.Admin) (string, error) {
-	// Get the JWT secret key from the environment
-	jwtSecret := os.Getenv("JWT_SECRET")
+func newUserPayload(user models.User) UserPayload {
+	return UserPayload{
+		ID:          user.ID,
+		Name:        user.Name,
+		Email:       user.Email,
+		Verified:    user.Verified,
+		Provider:    user.Provider,
+		IsAdmin:     false,
+		Roles:       user.Roles,
+		Permissions: user.Permissions,
+	}
+}
+
+// GenerateAdminToken generates the access token of an admin, its id is what LogoutAdmin blacklists
+func GenerateAdminToken(admin models.Admin, keys *KeyManager) (string, error) {
+	// generate a random id
+	id, err := gonanoid.New()
+	if err != nil {
+		return "", err
+	}
+
 	// Create the claims for the JWT token
 	claims := AdminCustomClaims{
 		User: AdminPayload{
@@ -80,13 +239,47 @@ func GenerateAdminToken(admin models.Admin) (string, error) {
 			Email:   admin.Email,
 			IsAdmin: true,
 		},
+		Version: admin.TokenVersion,
 		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{AccessTokenAudience()},
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour * 72)),
+			ID:        id,
 		},
 	}
 
-	// Create the token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(jwtSecret))
+	// Sign the token with the active key
+	return keys.Sign(claims)
+}
+
+// ParseAccessToken verifies the signature, expiry and audience of a user or admin access token. The
+// admin tokens are the ones whose payload has is_admin set.
+func ParseAccessToken(token string, audience string, keys *KeyManager) (*AuthCustomClaims, error) {
+	claims := &AuthCustomClaims{}
+	_, err := jwt.ParseWithClaims(
+		token,
+		claims,
+		keys.Keyfunc,
+		jwt.WithValidMethods(keys.Algorithms()),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// GenerateRefreshToken generates an opaque refresh token
+func GenerateRefreshToken() (string, error) {
+	return gonanoid.New(64)
+}
+
+func HashRefreshToken(token string) (string, error) {
+	hash := sha256.New()
+	_, err := hash.Write([]byte(token))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
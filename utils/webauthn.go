@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+
+	"github.com/isaacwassouf/authentication-service/models"
+)
+
+// NewWebAuthn creates the WebAuthn relying party from the WEBAUTHN_* environment variables
+func NewWebAuthn() (*webauthn.WebAuthn, error) {
+	var origins []string
+	for _, origin := range strings.Split(GetEnvVar("WEBAUTHN_RP_ORIGINS", "http://localhost:5173"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+
+	return webauthn.New(&webauthn.Config{
+		RPID:          GetEnvVar("WEBAUTHN_RP_ID", "localhost"),
+		RPDisplayName: GetEnvVar("WEBAUTHN_RP_DISPLAY_NAME", "Authentication Service"),
+		RPOrigins:     origins,
+	})
+}
+
+// WebAuthnUser adapts a user and their registered credentials to the WebAuthn library
+type WebAuthnUser struct {
+	User        models.User
+	Credentials []webauthn.Credential
+}
+
+func (u WebAuthnUser) WebAuthnID() []byte {
+	return WebAuthnUserHandle(u.User.ID)
+}
+
+func (u WebAuthnUser) WebAuthnName() string {
+	return u.User.Email
+}
+
+func (u WebAuthnUser) WebAuthnDisplayName() string {
+	if u.User.Name != "" {
+		return u.User.Name
+	}
+	return u.User.Email
+}
+
+func (u WebAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.Credentials
+}
+
+func (u WebAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+// WebAuthnUserHandle is the opaque user handle stored by the authenticators, it is the user id so
+// that the discoverable logins can find the user back
+func WebAuthnUserHandle(userID int) []byte {
+	return []byte(strconv.Itoa(userID))
+}
+
+// ParseWebAuthnUserHandle returns the user id of a user handle returned by an authenticator
+func ParseWebAuthnUserHandle(handle []byte) (int, error) {
+	return strconv.Atoi(string(handle))
+}